@@ -0,0 +1,66 @@
+package lsmt
+
+import (
+	"time"
+
+	"github.com/patrickgombert/lsmt/common"
+)
+
+// A record within a batch. The record type tells each kind of record apart so that
+// they can be validated and applied differently. A range deletion covers every key
+// from the record's key to its end inclusive. A put which expires does so once its ttl
+// has passed since the batch was written.
+type batchRecord struct {
+	key        []byte
+	value      []byte
+	end        []byte
+	expires    bool
+	ttl        time.Duration
+	recordType common.RecordType
+}
+
+// A batch of writes and deletes which are committed together. Records are applied in
+// the order they were added to the batch, so a later record for a key wins.
+type Batch struct {
+	records []batchRecord
+}
+
+// Creates a new empty batch.
+func NewBatch() *Batch {
+	return &Batch{records: []batchRecord{}}
+}
+
+// Adds a key/value pair to the batch.
+func (batch *Batch) Write(key, value []byte) {
+	batch.records = append(batch.records, batchRecord{key: key, value: value, recordType: common.PUT})
+}
+
+// Adds a key/value pair which expires once the ttl has passed to the batch.
+func (batch *Batch) WriteWithTTL(key, value []byte, ttl time.Duration) {
+	batch.records = append(batch.records, batchRecord{key: key, value: value, expires: true, ttl: ttl, recordType: common.PUT})
+}
+
+// Adds the deletion of a key to the batch.
+func (batch *Batch) Delete(key []byte) {
+	batch.records = append(batch.records, batchRecord{key: key, recordType: common.DELETE})
+}
+
+// Adds the single deletion of a key which has been written only once to the batch.
+func (batch *Batch) SingleDelete(key []byte) {
+	batch.records = append(batch.records, batchRecord{key: key, recordType: common.SINGLE_DELETE})
+}
+
+// Adds a merge operand for a key to the batch.
+func (batch *Batch) Merge(key, operand []byte) {
+	batch.records = append(batch.records, batchRecord{key: key, value: operand, recordType: common.MERGE})
+}
+
+// Adds the deletion of every key between start and end inclusive to the batch.
+func (batch *Batch) DeleteRange(start, end []byte) {
+	batch.records = append(batch.records, batchRecord{key: start, end: end, recordType: common.RANGE_DELETE})
+}
+
+// Returns the number of records in the batch.
+func (batch *Batch) Len() int {
+	return len(batch.records)
+}
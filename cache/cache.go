@@ -1,7 +1,50 @@
 package cache
 
-// Cache provides an interface for a write-through cache. Keys must be Shardable.
+import "errors"
+
+// Returned to the callers waiting on a load whose provider panicked.
+var ERR_LOAD_PANICKED = errors.New("cache provider panicked while loading the value")
+
+// Priority classes for cache entries. Entries are evicted in priority order, so no
+// HIGH entry is evicted to make room while a LOW entry remains. PINNED entries are
+// never evicted to make room and are only removed by Evict.
+type Priority int8
+
+const (
+	LOW    Priority = 0
+	HIGH   Priority = 1
+	PINNED Priority = 2
+)
+
+// Cache provides an interface for a write-through cache keyed by Key.
+// Get inserts missing values with LOW priority while GetWithPriority allows the caller
+// to choose the priority class. Requesting a cached entry with a higher priority than
+// it was inserted with raises the entry's priority.
+// Lookup returns a cached value without inserting on a miss or updating the entry's
+// standing in the eviction policy on a hit, for reads which should not disturb the
+// cache's working set. Stats returns a point in time snapshot of the cache's counters
+// and capacity usage.
 type Cache interface {
-	Get(key Shardable, provider func(Shardable) ([]byte, error)) ([]byte, error)
-	Evict(key Shardable) error
+	Get(key Key, provider func(Key) ([]byte, error)) ([]byte, error)
+	GetWithPriority(key Key, priority Priority, provider func(Key) ([]byte, error)) ([]byte, error)
+	Lookup(key Key) ([]byte, bool)
+	Evict(key Key) error
+	Stats() Stats
+}
+
+// An in flight call to a provider. Callers which miss on a key that is already being
+// loaded wait for done to be closed and then share the loaded value and error, so that
+// only a single load runs per key at a time. Evicting the key while the call is in
+// flight marks the call evicted so that its value, which may already be stale, is not
+// inserted once it has loaded. A call starts out with an error which a provider
+// returning replaces, so that the waiters of a provider which panics are woken with it.
+type call struct {
+	done    chan struct{}
+	value   []byte
+	err     error
+	evicted bool
+}
+
+func newCall() *call {
+	return &call{done: make(chan struct{}), err: ERR_LOAD_PANICKED}
 }
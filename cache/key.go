@@ -0,0 +1,22 @@
+package cache
+
+// Identifies a cached block by the file which contains it and the block's offset
+// within that file. Keys are values, so two keys for the same block are always equal
+// regardless of how many times the file has been opened.
+type Key struct {
+	FileID uint64
+	Offset int64
+}
+
+// Returns the shard the key belongs to. Both the file id and the offset are mixed
+// through a finalizer so that blocks at identical offsets in different files are
+// spread evenly across shards.
+func (key Key) Shard(numShards int) int {
+	h := key.FileID ^ (uint64(key.Offset) * 0x9e3779b97f4a7c15)
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return int(h % uint64(numShards))
+}
@@ -0,0 +1,18 @@
+package cache
+
+import "testing"
+
+func TestShardDistributesIdenticalOffsets(t *testing.T) {
+	numShards := 16
+	counts := make([]int, numShards)
+	for i := 0; i < 1600; i++ {
+		key := Key{FileID: uint64(i), Offset: 0}
+		counts[key.Shard(numShards)]++
+	}
+
+	for shard, count := range counts {
+		if count == 0 {
+			t.Errorf("Expected keys with identical offsets to be spread across shards, but shard %d was empty", shard)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// The portion of each shard which is reserved for the protected segment.
+const protectedRatio = 0.8
+
+type segment int8
+
+// LOW priority entries move between PROBATION and PROTECTED. HIGH priority entries are
+// held in PRIORITIZED and PINNED entries in RETAINED, outside of the segmented policy.
+const (
+	PROBATION   segment = 0
+	PROTECTED   segment = 1
+	PRIORITIZED segment = 2
+	RETAINED    segment = 3
+)
+
+// A single cache entry to be contained in a list.Element of a segment.
+type slruEntry struct {
+	key     Key
+	value   []byte
+	size    int
+	segment segment
+}
+
+// A shard contained within the larger SegmentedLRUCache.
+// Each shard maintains an ordering list per segment. Entries are always evicted from
+// the probation segment first, then the protected segment and finally the prioritized
+// segment. Retained entries are never evicted to make room. Loads which are in flight
+// are tracked so that concurrent misses on a key share a single load.
+type slruShard struct {
+	lock            sync.Mutex
+	probationSize   int64
+	protectedSize   int64
+	prioritizedSize int64
+	retainedSize    int64
+	entries         map[Key]*list.Element
+	probation       *list.List
+	protected       *list.List
+	prioritized     *list.List
+	retained        *list.List
+	loading         map[Key]*call
+	counters        counters
+}
+
+// A scan resistant Cache implementation. Each shard is split into a probation segment
+// and a protected segment. New entries are inserted into probation and only move to
+// the protected segment once they are hit again. A single pass over many blocks, such
+// as a long range scan, can therefore only displace other probationary entries and
+// leaves the frequently used working set in the protected segment alone. HIGH and
+// PINNED priority entries bypass the segments and are only displaced once every LOW
+// priority entry has been evicted.
+type SegmentedLRUCache struct {
+	shardMaxSize     int64
+	protectedMaxSize int64
+	shards           []*slruShard
+}
+
+// Generates a new instance of a SegmentedLRUCache for the number of shards provided.
+// Each shard is of equal size.
+func NewSegmentedLRUCache(numShards int, size int64) *SegmentedLRUCache {
+	shards := make([]*slruShard, numShards)
+	shardSize := size / int64(numShards)
+	for i := range shards {
+		entries := make(map[Key]*list.Element)
+		shards[i] = &slruShard{
+			entries:     entries,
+			probation:   list.New(),
+			protected:   list.New(),
+			prioritized: list.New(),
+			retained:    list.New(),
+			loading:     make(map[Key]*call),
+		}
+	}
+
+	return &SegmentedLRUCache{
+		shardMaxSize:     shardSize,
+		protectedMaxSize: int64(float64(shardSize) * protectedRatio),
+		shards:           shards,
+	}
+}
+
+// Get the value for a given key, falling back to the provider function if it does not
+// exist. A hit promotes the entry into the protected segment while a miss inserts the
+// provided value into the probation segment. If the key is already being loaded by
+// another caller then Get waits for that load rather than invoking the provider again.
+// Values are inserted with LOW priority.
+func (slru *SegmentedLRUCache) Get(key Key, provider func(Key) ([]byte, error)) ([]byte, error) {
+	return slru.GetWithPriority(key, LOW, provider)
+}
+
+// Get the value for a given key in the same manner as Get, inserting a missing value
+// with the given priority. HIGH and PINNED priority values skip the probation segment.
+func (slru *SegmentedLRUCache) GetWithPriority(key Key, priority Priority, provider func(Key) ([]byte, error)) ([]byte, error) {
+	shard := slru.getShard(key)
+
+	shard.lock.Lock()
+	listElement, found := shard.entries[key]
+	if found {
+		listElement = shard.touch(listElement, priority, slru.protectedMaxSize)
+		value := listElement.Value.(*slruEntry).value
+		shard.lock.Unlock()
+		shard.counters.hit()
+		return value, nil
+	}
+	shard.counters.miss()
+	if inFlight, loading := shard.loading[key]; loading {
+		shard.lock.Unlock()
+		<-inFlight.done
+		return inFlight.value, inFlight.err
+	}
+	load := newCall()
+	shard.loading[key] = load
+	shard.lock.Unlock()
+
+	// Deferred so that waiters are woken and the key can be loaded again even if the
+	// provider panics
+	defer func() {
+		shard.lock.Lock()
+		delete(shard.loading, key)
+		if load.err == nil && !load.evicted {
+			existing, found := shard.entries[key]
+			if found {
+				shard.remove(existing)
+			}
+			entry := &slruEntry{key: key, value: load.value, size: len(load.value), segment: segmentFor(priority)}
+			shard.entries[key] = shard.push(entry)
+			shard.counters.insert()
+			shard.evict(slru.shardMaxSize)
+		}
+		shard.lock.Unlock()
+		close(load.done)
+	}()
+	load.value, load.err = provider(key)
+
+	if load.err != nil {
+		return nil, load.err
+	}
+	return load.value, nil
+}
+
+// Get the value for a given key if it is cached. The entry is not promoted.
+func (slru *SegmentedLRUCache) Lookup(key Key) ([]byte, bool) {
+	shard := slru.getShard(key)
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	listElement, found := shard.entries[key]
+	if !found {
+		shard.counters.miss()
+		return nil, false
+	}
+	shard.counters.hit()
+	return listElement.Value.(*slruEntry).value, true
+}
+
+// Evict the entry for a given key from the cache. A load of the key which is in flight
+// is not inserted once it completes.
+func (slru *SegmentedLRUCache) Evict(key Key) error {
+	shard := slru.getShard(key)
+
+	shard.lock.Lock()
+	listElement, found := shard.entries[key]
+	if found {
+		shard.remove(listElement)
+	}
+	if inFlight, loading := shard.loading[key]; loading {
+		inFlight.evicted = true
+	}
+	shard.lock.Unlock()
+
+	return nil
+}
+
+// Returns the cache's counters along with the bytes and entries held by each shard.
+func (slru *SegmentedLRUCache) Stats() Stats {
+	stats := Stats{Shards: make([]ShardStats, 0, len(slru.shards))}
+	for _, shard := range slru.shards {
+		shard.lock.Lock()
+		shardStats := shard.counters.shardStats(shard.size(), len(shard.entries))
+		shard.lock.Unlock()
+		stats.add(shardStats)
+	}
+	return stats
+}
+
+func (slru *SegmentedLRUCache) getShard(key Key) *slruShard {
+	return slru.shards[key.Shard(len(slru.shards))]
+}
+
+// Returns the segment in which a newly inserted entry of the given priority is held.
+func segmentFor(priority Priority) segment {
+	switch priority {
+	case HIGH:
+		return PRIORITIZED
+	case PINNED:
+		return RETAINED
+	default:
+		return PROBATION
+	}
+}
+
+// Marks an entry as used. LOW priority entries are promoted while HIGH and PINNED
+// entries move to the front of their segment. If a higher priority than the entry's
+// current priority is requested then the entry moves into that priority's segment.
+func (s *slruShard) touch(listElement *list.Element, priority Priority, protectedMaxSize int64) *list.Element {
+	entry := listElement.Value.(*slruEntry)
+	current := entry.segment
+	if current == PROTECTED {
+		current = PROBATION
+	}
+	requested := segmentFor(priority)
+	if requested > current {
+		s.remove(listElement)
+		entry.segment = requested
+		listElement = s.push(entry)
+		s.entries[entry.key] = listElement
+		return listElement
+	}
+
+	switch entry.segment {
+	case PRIORITIZED:
+		s.prioritized.MoveToFront(listElement)
+	case RETAINED:
+		s.retained.MoveToFront(listElement)
+	default:
+		s.promote(listElement, protectedMaxSize)
+	}
+	return listElement
+}
+
+// Moves an entry to the front of the protected segment. If the protected segment grows
+// beyond its maximum size then its least recently used entries are demoted back to
+// the front of the probation segment.
+func (s *slruShard) promote(listElement *list.Element, protectedMaxSize int64) {
+	entry := listElement.Value.(*slruEntry)
+	if entry.segment == PROTECTED {
+		s.protected.MoveToFront(listElement)
+		return
+	}
+
+	s.probation.Remove(listElement)
+	s.probationSize -= int64(entry.size)
+	entry.segment = PROTECTED
+	s.entries[entry.key] = s.protected.PushFront(entry)
+	s.protectedSize += int64(entry.size)
+
+	for s.protectedSize > protectedMaxSize {
+		demoted := s.protected.Back()
+		if demoted == nil {
+			break
+		}
+		demotedEntry := demoted.Value.(*slruEntry)
+		s.protected.Remove(demoted)
+		s.protectedSize -= int64(demotedEntry.size)
+		demotedEntry.segment = PROBATION
+		s.entries[demotedEntry.key] = s.probation.PushFront(demotedEntry)
+		s.probationSize += int64(demotedEntry.size)
+	}
+}
+
+// Evicts entries until the shard fits within maxSize, starting with the least recently
+// used probationary entries. Retained entries are never evicted.
+func (s *slruShard) evict(maxSize int64) {
+	for s.size() > maxSize {
+		removed := s.probation.Back()
+		if removed == nil {
+			removed = s.protected.Back()
+		}
+		if removed == nil {
+			removed = s.prioritized.Back()
+		}
+		if removed == nil {
+			break
+		}
+		s.remove(removed)
+		s.counters.evict()
+	}
+}
+
+func (s *slruShard) size() int64 {
+	return s.probationSize + s.protectedSize + s.prioritizedSize + s.retainedSize
+}
+
+// Returns the list and size counter backing a segment.
+func (s *slruShard) segment(seg segment) (*list.List, *int64) {
+	switch seg {
+	case PROTECTED:
+		return s.protected, &s.protectedSize
+	case PRIORITIZED:
+		return s.prioritized, &s.prioritizedSize
+	case RETAINED:
+		return s.retained, &s.retainedSize
+	default:
+		return s.probation, &s.probationSize
+	}
+}
+
+// Pushes an entry onto the front of its segment.
+func (s *slruShard) push(entry *slruEntry) *list.Element {
+	ordering, size := s.segment(entry.segment)
+	*size += int64(entry.size)
+	return ordering.PushFront(entry)
+}
+
+func (s *slruShard) remove(listElement *list.Element) {
+	entry := listElement.Value.(*slruEntry)
+	delete(s.entries, entry.key)
+	ordering, size := s.segment(entry.segment)
+	ordering.Remove(listElement)
+	*size -= int64(entry.size)
+}
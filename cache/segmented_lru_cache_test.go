@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	c "github.com/patrickgombert/lsmt/comparator"
+)
+
+func TestSegmentedGetNewGeneratedValue(t *testing.T) {
+	slru := NewSegmentedLRUCache(1, 100)
+	key := Key{FileID: 1, Offset: 0}
+	value, _ := slru.Get(key, staticProvider([]byte{1, 2}))
+	if c.Compare([]byte{1, 2}, value) != c.EQUAL {
+		t.Errorf("Expected Get() to return %q, but got %q", []byte{1, 2}, value)
+	}
+}
+
+func TestSegmentedReadIgnoresProviderIfPresent(t *testing.T) {
+	slru := NewSegmentedLRUCache(1, 100)
+	key := Key{FileID: 1, Offset: 0}
+	slru.Get(key, staticProvider([]byte{1, 2}))
+	value, _ := slru.Get(key, staticProvider([]byte{2, 1}))
+	if c.Compare([]byte{1, 2}, value) != c.EQUAL {
+		t.Errorf("Expected Get() to return %q, but got %q", []byte{1, 2}, value)
+	}
+}
+
+func TestSegmentedEvict(t *testing.T) {
+	slru := NewSegmentedLRUCache(1, 100)
+	key := Key{FileID: 1, Offset: 0}
+	slru.Get(key, staticProvider([]byte{1, 2}))
+	slru.Get(key, staticProvider([]byte{1, 2}))
+	slru.Evict(key)
+	_, found := slru.Lookup(key)
+	if found {
+		t.Error("Expected evicted key to not be found, but was found")
+	}
+	if slru.shards[0].protectedSize != 0 {
+		t.Errorf("Expected protected segment to be empty, but had size %d", slru.shards[0].protectedSize)
+	}
+}
+
+func TestSegmentedScanDoesNotEvictProtected(t *testing.T) {
+	slru := NewSegmentedLRUCache(1, 10)
+	hot := Key{FileID: 1, Offset: 0}
+	slru.Get(hot, staticProvider([]byte{1}))
+	slru.Get(hot, staticProvider([]byte{1}))
+
+	for i := int64(1); i <= 100; i++ {
+		slru.Get(Key{FileID: 2, Offset: i}, staticProvider([]byte{2}))
+	}
+
+	_, found := slru.Lookup(hot)
+	if !found {
+		t.Error("Expected a scan to leave the protected entry cached, but it was evicted")
+	}
+	if slru.shards[0].probationSize+slru.shards[0].protectedSize > 10 {
+		t.Errorf("Expected shard to stay within max size 10, but got %d", slru.shards[0].probationSize+slru.shards[0].protectedSize)
+	}
+}
+
+func TestSegmentedProtectedOverflowDemotes(t *testing.T) {
+	slru := NewSegmentedLRUCache(1, 10)
+	for i := int64(0); i < 9; i++ {
+		key := Key{FileID: 1, Offset: i}
+		slru.Get(key, staticProvider([]byte{1}))
+		slru.Get(key, staticProvider([]byte{1}))
+	}
+
+	if slru.shards[0].protectedSize != 8 {
+		t.Errorf("Expected protected segment to be capped at 8, but got %d", slru.shards[0].protectedSize)
+	}
+	if slru.shards[0].probationSize != 1 {
+		t.Errorf("Expected demoted entry to move to probation, but probation had size %d", slru.shards[0].probationSize)
+	}
+}
+
+func TestSegmentedLookupDoesNotInsert(t *testing.T) {
+	slru := NewSegmentedLRUCache(1, 100)
+	_, found := slru.Lookup(Key{FileID: 1, Offset: 0})
+	if found {
+		t.Error("Expected Lookup() on an empty cache to not find a value, but did")
+	}
+}
+
+func TestSegmentedConcurrentMissesShareOneLoad(t *testing.T) {
+	slru := NewSegmentedLRUCache(1, 100)
+	key := Key{FileID: 1, Offset: 0}
+	var loads int32
+	provider := func(Key) ([]byte, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(10 * time.Millisecond)
+		return []byte{1, 2}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slru.Get(key, provider)
+		}()
+	}
+	wg.Wait()
+
+	if loads != 1 {
+		t.Errorf("Expected concurrent misses to invoke the provider once, but invoked it %d times", loads)
+	}
+	if slru.shards[0].probationSize+slru.shards[0].protectedSize != 2 {
+		t.Errorf("Expected shard size to be 2, but got %d", slru.shards[0].probationSize+slru.shards[0].protectedSize)
+	}
+}
+
+func TestSegmentedHighPriorityEvictedAfterLowPriority(t *testing.T) {
+	slru := NewSegmentedLRUCache(1, 3)
+	high := Key{FileID: 1, Offset: 0}
+	slru.GetWithPriority(high, HIGH, staticProvider([]byte{1}))
+	for i := int64(1); i <= 10; i++ {
+		key := Key{FileID: 2, Offset: i}
+		slru.Get(key, staticProvider([]byte{2}))
+		slru.Get(key, staticProvider([]byte{2}))
+	}
+
+	_, found := slru.Lookup(high)
+	if !found {
+		t.Error("Expected LOW priority entries to leave the HIGH priority entry cached, but it was evicted")
+	}
+}
+
+func TestSegmentedPinnedIsNeverEvicted(t *testing.T) {
+	slru := NewSegmentedLRUCache(1, 1)
+	pinned := Key{FileID: 1, Offset: 0}
+	slru.GetWithPriority(pinned, PINNED, staticProvider([]byte{1}))
+	slru.GetWithPriority(Key{FileID: 2, Offset: 0}, HIGH, staticProvider([]byte{2}))
+
+	_, found := slru.Lookup(pinned)
+	if !found {
+		t.Error("Expected the PINNED entry to stay cached, but it was evicted")
+	}
+	slru.Evict(pinned)
+	if slru.shards[0].size() != 0 {
+		t.Errorf("Expected shard to be empty, but got size %d", slru.shards[0].size())
+	}
+}
+
+func TestSegmentedGetWithPriorityRaisesPriority(t *testing.T) {
+	slru := NewSegmentedLRUCache(1, 10)
+	key := Key{FileID: 1, Offset: 0}
+	slru.Get(key, staticProvider([]byte{1}))
+	slru.GetWithPriority(key, PINNED, staticProvider([]byte{1}))
+
+	if slru.shards[0].retainedSize != 1 || slru.shards[0].probationSize != 0 {
+		t.Errorf("Expected entry to move to the retained segment, but retained had size %d", slru.shards[0].retainedSize)
+	}
+}
+
+func TestSegmentedEvictDuringLoadDropsTheLoadedValue(t *testing.T) {
+	slru := NewSegmentedLRUCache(1, 100)
+	key := Key{FileID: 1, Offset: 0}
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	loaded := make(chan []byte)
+	go func() {
+		value, _ := slru.Get(key, func(Key) ([]byte, error) {
+			close(started)
+			<-finish
+			return []byte{1}, nil
+		})
+		loaded <- value
+	}()
+
+	<-started
+	slru.Evict(key)
+	close(finish)
+	value := <-loaded
+	if c.Compare([]byte{1}, value) != c.EQUAL {
+		t.Errorf("Expected Get() to return %q, but got %q", []byte{1}, value)
+	}
+	_, found := slru.Lookup(key)
+	if found {
+		t.Error("Expected a load evicted while in flight to not be cached, but was")
+	}
+}
+
+func TestSegmentedPanickingProviderReleasesTheLoad(t *testing.T) {
+	slru := NewSegmentedLRUCache(1, 100)
+	key := Key{FileID: 1, Offset: 0}
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		slru.Get(key, func(Key) ([]byte, error) {
+			close(started)
+			<-finish
+			panic("failed")
+		})
+	}()
+
+	<-started
+	waited := make(chan error)
+	go func() {
+		_, err := slru.Get(key, staticProvider([]byte{2}))
+		waited <- err
+	}()
+	// Wait for the second caller to start waiting on the in flight load
+	for slru.Stats().Misses < 2 {
+		runtime.Gosched()
+	}
+	close(finish)
+	err := <-waited
+	if err != ERR_LOAD_PANICKED {
+		t.Errorf("Expected waiting Get() to return %v, but got %v", ERR_LOAD_PANICKED, err)
+	}
+
+	value, err := slru.Get(key, staticProvider([]byte{3}))
+	if err != nil || c.Compare([]byte{3}, value) != c.EQUAL {
+		t.Errorf("Expected Get() after the panic to load %q, but got %q and %v", []byte{3}, value, err)
+	}
+}
@@ -2,34 +2,34 @@ package cache
 
 import (
 	"container/list"
-	"fmt"
 	"sync"
 )
 
-type Shardable interface {
-	Shard(numShards int) int
-}
-
 // A single cache entry to be contained in a list.Element
 type e struct {
-	key   Shardable
-	value []byte
-	size  int
+	key      Key
+	value    []byte
+	size     int
+	priority Priority
 }
 
 // A shard contained within the larger ShardedLRUCache.
-// Each shard contains its own read-write lock. An ordering list is maintained so that
-// the shard knows what value to evict the least recently used element(s).
+// Each shard contains its own read-write lock. An ordering list is maintained per
+// priority class so that the shard knows what value to evict the least recently used
+// element(s) of the lowest priority. Loads which are in flight are tracked so that
+// concurrent misses on a key share a single load.
 type shard struct {
-	lock     sync.RWMutex
-	size     int64
-	entries  map[Shardable]*list.Element
-	ordering *list.List
+	lock      sync.RWMutex
+	size      int64
+	entries   map[Key]*list.Element
+	orderings [PINNED + 1]*list.List
+	loading   map[Key]*call
+	counters  counters
 }
 
 // A Cache implementation which provides shards in order to minimize lock contention.
-// All shards are of equal size as defined by shardMaxSize. A hashing function is also
-// stored in order to route new incoming elements to the correct shard.
+// All shards are of equal size as defined by shardMaxSize. Incoming keys are routed to
+// a shard by their hash.
 type ShardedLRUCache struct {
 	shardMaxSize int64
 	shards       []*shard
@@ -41,8 +41,9 @@ func NewShardedLRUCache(numShards int, size int64) *ShardedLRUCache {
 	shards := make([]*shard, numShards)
 	shardSize := size / int64(numShards)
 	for i := range shards {
-		entries := make(map[Shardable]*list.Element)
-		shards[i] = &shard{size: 0, entries: entries, ordering: list.New()}
+		entries := make(map[Key]*list.Element)
+		orderings := [PINNED + 1]*list.List{list.New(), list.New(), list.New()}
+		shards[i] = &shard{size: 0, entries: entries, orderings: orderings, loading: make(map[Key]*call)}
 	}
 
 	return &ShardedLRUCache{shardMaxSize: shardSize, shards: shards}
@@ -50,80 +51,150 @@ func NewShardedLRUCache(numShards int, size int64) *ShardedLRUCache {
 
 // Get the value for a given key, falling back to the provider function if it does not
 // exist. The provider function must provide both the value for the associated key and
-// the size of the generated value.
-func (lru *ShardedLRUCache) Get(key Shardable, provider func(Shardable) ([]byte, error)) ([]byte, error) {
-	shard, err := lru.getShard(key)
-	if err != nil {
-		return nil, err
-	}
+// the size of the generated value. If the key is already being loaded by another
+// caller then Get waits for that load rather than invoking the provider again.
+// Values are inserted with LOW priority.
+func (lru *ShardedLRUCache) Get(key Key, provider func(Key) ([]byte, error)) ([]byte, error) {
+	return lru.GetWithPriority(key, LOW, provider)
+}
 
-	shard.lock.RLock()
-	listElement, found := shard.entries[key]
-	shard.lock.RUnlock()
+// Get the value for a given key in the same manner as Get, inserting a missing value
+// with the given priority.
+func (lru *ShardedLRUCache) GetWithPriority(key Key, priority Priority, provider func(Key) ([]byte, error)) ([]byte, error) {
+	shard := lru.getShard(key)
 
+	shard.lock.Lock()
+	listElement, found := shard.entries[key]
 	if found {
-		shard.lock.Lock()
-		shard.ordering.MoveToFront(listElement)
+		listElement = shard.touch(listElement, priority)
+		value := listElement.Value.(*e).value
+		shard.lock.Unlock()
+		shard.counters.hit()
+		return value, nil
+	}
+	shard.counters.miss()
+	if inFlight, loading := shard.loading[key]; loading {
 		shard.lock.Unlock()
+		<-inFlight.done
+		return inFlight.value, inFlight.err
+	}
+	load := newCall()
+	shard.loading[key] = load
+	shard.lock.Unlock()
 
-		return listElement.Value.(*e).value, nil
-	} else {
-		value, err := provider(key)
-		if err != nil {
-			return nil, err
-		}
-		size := len(value)
-		entry := &e{key: key, value: value, size: size}
+	// Deferred so that waiters are woken and the key can be loaded again even if the
+	// provider panics
+	defer func() {
 		shard.lock.Lock()
-		listElement = shard.ordering.PushFront(entry)
-		shard.entries[key] = listElement
-		shard.size += int64(size)
-		for shard.size > lru.shardMaxSize {
-			removed := shard.ordering.Back()
-			if removed == nil {
-				break
-			}
-			shard.remove(removed)
+		delete(shard.loading, key)
+		if load.err == nil && !load.evicted {
+			shard.insert(key, load.value, priority, lru.shardMaxSize)
 		}
 		shard.lock.Unlock()
+		close(load.done)
+	}()
+	load.value, load.err = provider(key)
 
-		return value, nil
+	if load.err != nil {
+		return nil, load.err
 	}
+	return load.value, nil
 }
 
-// Evict the entry for a given key from the cache.
-func (lru *ShardedLRUCache) Evict(key Shardable) error {
-	shard, err := lru.getShard(key)
-	if err != nil {
-		return err
-	}
+// Get the value for a given key if it is cached. The entry's recency is not updated.
+func (lru *ShardedLRUCache) Lookup(key Key) ([]byte, bool) {
+	shard := lru.getShard(key)
 
 	shard.lock.RLock()
+	defer shard.lock.RUnlock()
 	listElement, found := shard.entries[key]
-	shard.lock.RUnlock()
+	if !found {
+		shard.counters.miss()
+		return nil, false
+	}
+	shard.counters.hit()
+	return listElement.Value.(*e).value, true
+}
+
+// Evict the entry for a given key from the cache. A load of the key which is in flight
+// is not inserted once it completes.
+func (lru *ShardedLRUCache) Evict(key Key) error {
+	shard := lru.getShard(key)
 
+	shard.lock.Lock()
+	listElement, found := shard.entries[key]
 	if found {
-		shard.lock.Lock()
 		shard.remove(listElement)
-		shard.lock.Unlock()
 	}
+	if inFlight, loading := shard.loading[key]; loading {
+		inFlight.evicted = true
+	}
+	shard.lock.Unlock()
 
 	return nil
 }
 
-func (lru *ShardedLRUCache) getShard(key Shardable) (*shard, error) {
-	shardNum := key.Shard(len(lru.shards))
-	if shardNum < 0 || shardNum > len(lru.shards) {
-		return nil, fmt.Errorf("shard key produced %d for number of shards %d with key %q", shardNum, len(lru.shards), key)
+// Returns the cache's counters along with the bytes and entries held by each shard.
+func (lru *ShardedLRUCache) Stats() Stats {
+	stats := Stats{Shards: make([]ShardStats, 0, len(lru.shards))}
+	for _, shard := range lru.shards {
+		shard.lock.RLock()
+		shardStats := shard.counters.shardStats(shard.size, len(shard.entries))
+		shard.lock.RUnlock()
+		stats.add(shardStats)
+	}
+	return stats
+}
+
+func (lru *ShardedLRUCache) getShard(key Key) *shard {
+	return lru.shards[key.Shard(len(lru.shards))]
+}
+
+// Inserts a value for the key and evicts the least recently used entries of the lowest
+// priority until the shard fits within maxSize. If the key is already present then its
+// value is replaced so that the key is only accounted for once.
+func (s *shard) insert(key Key, value []byte, priority Priority, maxSize int64) {
+	existing, found := s.entries[key]
+	if found {
+		s.remove(existing)
+	}
+
+	entry := &e{key: key, value: value, size: len(value), priority: priority}
+	s.entries[key] = s.orderings[priority].PushFront(entry)
+	s.size += int64(entry.size)
+	s.counters.insert()
+	for s.size > maxSize {
+		removed := s.orderings[LOW].Back()
+		if removed == nil {
+			removed = s.orderings[HIGH].Back()
+		}
+		if removed == nil {
+			break
+		}
+		s.remove(removed)
+		s.counters.evict()
+	}
+}
+
+// Marks an entry as the most recently used entry of its priority class, raising the
+// entry's priority if a higher priority was requested.
+func (s *shard) touch(listElement *list.Element, priority Priority) *list.Element {
+	entry := listElement.Value.(*e)
+	if priority <= entry.priority {
+		s.orderings[entry.priority].MoveToFront(listElement)
+		return listElement
 	}
 
-	shard := lru.shards[shardNum]
-	return shard, nil
+	s.orderings[entry.priority].Remove(listElement)
+	entry.priority = priority
+	listElement = s.orderings[priority].PushFront(entry)
+	s.entries[entry.key] = listElement
+	return listElement
 }
 
 func (s *shard) remove(listElement *list.Element) {
 	entry := listElement.Value.(*e)
 	delete(s.entries, entry.key)
-	s.ordering.Remove(listElement)
+	s.orderings[entry.priority].Remove(listElement)
 	s.size -= int64(entry.size)
 }
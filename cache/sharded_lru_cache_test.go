@@ -1,22 +1,19 @@
 package cache
 
 import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	c "github.com/patrickgombert/lsmt/comparator"
 )
 
-type sharded struct {
-	shard int
-}
-
-func (s *sharded) Shard(numShards int) int {
-	return s.shard
-}
-
 func TestGetNewGeneratedValue(t *testing.T) {
 	lru := NewShardedLRUCache(1, 100)
-	key := &sharded{shard: 0}
+	key := Key{FileID: 1, Offset: 0}
 	value, _ := lru.Get(key, staticProvider([]byte{1, 2}))
 	if c.Compare([]byte{1, 2}, value) != c.EQUAL {
 		t.Errorf("Expected Get() to return %q, but got %q", []byte{1, 2}, value)
@@ -25,7 +22,7 @@ func TestGetNewGeneratedValue(t *testing.T) {
 
 func TestEvictEmptyCacheNoError(t *testing.T) {
 	lru := NewShardedLRUCache(1, 100)
-	err := lru.Evict(&sharded{shard: 0})
+	err := lru.Evict(Key{FileID: 1, Offset: 0})
 	if err != nil {
 		t.Error("Expected empty cache to Evict() without an error, but did not")
 	}
@@ -33,7 +30,7 @@ func TestEvictEmptyCacheNoError(t *testing.T) {
 
 func TestEvict(t *testing.T) {
 	lru := NewShardedLRUCache(1, 100)
-	key := &sharded{shard: 0}
+	key := Key{FileID: 1, Offset: 0}
 	lru.Get(key, staticProvider([]byte{1, 2}))
 	lru.Evict(key)
 	value, _ := lru.Get(key, staticProvider([]byte{2, 1}))
@@ -44,7 +41,7 @@ func TestEvict(t *testing.T) {
 
 func TestReadIgnoresProviderIfPresent(t *testing.T) {
 	lru := NewShardedLRUCache(1, 100)
-	key := &sharded{shard: 0}
+	key := Key{FileID: 1, Offset: 0}
 	lru.Get(key, staticProvider([]byte{1, 2}))
 	value, _ := lru.Get(key, staticProvider([]byte{2, 1}))
 	if c.Compare([]byte{1, 2}, value) != c.EQUAL {
@@ -54,8 +51,8 @@ func TestReadIgnoresProviderIfPresent(t *testing.T) {
 
 func TestTwoShardsNoEvictions(t *testing.T) {
 	lru := NewShardedLRUCache(2, 100)
-	key0 := &sharded{shard: 0}
-	key1 := &sharded{shard: 1}
+	key0 := Key{FileID: 1, Offset: 0}
+	key1 := keyInOtherShard(key0, 2)
 	lru.Get(key0, staticProvider([]byte{0}))
 	lru.Get(key1, staticProvider([]byte{1}))
 
@@ -71,8 +68,8 @@ func TestTwoShardsNoEvictions(t *testing.T) {
 
 func TestSizeEviction(t *testing.T) {
 	lru := NewShardedLRUCache(1, 1)
-	k1 := &sharded{shard: 0}
-	k2 := &sharded{shard: 0}
+	k1 := Key{FileID: 1, Offset: 0}
+	k2 := Key{FileID: 1, Offset: 4096}
 	lru.Get(k1, staticProvider([]byte{1}))
 	value, _ := lru.Get(k2, staticProvider([]byte{2}))
 	if c.Compare([]byte{2}, value) != c.EQUAL {
@@ -83,8 +80,202 @@ func TestSizeEviction(t *testing.T) {
 	}
 }
 
-func staticProvider(value []byte) func(Shardable) ([]byte, error) {
-	return func(Shardable) ([]byte, error) {
+func staticProvider(value []byte) func(Key) ([]byte, error) {
+	return func(Key) ([]byte, error) {
 		return value, nil
 	}
 }
+
+func keyInOtherShard(key Key, numShards int) Key {
+	other := Key{FileID: key.FileID, Offset: key.Offset}
+	for other.Shard(numShards) == key.Shard(numShards) {
+		other.Offset++
+	}
+	return other
+}
+
+func TestLookupDoesNotInsert(t *testing.T) {
+	lru := NewShardedLRUCache(1, 100)
+	key := Key{FileID: 1, Offset: 0}
+	_, found := lru.Lookup(key)
+	if found {
+		t.Error("Expected Lookup() on an empty cache to not find a value, but did")
+	}
+
+	lru.Get(key, staticProvider([]byte{1}))
+	value, found := lru.Lookup(key)
+	if !found || c.Compare([]byte{1}, value) != c.EQUAL {
+		t.Errorf("Expected Lookup() to return %q, but got %q", []byte{1}, value)
+	}
+}
+
+func TestConcurrentMissesShareOneLoad(t *testing.T) {
+	lru := NewShardedLRUCache(1, 100)
+	key := Key{FileID: 1, Offset: 0}
+	var loads int32
+	provider := func(Key) ([]byte, error) {
+		atomic.AddInt32(&loads, 1)
+		time.Sleep(10 * time.Millisecond)
+		return []byte{1, 2}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, _ := lru.Get(key, provider)
+			if c.Compare([]byte{1, 2}, value) != c.EQUAL {
+				t.Errorf("Expected Get() to return %q, but got %q", []byte{1, 2}, value)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if loads != 1 {
+		t.Errorf("Expected concurrent misses to invoke the provider once, but invoked it %d times", loads)
+	}
+	if lru.shards[0].size != 2 {
+		t.Errorf("Expected shard size to be 2, but got %d", lru.shards[0].size)
+	}
+}
+
+func TestProviderErrorIsShared(t *testing.T) {
+	lru := NewShardedLRUCache(1, 100)
+	key := Key{FileID: 1, Offset: 0}
+	failure := errors.New("failed")
+	_, err := lru.Get(key, func(Key) ([]byte, error) {
+		return nil, failure
+	})
+	if err != failure {
+		t.Errorf("Expected Get() to return the provider's error, but got %v", err)
+	}
+	_, found := lru.Lookup(key)
+	if found {
+		t.Error("Expected a failed load to not be cached, but was")
+	}
+}
+
+func TestDuplicateInsertIsAccountedOnce(t *testing.T) {
+	lru := NewShardedLRUCache(1, 100)
+	key := Key{FileID: 1, Offset: 0}
+	lru.shards[0].insert(key, []byte{1, 2}, LOW, 100)
+	lru.shards[0].insert(key, []byte{1, 2, 3}, LOW, 100)
+	if lru.shards[0].size != 3 {
+		t.Errorf("Expected duplicate insert to replace the entry with size 3, but got %d", lru.shards[0].size)
+	}
+}
+
+func TestHighPriorityEvictedAfterLowPriority(t *testing.T) {
+	lru := NewShardedLRUCache(1, 2)
+	high := Key{FileID: 1, Offset: 0}
+	lru.GetWithPriority(high, HIGH, staticProvider([]byte{1}))
+	for i := int64(1); i <= 10; i++ {
+		lru.Get(Key{FileID: 2, Offset: i}, staticProvider([]byte{2}))
+	}
+
+	_, found := lru.Lookup(high)
+	if !found {
+		t.Error("Expected LOW priority inserts to leave the HIGH priority entry cached, but it was evicted")
+	}
+}
+
+func TestPinnedIsNeverEvicted(t *testing.T) {
+	lru := NewShardedLRUCache(1, 1)
+	pinned := Key{FileID: 1, Offset: 0}
+	lru.GetWithPriority(pinned, PINNED, staticProvider([]byte{1}))
+	lru.GetWithPriority(Key{FileID: 2, Offset: 0}, HIGH, staticProvider([]byte{2}))
+
+	_, found := lru.Lookup(pinned)
+	if !found {
+		t.Error("Expected the PINNED entry to stay cached, but it was evicted")
+	}
+	lru.Evict(pinned)
+	_, found = lru.Lookup(pinned)
+	if found {
+		t.Error("Expected Evict() to remove the PINNED entry, but it was found")
+	}
+	if lru.shards[0].size != 0 {
+		t.Errorf("Expected shard to be empty, but got size %d", lru.shards[0].size)
+	}
+}
+
+func TestGetWithPriorityRaisesPriority(t *testing.T) {
+	lru := NewShardedLRUCache(1, 2)
+	key := Key{FileID: 1, Offset: 0}
+	lru.Get(key, staticProvider([]byte{1}))
+	lru.GetWithPriority(key, HIGH, staticProvider([]byte{1}))
+	lru.Get(key, staticProvider([]byte{1}))
+	for i := int64(1); i <= 10; i++ {
+		lru.Get(Key{FileID: 2, Offset: i}, staticProvider([]byte{2}))
+	}
+
+	_, found := lru.Lookup(key)
+	if !found {
+		t.Error("Expected the raised entry to stay cached, but it was evicted")
+	}
+}
+
+func TestEvictDuringLoadDropsTheLoadedValue(t *testing.T) {
+	lru := NewShardedLRUCache(1, 100)
+	key := Key{FileID: 1, Offset: 0}
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	loaded := make(chan []byte)
+	go func() {
+		value, _ := lru.Get(key, func(Key) ([]byte, error) {
+			close(started)
+			<-finish
+			return []byte{1}, nil
+		})
+		loaded <- value
+	}()
+
+	<-started
+	lru.Evict(key)
+	close(finish)
+	value := <-loaded
+	if c.Compare([]byte{1}, value) != c.EQUAL {
+		t.Errorf("Expected Get() to return %q, but got %q", []byte{1}, value)
+	}
+	_, found := lru.Lookup(key)
+	if found {
+		t.Error("Expected a load evicted while in flight to not be cached, but was")
+	}
+}
+
+func TestPanickingProviderReleasesTheLoad(t *testing.T) {
+	lru := NewShardedLRUCache(1, 100)
+	key := Key{FileID: 1, Offset: 0}
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		lru.Get(key, func(Key) ([]byte, error) {
+			close(started)
+			<-finish
+			panic("failed")
+		})
+	}()
+
+	<-started
+	waited := make(chan error)
+	go func() {
+		_, err := lru.Get(key, staticProvider([]byte{2}))
+		waited <- err
+	}()
+	// Wait for the second caller to start waiting on the in flight load
+	for lru.Stats().Misses < 2 {
+		runtime.Gosched()
+	}
+	close(finish)
+	err := <-waited
+	if err != ERR_LOAD_PANICKED {
+		t.Errorf("Expected waiting Get() to return %v, but got %v", ERR_LOAD_PANICKED, err)
+	}
+
+	value, err := lru.Get(key, staticProvider([]byte{3}))
+	if err != nil || c.Compare([]byte{3}, value) != c.EQUAL {
+		t.Errorf("Expected Get() after the panic to load %q, but got %q and %v", []byte{3}, value, err)
+	}
+}
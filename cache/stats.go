@@ -0,0 +1,73 @@
+package cache
+
+import "sync/atomic"
+
+// Point in time statistics for a single shard of a cache.
+type ShardStats struct {
+	Hits      int64
+	Misses    int64
+	Inserts   int64
+	Evictions int64
+	Bytes     int64
+	Entries   int
+}
+
+// Point in time statistics for a cache. The counters are the sums of each shard's
+// counters. Evictions only count entries removed to make room for new entries, not
+// entries removed by Evict.
+type Stats struct {
+	Hits      int64
+	Misses    int64
+	Inserts   int64
+	Evictions int64
+	Bytes     int64
+	Entries   int
+	Shards    []ShardStats
+}
+
+// Counters maintained by each shard. Counters are updated atomically so that they may
+// be modified while only holding a shard's read lock.
+type counters struct {
+	hits      int64
+	misses    int64
+	inserts   int64
+	evictions int64
+}
+
+func (c *counters) hit() {
+	atomic.AddInt64(&c.hits, 1)
+}
+
+func (c *counters) miss() {
+	atomic.AddInt64(&c.misses, 1)
+}
+
+func (c *counters) insert() {
+	atomic.AddInt64(&c.inserts, 1)
+}
+
+func (c *counters) evict() {
+	atomic.AddInt64(&c.evictions, 1)
+}
+
+func (c *counters) shardStats(bytes int64, entries int) ShardStats {
+	return ShardStats{
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Inserts:   atomic.LoadInt64(&c.inserts),
+		Evictions: atomic.LoadInt64(&c.evictions),
+		Bytes:     bytes,
+		Entries:   entries,
+	}
+}
+
+// Adds a shard's statistics to the cache wide totals.
+func (stats *Stats) add(shardStats ShardStats) {
+	stats.Hits += shardStats.Hits
+	stats.Misses += shardStats.Misses
+	stats.Inserts += shardStats.Inserts
+	stats.Evictions += shardStats.Evictions
+	stats.Bytes += shardStats.Bytes
+	stats.Entries += shardStats.Entries
+	stats.Shards = append(stats.Shards, shardStats)
+}
@@ -0,0 +1,62 @@
+package cache
+
+import "testing"
+
+func TestStatsCountsHitsMissesAndInserts(t *testing.T) {
+	lru := NewShardedLRUCache(2, 100)
+	key := Key{FileID: 1, Offset: 0}
+	lru.Get(key, staticProvider([]byte{1, 2}))
+	lru.Get(key, staticProvider([]byte{1, 2}))
+	lru.Lookup(Key{FileID: 2, Offset: 0})
+
+	stats := lru.Stats()
+	if stats.Hits != 1 {
+		t.Errorf("Expected 1 hit, but got %d", stats.Hits)
+	}
+	if stats.Misses != 2 {
+		t.Errorf("Expected 2 misses, but got %d", stats.Misses)
+	}
+	if stats.Inserts != 1 {
+		t.Errorf("Expected 1 insert, but got %d", stats.Inserts)
+	}
+	if stats.Bytes != 2 || stats.Entries != 1 {
+		t.Errorf("Expected 2 bytes in 1 entry, but got %d bytes in %d entries", stats.Bytes, stats.Entries)
+	}
+	if len(stats.Shards) != 2 {
+		t.Errorf("Expected stats for 2 shards, but got %d", len(stats.Shards))
+	}
+	shardStats := stats.Shards[key.Shard(2)]
+	if shardStats.Bytes != 2 || shardStats.Entries != 1 {
+		t.Errorf("Expected key's shard to hold 2 bytes in 1 entry, but got %d bytes in %d entries", shardStats.Bytes, shardStats.Entries)
+	}
+}
+
+func TestStatsCountsEvictions(t *testing.T) {
+	lru := NewShardedLRUCache(1, 1)
+	lru.Get(Key{FileID: 1, Offset: 0}, staticProvider([]byte{1}))
+	lru.Get(Key{FileID: 1, Offset: 1}, staticProvider([]byte{2}))
+	lru.Evict(Key{FileID: 1, Offset: 1})
+
+	stats := lru.Stats()
+	if stats.Evictions != 1 {
+		t.Errorf("Expected 1 eviction, but got %d", stats.Evictions)
+	}
+	if stats.Bytes != 0 || stats.Entries != 0 {
+		t.Errorf("Expected an empty cache, but got %d bytes in %d entries", stats.Bytes, stats.Entries)
+	}
+}
+
+func TestSegmentedStats(t *testing.T) {
+	slru := NewSegmentedLRUCache(1, 1)
+	slru.Get(Key{FileID: 1, Offset: 0}, staticProvider([]byte{1}))
+	slru.Get(Key{FileID: 1, Offset: 0}, staticProvider([]byte{1}))
+	slru.Get(Key{FileID: 1, Offset: 1}, staticProvider([]byte{2}))
+
+	stats := slru.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Inserts != 2 || stats.Evictions != 1 {
+		t.Errorf("Expected 1 hit, 2 misses, 2 inserts and 1 eviction, but got %+v", stats)
+	}
+	if stats.Bytes != 1 || stats.Entries != 1 {
+		t.Errorf("Expected 1 byte in 1 entry, but got %d bytes in %d entries", stats.Bytes, stats.Entries)
+	}
+}
@@ -15,6 +15,17 @@ func NewBloomFilter(size uint32) *BloomFilter {
 	return &BloomFilter{bitField: make([]byte, size/8+1)}
 }
 
+// Creates a BloomFilter from a bitfield previously returned by Bytes. The bitfield is
+// not copied.
+func BloomFilterFromBytes(bitField []byte) *BloomFilter {
+	return &BloomFilter{bitField: bitField}
+}
+
+// Returns the bitfield backing the filter so that it may be persisted.
+func (bf *BloomFilter) Bytes() []byte {
+	return bf.bitField
+}
+
 // Insert a new entry into the set of entries.
 func (bf *BloomFilter) Insert(bytes []byte) {
 	for _, h := range bf.newHashes() {
@@ -25,3 +25,12 @@ func TestBloomFilterDoesNotContainsValue(t *testing.T) {
 		t.Error("Expected bloom filter to not contain entry, but did")
 	}
 }
+
+func TestBloomFilterFromBytes(t *testing.T) {
+	bf := NewBloomFilter(100)
+	bf.Insert([]byte{1, 0, 1})
+	restored := BloomFilterFromBytes(bf.Bytes())
+	if !restored.Test([]byte{1, 0, 1}) {
+		t.Error("Expected restored bloom filter to contain written entry, but did not")
+	}
+}
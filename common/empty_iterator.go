@@ -12,6 +12,30 @@ func (iter *emptyIterator) Next() (bool, error) {
 	return false, nil
 }
 
+func (iter *emptyIterator) Prev() (bool, error) {
+	return false, nil
+}
+
+func (iter *emptyIterator) Seek(key []byte) (bool, error) {
+	return false, nil
+}
+
+func (iter *emptyIterator) SeekToFirst() (bool, error) {
+	return false, nil
+}
+
+func (iter *emptyIterator) SeekToLast() (bool, error) {
+	return false, nil
+}
+
+func (iter *emptyIterator) SeekForPrev(key []byte) (bool, error) {
+	return false, nil
+}
+
+func (iter *emptyIterator) Valid() bool {
+	return false
+}
+
 func (iter *emptyIterator) Get() (*Pair, error) {
 	return nil, nil
 }
@@ -6,13 +6,27 @@ var (
 	ERR_LSMT_CLOSED              = errors.New("lsmt is closed")
 	ERR_ITER_CLOSED              = errors.New("iterator is closed")
 	ERR_KEY_NIL_OR_EMPTY         = errors.New("key must not be nil and must not be empty")
-	ERR_VAL_NIL_OR_EMPTY         = errors.New("value must not be nil and must not be empty")
+	ERR_VAL_NIL                  = errors.New("value must not be nil")
 	ERR_KEY_TOO_LARGE            = errors.New("key must not be greater than the maximum key size")
 	ERR_VAL_TOO_LARGE            = errors.New("value must not be greater than the maximum value size")
+	ERR_TTL_NOT_POSITIVE         = errors.New("ttl must be greater than 0")
 	ERR_START_NIL_OR_EMPTY       = errors.New("start must not be nil and must not be empty")
 	ERR_END_NIL_OR_EMPTY         = errors.New("end must not be nil and must not be empty")
 	ERR_START_GREATER_THAN_END   = errors.New("start must be less than end")
+	ERR_BOUNDS_INVERTED          = errors.New("lower bound must not be greater than upper bound")
+	ERR_NEGATIVE_LIMIT           = errors.New("limit must not be negative")
 	ERR_NIL_ITERATOR             = errors.New("unable to flush nil iterator")
 	ERR_ITER_GET_INVOKED_ON_INIT = errors.New("Get() invoked before Next()")
 	ERR_BLOCK_UNDERFLOW          = errors.New("unable to read all used bytes for in block")
+	ERR_UNKNOWN_RECORD_TYPE      = errors.New("record has an unknown type")
+	ERR_NO_MERGE_OPERATOR        = errors.New("merge records require a merge operator")
+	ERR_SST_RELEASED             = errors.New("sst has already been released")
+	ERR_SST_FORMAT_UNSUPPORTED   = errors.New("sst was written in an unsupported format version")
+	ERR_LOG_CORRUPT              = errors.New("write-ahead log record is corrupt")
+	ERR_COMPARATOR_MISMATCH      = errors.New("manifest was written with a different comparator")
+	ERR_MMAP_UNSUPPORTED         = errors.New("memory mapped reads are not supported on this platform")
 )
+
+// Deprecated: empty values are allowed, so only nil values are rejected. Use
+// ERR_VAL_NIL instead.
+var ERR_VAL_NIL_OR_EMPTY = ERR_VAL_NIL
@@ -0,0 +1,80 @@
+package common
+
+// An iterator which stops after returning a maximum number of pairs. Every pair the
+// underlying iterator is moved onto counts towards the limit and each seek starts a
+// new count, so a limited iterator can be used to read a keyspace one page at a time.
+type limitIterator struct {
+	iterator  Iterator
+	limit     int
+	count     int
+	exhausted bool
+}
+
+// Creates a new iterator which returns at most limit pairs from the given iterator
+// between seeks.
+func NewLimitIterator(iterator Iterator, limit int) Iterator {
+	return &limitIterator{iterator: iterator, limit: limit}
+}
+
+func (iter *limitIterator) Next() (bool, error) {
+	if iter.count >= iter.limit {
+		iter.exhausted = true
+		return false, nil
+	}
+	return iter.counted(iter.iterator.Next())
+}
+
+func (iter *limitIterator) Prev() (bool, error) {
+	if iter.count >= iter.limit {
+		iter.exhausted = true
+		return false, nil
+	}
+	return iter.counted(iter.iterator.Prev())
+}
+
+func (iter *limitIterator) Seek(key []byte) (bool, error) {
+	iter.count = 0
+	return iter.counted(iter.iterator.Seek(key))
+}
+
+func (iter *limitIterator) SeekToFirst() (bool, error) {
+	iter.count = 0
+	return iter.counted(iter.iterator.SeekToFirst())
+}
+
+func (iter *limitIterator) SeekToLast() (bool, error) {
+	iter.count = 0
+	return iter.counted(iter.iterator.SeekToLast())
+}
+
+func (iter *limitIterator) SeekForPrev(key []byte) (bool, error) {
+	iter.count = 0
+	return iter.counted(iter.iterator.SeekForPrev(key))
+}
+
+func (iter *limitIterator) Valid() bool {
+	return !iter.exhausted && iter.iterator.Valid()
+}
+
+func (iter *limitIterator) Get() (*Pair, error) {
+	if iter.exhausted {
+		return nil, nil
+	}
+	return iter.iterator.Get()
+}
+
+func (iter *limitIterator) Close() error {
+	return iter.iterator.Close()
+}
+
+// Counts a successful move of the underlying iterator towards the limit.
+func (iter *limitIterator) counted(found bool, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	iter.exhausted = !found
+	if found {
+		iter.count++
+	}
+	return found, nil
+}
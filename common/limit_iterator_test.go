@@ -0,0 +1,41 @@
+package common
+
+import "testing"
+
+func TestLimitIterator(t *testing.T) {
+	pairs := []*Pair{&Pair{Key: []byte{0}, Value: []byte{0}}, &Pair{Key: []byte{1}, Value: []byte{1}}, &Pair{Key: []byte{2}, Value: []byte{2}}}
+	iter := NewLimitIterator(&sliceIterator{pairs: pairs}, 2)
+	defer iter.Close()
+
+	CompareNext(iter, true, t)
+	CompareGet(iter, []byte{0}, []byte{0}, t)
+	CompareNext(iter, true, t)
+	CompareGet(iter, []byte{1}, []byte{1}, t)
+	CompareNext(iter, false, t)
+	if iter.Valid() {
+		t.Error("Expected iterator at its limit to not be valid, but was")
+	}
+	pair, _ := iter.Get()
+	if pair != nil {
+		t.Errorf("Expected nil : nil but got %q : %q", pair.Key, pair.Value)
+	}
+}
+
+func TestLimitIteratorSeekStartsNewCount(t *testing.T) {
+	pairs := []*Pair{&Pair{Key: []byte{0}, Value: []byte{0}}, &Pair{Key: []byte{1}, Value: []byte{1}}, &Pair{Key: []byte{2}, Value: []byte{2}}}
+	iter := NewLimitIterator(&sliceIterator{pairs: pairs}, 2)
+	defer iter.Close()
+
+	CompareNext(iter, true, t)
+	CompareNext(iter, true, t)
+	CompareNext(iter, false, t)
+
+	found, _ := iter.Seek([]byte{2})
+	if !found {
+		t.Error("Expected Seek() to find a pair, but did not")
+	}
+	CompareGet(iter, []byte{2}, []byte{2}, t)
+	ComparePrev(iter, true, t)
+	CompareGet(iter, []byte{1}, []byte{1}, t)
+	ComparePrev(iter, false, t)
+}
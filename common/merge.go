@@ -0,0 +1,18 @@
+package common
+
+import "github.com/patrickgombert/lsmt/config"
+
+// Combines merge operands, ordered newest first, with the value beneath them. A nil
+// value means the key has no value beneath the operands.
+func FullMerge(operator config.MergeOperator, key, value []byte, operands [][]byte) []byte {
+	for i := len(operands) - 1; i >= 0; i-- {
+		value = operator.Merge(key, value, operands[i])
+	}
+	return value
+}
+
+// Combines merge operands, ordered newest first, into a single operand for when the
+// value beneath them is not known.
+func PartialMerge(operator config.MergeOperator, key []byte, operands [][]byte) []byte {
+	return FullMerge(operator, key, operands[len(operands)-1], operands[:len(operands)-1])
+}
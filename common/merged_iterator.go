@@ -1,17 +1,35 @@
 package common
 
-import c "github.com/patrickgombert/lsmt/comparator"
+import (
+	c "github.com/patrickgombert/lsmt/comparator"
+	"github.com/patrickgombert/lsmt/config"
+)
 
 const (
 	INIT   int = -1
 	CLOSED int = -2
 )
 
+// The direction in which a mergedIterator's underlying iterators were last moved.
+type direction int8
+
+const (
+	FORWARD direction = 0
+	REVERSE direction = 1
+)
+
 type mergedIterator struct {
 	iterators       []Iterator
+	rangeTombstones [][]RangeTombstone
 	peek            []*Pair
+	current         *Pair
 	next            int
+	position        Position
+	direction       direction
 	returnTombstone bool
+	operator        config.MergeOperator
+	now             int64
+	comparator      c.Comparator
 }
 
 // Creates a new merged iterator from the given slice of iterators.
@@ -20,65 +38,147 @@ type mergedIterator struct {
 // index. Each key will only be returned once from a merged iterator and it is assumed
 // that each key only appears once in each provided iterator.
 //
-// Accepts a returnTombstone parameter which indicates whether to return pairs with a
-// tombstone value.
-func NewMergedIterator(iterators []Iterator, returnTombstone bool) *mergedIterator {
+// Accepts a returnTombstone parameter which indicates whether to return pairs written
+// by a delete. Tombstones are resolved after merging, so a tombstone hides the
+// pairs for the same key in every lower priority iterator.
+//
+// Iterators which carry range tombstones hide the pairs they cover in every lower
+// priority iterator. Covered pairs are never returned, whether or not tombstones are.
+//
+// A merge record is combined by the operator with the pairs for the same key in every
+// lower priority iterator. A merged iterator which hides tombstones is assumed to read
+// all of the data beneath its iterators, so its merge records are resolved into puts.
+// One which returns tombstones may be missing older data, so unless a put, delete or
+// range tombstone is found beneath the merge records they are combined into a single
+// merge record. Get returns ERR_NO_MERGE_OPERATOR for a merge record without an
+// operator.
+//
+// A merged iterator which returns tombstones drops a single delete along with the put
+// for the same key directly beneath it, since the put was the only value of its key.
+//
+// A put which has expired at now, given in nanoseconds since the unix epoch, is treated
+// as a delete, so its value is never returned. A now of 0 expires nothing.
+//
+// Keys are ordered by the comparator, which must be the one that ordered each iterator.
+func NewMergedIterator(iterators []Iterator, returnTombstone bool, operator config.MergeOperator, now int64, comparator c.Comparator) *mergedIterator {
 	peek := make([]*Pair, len(iterators))
-	return &mergedIterator{iterators: iterators, peek: peek, next: INIT, returnTombstone: returnTombstone}
+	rangeTombstones := make([][]RangeTombstone, len(iterators))
+	for i, iterator := range iterators {
+		rangeTombstones[i] = RangeTombstonesOf(iterator)
+	}
+	return &mergedIterator{iterators: iterators, rangeTombstones: rangeTombstones, peek: peek, next: INIT, returnTombstone: returnTombstone, operator: operator, now: now, comparator: comparator}
+}
+
+// Returns the range tombstones of every underlying iterator.
+func (iter *mergedIterator) RangeTombstones() []RangeTombstone {
+	tombstones := []RangeTombstone{}
+	for _, carried := range iter.rangeTombstones {
+		tombstones = append(tombstones, carried...)
+	}
+	return tombstones
 }
 
-// Peeks in all iterators and returns true if there exists at least one more pair
-// available.
+// Moves to the pair with the next least key. Returns false once every underlying
+// iterator has been exhausted.
 func (iter *mergedIterator) Next() (bool, error) {
 	if iter.next == CLOSED {
 		return false, nil
 	}
-	if iter.next == INIT {
+
+	switch iter.position {
+	case UNPOSITIONED, BEFORE_FIRST:
 		for i := range iter.iterators {
-			err := iter.progress(i)
+			err := iter.progress(i, FORWARD)
 			if err != nil {
 				return false, err
 			}
 		}
-	} else {
-		err := iter.progress(iter.next)
+		iter.direction = FORWARD
+	case AT_PAIR:
+		err := iter.step(FORWARD)
 		if err != nil {
 			return false, err
 		}
+	case AFTER_LAST:
+		return false, nil
 	}
 
-	var minPair *Pair
-	for i, next := range iter.peek {
-		if next != nil {
-			if minPair == nil {
-				minPair = next
-				iter.next = i
-			} else {
-				switch c.Compare(next.Key, minPair.Key) {
-				case c.LESS_THAN:
-					minPair = next
-					iter.next = i
-				case c.EQUAL:
-					err := iter.progress(i)
-					if err != nil {
-						return false, err
-					}
-				}
+	return iter.settle(FORWARD)
+}
+
+// Moves to the pair with the next greatest key. Returns false once every underlying
+// iterator has been exhausted.
+func (iter *mergedIterator) Prev() (bool, error) {
+	if iter.next == CLOSED {
+		return false, nil
+	}
+
+	switch iter.position {
+	case UNPOSITIONED, AFTER_LAST:
+		for i := range iter.iterators {
+			err := iter.progress(i, REVERSE)
+			if err != nil {
+				return false, err
 			}
 		}
+		iter.direction = REVERSE
+	case AT_PAIR:
+		err := iter.step(REVERSE)
+		if err != nil {
+			return false, err
+		}
+	case BEFORE_FIRST:
+		return false, nil
 	}
 
-	return minPair != nil, nil
+	return iter.settle(REVERSE)
+}
+
+// Positions every underlying iterator at its first pair with a key greater than or
+// equal to the given key and moves to the least of those keys.
+func (iter *mergedIterator) Seek(key []byte) (bool, error) {
+	return iter.seek(FORWARD, func(iterator Iterator) (bool, error) {
+		return iterator.Seek(key)
+	})
+}
+
+// Positions every underlying iterator at its first pair and moves to the least key.
+func (iter *mergedIterator) SeekToFirst() (bool, error) {
+	return iter.seek(FORWARD, func(iterator Iterator) (bool, error) {
+		return iterator.SeekToFirst()
+	})
+}
+
+// Positions every underlying iterator at its last pair and moves to the greatest key.
+func (iter *mergedIterator) SeekToLast() (bool, error) {
+	return iter.seek(REVERSE, func(iterator Iterator) (bool, error) {
+		return iterator.SeekToLast()
+	})
+}
+
+// Positions every underlying iterator at its last pair with a key less than or equal to
+// the given key and moves to the greatest of those keys.
+func (iter *mergedIterator) SeekForPrev(key []byte) (bool, error) {
+	return iter.seek(REVERSE, func(iterator Iterator) (bool, error) {
+		return iterator.SeekForPrev(key)
+	})
+}
+
+// Returns whether the iterator is positioned at a pair.
+func (iter *mergedIterator) Valid() bool {
+	return iter.next != CLOSED && iter.position == AT_PAIR
 }
 
-// Gets the pair with the least key.
+// Gets the pair at the iterator's current position.
 func (iter *mergedIterator) Get() (*Pair, error) {
-	if iter.next == INIT {
+	if iter.next == CLOSED {
+		return nil, nil
+	} else if iter.position == UNPOSITIONED {
 		return nil, ERR_ITER_GET_INVOKED_ON_INIT
-	} else if iter.next == CLOSED {
+	} else if iter.position != AT_PAIR {
 		return nil, nil
 	} else {
-		return iter.peek[iter.next], nil
+		return iter.current, nil
 	}
 }
 
@@ -98,34 +198,217 @@ func (iter *mergedIterator) Close() error {
 	return err
 }
 
-func (iter *mergedIterator) progress(index int) error {
-	next, err := iter.iterators[index].Next()
-	if err != nil {
-		return err
+// Positions every underlying iterator with the given seek and then selects the first
+// pair in the given direction.
+func (iter *mergedIterator) seek(dir direction, seek func(Iterator) (bool, error)) (bool, error) {
+	if iter.next == CLOSED {
+		return false, nil
 	}
-	if next {
-		pair, err := iter.iterators[index].Get()
-		if !iter.returnTombstone {
-			for c.Compare(pair.Value, Tombstone) == c.EQUAL {
-				next, err := iter.iterators[index].Next()
+
+	for i, iterator := range iter.iterators {
+		found, err := seek(iterator)
+		if err != nil {
+			return false, err
+		}
+		iter.peek[i] = nil
+		if found {
+			iter.peek[i], err = iterator.Get()
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	iter.direction = dir
+	return iter.settle(dir)
+}
+
+// Moves off of the current key in the given direction. Every underlying iterator
+// positioned at the current key is moved, and if the direction has changed then every
+// other underlying iterator is first moved to the opposite side of the current key.
+func (iter *mergedIterator) step(dir direction) error {
+	key := iter.peek[iter.next].Key
+	if iter.direction != dir {
+		for i := range iter.iterators {
+			if iter.peek[i] == nil {
+				err := iter.progress(i, dir)
 				if err != nil {
 					return err
 				}
-
-				if next {
-					pair, err = iter.iterators[index].Get()
-				} else {
-					iter.peek[index] = nil
-					return nil
+			}
+			for iter.peek[i] != nil && !iter.beyond(iter.peek[i].Key, key, dir) {
+				err := iter.progress(i, dir)
+				if err != nil {
+					return err
 				}
 			}
 		}
+		iter.direction = dir
+		return nil
+	}
+
+	for i, pair := range iter.peek {
+		if pair != nil && iter.comparator.Compare(pair.Key, key) == c.EQUAL {
+			err := iter.progress(i, dir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Selects the next pair in the given direction, skipping tombstones if they are not to
+// be returned and pairs covered by a range tombstone, and resolving merge records.
+// Returns whether the iterator is positioned at a pair.
+func (iter *mergedIterator) settle(dir direction) (bool, error) {
+	for {
+		iter.next = iter.choose(dir)
+		if iter.next == INIT {
+			if dir == FORWARD {
+				iter.position = AFTER_LAST
+			} else {
+				iter.position = BEFORE_FIRST
+			}
+			return false, nil
+		}
+		iter.position = AT_PAIR
+
+		pair := iter.peek[iter.next]
+		if pair.Expired(iter.now) {
+			pair = &Pair{Key: pair.Key, Value: []byte{}, Type: DELETE}
+		}
+		visible := iter.returnTombstone || !pair.IsTombstone()
+		if !iter.coveredAbove(iter.next, pair.Key) && visible && !iter.singleDeleted(iter.next) {
+			if pair.Type != MERGE {
+				iter.current = pair
+				return true, nil
+			}
+			if iter.operator == nil {
+				return false, ERR_NO_MERGE_OPERATOR
+			}
+			iter.current = iter.resolve(iter.next)
+			return true, nil
+		}
+		err := iter.step(dir)
 		if err != nil {
-			return err
+			return false, err
+		}
+	}
+}
+
+// Combines the merge record of the iterator at the given index with the pairs for its
+// key in the lower priority iterators, stopping at the first put, delete or range
+// tombstone beneath it.
+func (iter *mergedIterator) resolve(index int) *Pair {
+	pair := iter.peek[index]
+	operands := [][]byte{pair.Value}
+	var value []byte
+	resolved := !iter.returnTombstone
+	for i := index; i < len(iter.peek); i++ {
+		if Covers(iter.comparator, iter.rangeTombstones[i], pair.Key) {
+			resolved = true
+			break
+		}
+		if i+1 == len(iter.peek) {
+			break
+		}
+		lower := iter.peek[i+1]
+		if lower == nil || iter.comparator.Compare(lower.Key, pair.Key) != c.EQUAL {
+			continue
+		}
+		if lower.Type == MERGE {
+			operands = append(operands, lower.Value)
+			continue
+		}
+		resolved = true
+		if lower.Type == PUT && !lower.Expired(iter.now) {
+			value = lower.Value
+		}
+		break
+	}
+
+	if !resolved {
+		return &Pair{Key: pair.Key, Value: PartialMerge(iter.operator, pair.Key, operands), Type: MERGE}
+	}
+	return &Pair{Key: pair.Key, Value: FullMerge(iter.operator, pair.Key, value, operands), Type: PUT}
+}
+
+// Returns whether the pair of the iterator at the given index is a single delete which
+// meets a put for its key, when tombstones are returned. The put must be the next pair
+// for the key beneath the single delete and must not be covered by a range tombstone.
+func (iter *mergedIterator) singleDeleted(index int) bool {
+	pair := iter.peek[index]
+	if !iter.returnTombstone || pair.Type != SINGLE_DELETE {
+		return false
+	}
+	for i := index; i+1 < len(iter.peek); i++ {
+		if Covers(iter.comparator, iter.rangeTombstones[i], pair.Key) {
+			return false
+		}
+		lower := iter.peek[i+1]
+		if lower != nil && iter.comparator.Compare(lower.Key, pair.Key) == c.EQUAL {
+			return lower.Type == PUT
+		}
+	}
+	return false
+}
+
+// Returns whether the key is covered by a range tombstone of an iterator with a higher
+// priority than the iterator at the given index.
+func (iter *mergedIterator) coveredAbove(index int, key []byte) bool {
+	for _, tombstones := range iter.rangeTombstones[:index] {
+		if Covers(iter.comparator, tombstones, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the index of the iterator holding the least key when moving forward or the
+// greatest key when moving in reverse. When multiple iterators hold the same key the
+// smallest index wins. Returns INIT if every iterator has been exhausted.
+func (iter *mergedIterator) choose(dir direction) int {
+	selected := INIT
+	for i, pair := range iter.peek {
+		if pair == nil {
+			continue
+		}
+		if selected == INIT || iter.beyond(iter.peek[selected].Key, pair.Key, dir) {
+			selected = i
 		}
-		iter.peek[index] = pair
+	}
+	return selected
+}
+
+// Moves the iterator at the given index in the given direction and records its pair.
+func (iter *mergedIterator) progress(index int, dir direction) error {
+	var next bool
+	var err error
+	if dir == FORWARD {
+		next, err = iter.iterators[index].Next()
 	} else {
+		next, err = iter.iterators[index].Prev()
+	}
+	if err != nil {
+		return err
+	}
+	if !next {
 		iter.peek[index] = nil
+		return nil
 	}
+
+	pair, err := iter.iterators[index].Get()
+	if err != nil {
+		return err
+	}
+	iter.peek[index] = pair
 	return nil
 }
+
+// Returns whether key lies beyond other when moving in the given direction.
+func (iter *mergedIterator) beyond(key, other []byte, dir direction) bool {
+	if dir == FORWARD {
+		return iter.comparator.Compare(key, other) == c.GREATER_THAN
+	}
+	return iter.comparator.Compare(key, other) == c.LESS_THAN
+}
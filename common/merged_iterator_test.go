@@ -1,12 +1,14 @@
 package common
 
 import (
-	"container/list"
 	"testing"
+
+	c "github.com/patrickgombert/lsmt/comparator"
+	"github.com/patrickgombert/lsmt/config"
 )
 
 func TestMergedIteratorsWithNoIterators(t *testing.T) {
-	merged := NewMergedIterator([]Iterator{}, true)
+	merged := NewMergedIterator([]Iterator{}, true, nil, 0, c.BytewiseComparator{})
 	defer merged.Close()
 
 	CompareNext(merged, false, t)
@@ -30,7 +32,7 @@ func TestMergedIterators(t *testing.T) {
 }
 
 func TestMergedIteratorsMissingIterators(t *testing.T) {
-	merged := NewMergedIterator([]Iterator{}, true)
+	merged := NewMergedIterator([]Iterator{}, true, nil, 0, c.BytewiseComparator{})
 	defer merged.Close()
 	CompareNext(merged, false, t)
 }
@@ -95,13 +97,13 @@ func TestMergedIteratorCloses(t *testing.T) {
 
 func TestMergedIteratorRespectsReturnTombstone(t *testing.T) {
 	pairs1 := []*Pair{&Pair{Key: []byte{0}, Value: []byte{0}}}
-	pairs2 := []*Pair{&Pair{Key: []byte{1}, Value: Tombstone}}
+	pairs2 := []*Pair{&Pair{Key: []byte{1}, Value: []byte{}, Type: DELETE}}
 	merged := makeMergedIterator(true, pairs1, pairs2)
 
 	CompareNext(merged, true, t)
 	CompareGet(merged, []byte{0}, []byte{0}, t)
 	CompareNext(merged, true, t)
-	CompareGet(merged, []byte{1}, Tombstone, t)
+	CompareGet(merged, []byte{1}, []byte{}, t)
 	merged.Close()
 
 	merged = makeMergedIterator(false, pairs1, pairs2)
@@ -111,40 +113,399 @@ func TestMergedIteratorRespectsReturnTombstone(t *testing.T) {
 	merged.Close()
 }
 
-type listIterator struct {
-	next *Pair
-	l    *list.List
+func TestMergedIteratorPrev(t *testing.T) {
+	pairs1 := []*Pair{&Pair{Key: []byte{1}, Value: []byte{1}}, &Pair{Key: []byte{2}, Value: []byte{2}}}
+	pairs2 := []*Pair{&Pair{Key: []byte{0}, Value: []byte{0}}, &Pair{Key: []byte{2}, Value: []byte{9}}, &Pair{Key: []byte{3}, Value: []byte{3}}}
+	merged := makeMergedIterator(true, pairs1, pairs2)
+	defer merged.Close()
+
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{3}, []byte{3}, t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{2}, []byte{2}, t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{1}, []byte{1}, t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{0}, []byte{0}, t)
+	ComparePrev(merged, false, t)
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{0}, []byte{0}, t)
+}
+
+func TestMergedIteratorChangesDirection(t *testing.T) {
+	pairs1 := []*Pair{&Pair{Key: []byte{1}, Value: []byte{1}}, &Pair{Key: []byte{3}, Value: []byte{3}}}
+	pairs2 := []*Pair{&Pair{Key: []byte{0}, Value: []byte{0}}, &Pair{Key: []byte{1}, Value: []byte{9}}, &Pair{Key: []byte{2}, Value: []byte{2}}}
+	merged := makeMergedIterator(true, pairs1, pairs2)
+	defer merged.Close()
+
+	CompareNext(merged, true, t)
+	CompareNext(merged, true, t)
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{2}, []byte{2}, t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{1}, []byte{1}, t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{0}, []byte{0}, t)
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{1}, []byte{1}, t)
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{2}, []byte{2}, t)
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{3}, []byte{3}, t)
+	CompareNext(merged, false, t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{3}, []byte{3}, t)
+}
+
+func TestMergedIteratorSeekToLast(t *testing.T) {
+	pairs1 := []*Pair{&Pair{Key: []byte{1}, Value: []byte{1}}}
+	pairs2 := []*Pair{&Pair{Key: []byte{0}, Value: []byte{0}}, &Pair{Key: []byte{2}, Value: []byte{2}}}
+	merged := makeMergedIterator(true, pairs1, pairs2)
+	defer merged.Close()
+
+	found, _ := merged.SeekToLast()
+	if !found {
+		t.Error("Expected SeekToLast() to find a pair, but did not")
+	}
+	CompareGet(merged, []byte{2}, []byte{2}, t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{1}, []byte{1}, t)
 }
 
-func (li *listIterator) Next() (bool, error) {
-	next := li.l.Front()
-	if next == nil {
-		li.next = nil
+func TestMergedIteratorSeekForPrev(t *testing.T) {
+	pairs1 := []*Pair{&Pair{Key: []byte{1}, Value: []byte{1}}, &Pair{Key: []byte{5}, Value: []byte{5}}}
+	pairs2 := []*Pair{&Pair{Key: []byte{0}, Value: []byte{0}}, &Pair{Key: []byte{3}, Value: []byte{3}}}
+	merged := makeMergedIterator(true, pairs1, pairs2)
+	defer merged.Close()
+
+	found, _ := merged.SeekForPrev([]byte{4})
+	if !found {
+		t.Error("Expected SeekForPrev() to find a pair, but did not")
+	}
+	CompareGet(merged, []byte{3}, []byte{3}, t)
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{5}, []byte{5}, t)
+
+	found, _ = merged.SeekForPrev([]byte{})
+	if found {
+		t.Error("Expected SeekForPrev() before the first key to not find a pair, but did")
+	}
+}
+
+func TestMergedIteratorTombstoneHidesLowerPriorityPairs(t *testing.T) {
+	pairs1 := []*Pair{&Pair{Key: []byte{1}, Value: []byte{}, Type: DELETE}}
+	pairs2 := []*Pair{&Pair{Key: []byte{0}, Value: []byte{0}}, &Pair{Key: []byte{1}, Value: []byte{1}}, &Pair{Key: []byte{2}, Value: []byte{2}}}
+	merged := makeMergedIterator(false, pairs1, pairs2)
+	defer merged.Close()
+
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{0}, []byte{0}, t)
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{2}, []byte{2}, t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{0}, []byte{0}, t)
+}
+
+func TestMergedIteratorSeek(t *testing.T) {
+	pairs1 := []*Pair{&Pair{Key: []byte{1}, Value: []byte{1}}, &Pair{Key: []byte{4}, Value: []byte{}, Type: DELETE}}
+	pairs2 := []*Pair{&Pair{Key: []byte{0}, Value: []byte{0}}, &Pair{Key: []byte{4}, Value: []byte{4}}, &Pair{Key: []byte{5}, Value: []byte{5}}}
+	merged := makeMergedIterator(false, pairs1, pairs2)
+	defer merged.Close()
+
+	found, _ := merged.Seek([]byte{2})
+	if !found || !merged.Valid() {
+		t.Error("Expected Seek() to find a pair, but did not")
+	}
+	CompareGet(merged, []byte{5}, []byte{5}, t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{1}, []byte{1}, t)
+
+	found, _ = merged.SeekToFirst()
+	if !found {
+		t.Error("Expected SeekToFirst() to find a pair, but did not")
+	}
+	CompareGet(merged, []byte{0}, []byte{0}, t)
+
+	found, _ = merged.Seek([]byte{6})
+	if found || merged.Valid() {
+		t.Error("Expected Seek() past the last key to not find a pair, but did")
+	}
+}
+
+func TestMergedIteratorHidesPairsCoveredByHigherPriorityRangeTombstones(t *testing.T) {
+	newer := &rangeTombstoneSliceIterator{
+		sliceIterator: &sliceIterator{pairs: []*Pair{&Pair{Key: []byte{2}, Value: []byte{9}}}},
+		tombstones:    []RangeTombstone{RangeTombstone{Start: []byte{1}, End: []byte{3}}},
+	}
+	older := &sliceIterator{pairs: []*Pair{
+		&Pair{Key: []byte{0}, Value: []byte{0}},
+		&Pair{Key: []byte{1}, Value: []byte{1}},
+		&Pair{Key: []byte{2}, Value: []byte{2}},
+		&Pair{Key: []byte{3}, Value: []byte{3}},
+		&Pair{Key: []byte{4}, Value: []byte{4}},
+	}}
+	merged := NewMergedIterator([]Iterator{newer, older}, true, nil, 0, c.BytewiseComparator{})
+	defer merged.Close()
+
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{0}, []byte{0}, t)
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{2}, []byte{9}, t)
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{4}, []byte{4}, t)
+	CompareNext(merged, false, t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{4}, []byte{4}, t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{2}, []byte{9}, t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{0}, []byte{0}, t)
+
+	if len(merged.RangeTombstones()) != 1 {
+		t.Errorf("Expected the merged iterator to carry 1 range tombstone, but got %d", len(merged.RangeTombstones()))
+	}
+}
+
+// A slice iterator which carries range tombstones.
+type rangeTombstoneSliceIterator struct {
+	*sliceIterator
+	tombstones []RangeTombstone
+}
+
+func (iter *rangeTombstoneSliceIterator) RangeTombstones() []RangeTombstone {
+	return iter.tombstones
+}
+
+type sliceIterator struct {
+	pairs    []*Pair
+	index    int
+	position Position
+}
+
+func (si *sliceIterator) Next() (bool, error) {
+	switch si.position {
+	case UNPOSITIONED, BEFORE_FIRST:
+		si.index = 0
+	case AT_PAIR:
+		si.index++
+	case AFTER_LAST:
 		return false, nil
 	}
+	return si.settle(AFTER_LAST), nil
+}
 
-	li.next = next.Value.(*Pair)
-	li.l.Remove(next)
-	return true, nil
+func (si *sliceIterator) Prev() (bool, error) {
+	switch si.position {
+	case UNPOSITIONED, AFTER_LAST:
+		return si.SeekToLast()
+	case AT_PAIR:
+		si.index--
+	case BEFORE_FIRST:
+		return false, nil
+	}
+	return si.settle(BEFORE_FIRST), nil
 }
 
-func (li *listIterator) Get() (*Pair, error) {
-	return li.next, nil
+func (si *sliceIterator) Seek(key []byte) (bool, error) {
+	si.index = 0
+	for si.index < len(si.pairs) && c.Compare(si.pairs[si.index].Key, key) == c.LESS_THAN {
+		si.index++
+	}
+	return si.settle(AFTER_LAST), nil
 }
 
-func (li *listIterator) Close() error {
-	li.l = li.l.Init()
+func (si *sliceIterator) SeekToFirst() (bool, error) {
+	si.index = 0
+	return si.settle(AFTER_LAST), nil
+}
+
+func (si *sliceIterator) SeekToLast() (bool, error) {
+	si.index = len(si.pairs) - 1
+	return si.settle(BEFORE_FIRST), nil
+}
+
+func (si *sliceIterator) SeekForPrev(key []byte) (bool, error) {
+	si.index = len(si.pairs) - 1
+	for si.index >= 0 && c.Compare(si.pairs[si.index].Key, key) == c.GREATER_THAN {
+		si.index--
+	}
+	return si.settle(BEFORE_FIRST), nil
+}
+
+func (si *sliceIterator) Valid() bool {
+	return si.position == AT_PAIR
+}
+
+func (si *sliceIterator) Get() (*Pair, error) {
+	if si.position != AT_PAIR {
+		return nil, nil
+	}
+	return si.pairs[si.index], nil
+}
+
+func (si *sliceIterator) Close() error {
+	si.pairs = nil
+	si.position = AFTER_LAST
 	return nil
 }
 
+func (si *sliceIterator) settle(exhausted Position) bool {
+	if si.index < 0 || si.index >= len(si.pairs) {
+		si.position = exhausted
+		return false
+	}
+	si.position = AT_PAIR
+	return true
+}
+
 func makeMergedIterator(returnTombstone bool, pairs ...[]*Pair) *mergedIterator {
 	iterators := make([]Iterator, len(pairs))
 	for i, p := range pairs {
-		l := list.New()
-		for _, pair := range p {
-			l.PushBack(pair)
-		}
-		iterators[i] = &listIterator{l: l}
+		iterators[i] = &sliceIterator{pairs: p}
+	}
+	return NewMergedIterator(iterators, returnTombstone, nil, 0, c.BytewiseComparator{})
+}
+
+func TestMergedIteratorResolvesMergeRecords(t *testing.T) {
+	newer := &sliceIterator{pairs: []*Pair{
+		&Pair{Key: []byte{1}, Value: []byte{'c'}, Type: MERGE},
+		&Pair{Key: []byte{2}, Value: []byte{'b'}, Type: MERGE},
+	}}
+	middle := &sliceIterator{pairs: []*Pair{&Pair{Key: []byte{1}, Value: []byte{'b'}, Type: MERGE}}}
+	older := &sliceIterator{pairs: []*Pair{
+		&Pair{Key: []byte{1}, Value: []byte{'a'}, Type: PUT},
+		&Pair{Key: []byte{2}, Value: []byte{'a'}, Type: PUT},
+	}}
+	merged := NewMergedIterator([]Iterator{newer, middle, older}, false, config.AppendOperator{}, 0, c.BytewiseComparator{})
+	defer merged.Close()
+
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{1}, []byte("abc"), t)
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{2}, []byte("ab"), t)
+	CompareNext(merged, false, t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{2}, []byte("ab"), t)
+	ComparePrev(merged, true, t)
+	CompareGet(merged, []byte{1}, []byte("abc"), t)
+	pair, _ := merged.Get()
+	if pair.Type != PUT {
+		t.Errorf("Expected a resolved merge to be a put, but got type %d", pair.Type)
+	}
+}
+
+func TestMergedIteratorReturningTombstonesCombinesMergeRecords(t *testing.T) {
+	newer := &sliceIterator{pairs: []*Pair{
+		&Pair{Key: []byte{1}, Value: []byte{'c'}, Type: MERGE},
+		&Pair{Key: []byte{2}, Value: []byte{'b'}, Type: MERGE},
+	}}
+	older := &sliceIterator{pairs: []*Pair{
+		&Pair{Key: []byte{1}, Value: []byte{'b'}, Type: MERGE},
+		&Pair{Key: []byte{2}, Value: []byte{}, Type: DELETE},
+	}}
+	merged := NewMergedIterator([]Iterator{newer, older}, true, config.AppendOperator{}, 0, c.BytewiseComparator{})
+	defer merged.Close()
+
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{1}, []byte("bc"), t)
+	pair, _ := merged.Get()
+	if pair.Type != MERGE {
+		t.Errorf("Expected merge records without a value beneath them to stay a merge, but got type %d", pair.Type)
+	}
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{2}, []byte("b"), t)
+	pair, _ = merged.Get()
+	if pair.Type != PUT {
+		t.Errorf("Expected a merge over a delete to be a put, but got type %d", pair.Type)
+	}
+}
+
+func TestMergedIteratorMergeRecordWithoutOperatorReturnsError(t *testing.T) {
+	merged := makeMergedIterator(false, []*Pair{&Pair{Key: []byte{1}, Value: []byte{1}, Type: MERGE}})
+	defer merged.Close()
+
+	_, err := merged.Next()
+	if err != ERR_NO_MERGE_OPERATOR {
+		t.Errorf("Expected %v but got %v", ERR_NO_MERGE_OPERATOR, err)
 	}
-	return NewMergedIterator(iterators, returnTombstone)
+}
+
+func TestMergedIteratorReturningTombstonesDropsSingleDeletesWithTheirPut(t *testing.T) {
+	newer := []*Pair{
+		&Pair{Key: []byte{1}, Value: []byte{}, Type: SINGLE_DELETE},
+		&Pair{Key: []byte{2}, Value: []byte{}, Type: SINGLE_DELETE},
+		&Pair{Key: []byte{3}, Value: []byte{}, Type: SINGLE_DELETE},
+	}
+	older := []*Pair{
+		&Pair{Key: []byte{1}, Value: []byte{1}},
+		&Pair{Key: []byte{2}, Value: []byte{}, Type: DELETE},
+		&Pair{Key: []byte{4}, Value: []byte{4}},
+	}
+	merged := makeMergedIterator(true, newer, older)
+	defer merged.Close()
+
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{2}, []byte{}, t)
+	pair, _ := merged.Get()
+	if pair.Type != SINGLE_DELETE {
+		t.Errorf("Expected a single delete over a delete to be kept, but got type %d", pair.Type)
+	}
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{3}, []byte{}, t)
+	pair, _ = merged.Get()
+	if pair.Type != SINGLE_DELETE {
+		t.Errorf("Expected a single delete without a put beneath it to be kept, but got type %d", pair.Type)
+	}
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{4}, []byte{4}, t)
+	CompareNext(merged, false, t)
+}
+
+func TestMergedIteratorHidesSingleDeletes(t *testing.T) {
+	newer := []*Pair{&Pair{Key: []byte{1}, Value: []byte{}, Type: SINGLE_DELETE}}
+	older := []*Pair{&Pair{Key: []byte{1}, Value: []byte{1}}, &Pair{Key: []byte{2}, Value: []byte{2}}}
+	merged := makeMergedIterator(false, newer, older)
+	defer merged.Close()
+
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{2}, []byte{2}, t)
+	CompareNext(merged, false, t)
+}
+
+func TestMergedIteratorHidesExpiredPairs(t *testing.T) {
+	newer := &sliceIterator{pairs: []*Pair{
+		&Pair{Key: []byte{1}, Value: []byte{1}, Expiry: 10},
+		&Pair{Key: []byte{2}, Value: []byte{2}, Expiry: 11},
+	}}
+	older := &sliceIterator{pairs: []*Pair{&Pair{Key: []byte{1}, Value: []byte{0}}}}
+	merged := NewMergedIterator([]Iterator{newer, older}, false, nil, 10, c.BytewiseComparator{})
+	defer merged.Close()
+
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{2}, []byte{2}, t)
+	CompareNext(merged, false, t)
+}
+
+func TestMergedIteratorReturningTombstonesTurnsExpiredPairsIntoDeletes(t *testing.T) {
+	newer := &sliceIterator{pairs: []*Pair{
+		&Pair{Key: []byte{1}, Value: []byte{1}, Expiry: 10},
+		&Pair{Key: []byte{2}, Value: []byte("b"), Type: MERGE},
+	}}
+	older := &sliceIterator{pairs: []*Pair{&Pair{Key: []byte{2}, Value: []byte("a"), Expiry: 10}}}
+	merged := NewMergedIterator([]Iterator{newer, older}, true, config.AppendOperator{}, 10, c.BytewiseComparator{})
+	defer merged.Close()
+
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{1}, []byte{}, t)
+	pair, _ := merged.Get()
+	if pair.Type != DELETE {
+		t.Errorf("Expected an expired put to be a delete, but got type %d", pair.Type)
+	}
+	CompareNext(merged, true, t)
+	CompareGet(merged, []byte{2}, []byte("b"), t)
+	pair, _ = merged.Get()
+	if pair.Type != PUT || pair.Expiry != 0 {
+		t.Errorf("Expected a merge over an expired put to be a put which does not expire, but got type %d expiring at %d", pair.Type, pair.Expiry)
+	}
+	CompareNext(merged, false, t)
 }
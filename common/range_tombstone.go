@@ -0,0 +1,70 @@
+package common
+
+import (
+	"sort"
+
+	c "github.com/patrickgombert/lsmt/comparator"
+)
+
+// A range tombstone deletes every key between Start and End inclusive. A range
+// tombstone only hides keys in data older than the memtable or level which holds it,
+// pairs held alongside it are always newer than the range tombstone.
+type RangeTombstone struct {
+	Start []byte
+	End   []byte
+}
+
+// Iterators which carry range tombstones. A merged iterator hides the pairs of lower
+// priority iterators which are covered by the range tombstones of a higher priority
+// iterator.
+type RangeTombstoneIterator interface {
+	Iterator
+	RangeTombstones() []RangeTombstone
+}
+
+// Returns whether the range tombstone covers the key in the comparator's order.
+func (tombstone RangeTombstone) Covers(comparator c.Comparator, key []byte) bool {
+	return comparator.Compare(key, tombstone.Start) != c.LESS_THAN && comparator.Compare(key, tombstone.End) != c.GREATER_THAN
+}
+
+// Returns whether any of the range tombstones covers the key in the comparator's order.
+func Covers(comparator c.Comparator, tombstones []RangeTombstone, key []byte) bool {
+	for _, tombstone := range tombstones {
+		if tombstone.Covers(comparator, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the range tombstones carried by the iterator, or nil if it does not carry any.
+func RangeTombstonesOf(iter Iterator) []RangeTombstone {
+	carrier, ok := iter.(RangeTombstoneIterator)
+	if !ok {
+		return nil
+	}
+	return carrier.RangeTombstones()
+}
+
+// Returns the range tombstones sorted by start in the comparator's order with
+// overlapping range tombstones combined.
+func CoalesceRangeTombstones(comparator c.Comparator, tombstones []RangeTombstone) []RangeTombstone {
+	if len(tombstones) == 0 {
+		return nil
+	}
+	sorted := append([]RangeTombstone{}, tombstones...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return comparator.Compare(sorted[i].Start, sorted[j].Start) == c.LESS_THAN
+	})
+
+	coalesced := []RangeTombstone{sorted[0]}
+	for _, tombstone := range sorted[1:] {
+		last := &coalesced[len(coalesced)-1]
+		if comparator.Compare(tombstone.Start, last.End) == c.GREATER_THAN {
+			coalesced = append(coalesced, tombstone)
+		} else if comparator.Compare(tombstone.End, last.End) == c.GREATER_THAN {
+			last.End = tombstone.End
+		}
+	}
+	return coalesced
+}
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"testing"
+
+	c "github.com/patrickgombert/lsmt/comparator"
+)
+
+func TestRangeTombstoneCoversInclusiveBounds(t *testing.T) {
+	tombstone := RangeTombstone{Start: []byte{2}, End: []byte{4}}
+	for key, expected := range map[byte]bool{1: false, 2: true, 3: true, 4: true, 5: false} {
+		if tombstone.Covers(c.BytewiseComparator{}, []byte{key}) != expected {
+			t.Errorf("Expected Covers(%q) to be %t, but was not", []byte{key}, expected)
+		}
+	}
+}
+
+func TestCoalesceRangeTombstones(t *testing.T) {
+	tombstones := []RangeTombstone{
+		RangeTombstone{Start: []byte{6}, End: []byte{7}},
+		RangeTombstone{Start: []byte{1}, End: []byte{3}},
+		RangeTombstone{Start: []byte{3}, End: []byte{4}},
+		RangeTombstone{Start: []byte{2}, End: []byte{2}},
+	}
+	coalesced := CoalesceRangeTombstones(c.BytewiseComparator{}, tombstones)
+	expected := []RangeTombstone{
+		RangeTombstone{Start: []byte{1}, End: []byte{4}},
+		RangeTombstone{Start: []byte{6}, End: []byte{7}},
+	}
+	if len(coalesced) != len(expected) {
+		t.Fatalf("Expected %d range tombstones, but got %d", len(expected), len(coalesced))
+	}
+	for i, tombstone := range coalesced {
+		if c.Compare(tombstone.Start, expected[i].Start) != c.EQUAL || c.Compare(tombstone.End, expected[i].End) != c.EQUAL {
+			t.Errorf("Expected range tombstone %q-%q, but got %q-%q", expected[i].Start, expected[i].End, tombstone.Start, tombstone.End)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package common
+
+// An iterator which walks another iterator in descending key order. Next() and Prev()
+// are swapped while seeks keep their meaning in key order, so SeekToLast() and
+// SeekForPrev() position a reverse iterator at the start of a descending walk while
+// SeekToFirst() and Seek() position it at the end of one.
+type reverseIterator struct {
+	iterator Iterator
+}
+
+// Creates a new iterator which walks the given iterator in descending key order.
+func NewReverseIterator(iterator Iterator) Iterator {
+	return &reverseIterator{iterator: iterator}
+}
+
+func (iter *reverseIterator) Next() (bool, error) {
+	return iter.iterator.Prev()
+}
+
+func (iter *reverseIterator) Prev() (bool, error) {
+	return iter.iterator.Next()
+}
+
+func (iter *reverseIterator) Seek(key []byte) (bool, error) {
+	return iter.iterator.Seek(key)
+}
+
+func (iter *reverseIterator) SeekToFirst() (bool, error) {
+	return iter.iterator.SeekToFirst()
+}
+
+func (iter *reverseIterator) SeekToLast() (bool, error) {
+	return iter.iterator.SeekToLast()
+}
+
+func (iter *reverseIterator) SeekForPrev(key []byte) (bool, error) {
+	return iter.iterator.SeekForPrev(key)
+}
+
+func (iter *reverseIterator) Valid() bool {
+	return iter.iterator.Valid()
+}
+
+func (iter *reverseIterator) Get() (*Pair, error) {
+	return iter.iterator.Get()
+}
+
+func (iter *reverseIterator) Close() error {
+	return iter.iterator.Close()
+}
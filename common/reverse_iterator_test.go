@@ -0,0 +1,35 @@
+package common
+
+import "testing"
+
+func TestReverseIterator(t *testing.T) {
+	pairs := []*Pair{&Pair{Key: []byte{0}, Value: []byte{0}}, &Pair{Key: []byte{1}, Value: []byte{1}}, &Pair{Key: []byte{2}, Value: []byte{2}}}
+	iter := NewReverseIterator(&sliceIterator{pairs: pairs})
+	defer iter.Close()
+
+	CompareNext(iter, true, t)
+	CompareGet(iter, []byte{2}, []byte{2}, t)
+	CompareNext(iter, true, t)
+	CompareGet(iter, []byte{1}, []byte{1}, t)
+	ComparePrev(iter, true, t)
+	CompareGet(iter, []byte{2}, []byte{2}, t)
+	CompareNext(iter, true, t)
+	CompareNext(iter, true, t)
+	CompareGet(iter, []byte{0}, []byte{0}, t)
+	CompareNext(iter, false, t)
+}
+
+func TestReverseIteratorSeekForPrev(t *testing.T) {
+	pairs := []*Pair{&Pair{Key: []byte{0}, Value: []byte{0}}, &Pair{Key: []byte{2}, Value: []byte{2}}, &Pair{Key: []byte{4}, Value: []byte{4}}}
+	iter := NewReverseIterator(&sliceIterator{pairs: pairs})
+	defer iter.Close()
+
+	found, _ := iter.SeekForPrev([]byte{3})
+	if !found {
+		t.Error("Expected SeekForPrev() to find a pair, but did not")
+	}
+	CompareGet(iter, []byte{2}, []byte{2}, t)
+	CompareNext(iter, true, t)
+	CompareGet(iter, []byte{0}, []byte{0}, t)
+	CompareNext(iter, false, t)
+}
@@ -29,6 +29,12 @@ func (s Semaphore) TryLock() bool {
 	return true
 }
 
+// Acquire a lock, blocking until one is available. The caller is responsible for its
+// own call to Unlock.
+func (s Semaphore) Lock() {
+	<-s
+}
+
 // Unlocks a lock. This function assumes that the caller had previously called TryLock
 // successfully. This function also assumed that Unlock will be called only once per
 // unlock attempt.
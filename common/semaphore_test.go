@@ -24,3 +24,20 @@ func TestTryLockFull(t *testing.T) {
 		t.Error("Expected sempahore to not be acquire lock, but did")
 	}
 }
+
+func TestLockWaitsForUnlock(t *testing.T) {
+	s := NewSemaphore(1)
+	s.TryLock()
+	unlocked := make(chan bool)
+	go func() {
+		s.Lock()
+		unlocked <- true
+	}()
+	s.Unlock()
+	if !<-unlocked {
+		t.Error("Expected Lock to acquire the lock once unlocked, but did not")
+	}
+	if !s.IsLocked() {
+		t.Error("Expected semaphore to be locked, but was not")
+	}
+}
@@ -26,13 +26,20 @@ func CompareNext(iter Iterator, expected bool, t *testing.T) {
 	}
 }
 
-func SetUp(t *testing.T) {
+func ComparePrev(iter Iterator, expected bool, t *testing.T) {
+	actual, _ := iter.Prev()
+	if actual != expected {
+		t.Errorf("Expected Prev() to produce %t, but got %t.", expected, actual)
+	}
+}
+
+func SetUp(t testing.TB) {
 	if os.Mkdir(TEST_DIR, os.ModeDir|os.ModePerm) != nil {
 		t.Errorf("Failed to setUp by creating directory: %s", TEST_DIR)
 	}
 }
 
-func TearDown(t *testing.T) {
+func TearDown(t testing.TB) {
 	if os.RemoveAll(TEST_DIR) != nil {
 		t.Errorf("Failed to tearDown by removing directory: %s", TEST_DIR)
 	}
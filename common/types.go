@@ -1,19 +1,137 @@
 package common
 
-// Container for a key/value pair
+import c "github.com/patrickgombert/lsmt/comparator"
+
+// Container for a key/value pair along with the type of record which wrote it. Expiry
+// is the time, in nanoseconds since the unix epoch, at which a put expires, or 0 if it
+// never expires.
 type Pair struct {
-	Key   []byte
-	Value []byte
+	Key    []byte
+	Value  []byte
+	Type   RecordType
+	Expiry int64
+}
+
+// The type of record which wrote a pair. A put maps its key to its value, a delete
+// hides older values of its key and a merge holds an operand to combine with older
+// values of its key. A range delete hides older values of every key in a range and is
+// held as a RangeTombstone rather than as a pair. A single delete hides the one put of
+// a key which is written only once, and is dropped along with that put when the two
+// meet during a flush.
+type RecordType uint8
+
+const (
+	PUT           RecordType = 0
+	DELETE        RecordType = 1
+	MERGE         RecordType = 2
+	RANGE_DELETE  RecordType = 3
+	SINGLE_DELETE RecordType = 4
+)
+
+// Returns whether the pair is a tombstone, hiding older values of its key.
+func (pair Pair) IsTombstone() bool {
+	return pair.Type == DELETE || pair.Type == SINGLE_DELETE
 }
 
-// Iterators allow for the sequential movement through ordered data structures
-// Next() must always be called before Get(). If Next() returns false then there are
-// no more values to Get() and Close() should be invoked.
+// Returns whether the pair has expired at now, given in nanoseconds since the unix
+// epoch. An expired pair hides older values of its key like a tombstone. Nothing has
+// expired at a now of 0.
+func (pair Pair) Expired(now int64) bool {
+	return pair.Expiry != 0 && now != 0 && pair.Expiry <= now
+}
+
+// Iterators allow for the sequential movement through ordered data structures in
+// either direction. Next() or Prev() must always be called before Get(). If Next()
+// returns false then the iterator has moved past the last pair and if Prev() returns
+// false then it has moved past the first pair. An iterator which has moved past one
+// end can be moved back onto its pairs by moving in the opposite direction, and an
+// iterator which has not been positioned yet moves onto the first pair with Next() or
+// the last pair with Prev().
+// SeekToFirst() positions the iterator at the first pair and Seek() positions the
+// iterator at the first pair whose key is greater than or equal to the given key.
+// SeekToLast() positions the iterator at the last pair and SeekForPrev() positions the
+// iterator at the last pair whose key is less than or equal to the given key. Each
+// returns false if there is no such pair. Valid() reports whether the iterator is
+// positioned at a pair. Close() should be invoked once the iterator is no longer
+// needed.
 type Iterator interface {
 	Next() (bool, error)
+	Prev() (bool, error)
+	Seek(key []byte) (bool, error)
+	SeekToFirst() (bool, error)
+	SeekToLast() (bool, error)
+	SeekForPrev(key []byte) (bool, error)
+	Valid() bool
 	Get() (*Pair, error)
 	Close() error
 }
 
-// Tombstones are values used to represent a deleted key
-var Tombstone = []byte{}
+// The position of an iterator relative to the pairs it iterates over.
+type Position int8
+
+const (
+	UNPOSITIONED Position = 0
+	AT_PAIR      Position = 1
+	BEFORE_FIRST Position = 2
+	AFTER_LAST   Position = 3
+)
+
+// Options which control how an iterator reads data.
+// DontFillCache prevents blocks read by the iterator from being inserted into the
+// block cache. It is intended for long scans which would otherwise evict the working
+// set of point lookups. Reverse creates an iterator which walks its pairs in
+// descending key order.
+// LowerBound and UpperBound restrict the keys visited by the iterator. A nil bound
+// leaves that side of the iterator open ended. Bounds are inclusive unless
+// ExcludeLowerBound or ExcludeUpperBound is set. Limit is the maximum number of pairs
+// returned by the iterator between seeks, zero meaning no limit. Comparator orders the
+// keys visited by the iterator, defaulting to bytewise order. The LSMT replaces it with
+// its own comparator.
+type IterOptions struct {
+	DontFillCache     bool
+	Reverse           bool
+	LowerBound        []byte
+	UpperBound        []byte
+	ExcludeLowerBound bool
+	ExcludeUpperBound bool
+	Limit             int
+	Comparator        c.Comparator
+}
+
+// Returns the comparator which orders the keys visited, defaulting to bytewise order.
+func (opts IterOptions) GetComparator() c.Comparator {
+	if opts.Comparator == nil {
+		return c.BytewiseComparator{}
+	}
+	return opts.Comparator
+}
+
+// Returns whether key is not before the lower bound.
+func (opts IterOptions) WithinLowerBound(key []byte) bool {
+	if opts.LowerBound == nil {
+		return true
+	}
+	comparison := opts.GetComparator().Compare(key, opts.LowerBound)
+	return comparison == c.GREATER_THAN || (comparison == c.EQUAL && !opts.ExcludeLowerBound)
+}
+
+// Returns whether key is not after the upper bound.
+func (opts IterOptions) WithinUpperBound(key []byte) bool {
+	if opts.UpperBound == nil {
+		return true
+	}
+	comparison := opts.GetComparator().Compare(key, opts.UpperBound)
+	return comparison == c.LESS_THAN || (comparison == c.EQUAL && !opts.ExcludeUpperBound)
+}
+
+// Returns whether key falls within both bounds.
+func (opts IterOptions) WithinBounds(key []byte) bool {
+	return opts.WithinLowerBound(key) && opts.WithinUpperBound(key)
+}
+
+// Returns a copy of the options without a limit, for iterators which are merged
+// before the limit is applied.
+func (opts IterOptions) Unlimited() IterOptions {
+	opts.Limit = 0
+	return opts
+}
@@ -1,15 +1,35 @@
 package comparator
 
-type comparison int
+type Comparison int
 
 const (
-	LESS_THAN    comparison = -1
-	EQUAL        comparison = 0
-	GREATER_THAN comparison = 1
+	LESS_THAN    Comparison = -1
+	EQUAL        Comparison = 0
+	GREATER_THAN Comparison = 1
 )
 
+// Orders keys. Compare returns how a compares to b. Name identifies the ordering and is
+// persisted, so that data is never read with a different ordering than it was written
+// with. FindShortestSeparator returns a key which is not less than start and is less
+// than limit, as short as possible, given that start is less than limit.
+// FindShortSuccessor returns a key which is not less than key, as short as possible.
+// Both are used to shorten the block end keys held in an sst's index, so the returned
+// keys must not share memory with the keys passed in.
+type Comparator interface {
+	Compare(a, b []byte) Comparison
+	Name() string
+	FindShortestSeparator(start, limit []byte) []byte
+	FindShortSuccessor(key []byte) []byte
+}
+
+// Orders keys bytewise in lexicographical order.
+type BytewiseComparator struct{}
+
+// Orders keys bytewise in reverse lexicographical order.
+type ReverseBytewiseComparator struct{}
+
 // Compare two byte slices in lexicographical order
-func Compare(a, b []byte) comparison {
+func Compare(a, b []byte) Comparison {
 	for i, _ := range a {
 		if i+1 > len(b) {
 			return GREATER_THAN
@@ -26,3 +46,69 @@ func Compare(a, b []byte) comparison {
 	}
 	return EQUAL
 }
+
+func (comparator BytewiseComparator) Compare(a, b []byte) Comparison {
+	return Compare(a, b)
+}
+
+func (comparator BytewiseComparator) Name() string {
+	return "BytewiseComparator"
+}
+
+// Increments the first byte at which start and limit differ, if that keeps the
+// separator below limit, and drops the bytes after it.
+func (comparator BytewiseComparator) FindShortestSeparator(start, limit []byte) []byte {
+	i := 0
+	for i < len(start) && i < len(limit) && start[i] == limit[i] {
+		i++
+	}
+	if i < len(start) && i < len(limit) && start[i] < 0xff && start[i]+1 < limit[i] {
+		separator := append([]byte{}, start[:i+1]...)
+		separator[i]++
+		return separator
+	}
+	return append([]byte{}, start...)
+}
+
+// Increments the first byte which can be incremented and drops the bytes after it.
+func (comparator BytewiseComparator) FindShortSuccessor(key []byte) []byte {
+	for i, b := range key {
+		if b != 0xff {
+			successor := append([]byte{}, key[:i+1]...)
+			successor[i]++
+			return successor
+		}
+	}
+	return append([]byte{}, key...)
+}
+
+func (comparator ReverseBytewiseComparator) Compare(a, b []byte) Comparison {
+	return Compare(b, a)
+}
+
+func (comparator ReverseBytewiseComparator) Name() string {
+	return "ReverseBytewiseComparator"
+}
+
+// Keeps start up to and including the first byte at which it differs from limit. In
+// reverse order a prefix of start is not less than start, and the differing byte keeps
+// it less than limit.
+func (comparator ReverseBytewiseComparator) FindShortestSeparator(start, limit []byte) []byte {
+	i := 0
+	for i < len(start) && i < len(limit) && start[i] == limit[i] {
+		i++
+	}
+	if i < len(start) {
+		return append([]byte{}, start[:i+1]...)
+	}
+	return append([]byte{}, start...)
+}
+
+// Keeps only the first byte of key. In reverse order a prefix of key is not less than
+// key.
+func (comparator ReverseBytewiseComparator) FindShortSuccessor(key []byte) []byte {
+	if len(key) == 0 {
+		return []byte{}
+	}
+	return append([]byte{}, key[:1]...)
+}
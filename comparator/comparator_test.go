@@ -22,7 +22,74 @@ func TestLessThanWhenShorter(t *testing.T) {
 	testComparison(t, []byte{1, 1, 1}, []byte{1, 1, 1, 0}, LESS_THAN)
 }
 
-func testComparison(t *testing.T, a []byte, b []byte, comparison comparison) {
+func TestReverseBytewiseComparatorInvertsOrder(t *testing.T) {
+	result := ReverseBytewiseComparator{}.Compare([]byte{1, 0, 0}, []byte{1, 1, 0})
+	if result != GREATER_THAN {
+		t.Errorf("Expected %q and %q to compare %q, got %q", []byte{1, 0, 0}, []byte{1, 1, 0}, GREATER_THAN, result)
+	}
+}
+
+func TestFindShortestSeparator(t *testing.T) {
+	testSeparator(t, []byte{1, 2, 3}, []byte{1, 5}, []byte{1, 3})
+	testSeparator(t, []byte{1, 2, 3}, []byte{1, 3}, []byte{1, 2, 3})
+	testSeparator(t, []byte{1, 2}, []byte{1, 2, 3}, []byte{1, 2})
+}
+
+func TestFindShortSuccessor(t *testing.T) {
+	testSuccessor(t, []byte{1, 2, 3}, []byte{2})
+	testSuccessor(t, []byte{0xff, 2}, []byte{0xff, 3})
+	testSuccessor(t, []byte{0xff, 0xff}, []byte{0xff, 0xff})
+}
+
+func TestReverseBytewiseFindShortSuccessor(t *testing.T) {
+	testReverseSuccessor(t, []byte{1, 2, 3}, []byte{1})
+	testReverseSuccessor(t, []byte{0xff}, []byte{0xff})
+	testReverseSuccessor(t, []byte{}, []byte{})
+}
+
+func TestReverseBytewiseFindShortestSeparator(t *testing.T) {
+	testReverseSeparator(t, []byte{1, 5, 3}, []byte{1, 2}, []byte{1, 5})
+	testReverseSeparator(t, []byte{1, 2, 3}, []byte{1, 2}, []byte{1, 2, 3})
+	testReverseSeparator(t, []byte{3, 1, 1}, []byte{1, 9}, []byte{3})
+}
+
+func testSeparator(t *testing.T, start, limit, expected []byte) {
+	separator := BytewiseComparator{}.FindShortestSeparator(start, limit)
+	if Compare(separator, expected) != EQUAL {
+		t.Errorf("Expected separator of %q and %q to be %q, got %q", start, limit, expected, separator)
+	}
+}
+
+func testSuccessor(t *testing.T, key, expected []byte) {
+	successor := BytewiseComparator{}.FindShortSuccessor(key)
+	if Compare(successor, expected) != EQUAL {
+		t.Errorf("Expected successor of %q to be %q, got %q", key, expected, successor)
+	}
+}
+
+func testReverseSuccessor(t *testing.T, key, expected []byte) {
+	comparator := ReverseBytewiseComparator{}
+	successor := comparator.FindShortSuccessor(key)
+	if Compare(successor, expected) != EQUAL {
+		t.Errorf("Expected successor of %q to be %q, got %q", key, expected, successor)
+	}
+	if comparator.Compare(successor, key) == LESS_THAN {
+		t.Errorf("Expected successor %q to not be less than %q", successor, key)
+	}
+}
+
+func testReverseSeparator(t *testing.T, start, limit, expected []byte) {
+	comparator := ReverseBytewiseComparator{}
+	separator := comparator.FindShortestSeparator(start, limit)
+	if Compare(separator, expected) != EQUAL {
+		t.Errorf("Expected separator of %q and %q to be %q, got %q", start, limit, expected, separator)
+	}
+	if comparator.Compare(separator, start) == LESS_THAN || comparator.Compare(separator, limit) != LESS_THAN {
+		t.Errorf("Expected separator %q to be between %q and %q", separator, start, limit)
+	}
+}
+
+func testComparison(t *testing.T, a []byte, b []byte, comparison Comparison) {
 	result := Compare(a, b)
 	if result != comparison {
 		t.Errorf("Expected %q and %q to compare %q, got %q", a, b, comparison, result)
@@ -0,0 +1,16 @@
+package config
+
+import "time"
+
+// Tells the current time. Records written with a time to live expire relative to the
+// clock, so a fake clock can be provided to control expiry.
+type Clock interface {
+	Now() time.Time
+}
+
+// Tells the current time using the system clock.
+type SystemClock struct{}
+
+func (clock SystemClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,38 @@
+package config
+
+// The decision a CompactionFilter makes for a record.
+type CompactionDecision int
+
+const (
+	// The record is written unchanged.
+	Keep CompactionDecision = 0
+	// The record is removed. A record removed above the sink is replaced by a tombstone
+	// so that older values of its key in the levels beneath it are not revealed.
+	Remove CompactionDecision = 1
+	// The record is written with the value returned by the filter.
+	ChangeValue CompactionDecision = 2
+)
+
+// Describes the level a flush is writing when it invokes a CompactionFilter. Level is
+// the index of the level, which is the number of levels for the sink. Start and End
+// bound the keys of the memtables and levels merged into the level. Start is the
+// smallest key, while End is the largest key unless it is taken from a level, whose
+// index holds a shortened successor of its largest key.
+type CompactionContext struct {
+	Level  int
+	IsSink bool
+	Start  []byte
+	End    []byte
+}
+
+// Decides what a flush does with each put it writes, so that records can be removed or
+// their values rewritten by application logic. Filter is given the key and value of
+// the put and returns its decision along with the new value for ChangeValue, which
+// must not be larger than the maximum value size. Tombstones and merge records are not
+// filtered. A put is filtered each time it is written to a level, so the filter must
+// make the same decision when given a value it has already filtered. Name identifies
+// the filter.
+type CompactionFilter interface {
+	Name() string
+	Filter(context CompactionContext, key, value []byte) (CompactionDecision, []byte)
+}
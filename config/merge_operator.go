@@ -0,0 +1,50 @@
+package config
+
+import "encoding/binary"
+
+// Combines the operands written by Merge with the value of a key. Merge is given the
+// existing value of the key, or nil if the key has no value, and returns the value
+// after applying the operand. Operands are resolved lazily, so when no value is found
+// beneath them adjacent operands are combined by passing the older operand as the
+// existing value. The operator must therefore be associative. Name identifies the
+// operator.
+type MergeOperator interface {
+	Name() string
+	Merge(key, existing, operand []byte) []byte
+}
+
+// Adds operands to the existing value as unsigned 64 bit integers encoded as 8 big
+// endian bytes. A missing value, or a value or operand which is not 8 bytes long,
+// counts as zero. Addition wraps around on overflow.
+type UInt64AddOperator struct{}
+
+// Appends operands to the existing value.
+type AppendOperator struct{}
+
+func (operator UInt64AddOperator) Name() string {
+	return "UInt64AddOperator"
+}
+
+func (operator UInt64AddOperator) Merge(key, existing, operand []byte) []byte {
+	sum := make([]byte, 8)
+	binary.BigEndian.PutUint64(sum, decodeUInt64(existing)+decodeUInt64(operand))
+	return sum
+}
+
+func (operator AppendOperator) Name() string {
+	return "AppendOperator"
+}
+
+func (operator AppendOperator) Merge(key, existing, operand []byte) []byte {
+	appended := make([]byte, 0, len(existing)+len(operand))
+	appended = append(appended, existing...)
+	return append(appended, operand...)
+}
+
+// Decodes an unsigned 64 bit integer, treating anything other than 8 bytes as zero.
+func decodeUInt64(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
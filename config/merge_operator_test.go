@@ -0,0 +1,43 @@
+package config
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestUInt64AddOperator(t *testing.T) {
+	operator := UInt64AddOperator{}
+	sum := operator.Merge([]byte{0}, nil, uint64Bytes(2))
+	sum = operator.Merge([]byte{0}, sum, uint64Bytes(3))
+	if binary.BigEndian.Uint64(sum) != 5 {
+		t.Errorf("Expected sum of 5, but got %d", binary.BigEndian.Uint64(sum))
+	}
+
+	sum = operator.Merge([]byte{0}, []byte{1}, uint64Bytes(7))
+	if binary.BigEndian.Uint64(sum) != 7 {
+		t.Errorf("Expected a malformed value to count as zero, but got %d", binary.BigEndian.Uint64(sum))
+	}
+}
+
+func TestAppendOperator(t *testing.T) {
+	operator := AppendOperator{}
+	existing := []byte("ab")
+	appended := operator.Merge([]byte{0}, existing, []byte("c"))
+	if !bytes.Equal(appended, []byte("abc")) {
+		t.Errorf("Expected %q but got %q", []byte("abc"), appended)
+	}
+	if !bytes.Equal(existing, []byte("ab")) {
+		t.Errorf("Expected the existing value to be left unchanged, but got %q", existing)
+	}
+	appended = operator.Merge([]byte{0}, nil, []byte("c"))
+	if !bytes.Equal(appended, []byte("c")) {
+		t.Errorf("Expected %q but got %q", []byte("c"), appended)
+	}
+}
+
+func uint64Bytes(i uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, i)
+	return b
+}
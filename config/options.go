@@ -2,6 +2,10 @@ package config
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/patrickgombert/lsmt/cache"
+	c "github.com/patrickgombert/lsmt/comparator"
 )
 
 // Common options for Levels and the Sink
@@ -34,15 +38,82 @@ type Sink struct {
 	BloomFilterSize  uint32
 }
 
+// Limits at which writes are stalled so that flushing can catch up with writers. The
+// limits are checked before every group of writes. Crossing a soft limit delays the
+// group by Delay and crossing a hard limit blocks writes until a flush brings the LSMT
+// back under it. Pending flush bytes are the bytes the flushes of the immutable
+// memtables are expected to merge: the immutable memtables and the SSTs of the first
+// level. A limit of 0 is disabled.
+type WriteStall struct {
+	ImmutableMemtablesSoftLimit int
+	ImmutableMemtablesHardLimit int
+	L0FilesSoftLimit            int
+	L0FilesHardLimit            int
+	PendingFlushBytesSoftLimit  int64
+	PendingFlushBytesHardLimit  int64
+	Delay                       time.Duration
+}
+
+// The strategy used to read blocks from SST files.
+type IOMode int
+
+const (
+	// Blocks are read from the SST file and stored in the level's block cache.
+	StandardIO IOMode = 0
+	// SST files are memory mapped and blocks are served directly from the mapping
+	// without being copied or cached.
+	MmapIO IOMode = 1
+)
+
+// The data structure which backs memtables.
+type MemtableType int
+
+const (
+	// Memtables are persistent red-black trees which are safe for concurrent writers.
+	TreeMemtable MemtableType = 0
+	// Memtables are arena backed skiplists with lock free reads and a single writer,
+	// which allocate far less per write than the tree.
+	SkiplistMemtable MemtableType = 1
+)
+
 // Options for an LSMT.
 // All size options are specified in bytes.
+// BlockCache is optional and may be shared across levels and across multiple LSMTs. If
+// it is not provided then a cache is created which is sized by each level's
+// BlockCacheSize and BlockCacheShards.
+// Filter blocks are cached with a higher priority than data blocks. When
+// PinL0IndexAndFilterBlocks is set the filter blocks of the first level's SSTs are
+// pinned in the block cache for the lifetime of each SST. Index blocks are always held
+// in memory for the lifetime of each SST.
+// WriteStall is optional, when it is not provided writes are never stalled.
+// MaximumImmutableMemtables is the number of full memtables which may be waiting to be
+// flushed. Once it is reached, a full memtable is only retired after a flush completes.
+// A maximum of 0 is unlimited.
+// MemtableType selects the data structure backing memtables, defaulting to the tree.
+// MergeOperator is optional and resolves the operands written by Merge. Merge is
+// rejected when it is not provided.
+// Clock is optional and tells the time against which records written with a time to
+// live expire, defaulting to the system clock.
+// CompactionFilter is optional and is invoked for every put written by a flush.
+// Comparator is optional and orders keys, defaulting to bytewise order. An LSMT must
+// always be opened with the comparator it was created with.
 type Options struct {
-	Levels              []*Level
-	Sink                *Sink
-	Path                string
-	MemtableMaximumSize int64
-	KeyMaximumSize      int
-	ValueMaximumSize    int
+	Levels                    []*Level
+	Sink                      *Sink
+	Path                      string
+	MemtableMaximumSize       int64
+	KeyMaximumSize            int
+	ValueMaximumSize          int
+	IOMode                    IOMode
+	BlockCache                cache.Cache
+	PinL0IndexAndFilterBlocks bool
+	WriteStall                *WriteStall
+	MaximumImmutableMemtables int
+	MemtableType              MemtableType
+	MergeOperator             MergeOperator
+	Clock                     Clock
+	CompactionFilter          CompactionFilter
+	Comparator                c.Comparator
 }
 
 // Returns the level options for a given integer level.
@@ -56,6 +127,22 @@ func (options *Options) GetLevel(i int) (LevelOptions, error) {
 	}
 }
 
+// Returns the comparator which orders keys, defaulting to bytewise order.
+func (options *Options) GetComparator() c.Comparator {
+	if options.Comparator == nil {
+		return c.BytewiseComparator{}
+	}
+	return options.Comparator
+}
+
+// Returns the current time of the options' clock in nanoseconds since the unix epoch.
+func (options *Options) Now() int64 {
+	if options.Clock == nil {
+		return time.Now().UnixNano()
+	}
+	return options.Clock.Now().UnixNano()
+}
+
 // Validates that all of the fields contained with the Options are valid. Returns a list
 // of errors. If there are no errors then the list will be empty.
 func (options *Options) Validate() []error {
@@ -73,12 +160,28 @@ func (options *Options) Validate() []error {
 		errs = append(errs, fmt.Errorf("ValueMaximumSize %d must be greater than 0", options.ValueMaximumSize))
 	}
 
+	if options.MaximumImmutableMemtables < 0 {
+		errs = append(errs, fmt.Errorf("MaximumImmutableMemtables %d must not be negative", options.MaximumImmutableMemtables))
+	}
+
+	if options.IOMode != StandardIO && options.IOMode != MmapIO {
+		errs = append(errs, fmt.Errorf("IOMode %d is not a known IOMode", options.IOMode))
+	}
+
+	if options.MemtableType != TreeMemtable && options.MemtableType != SkiplistMemtable {
+		errs = append(errs, fmt.Errorf("MemtableType %d is not a known MemtableType", options.MemtableType))
+	}
+
 	for _, level := range options.Levels {
 		errs = append(errs, level.validate(options)...)
 	}
 
 	errs = append(errs, options.Sink.validate(options)...)
 
+	if options.WriteStall != nil {
+		errs = append(errs, options.WriteStall.validate()...)
+	}
+
 	return errs
 }
 
@@ -92,7 +195,7 @@ func (level *Level) validate(options *Options) []error {
 		errs = append(errs, fmt.Errorf("ValueMaximumSize %d is larger than the level's BlockSize %d", options.ValueMaximumSize, level.BlockSize))
 	}
 
-	if level.BlockSize > level.BlockCacheSize {
+	if options.BlockCache == nil && level.BlockSize > level.BlockCacheSize {
 		errs = append(errs, fmt.Errorf("BlockSize %d is larger than the level's BlockCacheSize %d", level.BlockSize, level.BlockCacheSize))
 	}
 
@@ -117,7 +220,7 @@ func (sink *Sink) validate(options *Options) []error {
 		errs = append(errs, fmt.Errorf("ValueMaximumSize %d is larger than the sink's BlockSize %d", options.ValueMaximumSize, sink.BlockSize))
 	}
 
-	if sink.BlockSize > sink.BlockCacheSize {
+	if options.BlockCache == nil && sink.BlockSize > sink.BlockCacheSize {
 		errs = append(errs, fmt.Errorf("BlockSize %d is larger than the sink's BlockCacheSize %d", sink.BlockSize, sink.BlockCacheSize))
 	}
 
@@ -128,6 +231,25 @@ func (sink *Sink) validate(options *Options) []error {
 	return errs
 }
 
+func (stall *WriteStall) validate() []error {
+	errs := []error{}
+
+	if stall.ImmutableMemtablesSoftLimit < 0 || stall.ImmutableMemtablesHardLimit < 0 {
+		errs = append(errs, fmt.Errorf("ImmutableMemtables limits %d and %d must not be negative", stall.ImmutableMemtablesSoftLimit, stall.ImmutableMemtablesHardLimit))
+	}
+	if stall.L0FilesSoftLimit < 0 || stall.L0FilesHardLimit < 0 {
+		errs = append(errs, fmt.Errorf("L0Files limits %d and %d must not be negative", stall.L0FilesSoftLimit, stall.L0FilesHardLimit))
+	}
+	if stall.PendingFlushBytesSoftLimit < 0 || stall.PendingFlushBytesHardLimit < 0 {
+		errs = append(errs, fmt.Errorf("PendingFlushBytes limits %d and %d must not be negative", stall.PendingFlushBytesSoftLimit, stall.PendingFlushBytesHardLimit))
+	}
+	if stall.Delay < 0 {
+		errs = append(errs, fmt.Errorf("Delay %s must not be negative", stall.Delay))
+	}
+
+	return errs
+}
+
 func (level *Level) GetBlockSize() int64 {
 	return level.BlockSize
 }
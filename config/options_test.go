@@ -1,6 +1,11 @@
 package config
 
-import "testing"
+import (
+	"testing"
+	"time"
+
+	"github.com/patrickgombert/lsmt/cache"
+)
 
 func TestValid(t *testing.T) {
 	options := validOptions()
@@ -104,6 +109,17 @@ func TestBlockCacheSizeMustBeLargerThanBlockSize(t *testing.T) {
 	}
 }
 
+func TestBlockCacheSizeIgnoredWithSharedBlockCache(t *testing.T) {
+	options := validOptions()
+	options.Sink.BlockCacheSize = 0
+	options.BlockCache = cache.NewShardedLRUCache(1, 1000)
+
+	err := options.Validate()
+	if len(err) != 0 {
+		t.Error("Expected BlockCacheSize to be ignored when a shared BlockCache is provided, but was not")
+	}
+}
+
 func TestBloomFilterSizeMustBeGreaterThan0(t *testing.T) {
 	level := &Level{BlockSize: 1000, SSTSize: 1000, BlockCacheSize: 2000, BloomFilterSize: 0, MaximumSSTFiles: 100}
 	options := validOptions()
@@ -123,6 +139,64 @@ func TestBloomFilterSizeMustBeGreaterThan0(t *testing.T) {
 	}
 }
 
+func TestIOModeMustBeKnown(t *testing.T) {
+	options := validOptions()
+	options.IOMode = MmapIO
+
+	err := options.Validate()
+	if len(err) != 0 {
+		t.Error("Expected MmapIO to be a valid IOMode, but was not")
+	}
+
+	options.IOMode = IOMode(2)
+	err = options.Validate()
+	if len(err) != 1 {
+		t.Error("Expected unknown IOMode to produce an error, but did not")
+	}
+}
+
+func TestMemtableTypeMustBeKnown(t *testing.T) {
+	options := validOptions()
+	options.MemtableType = SkiplistMemtable
+
+	err := options.Validate()
+	if len(err) != 0 {
+		t.Error("Expected SkiplistMemtable to be a valid MemtableType, but was not")
+	}
+
+	options.MemtableType = MemtableType(2)
+	err = options.Validate()
+	if len(err) != 1 {
+		t.Error("Expected unknown MemtableType to produce an error, but did not")
+	}
+}
+
+func TestMaximumImmutableMemtablesMustNotBeNegative(t *testing.T) {
+	options := validOptions()
+	options.MaximumImmutableMemtables = -1
+
+	err := options.Validate()
+	if len(err) != 1 {
+		t.Error("Expected negative MaximumImmutableMemtables to produce an error, but did not")
+	}
+}
+
+func TestWriteStallLimitsMustNotBeNegative(t *testing.T) {
+	options := validOptions()
+	options.WriteStall = &WriteStall{ImmutableMemtablesSoftLimit: 2, ImmutableMemtablesHardLimit: 4, Delay: time.Millisecond}
+
+	err := options.Validate()
+	if len(err) != 0 {
+		t.Error("Expected valid WriteStall to not produce error(s), but did")
+	}
+
+	options.WriteStall = &WriteStall{L0FilesHardLimit: -1, Delay: -time.Millisecond}
+	err = options.Validate()
+	if len(err) != 2 {
+		t.Errorf("Expected negative WriteStall limits to produce 2 errors, but got %d", len(err))
+	}
+}
+
 func validOptions() *Options {
 	sink := &Sink{BlockSize: 100, SSTSize: 1000, BlockCacheSize: 200, BloomFilterSize: 1000}
 	return &Options{Levels: []*Level{}, Sink: sink, KeyMaximumSize: 50, ValueMaximumSize: 50, MemtableMaximumSize: 1000}
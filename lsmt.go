@@ -1,11 +1,15 @@
 package lsmt
 
 import (
+	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/patrickgombert/lsmt/cache"
 	"github.com/patrickgombert/lsmt/common"
 	c "github.com/patrickgombert/lsmt/comparator"
 	"github.com/patrickgombert/lsmt/config"
@@ -18,18 +22,49 @@ const (
 	Action    = "action"
 )
 
+// A log-structured merge-tree, safe for concurrent use.
+// The memtables and ssts are published together as an immutable version which is
+// replaced whenever a memtable is retired or a flush completes, see version for
+// details. Reads never take a lock: Get and Iterator acquire the current version and
+// read from it. Writes are committed in groups through the writer queue, see commit.
+// Every memtable has a write-ahead log which only the leader of a group appends to.
+// The logs of retired memtables are kept, newest first, until their memtable has been
+// flushed. The write lock guards the writer queue, the publishing of versions, the
+// logs and closed. At most one flush runs at a time, guarded by the flush lock.
 type lsmt struct {
-	options           *config.Options
-	activeMemtable    *mt.Memtable
-	inactiveMemtables []*mt.Memtable
-	sstManager        sst.SSTManager
-	flushLock         common.Semaphore
-	closed            bool
+	stalls      stallCounters
+	options     *config.Options
+	version     unsafe.Pointer
+	writeLock   sync.Mutex
+	writers     []*writer
+	wal         *writeAheadLog
+	logNumber   int
+	retiredLogs []string
+	flushLock   common.Semaphore
+	flushed     *sync.Cond
+	closed      bool
+}
+
+// Point in time metrics for a log-structured merge-tree.
+type Metrics struct {
+	BlockCache         cache.Stats
+	Levels             []sst.LevelStats
+	ImmutableMemtables int
+	Memtables          MemtableStats
+	WriteStalls        WriteStallStats
+}
+
+// Totals across the active and immutable memtables of a log-structured merge-tree.
+type MemtableStats struct {
+	Bytes      int64
+	Entries    int64
+	Tombstones int64
 }
 
 // Creates a new log-structured merge-tree in accordance with the options provided.
 // If an existing lsmt exists at options.path then it will be opened, otherwise a new
-// lsmt will be created.
+// lsmt will be created. Writes left in the write-ahead logs of an lsmt which was not
+// closed are replayed and flushed before it is opened.
 func Lsmt(options *config.Options) (*lsmt, []error) {
 	errs := options.Validate()
 	if len(errs) != 0 {
@@ -41,91 +76,186 @@ func Lsmt(options *config.Options) (*lsmt, []error) {
 		return nil, []error{err}
 	}
 	if mostRecentManifest == nil {
-		mostRecentManifest = &sst.Manifest{Levels: [][]sst.Entry{}, Version: 0}
+		mostRecentManifest = &sst.Manifest{Levels: [][]sst.Entry{}, Version: 0, Comparator: options.GetComparator().Name()}
 	}
 
-	sstManager, err := sst.OpenBlockBasedSSTManager(mostRecentManifest, options)
+	opened, err := sst.OpenBlockBasedSSTManager(mostRecentManifest, options)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	db := &lsmt{options: options, flushLock: common.NewSemaphore(1), closed: false}
+	sstManager, err := db.recover(opened, mostRecentManifest.LogNumber)
+	if err != nil {
+		return nil, []error{err}
+	}
+	db.wal, err = newWriteAheadLog(options.Path, db.logNumber)
 	if err != nil {
+		sstManager.Close()
 		return nil, []error{err}
 	}
 
 	log.Info().
 		Int("manifest_version", mostRecentManifest.Version).
+		Int("log_number", db.logNumber).
 		Str(Lifecycle, "open").
 		Send()
 
-	return &lsmt{options: options, activeMemtable: mt.NewMemtable(), inactiveMemtables: []*mt.Memtable{}, sstManager: sstManager, flushLock: common.NewSemaphore(1), closed: false}, nil
+	db.version = unsafe.Pointer(newVersion(db.newMemtable(), []mt.Memtable{}, sstManager))
+	db.flushed = sync.NewCond(&db.writeLock)
+	return db, nil
 }
 
 // Get the value for a given key. If the key does not exist then the value will be nil.
 func (db *lsmt) Get(key []byte) ([]byte, error) {
-	value, found := db.activeMemtable.Get(key)
-	if found {
-		if c.Compare(value, common.Tombstone) == c.EQUAL {
-			return nil, nil
-		} else {
-			return value, nil
-		}
+	current := db.acquireVersion()
+	if current == nil {
+		return nil, common.ERR_LSMT_CLOSED
 	}
-	for _, mt := range db.inactiveMemtables {
-		value, found = mt.Get(key)
+	defer current.release()
+
+	// Merge operands are gathered, newest first, until a value or deletion is found
+	operands := [][]byte{}
+	for _, mt := range current.memtables() {
+		pair, found := mt.Get(key)
 		if found {
-			if c.Compare(value, common.Tombstone) == c.EQUAL {
-				return nil, nil
-			} else {
-				return value, nil
+			if pair.Type == common.MERGE {
+				operands = append(operands, pair.Value)
+				continue
 			}
+			return db.resolve(key, &pair, operands), nil
+		}
+		if common.Covers(db.options.GetComparator(), mt.RangeTombstones(), key) {
+			return db.resolve(key, nil, operands), nil
 		}
 	}
 
-	v, err := db.sstManager.Get(key)
+	pair, err := current.sstManager.Get(key)
 	if err != nil {
 		return nil, err
 	}
-	if v != nil && c.Compare(v, common.Tombstone) != c.EQUAL {
-		return v, nil
-	}
+	return db.resolve(key, pair, operands), nil
+}
 
-	return nil, nil
+// Returns the value of the pair after combining it with the merge operands, ordered
+// newest first, written above it. A nil, deleted or expired pair has no value to
+// combine with.
+// Returns nil if there is neither a value nor any operands.
+func (db *lsmt) resolve(key []byte, pair *common.Pair, operands [][]byte) []byte {
+	var value []byte
+	if pair != nil && !pair.IsTombstone() && !pair.Expired(db.options.Now()) {
+		value = pair.Value
+	}
+	if len(operands) == 0 {
+		return value
+	}
+	return common.FullMerge(db.options.MergeOperator, key, value, operands)
 }
 
 // Write a key/value pair. If an error is returned then the key/value pair will not have
 // been written.
 func (db *lsmt) Write(key, value []byte) error {
-	if db.closed {
-		return common.ERR_LSMT_CLOSED
-	}
-	if key == nil || len(key) == 0 {
-		return common.ERR_KEY_NIL_OR_EMPTY
-	}
-	if len(key) > db.options.KeyMaximumSize {
-		return common.ERR_KEY_TOO_LARGE
-	}
-	if value == nil || len(value) == 0 {
-		return common.ERR_VAL_NIL_OR_EMPTY
-	}
-	if len(value) > db.options.ValueMaximumSize {
-		return common.ERR_VAL_TOO_LARGE
-	}
+	batch := NewBatch()
+	batch.Write(key, value)
+	return db.WriteBatch(batch)
+}
 
-	db.activeMemtable.Write(key, value)
-	db.checkFlush()
+// Write a key/value pair which expires once the ttl has passed, measured by the options'
+// clock. An expired pair is hidden from reads and is dropped when it is flushed. If an
+// error is returned then the key/value pair will not have been written.
+func (db *lsmt) WriteWithTTL(key, value []byte, ttl time.Duration) error {
+	batch := NewBatch()
+	batch.WriteWithTTL(key, value, ttl)
+	return db.WriteBatch(batch)
+}
 
-	return nil
+// Writes a merge operand for a key. The operand is combined with the key's value by the
+// merge operator when the key is read or compacted, so that the key's value is never
+// read to write it. Returns ERR_NO_MERGE_OPERATOR if the options have no merge
+// operator.
+func (db *lsmt) Merge(key, operand []byte) error {
+	batch := NewBatch()
+	batch.Merge(key, operand)
+	return db.WriteBatch(batch)
 }
 
 // Deletes a key/value pair.
 func (db *lsmt) Delete(key []byte) error {
-	if db.closed {
-		return common.ERR_LSMT_CLOSED
+	batch := NewBatch()
+	batch.Delete(key)
+	return db.WriteBatch(batch)
+}
+
+// Deletes a key/value pair which has been written only once. The tombstone is dropped
+// along with the pair as soon as the two meet in a flush rather than being carried down
+// to the last level. The result is undefined if the key was written more than once, or
+// written with Merge, since the last write was deleted.
+func (db *lsmt) SingleDelete(key []byte) error {
+	batch := NewBatch()
+	batch.SingleDelete(key)
+	return db.WriteBatch(batch)
+}
+
+// Deletes every key between start and end inclusive with a single range tombstone.
+func (db *lsmt) DeleteRange(start, end []byte) error {
+	batch := NewBatch()
+	batch.DeleteRange(start, end)
+	return db.WriteBatch(batch)
+}
+
+// Writes every record of a batch. If an error is returned then none of the batch's
+// records will have been written.
+func (db *lsmt) WriteBatch(batch *Batch) error {
+	for _, record := range batch.records {
+		err := db.validate(record)
+		if err != nil {
+			return err
+		}
 	}
-	if key == nil || len(key) == 0 {
-		return common.ERR_KEY_NIL_OR_EMPTY
+	if batch.Len() == 0 {
+		return nil
 	}
 
-	db.activeMemtable.Write(key, common.Tombstone)
-	db.checkFlush()
+	return db.commit(batch)
+}
 
+// Validates the key and, unless the record is a delete, the value of a record. Values
+// may be empty but must not be nil. The end of a range deletion is validated like a key
+// and must not be less than the start. The ttl of a pair which expires must be positive.
+func (db *lsmt) validate(record batchRecord) error {
+	if record.key == nil || len(record.key) == 0 {
+		return common.ERR_KEY_NIL_OR_EMPTY
+	}
+	if len(record.key) > db.options.KeyMaximumSize {
+		return common.ERR_KEY_TOO_LARGE
+	}
+	if record.recordType == common.RANGE_DELETE {
+		if record.end == nil || len(record.end) == 0 {
+			return common.ERR_END_NIL_OR_EMPTY
+		}
+		if len(record.end) > db.options.KeyMaximumSize {
+			return common.ERR_KEY_TOO_LARGE
+		}
+		if db.options.GetComparator().Compare(record.key, record.end) == c.GREATER_THAN {
+			return common.ERR_START_GREATER_THAN_END
+		}
+	}
+	if record.recordType == common.DELETE || record.recordType == common.SINGLE_DELETE ||
+		record.recordType == common.RANGE_DELETE {
+		return nil
+	}
+	if record.expires && record.ttl <= 0 {
+		return common.ERR_TTL_NOT_POSITIVE
+	}
+	if record.recordType == common.MERGE && db.options.MergeOperator == nil {
+		return common.ERR_NO_MERGE_OPERATOR
+	}
+	if record.value == nil {
+		return common.ERR_VAL_NIL
+	}
+	if len(record.value) > db.options.ValueMaximumSize {
+		return common.ERR_VAL_TOO_LARGE
+	}
 	return nil
 }
 
@@ -137,44 +267,108 @@ func (db *lsmt) Iterator(start, end []byte) (common.Iterator, error) {
 	if end == nil || len(end) == 0 {
 		return nil, common.ERR_END_NIL_OR_EMPTY
 	}
-	if c.Compare(start, end) != c.LESS_THAN {
+	if db.options.GetComparator().Compare(start, end) != c.LESS_THAN {
 		return nil, common.ERR_START_GREATER_THAN_END
 	}
+	return db.IteratorWithOptions(common.IterOptions{LowerBound: start, UpperBound: end})
+}
 
-	memtable := db.activeMemtable
-	inactive := db.inactiveMemtables
-	iters := make([]common.Iterator, 2+len(inactive))
-	iters[0] = memtable.Iterator(start, end)
-	for i, inactiveMt := range inactive {
-		iters[i+1] = inactiveMt.Iterator(start, end)
+// Creates an iterator which reads in accordance with the options provided. Either bound
+// may be left nil to iterate from the first key or up to the last key, and a reverse
+// iterator walks from the upper bound towards the lower bound. The limit applies to the
+// pairs returned after the memtables and ssts are merged. The iterator reads from the
+// version of the lsmt current when it was created and holds a reference to it until it
+// is closed, so flushes neither change what it sees nor remove the files it reads. The
+// keys and values of the pairs it returns may point into the memory mapping of an sst,
+// so they must not be modified and are only valid until the iterator is closed.
+func (db *lsmt) IteratorWithOptions(opts common.IterOptions) (common.Iterator, error) {
+	comparator := db.options.GetComparator()
+	if opts.LowerBound != nil && opts.UpperBound != nil && comparator.Compare(opts.LowerBound, opts.UpperBound) == c.GREATER_THAN {
+		return nil, common.ERR_BOUNDS_INVERTED
 	}
-	sstIter, err := db.sstManager.Iterator(start, end)
+	if opts.Limit < 0 {
+		return nil, common.ERR_NEGATIVE_LIMIT
+	}
+
+	current := db.acquireVersion()
+	if current == nil {
+		return nil, common.ERR_LSMT_CLOSED
+	}
+
+	unlimited := opts.Unlimited()
+	unlimited.Comparator = comparator
+	tables := current.memtables()
+	iters := make([]common.Iterator, len(tables)+1)
+	for i, table := range tables {
+		iters[i] = table.IteratorWithOptions(unlimited)
+	}
+	sstIter, err := current.sstManager.Iterator(unlimited)
 	if err != nil {
+		current.release()
 		return nil, err
 	}
 	iters[len(iters)-1] = sstIter
 
-	return common.NewMergedIterator(iters, false), nil
+	var iter common.Iterator = &versionIterator{Iterator: common.NewMergedIterator(iters, false, db.options.MergeOperator, db.options.Now(), comparator), version: current}
+	if opts.Reverse {
+		iter = common.NewReverseIterator(iter)
+	}
+	if opts.Limit > 0 {
+		iter = common.NewLimitIterator(iter, opts.Limit)
+	}
+	return iter, nil
+}
+
+// Returns the current metrics for the lsmt.
+func (db *lsmt) Metrics() Metrics {
+	current := db.acquireVersion()
+	if current == nil {
+		return Metrics{WriteStalls: db.stalls.stats()}
+	}
+	defer current.release()
+	return Metrics{
+		BlockCache:         current.sstManager.BlockCacheStats(),
+		Levels:             current.sstManager.LevelStats(),
+		ImmutableMemtables: len(current.inactiveMemtables),
+		Memtables:          memtableStats(current.memtables()),
+		WriteStalls:        db.stalls.stats(),
+	}
 }
 
-// Close the lsmt. Failure to call this function before exiting the process might result
-// data loss. All memtable will be force flushed to disk.
-// Once Close() is invoked all writes will fail.
+// Sums the sizes and counts of the memtables.
+func memtableStats(tables []mt.Memtable) MemtableStats {
+	stats := MemtableStats{}
+	for _, table := range tables {
+		stats.Bytes += table.Bytes()
+		stats.Entries += table.Entries()
+		stats.Tombstones += table.Tombstones()
+	}
+	return stats
+}
+
+// Close the lsmt. All memtable will be force flushed to disk and their write-ahead logs
+// removed. If the process exits without calling this function then the writes which
+// were not flushed are replayed from the logs the next time the lsmt is opened.
+// Once Close() is invoked all writes will fail. Iterators which are still open keep
+// reading the version they were created from.
 func (db *lsmt) Close() error {
-	db.closed = true
+	db.writeLock.Lock()
+	closing := db.closeWriters()
+	db.writeLock.Unlock()
+	if !closing {
+		return common.ERR_LSMT_CLOSED
+	}
 
 	log.Info().
 		Str(Lifecycle, "close").
 		Send()
 
-	for db.flushLock.IsLocked() {
-	}
+	// Wait for any running flush and prevent another from starting
+	db.flushLock.Lock()
+	db.wal.close()
 
-	tables := make([]*mt.Memtable, len(db.inactiveMemtables)+1)
-	tables[0] = db.activeMemtable
-	for i, inactive := range db.inactiveMemtables {
-		tables[i+1] = inactive
-	}
+	current := (*version)(atomic.LoadPointer(&db.version))
+	tables := current.memtables()
 
 	hasDataToFlush := false
 	for _, table := range tables {
@@ -186,61 +380,247 @@ func (db *lsmt) Close() error {
 
 	if hasDataToFlush {
 		log.Info().
-			Int64("active_memtable_bytes", db.activeMemtable.Bytes()).
+			Int64("active_memtable_bytes", current.activeMemtable.Bytes()).
 			Int64("maximum_memtable_bytes", db.options.MemtableMaximumSize).
-			Int("inactive_memtables", len(db.inactiveMemtables)).
+			Int("inactive_memtables", len(current.inactiveMemtables)).
 			Str(Action, "flush").
 			Msg("attempting to force flush memtables")
 
-		_, err := db.sstManager.Flush(tables)
+		// Every log is flushed, so the next lsmt replays none of them
+		newManager, err := current.sstManager.Flush(tables, db.logNumber+1)
 
 		if err != nil {
 			log.Error().
 				Err(err).
 				Str(Action, "flush").
 				Msg("failed to force flush on shutdown!")
+			current.release()
+			return err
 		}
 
-		return err
+		current.release()
+		db.removeLogs()
+		return newManager.Close()
 	}
 
-	return nil
+	db.removeLogs()
+	return current.release()
 }
 
-// Check to see if the active memtable is ready to be flushed to disk. If so,
-// asynchronously flush to disk.
-func (db *lsmt) checkFlush() {
-	activeMemtableBytes := db.activeMemtable.Bytes()
-	if (activeMemtableBytes > db.options.MemtableMaximumSize) && db.flushLock.TryLock() {
-		newTable := mt.NewMemtable()
-		unsafeActive := (*unsafe.Pointer)(unsafe.Pointer(&db.activeMemtable))
-		active := atomic.SwapPointer(unsafeActive, unsafe.Pointer(newTable))
-		db.inactiveMemtables = append(db.inactiveMemtables, (*mt.Memtable)(active))
+// Replays the write-ahead logs left by an lsmt which was not closed, oldest first and
+// each into its own memtable, and flushes the memtables. Logs numbered below the
+// manifest's log number were flushed before the lsmt stopped and are removed without
+// being replayed, since replaying merge operands twice would apply them twice. The logs
+// are removed once the flush has completed. Sets the number of the next log and returns
+// the sst manager holding the flushed writes.
+func (db *lsmt) recover(sstManager sst.SSTManager, flushedLogNumber int) (sst.SSTManager, error) {
+	db.logNumber = flushedLogNumber
+	found, err := logFiles(db.options.Path)
+	if err != nil {
+		return sstManager, err
+	}
+	logs := []logFile{}
+	for _, l := range found {
+		if l.number < flushedLogNumber {
+			removeLog(l.path)
+		} else {
+			logs = append(logs, l)
+		}
+	}
+	if len(logs) == 0 {
+		return sstManager, nil
+	}
+	db.logNumber = logs[len(logs)-1].number + 1
 
-		log.Info().
-			Int64("active_memtable_bytes", activeMemtableBytes).
-			Int64("maximum_memtable_bytes", db.options.MemtableMaximumSize).
-			Str(Action, "flush").
-			Msg("attempting to flush full memtable")
+	// Flush expects the memtables from newest to oldest
+	tables := make([]mt.Memtable, len(logs))
+	for i, l := range logs {
+		table := db.newMemtable()
+		err = db.replay(l.path, table)
+		if err != nil {
+			sstManager.Close()
+			return nil, err
+		}
+		tables[len(logs)-1-i] = table
+	}
 
-		go func() {
-			newManager, err := db.sstManager.Flush(db.inactiveMemtables)
-			if err == nil && newManager != nil {
-				db.inactiveMemtables = []*mt.Memtable{}
-				db.sstManager = newManager
-			}
+	log.Info().
+		Int("logs", len(logs)).
+		Str(Lifecycle, "recover").
+		Msg("flushing writes replayed from write-ahead logs")
+	newManager, err := sstManager.Flush(tables, db.logNumber)
+	sstManager.Close()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range logs {
+		removeLog(l.path)
+	}
+	return newManager, nil
+}
+
+// Removes the log of the active memtable and the logs of every retired memtable once
+// all of them have been flushed.
+func (db *lsmt) removeLogs() {
+	removeLog(db.wal.path)
+	for _, path := range db.retiredLogs {
+		removeLog(path)
+	}
+	db.retiredLogs = nil
+}
+
+// Removes a log whose writes have been flushed.
+func removeLog(path string) {
+	err := os.Remove(path)
+	if err != nil {
+		log.Warn().
+			Str("path", path).
+			Err(err).
+			Msg("failed to remove write-ahead log")
+	}
+}
 
-			if err != nil {
-				log.Error().
-					Str(Action, "flush").
-					Err(err).
-					Send()
+// Check to see if the active memtable is ready to be flushed to disk. If so, publish a
+// version in which the active memtable is retired in favour of a new one, and start a
+// flush unless one is already running. A running flush picks up memtables retired
+// while it runs. If the maximum number of immutable memtables has been reached then
+// the caller waits for a flush to complete before the memtable is retired. Must be
+// invoked while holding the write lock.
+func (db *lsmt) checkFlush(active mt.Memtable) {
+	activeMemtableBytes := active.Bytes()
+	if activeMemtableBytes <= db.options.MemtableMaximumSize {
+		return
+	}
+
+	current := (*version)(atomic.LoadPointer(&db.version))
+	if db.queueFull(current) {
+		start := time.Now()
+		atomic.AddUint64(&db.stalls.stops, 1)
+		log.Warn().
+			Int("maximum_immutable_memtables", db.options.MaximumImmutableMemtables).
+			Str(Action, "stall").
+			Msg("waiting for a flush before retiring full memtable")
+		for db.queueFull(current) {
+			if db.flushLock.TryLock() {
+				go db.flushInactive()
 			}
+			db.flushed.Wait()
+			current = (*version)(atomic.LoadPointer(&db.version))
+		}
+		atomic.AddInt64(&db.stalls.stallTime, int64(time.Since(start)))
+	}
+
+	sstManager, err := current.sstManager.Acquire()
+	if err != nil {
+		log.Error().
+			Str(Action, "flush").
+			Err(err).
+			Msg("failed to acquire the current sst manager")
+		return
+	}
+	// The full memtable keeps being written to, along with its log, until a log can be
+	// created for the new memtable
+	wal, err := newWriteAheadLog(db.options.Path, db.logNumber+1)
+	if err != nil {
+		log.Error().
+			Str(Action, "flush").
+			Err(err).
+			Msg("failed to create a write-ahead log for a new memtable")
+		sstManager.Close()
+		return
+	}
+	db.wal.close()
+	db.retiredLogs = append([]string{db.wal.path}, db.retiredLogs...)
+	db.wal = wal
+	db.logNumber++
+	inactive := append([]mt.Memtable{current.activeMemtable}, current.inactiveMemtables...)
+	db.installVersion(newVersion(db.newMemtable(), inactive, sstManager))
+
+	log.Info().
+		Int64("active_memtable_bytes", activeMemtableBytes).
+		Int64("maximum_memtable_bytes", db.options.MemtableMaximumSize).
+		Int("inactive_memtables", len(inactive)).
+		Str(Action, "flush").
+		Msg("retiring full memtable")
+
+	if db.flushLock.TryLock() {
+		go db.flushInactive()
+	}
+}
+
+// Flushes the inactive memtables one at a time, oldest first, until there are none
+// left. A version with the new sst manager is published after each flush which removes
+// only the memtable that was flushed, since more may have been retired while it ran.
+// Must be invoked while holding the flush lock, which is released once there is nothing
+// left to flush or a flush fails.
+func (db *lsmt) flushInactive() {
+	for {
+		db.writeLock.Lock()
+		flushing := (*version)(atomic.LoadPointer(&db.version))
+		if len(flushing.inactiveMemtables) == 0 || !flushing.acquire() {
+			db.releaseFlushLock()
+			db.writeLock.Unlock()
+			return
+		}
+		// The active memtable's log is numbered logNumber and each inactive memtable's
+		// log one below the next newer, so the log after the oldest's is the oldest left
+		// unflushed
+		logNumber := db.logNumber - len(flushing.inactiveMemtables) + 1
+		db.writeLock.Unlock()
 
-			db.flushLock.Unlock()
-			log.Info().
+		log.Info().
+			Int("inactive_memtables", len(flushing.inactiveMemtables)).
+			Str(Action, "flush").
+			Msg("attempting to flush oldest inactive memtable")
+
+		oldest := flushing.inactiveMemtables[len(flushing.inactiveMemtables)-1]
+		newManager, err := flushing.sstManager.Flush([]mt.Memtable{oldest}, logNumber)
+		flushing.release()
+
+		db.writeLock.Lock()
+		if err != nil {
+			log.Error().
 				Str(Action, "flush").
-				Msg("releasing flush lock")
-		}()
+				Err(err).
+				Send()
+			db.releaseFlushLock()
+			db.writeLock.Unlock()
+			return
+		}
+		current := (*version)(atomic.LoadPointer(&db.version))
+		remaining := current.inactiveMemtables[:len(current.inactiveMemtables)-1]
+		db.installVersion(newVersion(current.activeMemtable, remaining, newManager))
+		// Logs beyond the memtables still awaiting flush belong to flushed memtables
+		for len(db.retiredLogs) > len(remaining) {
+			removeLog(db.retiredLogs[len(db.retiredLogs)-1])
+			db.retiredLogs = db.retiredLogs[:len(db.retiredLogs)-1]
+		}
+		db.flushed.Broadcast()
+		db.writeLock.Unlock()
 	}
 }
+
+// Creates a new memtable of the configured type which orders keys by the configured
+// comparator.
+func (db *lsmt) newMemtable() mt.Memtable {
+	if db.options.MemtableType == config.SkiplistMemtable {
+		return mt.NewSkiplistMemtableWithComparator(db.options.GetComparator())
+	}
+	return mt.NewTreeMemtableWithComparator(db.options.GetComparator())
+}
+
+// Returns whether the version holds the maximum number of immutable memtables.
+func (db *lsmt) queueFull(current *version) bool {
+	maximum := db.options.MaximumImmutableMemtables
+	return maximum > 0 && len(current.inactiveMemtables) >= maximum
+}
+
+// Releases the flush lock and wakes writers stalled on the running flush. Must be
+// invoked while holding the write lock.
+func (db *lsmt) releaseFlushLock() {
+	db.flushLock.Unlock()
+	db.flushed.Broadcast()
+	log.Info().
+		Str(Action, "flush").
+		Msg("releasing flush lock")
+}
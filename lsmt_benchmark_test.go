@@ -0,0 +1,40 @@
+package lsmt
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/patrickgombert/lsmt/common"
+	"github.com/patrickgombert/lsmt/config"
+)
+
+// Measures write throughput as the number of concurrent writers grows. Concurrent
+// writers are committed in groups, so throughput should not fall as writers are added.
+func BenchmarkConcurrentWriters(b *testing.B) {
+	benchSink := &config.Sink{BlockSize: 4096, SSTSize: 1048576, BlockCacheShards: 1, BlockCacheSize: 1048576, BloomFilterSize: 1000}
+	benchOptions := &config.Options{Levels: common.EMPTY_LEVELS, Sink: benchSink, KeyMaximumSize: 16, ValueMaximumSize: 16, MemtableMaximumSize: 1048576, Path: common.TEST_DIR}
+
+	for _, writers := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(strconv.Itoa(writers)+"_writers", func(b *testing.B) {
+			common.SetUp(b)
+			defer common.TearDown(b)
+			lsmt, _ := Lsmt(benchOptions)
+			defer lsmt.Close()
+
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					value := []byte{byte(w)}
+					for i := w; i < b.N; i += writers {
+						lsmt.Write([]byte{byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)}, value)
+					}
+				}(w)
+			}
+			wg.Wait()
+		})
+	}
+}
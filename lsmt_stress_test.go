@@ -0,0 +1,208 @@
+package lsmt
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/patrickgombert/lsmt/common"
+	c "github.com/patrickgombert/lsmt/comparator"
+	"github.com/patrickgombert/lsmt/config"
+)
+
+// The stress tests exercise the engine from many goroutines at once and are intended to
+// be run with the race detector enabled. make test runs them again under -race after the
+// full suite, and make test-race runs every test under -race.
+
+const (
+	stressWriters = 8
+	stressKeys    = 200
+)
+
+func TestStressConcurrentWriters(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	var wg sync.WaitGroup
+	for w := 0; w < stressWriters; w++ {
+		wg.Add(1)
+		go func(w byte) {
+			defer wg.Done()
+			for i := 0; i < stressKeys; i++ {
+				err := lsmt.Write([]byte{w, byte(i)}, []byte{byte(i)})
+				if err != nil {
+					t.Errorf("Expected Write to succeed, but got %v", err)
+				}
+			}
+		}(byte(w))
+	}
+	wg.Wait()
+	compareStressKeys(lsmt, t)
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(options)
+	defer lsmt.Close()
+	compareStressKeys(lsmt, t)
+}
+
+func TestStressConcurrentWritersWithSkiplistMemtable(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	skiplistOptions := *options
+	skiplistOptions.MemtableType = config.SkiplistMemtable
+	lsmt, _ := Lsmt(&skiplistOptions)
+	var wg sync.WaitGroup
+	for w := 0; w < stressWriters; w++ {
+		wg.Add(1)
+		go func(w byte) {
+			defer wg.Done()
+			for i := 0; i < stressKeys; i++ {
+				lsmt.Write([]byte{w, byte(i)}, []byte{byte(i)})
+				if i%20 == 0 {
+					compareIteratorOrdered(lsmt, t)
+				}
+			}
+		}(byte(w))
+	}
+	wg.Wait()
+	compareStressKeys(lsmt, t)
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(&skiplistOptions)
+	defer lsmt.Close()
+	compareStressKeys(lsmt, t)
+}
+
+func TestStressReadersDuringWrites(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	defer lsmt.Close()
+
+	var writers sync.WaitGroup
+	for w := 0; w < stressWriters; w++ {
+		writers.Add(1)
+		go func(w byte) {
+			defer writers.Done()
+			for i := 0; i < stressKeys; i++ {
+				lsmt.Write([]byte{w, byte(i)}, []byte{byte(i)})
+				if i%3 == 0 {
+					lsmt.Delete([]byte{w, byte(i)})
+				}
+			}
+		}(byte(w))
+	}
+
+	done := make(chan bool)
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				value, err := lsmt.Get([]byte{0, 1})
+				if err != nil || (value != nil && c.Compare(value, []byte{1}) != c.EQUAL) {
+					t.Errorf("Expected Get() to produce nil or %q, but got %q, %v", []byte{1}, value, err)
+				}
+				compareIteratorOrdered(lsmt, t)
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	for w := byte(0); w < stressWriters; w++ {
+		for i := 0; i < stressKeys; i++ {
+			value, _ := lsmt.Get([]byte{w, byte(i)})
+			if i%3 == 0 && value != nil {
+				t.Errorf("Expected deleted key %q to produce nil, but got %q", []byte{w, byte(i)}, value)
+			}
+			if i%3 != 0 && c.Compare(value, []byte{byte(i)}) != c.EQUAL {
+				t.Errorf("Expected key %q to produce %q, but got %q", []byte{w, byte(i)}, []byte{byte(i)}, value)
+			}
+		}
+	}
+}
+
+func TestStressWritesDuringClose(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	written := make([][]int, stressWriters)
+	var wg sync.WaitGroup
+	for w := 0; w < stressWriters; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < stressKeys; i++ {
+				err := lsmt.Write([]byte{byte(w), byte(i)}, []byte{byte(i)})
+				if err == common.ERR_LSMT_CLOSED {
+					return
+				}
+				written[w] = append(written[w], i)
+			}
+		}(w)
+	}
+	lsmt.Close()
+	wg.Wait()
+
+	lsmt, _ = Lsmt(options)
+	defer lsmt.Close()
+	for w, keys := range written {
+		for _, i := range keys {
+			value, _ := lsmt.Get([]byte{byte(w), byte(i)})
+			if c.Compare(value, []byte{byte(i)}) != c.EQUAL {
+				t.Errorf("Expected written key %q to survive Close, but got %q", []byte{byte(w), byte(i)}, value)
+			}
+		}
+	}
+}
+
+// Checks that every key written by the stress writers is present.
+func compareStressKeys(lsmt *lsmt, t *testing.T) {
+	for w := byte(0); w < stressWriters; w++ {
+		for i := 0; i < stressKeys; i++ {
+			value, err := lsmt.Get([]byte{w, byte(i)})
+			if err != nil || c.Compare(value, []byte{byte(i)}) != c.EQUAL {
+				t.Errorf("Expected key %q to produce %q, but got %q, %v", []byte{w, byte(i)}, []byte{byte(i)}, value, err)
+			}
+		}
+	}
+}
+
+// Checks that an iterator over the whole keyspace produces strictly ascending keys.
+func compareIteratorOrdered(lsmt *lsmt, t *testing.T) {
+	iter, err := lsmt.IteratorWithOptions(common.IterOptions{})
+	if err != nil {
+		t.Errorf("Expected IteratorWithOptions() to succeed, but got %v", err)
+		return
+	}
+	defer iter.Close()
+
+	var previous []byte
+	for {
+		next, err := iter.Next()
+		if err != nil {
+			t.Errorf("Expected Next() to succeed, but got %v", err)
+			return
+		}
+		if !next {
+			return
+		}
+		pair, _ := iter.Get()
+		if previous != nil && c.Compare(previous, pair.Key) != c.LESS_THAN {
+			t.Errorf("Expected %q to follow %q, but did not", pair.Key, previous)
+		}
+		previous = pair.Key
+	}
+}
@@ -1,11 +1,19 @@
 package lsmt
 
 import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/patrickgombert/lsmt/common"
 	c "github.com/patrickgombert/lsmt/comparator"
 	"github.com/patrickgombert/lsmt/config"
+	mt "github.com/patrickgombert/lsmt/memtable"
+	"github.com/patrickgombert/lsmt/sst"
 )
 
 var sink *config.Sink = &config.Sink{BlockSize: 100, SSTSize: 1000, BlockCacheShards: 1, BlockCacheSize: 1000, BloomFilterSize: 1000}
@@ -31,22 +39,34 @@ func TestWriteNilOrEmptyKeyReturnsError(t *testing.T) {
 	}
 }
 
-func TestWriteNilOrEmptyValueReturnsError(t *testing.T) {
+func TestWriteNilValueReturnsError(t *testing.T) {
 	common.SetUp(t)
 	defer common.TearDown(t)
 
 	lsmt, _ := Lsmt(options)
 	defer lsmt.Close()
 	err := lsmt.Write([]byte{0}, nil)
-	if err == nil {
-		t.Error("Expected lsmt to error when writing nil value, but did not")
-	}
-	err = lsmt.Write([]byte{0}, []byte{})
-	if err == nil {
-		t.Error("Expected lsmt to error when writing empty value, but did not")
+	if err != common.ERR_VAL_NIL {
+		t.Errorf("Expected %v but got %v", common.ERR_VAL_NIL, err)
 	}
 }
 
+func TestWriteEmptyValueIsNotADelete(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	lsmt.Write([]byte{1}, []byte{})
+	lsmt.Write([]byte{2}, []byte{2})
+	lsmt.Delete([]byte{2})
+	compareEmptyValue(lsmt, t)
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(options)
+	defer lsmt.Close()
+	compareEmptyValue(lsmt, t)
+}
+
 func TestDeleteNilOrEmptyKeyReturnsError(t *testing.T) {
 	common.SetUp(t)
 	defer common.TearDown(t)
@@ -168,6 +188,963 @@ func TestFlushWithExistingLevel(t *testing.T) {
 	}
 }
 
+func TestMetricsReportsBlockCache(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	lsmt.Write([]byte{1}, []byte{1})
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(options)
+	defer lsmt.Close()
+	lsmt.Get([]byte{1})
+	lsmt.Get([]byte{1})
+
+	// Each Get reads the sst's filter block and then its data block
+	metrics := lsmt.Metrics()
+	if metrics.BlockCache.Misses != 2 || metrics.BlockCache.Hits != 2 {
+		t.Errorf("Expected block cache to have 2 misses and 2 hits, but got %d misses and %d hits", metrics.BlockCache.Misses, metrics.BlockCache.Hits)
+	}
+	if metrics.BlockCache.Entries != 2 {
+		t.Errorf("Expected block cache to hold 2 entries, but held %d", metrics.BlockCache.Entries)
+	}
+}
+
+func TestReverseIterator(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	for i := byte(1); i <= 4; i++ {
+		lsmt.Write([]byte{i}, []byte{i})
+	}
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(options)
+	defer lsmt.Close()
+	lsmt.Write([]byte{5}, []byte{5})
+	lsmt.Delete([]byte{3})
+
+	iter, _ := lsmt.IteratorWithOptions(common.IterOptions{LowerBound: []byte{1}, UpperBound: []byte{9}, Reverse: true})
+	defer iter.Close()
+	found, _ := iter.SeekForPrev([]byte{4})
+	if !found {
+		t.Error("Expected SeekForPrev() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{4}, []byte{4}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{1}, []byte{1}, t)
+	common.CompareNext(iter, false, t)
+
+	found, _ = iter.SeekToLast()
+	if !found {
+		t.Error("Expected SeekToLast() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{5}, []byte{5}, t)
+}
+
+func TestReverseBytewiseComparatorOrdersKeysBeforeAndAfterFlush(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	reversed := *options
+	reversed.Comparator = c.ReverseBytewiseComparator{}
+	lsmt, _ := Lsmt(&reversed)
+	lsmt.Write([]byte{1}, []byte{1})
+	lsmt.Write([]byte{3}, []byte{3})
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(&reversed)
+	defer lsmt.Close()
+	lsmt.Write([]byte{2}, []byte{2})
+	lsmt.Write([]byte{4}, []byte{4})
+
+	// Bounds are ordered by the comparator, so the lower bound is the greatest key
+	iter, err := lsmt.Iterator([]byte{9}, []byte{0})
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	defer iter.Close()
+	for i := byte(4); i >= 1; i-- {
+		common.CompareNext(iter, true, t)
+		common.CompareGet(iter, []byte{i}, []byte{i}, t)
+	}
+	common.CompareNext(iter, false, t)
+
+	result, _ := lsmt.Get([]byte{3})
+	if c.Compare(result, []byte{3}) != c.EQUAL {
+		t.Errorf("Expected lsmt to contain %q, but did not", []byte{3})
+	}
+}
+
+func TestOpeningWithMismatchedComparatorReturnsError(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	reversed := *options
+	reversed.Comparator = c.ReverseBytewiseComparator{}
+	lsmt, _ := Lsmt(&reversed)
+	lsmt.Write([]byte{1}, []byte{1})
+	lsmt.Close()
+
+	_, errs := Lsmt(options)
+	if len(errs) != 1 || errs[0] != common.ERR_COMPARATOR_MISMATCH {
+		t.Errorf("Expected opening with a different comparator to return %q, but got %q", common.ERR_COMPARATOR_MISMATCH, errs)
+	}
+}
+
+func TestIteratorSeekPaginates(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	defer lsmt.Close()
+	for i := byte(1); i <= 6; i++ {
+		lsmt.Write([]byte{i}, []byte{i})
+	}
+
+	iter, _ := lsmt.Iterator([]byte{1}, []byte{9})
+	defer iter.Close()
+	found, _ := iter.Seek([]byte{3})
+	if !found {
+		t.Error("Expected Seek() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{4}, []byte{4}, t)
+
+	found, _ = iter.Seek([]byte{6})
+	if !found {
+		t.Error("Expected Seek() to reposition the iterator, but did not")
+	}
+	common.CompareGet(iter, []byte{6}, []byte{6}, t)
+	common.CompareNext(iter, false, t)
+	if iter.Valid() {
+		t.Error("Expected exhausted iterator to not be valid, but was")
+	}
+}
+
+func TestIteratorWithOptionsOpenEndedAndLimited(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	for i := byte(1); i <= 3; i++ {
+		lsmt.Write([]byte{i}, []byte{i})
+	}
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(options)
+	defer lsmt.Close()
+	lsmt.Write([]byte{4}, []byte{4})
+	lsmt.Write([]byte{5}, []byte{5})
+	lsmt.Delete([]byte{2})
+
+	iter, _ := lsmt.IteratorWithOptions(common.IterOptions{LowerBound: []byte{1}, ExcludeLowerBound: true, Limit: 2})
+	defer iter.Close()
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{4}, []byte{4}, t)
+	common.CompareNext(iter, false, t)
+
+	found, _ := iter.Seek([]byte{5})
+	if !found {
+		t.Error("Expected Seek() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{5}, []byte{5}, t)
+	common.CompareNext(iter, false, t)
+}
+
+func TestIteratorWithOptionsInvertedBoundsReturnsError(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	defer lsmt.Close()
+
+	_, err := lsmt.IteratorWithOptions(common.IterOptions{LowerBound: []byte{2}, UpperBound: []byte{1}})
+	if err != common.ERR_BOUNDS_INVERTED {
+		t.Errorf("Expected %v but got %v", common.ERR_BOUNDS_INVERTED, err)
+	}
+	_, err = lsmt.IteratorWithOptions(common.IterOptions{Limit: -1})
+	if err != common.ERR_NEGATIVE_LIMIT {
+		t.Errorf("Expected %v but got %v", common.ERR_NEGATIVE_LIMIT, err)
+	}
+}
+
+func TestIteratorSurvivesFlush(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	for i := byte(1); i <= 3; i++ {
+		lsmt.Write([]byte{i}, []byte{i})
+	}
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(options)
+	defer lsmt.Close()
+	// Write-ahead logs are removed as soon as their memtable is flushed, so only the
+	// ssts are expected to outlive the flush
+	files := []os.DirEntry{}
+	entries, _ := os.ReadDir(common.TEST_DIR)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".sst") {
+			files = append(files, entry)
+		}
+	}
+
+	iter, _ := lsmt.Iterator([]byte{1}, []byte{9})
+	value := make([]byte, 10)
+	for i := byte(0); i < 100; i++ {
+		lsmt.Write([]byte{9, i}, value)
+	}
+	for lsmt.flushLock.IsLocked() {
+	}
+
+	for _, f := range files {
+		_, err := os.Stat(common.TEST_DIR + f.Name())
+		if err != nil {
+			t.Errorf("Expected %s to remain while an iterator reads it, but got %v", f.Name(), err)
+		}
+	}
+	for i := byte(1); i <= 3; i++ {
+		common.CompareNext(iter, true, t)
+		common.CompareGet(iter, []byte{i}, []byte{i}, t)
+	}
+	common.CompareNext(iter, false, t)
+	iter.Close()
+
+	removed := 0
+	for _, f := range files {
+		_, err := os.Stat(common.TEST_DIR + f.Name())
+		if os.IsNotExist(err) {
+			removed++
+		}
+	}
+	if removed != 1 {
+		t.Errorf("Expected the flushed over sst to be removed once released, but %d files were removed", removed)
+	}
+}
+
+func TestMetricsReportMemtableEntriesAndTombstones(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	defer lsmt.Close()
+	lsmt.Write([]byte{1}, []byte{1})
+	lsmt.Write([]byte{2}, []byte{2})
+	lsmt.Delete([]byte{1})
+
+	stats := lsmt.Metrics().Memtables
+	if stats.Entries != 2 || stats.Tombstones != 1 {
+		t.Errorf("Expected 2 entries and 1 tombstone, but got %d and %d", stats.Entries, stats.Tombstones)
+	}
+	if stats.Bytes <= 4 {
+		t.Errorf("Expected the memtable bytes to include entry overhead, but got %d", stats.Bytes)
+	}
+}
+
+func TestDeleteRangeHidesKeysBeforeAndAfterFlush(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	for i := byte(1); i <= 3; i++ {
+		lsmt.Write([]byte{i}, []byte{i})
+	}
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(options)
+	for i := byte(4); i <= 6; i++ {
+		lsmt.Write([]byte{i}, []byte{i})
+	}
+	lsmt.DeleteRange([]byte{2}, []byte{5})
+	lsmt.Write([]byte{4}, []byte{9})
+	compareDeletedRange(lsmt, t)
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(options)
+	defer lsmt.Close()
+	compareDeletedRange(lsmt, t)
+}
+
+func TestDeleteRangeInvalidBoundsReturnsError(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	defer lsmt.Close()
+	err := lsmt.DeleteRange([]byte{2}, []byte{1})
+	if err != common.ERR_START_GREATER_THAN_END {
+		t.Errorf("Expected %v but got %v", common.ERR_START_GREATER_THAN_END, err)
+	}
+	err = lsmt.DeleteRange([]byte{1}, []byte{})
+	if err != common.ERR_END_NIL_OR_EMPTY {
+		t.Errorf("Expected %v but got %v", common.ERR_END_NIL_OR_EMPTY, err)
+	}
+}
+
+// Checks that the key holds the unsigned 64 bit integer.
+func compareUInt64(db *lsmt, key []byte, expected uint64, t *testing.T) {
+	value, err := db.Get(key)
+	if err != nil || c.Compare(value, uint64Bytes(expected)) != c.EQUAL {
+		t.Errorf("Expected key %q to hold %d, but got %q and error %v", key, expected, value, err)
+	}
+}
+
+func uint64Bytes(i uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, i)
+	return b
+}
+
+// Checks that key 1 holds an empty value and key 2 was deleted.
+func compareEmptyValue(db *lsmt, t *testing.T) {
+	value, _ := db.Get([]byte{1})
+	if value == nil || len(value) != 0 {
+		t.Errorf("Expected an empty value, but got %q", value)
+	}
+	value, _ = db.Get([]byte{2})
+	if value != nil {
+		t.Errorf("Expected deleted key to produce nil, but got %q", value)
+	}
+
+	iter, _ := db.Iterator([]byte{1}, []byte{9})
+	defer iter.Close()
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{1}, []byte{}, t)
+	common.CompareNext(iter, false, t)
+}
+
+// Checks that keys 2, 3 and 5 were range deleted and key 4 was rewritten afterwards.
+func compareDeletedRange(db *lsmt, t *testing.T) {
+	expected := map[byte][]byte{1: {1}, 2: nil, 3: nil, 4: {9}, 5: nil, 6: {6}}
+	for key, value := range expected {
+		result, _ := db.Get([]byte{key})
+		if c.Compare(result, value) != c.EQUAL {
+			t.Errorf("Expected key %q to produce %q, but got %q", []byte{key}, value, result)
+		}
+	}
+
+	iter, _ := db.Iterator([]byte{1}, []byte{9})
+	defer iter.Close()
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{1}, []byte{1}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{4}, []byte{9}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{6}, []byte{6}, t)
+	common.CompareNext(iter, false, t)
+}
+
+func TestSingleDeleteHidesKeyBeforeAndAfterFlush(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	lsmt.Write([]byte{1}, []byte{1})
+	lsmt.Write([]byte{2}, []byte{2})
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(options)
+	err := lsmt.SingleDelete([]byte{1})
+	if err != nil {
+		t.Errorf("Expected single delete to succeed, but got %v", err)
+	}
+	compareSingleDeleted(lsmt, t)
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(options)
+	defer lsmt.Close()
+	compareSingleDeleted(lsmt, t)
+}
+
+// Checks that key 1 was single deleted from keys 1 and 2.
+func compareSingleDeleted(db *lsmt, t *testing.T) {
+	result, _ := db.Get([]byte{1})
+	if result != nil {
+		t.Errorf("Expected single deleted key to produce nil, but got %q", result)
+	}
+	result, _ = db.Get([]byte{2})
+	if c.Compare(result, []byte{2}) != c.EQUAL {
+		t.Errorf("Expected key %q to produce %q, but got %q", []byte{2}, []byte{2}, result)
+	}
+
+	iter, _ := db.Iterator([]byte{1}, []byte{9})
+	defer iter.Close()
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.CompareNext(iter, false, t)
+}
+
+// A clock which only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func TestWriteWithTTLExpiresBeforeAndAfterFlush(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	clock := &fakeClock{now: time.Unix(100, 0)}
+	expiring := *options
+	expiring.Clock = clock
+	lsmt, _ := Lsmt(&expiring)
+	lsmt.Write([]byte{1}, []byte{1})
+	lsmt.WriteWithTTL([]byte{1}, []byte{2}, time.Minute)
+	lsmt.WriteWithTTL([]byte{2}, []byte{2}, time.Hour)
+	compareExpiring(lsmt, []byte{1}, []byte{2}, t)
+
+	clock.now = clock.now.Add(time.Minute)
+	compareExpiring(lsmt, []byte{1}, nil, t)
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(&expiring)
+	defer lsmt.Close()
+	compareExpiring(lsmt, []byte{1}, nil, t)
+	compareExpiring(lsmt, []byte{2}, []byte{2}, t)
+
+	clock.now = clock.now.Add(time.Hour)
+	compareExpiring(lsmt, []byte{2}, nil, t)
+	iter, _ := lsmt.Iterator([]byte{1}, []byte{9})
+	defer iter.Close()
+	common.CompareNext(iter, false, t)
+}
+
+// Checks that Get produces the value for key, or nil if the key has expired.
+func compareExpiring(db *lsmt, key, value []byte, t *testing.T) {
+	result, _ := db.Get(key)
+	if c.Compare(result, value) != c.EQUAL || (value == nil && result != nil) {
+		t.Errorf("Expected key %q to produce %q, but got %q", key, value, result)
+	}
+}
+
+func TestWriteWithTTLNotPositiveReturnsError(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	defer lsmt.Close()
+	err := lsmt.WriteWithTTL([]byte{1}, []byte{1}, 0)
+	if err != common.ERR_TTL_NOT_POSITIVE {
+		t.Errorf("Expected %v but got %v", common.ERR_TTL_NOT_POSITIVE, err)
+	}
+}
+
+func TestMergeWithoutMergeOperatorReturnsError(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	defer lsmt.Close()
+	err := lsmt.Merge([]byte{1}, []byte{1})
+	if err != common.ERR_NO_MERGE_OPERATOR {
+		t.Errorf("Expected %v but got %v", common.ERR_NO_MERGE_OPERATOR, err)
+	}
+}
+
+func TestMergeResolvesAcrossFlushes(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	merging := *options
+	merging.MergeOperator = config.UInt64AddOperator{}
+	lsmt, _ := Lsmt(&merging)
+	lsmt.Write([]byte{1}, uint64Bytes(10))
+	lsmt.Merge([]byte{1}, uint64Bytes(1))
+	lsmt.Merge([]byte{2}, uint64Bytes(2))
+	lsmt.Merge([]byte{2}, uint64Bytes(3))
+	compareUInt64(lsmt, []byte{1}, 11, t)
+	compareUInt64(lsmt, []byte{2}, 5, t)
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(&merging)
+	lsmt.Merge([]byte{1}, uint64Bytes(1))
+	lsmt.Merge([]byte{2}, uint64Bytes(1))
+	lsmt.Delete([]byte{3})
+	lsmt.Merge([]byte{3}, uint64Bytes(7))
+	compareUInt64(lsmt, []byte{1}, 12, t)
+	compareUInt64(lsmt, []byte{2}, 6, t)
+	compareUInt64(lsmt, []byte{3}, 7, t)
+
+	iter, _ := lsmt.Iterator([]byte{1}, []byte{3})
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{1}, uint64Bytes(12), t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, uint64Bytes(6), t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{3}, uint64Bytes(7), t)
+	common.CompareNext(iter, false, t)
+	iter.Close()
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(&merging)
+	defer lsmt.Close()
+	lsmt.DeleteRange([]byte{1}, []byte{2})
+	lsmt.Merge([]byte{2}, uint64Bytes(1))
+	compareUInt64(lsmt, []byte{3}, 7, t)
+	compareUInt64(lsmt, []byte{2}, 1, t)
+	value, _ := lsmt.Get([]byte{1})
+	if value != nil {
+		t.Errorf("Expected range deleted key to produce nil, but got %q", value)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	defer lsmt.Close()
+	lsmt.Write([]byte{3}, []byte{3})
+
+	batch := NewBatch()
+	batch.Write([]byte{1}, []byte{1})
+	batch.Write([]byte{2}, []byte{2})
+	batch.Write([]byte{1}, []byte{9})
+	batch.Delete([]byte{3})
+	err := lsmt.WriteBatch(batch)
+	if err != nil {
+		t.Errorf("Expected WriteBatch to succeed, but got %v", err)
+	}
+
+	value, _ := lsmt.Get([]byte{1})
+	if c.Compare(value, []byte{9}) != c.EQUAL {
+		t.Errorf("Expected the later record for a key to win, but got %q", value)
+	}
+	value, _ = lsmt.Get([]byte{2})
+	if c.Compare(value, []byte{2}) != c.EQUAL {
+		t.Errorf("Expected %q but got %q", []byte{2}, value)
+	}
+	value, _ = lsmt.Get([]byte{3})
+	if value != nil {
+		t.Errorf("Expected deleted key to produce nil, but got %q", value)
+	}
+}
+
+func TestWritesAreRecoveredFromLogs(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	merging := *options
+	merging.MergeOperator = config.UInt64AddOperator{}
+	lsmt, _ := Lsmt(&merging)
+	lsmt.Write([]byte{1}, uint64Bytes(10))
+	lsmt.Merge([]byte{1}, uint64Bytes(1))
+	lsmt.Write([]byte{2}, []byte{2})
+	lsmt.Write([]byte{3}, []byte{3})
+	lsmt.Delete([]byte{2})
+	lsmt.DeleteRange([]byte{3}, []byte{4})
+	lsmt.Write([]byte{5}, []byte{5})
+	// Stop without closing, leaving the writes in the log alone
+	lsmt.wal.close()
+
+	recovered, errs := Lsmt(&merging)
+	if errs != nil {
+		t.Fatalf("Expected no errors recovering the lsmt, but got %v", errs)
+	}
+	defer recovered.Close()
+	compareUInt64(recovered, []byte{1}, 11, t)
+	for _, key := range []byte{2, 3} {
+		value, _ := recovered.Get([]byte{key})
+		if value != nil {
+			t.Errorf("Expected deleted key %q to produce nil, but got %q", []byte{key}, value)
+		}
+	}
+	value, _ := recovered.Get([]byte{5})
+	if c.Compare(value, []byte{5}) != c.EQUAL {
+		t.Errorf("Expected %q but got %q", []byte{5}, value)
+	}
+	if recovered.Metrics().Memtables.Entries != 0 {
+		t.Errorf("Expected recovered writes to be flushed, but got %d memtable entries", recovered.Metrics().Memtables.Entries)
+	}
+}
+
+func TestRecoveringMergesWithoutOperatorFails(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	merging := *options
+	merging.MergeOperator = config.UInt64AddOperator{}
+	lsmt, _ := Lsmt(&merging)
+	lsmt.Merge([]byte{1}, uint64Bytes(1))
+	lsmt.Merge([]byte{1}, uint64Bytes(2))
+	// Stop without closing, leaving the merges in the log alone
+	lsmt.wal.close()
+
+	_, errs := Lsmt(options)
+	if len(errs) != 1 || errs[0] != common.ERR_NO_MERGE_OPERATOR {
+		t.Errorf("Expected %v recovering merges without a merge operator, but got %v", common.ERR_NO_MERGE_OPERATOR, errs)
+	}
+}
+
+func TestFlushedLogsAreNotReplayed(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	merging := *options
+	merging.MergeOperator = config.UInt64AddOperator{}
+	lsmt, _ := Lsmt(&merging)
+	lsmt.Merge([]byte{1}, uint64Bytes(1))
+	lsmt.Merge([]byte{1}, uint64Bytes(2))
+	path := lsmt.wal.path
+	logged, _ := ioutil.ReadFile(path)
+	lsmt.Close()
+	// Stopping after the manifest is written but before the log is removed leaves the
+	// flushed log behind
+	ioutil.WriteFile(path, logged, 0644)
+
+	recovered, errs := Lsmt(&merging)
+	if errs != nil {
+		t.Fatalf("Expected no errors recovering the lsmt, but got %v", errs)
+	}
+	defer recovered.Close()
+	compareUInt64(recovered, []byte{1}, 3, t)
+	logs, _ := logFiles(common.TEST_DIR)
+	for _, l := range logs {
+		if l.path == path {
+			t.Errorf("Expected the flushed log %s to be removed, but it was not", path)
+		}
+	}
+}
+
+func TestIncompleteLogWriteIsIgnored(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	lsmt.Write([]byte{1}, []byte{1})
+	lsmt.wal.close()
+	// A frame whose header promises more bytes than were written before stopping
+	f, _ := os.OpenFile(lsmt.wal.path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{0, 0, 0, 99, 1, 2, 3, 4, 5})
+	f.Close()
+
+	recovered, errs := Lsmt(options)
+	if errs != nil {
+		t.Fatalf("Expected no errors recovering the lsmt, but got %v", errs)
+	}
+	defer recovered.Close()
+	value, _ := recovered.Get([]byte{1})
+	if c.Compare(value, []byte{1}) != c.EQUAL {
+		t.Errorf("Expected %q but got %q", []byte{1}, value)
+	}
+}
+
+func TestFailedLogAppendIsNotApplied(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	defer lsmt.Close()
+	lsmt.wal.close()
+
+	err := lsmt.Write([]byte{1}, []byte{1})
+	if err == nil {
+		t.Error("Expected Write to fail when the log cannot be appended to, but did not")
+	}
+	value, _ := lsmt.Get([]byte{1})
+	if value != nil {
+		t.Errorf("Expected the failed write to not be applied, but got %q", value)
+	}
+}
+
+func TestClosingEmptySkiplistLsmtWritesNoManifest(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	skiplist := *options
+	skiplist.MemtableType = config.SkiplistMemtable
+	lsmt, _ := Lsmt(&skiplist)
+	lsmt.Close()
+
+	manifest, _ := sst.MostRecentManifest(common.TEST_DIR)
+	if manifest != nil {
+		t.Errorf("Expected closing an empty lsmt to write no manifest, but got version %d", manifest.Version)
+	}
+}
+
+func TestCloseRemovesLogs(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	value := make([]byte, 10)
+	for i := byte(0); i < 100; i++ {
+		lsmt.Write([]byte{i}, value)
+	}
+	lsmt.Close()
+
+	logs, _ := logFiles(common.TEST_DIR)
+	if len(logs) != 0 {
+		t.Errorf("Expected every log to be removed on close, but got %v", logs)
+	}
+}
+
+func TestWriteBatchIsRejectedWhole(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	defer lsmt.Close()
+
+	batch := NewBatch()
+	batch.Write([]byte{1}, []byte{1})
+	batch.Write([]byte{2}, nil)
+	err := lsmt.WriteBatch(batch)
+	if err != common.ERR_VAL_NIL {
+		t.Errorf("Expected %v but got %v", common.ERR_VAL_NIL, err)
+	}
+	value, _ := lsmt.Get([]byte{1})
+	if value != nil {
+		t.Errorf("Expected no record of a rejected batch to be written, but got %q", value)
+	}
+
+	lsmt.Close()
+	batch = NewBatch()
+	batch.Write([]byte{1}, []byte{1})
+	err = lsmt.WriteBatch(batch)
+	if err != common.ERR_LSMT_CLOSED {
+		t.Errorf("Expected %v but got %v", common.ERR_LSMT_CLOSED, err)
+	}
+}
+
+func TestWriteStallDelaysWrites(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	stallOptions := *options
+	stallOptions.WriteStall = &config.WriteStall{ImmutableMemtablesSoftLimit: 1, Delay: 10 * time.Millisecond}
+	lsmt, _ := Lsmt(&stallOptions)
+	defer lsmt.Close()
+	simulateRunningFlush(lsmt)
+
+	start := time.Now()
+	lsmt.Write([]byte{1}, []byte{1})
+	if time.Since(start) < stallOptions.WriteStall.Delay {
+		t.Errorf("Expected write to be delayed by %s, but took %s", stallOptions.WriteStall.Delay, time.Since(start))
+	}
+	stalls := lsmt.Metrics().WriteStalls
+	if stalls.Delays != 1 || stalls.Stops != 0 {
+		t.Errorf("Expected 1 delay and 0 stops but got %d delays and %d stops", stalls.Delays, stalls.Stops)
+	}
+	completeRunningFlush(lsmt)
+}
+
+func TestWriteStallStopsWritesUntilFlushCompletes(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	stallOptions := *options
+	stallOptions.WriteStall = &config.WriteStall{ImmutableMemtablesHardLimit: 1}
+	lsmt, _ := Lsmt(&stallOptions)
+	defer lsmt.Close()
+	simulateRunningFlush(lsmt)
+
+	written := make(chan error)
+	go func() {
+		written <- lsmt.Write([]byte{1}, []byte{1})
+	}()
+	for lsmt.Metrics().WriteStalls.Stops == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-written:
+		t.Error("Expected write to be blocked by the hard limit, but was not")
+	default:
+	}
+
+	completeRunningFlush(lsmt)
+	err := <-written
+	if err != nil {
+		t.Errorf("Expected stopped write to succeed once the flush completed, but got %v", err)
+	}
+	value, _ := lsmt.Get([]byte{1})
+	if c.Compare(value, []byte{1}) != c.EQUAL {
+		t.Errorf("Expected %q but got %q", []byte{1}, value)
+	}
+}
+
+func TestWriteStallDelaysWritesWithoutRunningFlush(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	stallOptions := *options
+	stallOptions.WriteStall = &config.WriteStall{L0FilesSoftLimit: 1, Delay: 10 * time.Millisecond}
+	lsmt, _ := Lsmt(&stallOptions)
+	lsmt.Write([]byte{1}, []byte{1})
+	lsmt.Close()
+
+	lsmt, _ = Lsmt(&stallOptions)
+	defer lsmt.Close()
+	start := time.Now()
+	lsmt.Write([]byte{2}, []byte{2})
+	if time.Since(start) < stallOptions.WriteStall.Delay {
+		t.Errorf("Expected write to be delayed by %s, but took %s", stallOptions.WriteStall.Delay, time.Since(start))
+	}
+	stalls := lsmt.Metrics().WriteStalls
+	if stalls.Delays != 1 || stalls.Stops != 0 {
+		t.Errorf("Expected 1 delay and 0 stops but got %d delays and %d stops", stalls.Delays, stalls.Stops)
+	}
+}
+
+func TestWriteStallStartsFlushWhenStopped(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	stallOptions := *options
+	stallOptions.WriteStall = &config.WriteStall{ImmutableMemtablesHardLimit: 1}
+	lsmt, _ := Lsmt(&stallOptions)
+	defer lsmt.Close()
+	lsmt.Write([]byte{1}, []byte{1})
+	// Retire the memtable without starting a flush
+	simulateRunningFlush(lsmt)
+	lsmt.flushLock.Unlock()
+
+	err := lsmt.Write([]byte{2}, []byte{2})
+	if err != nil {
+		t.Errorf("Expected stopped write to succeed once the flush completed, but got %v", err)
+	}
+	metrics := lsmt.Metrics()
+	if metrics.WriteStalls.Stops != 1 || metrics.ImmutableMemtables != 0 {
+		t.Errorf("Expected 1 stop and no immutable memtables but got %d stops and %d immutable memtables", metrics.WriteStalls.Stops, metrics.ImmutableMemtables)
+	}
+	for _, key := range []byte{1, 2} {
+		value, _ := lsmt.Get([]byte{key})
+		if c.Compare(value, []byte{key}) != c.EQUAL {
+			t.Errorf("Expected %q but got %q", []byte{key}, value)
+		}
+	}
+}
+
+func TestMemtableRetiredWhileFlushRunning(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	defer lsmt.Close()
+	simulateRunningFlush(lsmt)
+
+	value := make([]byte, 10)
+	for i := byte(0); i < writesToRetireOneMemtable(); i++ {
+		lsmt.Write([]byte{i}, value)
+	}
+	current := (*version)(atomic.LoadPointer(&lsmt.version))
+	if len(current.inactiveMemtables) != 2 {
+		t.Errorf("Expected the full memtable to be retired, but there are %d inactive memtables", len(current.inactiveMemtables))
+	}
+	if current.activeMemtable.Bytes() > options.MemtableMaximumSize {
+		t.Errorf("Expected the active memtable to not grow past %d bytes, but has %d", options.MemtableMaximumSize, current.activeMemtable.Bytes())
+	}
+	completeRunningFlush(lsmt)
+}
+
+func TestFullImmutableMemtableQueueWaitsForFlush(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	queued := *options
+	queued.MaximumImmutableMemtables = 1
+	lsmt, _ := Lsmt(&queued)
+	defer lsmt.Close()
+	simulateRunningFlush(lsmt)
+
+	var written int32
+	go func() {
+		value := make([]byte, 10)
+		for i := byte(0); i < writesToRetireOneMemtable(); i++ {
+			lsmt.Write([]byte{i}, value)
+		}
+		atomic.StoreInt32(&written, 1)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&written) != 0 {
+		t.Error("Expected writes to wait for a flush while the immutable memtable queue is full, but they did not")
+	}
+	current := (*version)(atomic.LoadPointer(&lsmt.version))
+	if len(current.inactiveMemtables) != 1 {
+		t.Errorf("Expected 1 inactive memtable, but got %d", len(current.inactiveMemtables))
+	}
+
+	completeRunningFlush(lsmt)
+	for atomic.LoadInt32(&written) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	stops := lsmt.Metrics().WriteStalls.Stops
+	if stops != 1 {
+		t.Errorf("Expected 1 write stop, but got %d", stops)
+	}
+}
+
+func TestFlushPersistsOldestMemtableFirst(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	lsmt, _ := Lsmt(options)
+	defer lsmt.Close()
+	simulateRunningFlush(lsmt)
+
+	value := make([]byte, 10)
+	for round := byte(1); round <= 3; round++ {
+		lsmt.Write([]byte{0}, []byte{round})
+		for i := byte(1); i < 100; i++ {
+			lsmt.Write([]byte{i}, value)
+		}
+	}
+	if lsmt.Metrics().ImmutableMemtables < 2 {
+		t.Errorf("Expected at least 2 immutable memtables, but got %d", lsmt.Metrics().ImmutableMemtables)
+	}
+
+	lsmt.flushInactive()
+	if lsmt.Metrics().ImmutableMemtables != 0 {
+		t.Errorf("Expected every immutable memtable to be flushed, but got %d", lsmt.Metrics().ImmutableMemtables)
+	}
+	result, _ := lsmt.Get([]byte{0})
+	if c.Compare(result, []byte{3}) != c.EQUAL {
+		t.Errorf("Expected Get() to produce the newest value %q, but got %q", []byte{3}, result)
+	}
+}
+
+// Returns the number of writes of a one byte key and a ten byte value which fill the
+// active memtable and retire it exactly once.
+func writesToRetireOneMemtable() byte {
+	table := mt.NewMemtable()
+	table.Write([]byte{0}, make([]byte, 10))
+	return byte(options.MemtableMaximumSize/table.Bytes() + 2)
+}
+
+// Retires the active memtable and takes the flush lock without flushing, as though a
+// flush were running.
+func simulateRunningFlush(db *lsmt) {
+	db.flushLock.Lock()
+	db.writeLock.Lock()
+	current := (*version)(atomic.LoadPointer(&db.version))
+	sstManager, _ := current.sstManager.Acquire()
+	db.installVersion(newVersion(mt.NewMemtable(), []mt.Memtable{current.activeMemtable}, sstManager))
+	db.writeLock.Unlock()
+}
+
+// Completes a flush started by simulateRunningFlush by discarding the retired memtable.
+func completeRunningFlush(db *lsmt) {
+	db.writeLock.Lock()
+	current := (*version)(atomic.LoadPointer(&db.version))
+	sstManager, _ := current.sstManager.Acquire()
+	db.installVersion(newVersion(current.activeMemtable, []mt.Memtable{}, sstManager))
+	db.releaseFlushLock()
+	db.writeLock.Unlock()
+}
+
 //func TestMultiLevelStorage(t *testing.T) {
 //	common.SetUp(t)
 //	defer common.TearDown(t)
@@ -0,0 +1,98 @@
+package memtable
+
+import (
+	"unsafe"
+
+	"github.com/patrickgombert/lsmt/common"
+)
+
+const (
+	// The number of nodes, tower links and values allocated together by an arena.
+	ARENA_CHUNK_SIZE = 4096
+	// The size of the blocks which an arena copies keys and values into. Keys and values
+	// larger than a quarter of a block are copied into their own allocation so that they
+	// do not waste the remainder of a block.
+	ARENA_BLOCK_SIZE = 64 * 1024
+)
+
+var (
+	nodeOverhead  = int64(unsafe.Sizeof(skiplistNode{}))
+	linkOverhead  = int64(unsafe.Sizeof(unsafe.Pointer(nil)))
+	valueOverhead = int64(unsafe.Sizeof(skiplistValue{}))
+)
+
+// An arena allocates the nodes of a skiplist, their towers of links and their values in
+// chunks, and copies keys and values into large blocks, so that writing to a skiplist
+// does not allocate on every write and the skiplist never holds a caller's buffer.
+// Memory handed out by an arena lives as long as the skiplist which owns it. An arena
+// is not safe for concurrent use.
+type arena struct {
+	nodes  []skiplistNode
+	towers []unsafe.Pointer
+	values []skiplistValue
+	block  []byte
+	used   int64
+}
+
+// Creates a new arena whose first chunks are allocated on first use.
+func newArena() *arena {
+	return &arena{}
+}
+
+// Allocates a node with a tower of the given height holding copies of the pair's key
+// and value, written at the given sequence.
+func (a *arena) newNode(pair common.Pair, height int, sequence uint64) *skiplistNode {
+	if len(a.nodes) == cap(a.nodes) {
+		a.nodes = make([]skiplistNode, 0, ARENA_CHUNK_SIZE)
+	}
+	a.nodes = a.nodes[:len(a.nodes)+1]
+	node := &a.nodes[len(a.nodes)-1]
+
+	if len(a.towers)+height > cap(a.towers) {
+		a.towers = make([]unsafe.Pointer, 0, ARENA_CHUNK_SIZE)
+	}
+	start := len(a.towers)
+	a.towers = a.towers[:start+height]
+
+	node.key = a.copy(pair.Key)
+	node.value = unsafe.Pointer(a.newValue(pair, sequence, nil))
+	node.tower = a.towers[start : start+height : start+height]
+	a.used += nodeOverhead + linkOverhead*int64(height)
+	return node
+}
+
+// Allocates a slot holding a copy of the pair's value along with its record type and
+// expiry, written at the given sequence over the previous value of its node.
+func (a *arena) newValue(pair common.Pair, sequence uint64, previous *skiplistValue) *skiplistValue {
+	if len(a.values) == cap(a.values) {
+		a.values = make([]skiplistValue, 0, ARENA_CHUNK_SIZE)
+	}
+	a.values = append(a.values, skiplistValue{value: a.copy(pair.Value), recordType: pair.Type, expiry: pair.Expiry, sequence: sequence, previous: previous})
+	a.used += valueOverhead
+	return &a.values[len(a.values)-1]
+}
+
+// Returns a copy of bytes owned by the arena.
+func (a *arena) copy(bytes []byte) []byte {
+	if len(bytes) == 0 {
+		return []byte{}
+	}
+	a.used += leni64(bytes)
+	if len(bytes) > ARENA_BLOCK_SIZE/4 {
+		copied := make([]byte, len(bytes))
+		copy(copied, bytes)
+		return copied
+	}
+	if len(a.block)+len(bytes) > cap(a.block) {
+		a.block = make([]byte, 0, ARENA_BLOCK_SIZE)
+	}
+	start := len(a.block)
+	a.block = append(a.block, bytes...)
+	return a.block[start:len(a.block):len(a.block)]
+}
+
+// Returns the number of bytes handed out by the arena, including the overhead of the
+// nodes, links and value slots it has allocated.
+func (a *arena) size() int64 {
+	return a.used
+}
@@ -6,78 +6,118 @@ import (
 )
 
 // Stack based iterator which keeps the trees lineage in memory while iterating.
+// The stack holds the path from the root of the tree to the current node so that the
+// iterator can move to either neighbouring node.
 type memtableIterator struct {
-	init  bool
-	stack []persistentNode
-	end   []byte
+	root            persistentNode
+	rangeTombstones []common.RangeTombstone
+	opts            common.IterOptions
+	stack           []persistentNode
+	position        common.Position
 }
 
 // Creates a new bounded iterator for the current state of the memtable.
 // Since the memtable is backed by a persistent data structure, this reflects a point in
 // time snapshot of the memtable.
-func (memtable *Memtable) Iterator(start, end []byte) common.Iterator {
-	stack := []persistentNode{}
-	node := memtable.sortedMap.getRoot()
-	if node == nil {
-		return &memtableIterator{init: false, stack: stack, end: end}
-	}
-	for c.Compare(start, node.getPair().Key) == c.GREATER_THAN {
-		if node.getRight() == nil {
-			return &memtableIterator{init: false, stack: stack, end: end}
-		}
-	}
-	stack = appendStack(start, node, stack)
-	return &memtableIterator{init: false, stack: stack, end: end}
+func (memtable *TreeMemtable) Iterator(start, end []byte) common.Iterator {
+	return memtable.IteratorWithOptions(common.IterOptions{LowerBound: start, UpperBound: end})
 }
 
 // Creates a new unbounded iterator for the current state of the memtable.
 // Since the memtable is backed by a persistent data structure, this reflects a point in
 // time snapshot of the memtable.
-func (memtable *Memtable) UnboundedIterator() common.Iterator {
-	stack := []persistentNode{}
-	node := memtable.sortedMap.getRoot()
-	if node == nil {
-		return &memtableIterator{init: false, stack: stack, end: nil}
+func (memtable *TreeMemtable) UnboundedIterator() common.Iterator {
+	return memtable.IteratorWithOptions(common.IterOptions{})
+}
+
+// Creates a new iterator for the current state of the memtable which honours the
+// bounds and limit of the options provided. Keys are ordered by the memtable's
+// comparator.
+func (memtable *TreeMemtable) IteratorWithOptions(opts common.IterOptions) common.Iterator {
+	opts.Comparator = memtable.comparator
+	sortedMap := memtable.load()
+	var iter common.Iterator = &memtableIterator{root: sortedMap.getRoot(), rangeTombstones: sortedMap.rangeTombstones, opts: opts, stack: []persistentNode{}}
+	if opts.Limit > 0 {
+		iter = common.NewLimitIterator(iter, opts.Limit)
 	}
-	stack = appendStack(nil, node, stack)
-	return &memtableIterator{init: false, stack: stack, end: nil}
+	return iter
 }
 
 // Moves the iterator forward. Returns false when either the end of the tree has been
-// reached or if the end key has been passed (if the iterator is bounded).
+// reached or if the upper bound has been passed (if the iterator is bounded).
 // The Next() call should never error, but returns a nil error in order to
 // satisfy the Iterator interface.
 func (iter *memtableIterator) Next() (bool, error) {
-	if len(iter.stack) == 0 {
+	switch iter.position {
+	case common.UNPOSITIONED, common.BEFORE_FIRST:
+		return iter.SeekToFirst()
+	case common.AT_PAIR:
+		iter.stack = successor(iter.stack)
+	case common.AFTER_LAST:
 		return false, nil
 	}
-	if !iter.init {
-		iter.init = true
-		return true, nil
-	}
+	return iter.settle(common.AFTER_LAST), nil
+}
 
-	idx := len(iter.stack) - 1
-	node := iter.stack[idx]
-	iter.stack = appendStack(nil, node.getRight(), iter.stack[:idx])
-	if len(iter.stack) == 0 {
+// Moves the iterator backward. Returns false when either the start of the tree has been
+// reached or if the lower bound has been passed (if the iterator is bounded).
+func (iter *memtableIterator) Prev() (bool, error) {
+	switch iter.position {
+	case common.UNPOSITIONED, common.AFTER_LAST:
+		return iter.SeekToLast()
+	case common.AT_PAIR:
+		iter.stack = predecessor(iter.stack)
+	case common.BEFORE_FIRST:
 		return false, nil
-	} else {
-		idx = len(iter.stack) - 1
-		node = iter.stack[idx]
-		if iter.end != nil && c.Compare(node.getPair().Key, iter.end) == c.GREATER_THAN {
-			iter.stack = []persistentNode{}
-			return false, nil
-		} else {
-			return true, nil
-		}
 	}
+	return iter.settle(common.BEFORE_FIRST), nil
+}
+
+// Positions the iterator at the first pair within the lower bound (if the iterator is
+// bounded).
+func (iter *memtableIterator) SeekToFirst() (bool, error) {
+	iter.stack = first(iter.root, iter.opts.WithinLowerBound, iter.stack[:0])
+	return iter.settle(common.AFTER_LAST), nil
+}
+
+// Positions the iterator at the first pair whose key is greater than or equal to key.
+func (iter *memtableIterator) Seek(key []byte) (bool, error) {
+	iter.stack = first(iter.root, func(k []byte) bool {
+		return iter.opts.WithinLowerBound(k) && iter.opts.GetComparator().Compare(k, key) != c.LESS_THAN
+	}, iter.stack[:0])
+	return iter.settle(common.AFTER_LAST), nil
+}
+
+// Positions the iterator at the last pair within the upper bound (if the iterator is
+// bounded).
+func (iter *memtableIterator) SeekToLast() (bool, error) {
+	iter.stack = last(iter.root, iter.opts.WithinUpperBound, iter.stack[:0])
+	return iter.settle(common.BEFORE_FIRST), nil
+}
+
+// Positions the iterator at the last pair whose key is less than or equal to key.
+func (iter *memtableIterator) SeekForPrev(key []byte) (bool, error) {
+	iter.stack = last(iter.root, func(k []byte) bool {
+		return iter.opts.WithinUpperBound(k) && iter.opts.GetComparator().Compare(k, key) != c.GREATER_THAN
+	}, iter.stack[:0])
+	return iter.settle(common.BEFORE_FIRST), nil
+}
+
+// Returns the range tombstones of the memtable at the time the iterator was created.
+func (iter *memtableIterator) RangeTombstones() []common.RangeTombstone {
+	return iter.rangeTombstones
+}
+
+// Returns whether the iterator is positioned at a pair.
+func (iter *memtableIterator) Valid() bool {
+	return iter.position == common.AT_PAIR
 }
 
 // Returns the current element's Pair.
 // The Get() call should never error, but returns a nil error in order to
 // satisfy the Iterator interface.
 func (iter *memtableIterator) Get() (*common.Pair, error) {
-	if len(iter.stack) == 0 {
+	if iter.position != common.AT_PAIR {
 		return nil, nil
 	}
 	pair := iter.stack[len(iter.stack)-1].getPair()
@@ -87,28 +127,105 @@ func (iter *memtableIterator) Get() (*common.Pair, error) {
 // Closes the instance of the iterator which has the effect of making subsequent calls
 // to Next() return false and Get() return nil.
 func (iter *memtableIterator) Close() error {
+	iter.root = nil
 	iter.stack = []persistentNode{}
+	iter.position = common.AFTER_LAST
 	return nil
 }
 
-func appendStack(start []byte, root persistentNode, stack []persistentNode) []persistentNode {
-	node := root
-	for node != nil {
-		if start != nil {
-			switch c.Compare(start, node.getPair().Key) {
-			case c.EQUAL:
-				stack = append(stack, node)
-				return stack
-			case c.LESS_THAN:
-				stack = append(stack, node)
-				node = node.getLeft()
-			case c.GREATER_THAN:
-				node = node.getRight()
-			}
+// Records the iterator's position after the stack has been moved. If the stack is empty
+// or the current node falls outside of the iterator's bounds then the iterator is
+// positioned at the given end.
+func (iter *memtableIterator) settle(exhausted common.Position) bool {
+	if len(iter.stack) > 0 && iter.opts.WithinBounds(iter.stack[len(iter.stack)-1].getPair().Key) {
+		iter.position = common.AT_PAIR
+		return true
+	}
+	iter.stack = iter.stack[:0]
+	iter.position = exhausted
+	return false
+}
+
+// Appends the path from root to the least node in root's subtree.
+func leftmost(root persistentNode, stack []persistentNode) []persistentNode {
+	for node := root; node != nil; node = node.getLeft() {
+		stack = append(stack, node)
+	}
+	return stack
+}
+
+// Appends the path from root to the greatest node in root's subtree.
+func rightmost(root persistentNode, stack []persistentNode) []persistentNode {
+	for node := root; node != nil; node = node.getRight() {
+		stack = append(stack, node)
+	}
+	return stack
+}
+
+// Returns the path from root to the least node whose key satisfies within. The within
+// function must hold for every key after the first key it holds for. The returned stack
+// is empty if there is no such node.
+func first(root persistentNode, within func([]byte) bool, stack []persistentNode) []persistentNode {
+	found := 0
+	for node := root; node != nil; {
+		stack = append(stack, node)
+		if within(node.getPair().Key) {
+			found = len(stack)
+			node = node.getLeft()
+		} else {
+			node = node.getRight()
+		}
+	}
+	return stack[:found]
+}
+
+// Returns the path from root to the greatest node whose key satisfies within. The
+// within function must hold for every key before the last key it holds for. The
+// returned stack is empty if there is no such node.
+func last(root persistentNode, within func([]byte) bool, stack []persistentNode) []persistentNode {
+	found := 0
+	for node := root; node != nil; {
+		stack = append(stack, node)
+		if within(node.getPair().Key) {
+			found = len(stack)
+			node = node.getRight()
 		} else {
-			stack = append(stack, node)
 			node = node.getLeft()
 		}
 	}
-	return stack
+	return stack[:found]
+}
+
+// Moves the path to the node following the current node.
+func successor(stack []persistentNode) []persistentNode {
+	node := stack[len(stack)-1]
+	if node.getRight() != nil {
+		return leftmost(node.getRight(), stack)
+	}
+	for len(stack) > 1 {
+		child := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		parent := stack[len(stack)-1]
+		if parent.getLeft() == child {
+			return stack
+		}
+	}
+	return stack[:0]
+}
+
+// Moves the path to the node preceding the current node.
+func predecessor(stack []persistentNode) []persistentNode {
+	node := stack[len(stack)-1]
+	if node.getLeft() != nil {
+		return rightmost(node.getLeft(), stack)
+	}
+	for len(stack) > 1 {
+		child := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		parent := stack[len(stack)-1]
+		if parent.getRight() == child {
+			return stack
+		}
+	}
+	return stack[:0]
 }
@@ -109,3 +109,176 @@ func TestUnboundedIterator(t *testing.T) {
 	common.CompareGet(iter, []byte{2}, []byte{2}, t)
 	common.CompareNext(iter, false, t)
 }
+
+func TestIteratorPrev(t *testing.T) {
+	mt := NewMemtable()
+	for i := byte(0); i < 8; i++ {
+		mt.Write([]byte{i}, []byte{i})
+	}
+
+	iter := mt.Iterator([]byte{2}, []byte{5})
+	defer iter.Close()
+
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{5}, []byte{5}, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{4}, []byte{4}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{5}, []byte{5}, t)
+	common.ComparePrev(iter, true, t)
+	common.ComparePrev(iter, true, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.ComparePrev(iter, false, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+}
+
+func TestIteratorStartGreaterThanRoot(t *testing.T) {
+	mt := NewMemtable()
+	for i := byte(0); i < 8; i++ {
+		mt.Write([]byte{i}, []byte{i})
+	}
+
+	iter := mt.Iterator([]byte{6}, []byte{9})
+	defer iter.Close()
+
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{6}, []byte{6}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{7}, []byte{7}, t)
+	common.CompareNext(iter, false, t)
+}
+
+func TestIteratorSeekToLast(t *testing.T) {
+	mt := NewMemtable()
+	mt.Write([]byte{0}, []byte{0})
+	mt.Write([]byte{1}, []byte{1})
+	mt.Write([]byte{2}, []byte{2})
+
+	iter := mt.UnboundedIterator()
+	defer iter.Close()
+
+	found, _ := iter.SeekToLast()
+	if !found {
+		t.Error("Expected SeekToLast() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.CompareNext(iter, false, t)
+}
+
+func TestIteratorSeekForPrev(t *testing.T) {
+	mt := NewMemtable()
+	for i := byte(0); i < 8; i += 2 {
+		mt.Write([]byte{i}, []byte{i})
+	}
+
+	iter := mt.Iterator([]byte{2}, []byte{9})
+	defer iter.Close()
+
+	found, _ := iter.SeekForPrev([]byte{5})
+	if !found {
+		t.Error("Expected SeekForPrev() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{4}, []byte{4}, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.ComparePrev(iter, false, t)
+
+	found, _ = iter.SeekForPrev([]byte{1})
+	if found {
+		t.Error("Expected SeekForPrev() before the start key to not find a pair, but did")
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	mt := NewMemtable()
+	for i := byte(0); i < 8; i += 2 {
+		mt.Write([]byte{i}, []byte{i})
+	}
+
+	iter := mt.Iterator([]byte{2}, []byte{9})
+	defer iter.Close()
+
+	found, _ := iter.Seek([]byte{3})
+	if !found || !iter.Valid() {
+		t.Error("Expected Seek() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{4}, []byte{4}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{6}, []byte{6}, t)
+
+	found, _ = iter.Seek([]byte{0})
+	if !found {
+		t.Error("Expected Seek() before the start key to find the first pair, but did not")
+	}
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+
+	found, _ = iter.Seek([]byte{7})
+	if found || iter.Valid() {
+		t.Error("Expected Seek() past the last key to not find a pair, but did")
+	}
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{6}, []byte{6}, t)
+
+	found, _ = iter.SeekToFirst()
+	if !found {
+		t.Error("Expected SeekToFirst() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+}
+
+func TestIteratorWithExclusiveBounds(t *testing.T) {
+	mt := NewMemtable()
+	for i := byte(0); i < 5; i++ {
+		mt.Write([]byte{i}, []byte{i})
+	}
+
+	iter := mt.IteratorWithOptions(common.IterOptions{LowerBound: []byte{1}, UpperBound: []byte{3}, ExcludeLowerBound: true, ExcludeUpperBound: true})
+	defer iter.Close()
+
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.CompareNext(iter, false, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.ComparePrev(iter, false, t)
+
+	found, _ := iter.SeekForPrev([]byte{4})
+	if !found {
+		t.Error("Expected SeekForPrev() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+}
+
+func TestIteratorWithLowerBoundOnly(t *testing.T) {
+	mt := NewMemtable()
+	for i := byte(0); i < 4; i++ {
+		mt.Write([]byte{i}, []byte{i})
+	}
+
+	iter := mt.IteratorWithOptions(common.IterOptions{LowerBound: []byte{2}})
+	defer iter.Close()
+
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+	common.CompareNext(iter, false, t)
+}
+
+func TestIteratorWithLimit(t *testing.T) {
+	mt := NewMemtable()
+	for i := byte(0); i < 4; i++ {
+		mt.Write([]byte{i}, []byte{i})
+	}
+
+	iter := mt.IteratorWithOptions(common.IterOptions{Limit: 2})
+	defer iter.Close()
+
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{0}, []byte{0}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{1}, []byte{1}, t)
+	common.CompareNext(iter, false, t)
+}
@@ -1,6 +1,10 @@
 package memtable
 
 import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
 	"github.com/patrickgombert/lsmt/common"
 	c "github.com/patrickgombert/lsmt/comparator"
 )
@@ -48,13 +52,64 @@ type redBranch struct {
 }
 
 type persistentSortedMap struct {
-	root  persistentNode
-	count int64
-	bytes int64
-}
-
-type Memtable struct {
-	sortedMap *persistentSortedMap
+	root            persistentNode
+	count           int64
+	tombstones      int64
+	rangeTombstones []common.RangeTombstone
+}
+
+// The memory used by each entry of the tree in addition to its key and value. Every
+// entry of the tree is a node, the largest of which is a branch. The nodes copied along
+// the path of a write are not counted since the nodes they replace are garbage once no
+// reader holds the previous version of the tree.
+var treeEntryOverhead = int64(unsafe.Sizeof(blackBranch{}))
+
+// The memory used by each range tombstone in addition to its start and end.
+var rangeTombstoneOverhead = int64(unsafe.Sizeof(common.RangeTombstone{}))
+
+// A memtable holds recent writes in memory, sorted by key, until they are flushed to
+// SSTs.
+type Memtable interface {
+	// Returns the pair for a key, whose type tells a put from a delete, along with
+	// whether the key was found. Range tombstones are not reflected.
+	Get(key []byte) (common.Pair, bool)
+	Write(key, value []byte)
+	// Writes a put which expires at the given time. Expired puts are left for readers
+	// to hide.
+	WriteWithExpiry(key, value []byte, expiry int64)
+	Delete(key []byte)
+	// Writes a tombstone for a key which is only written once.
+	SingleDelete(key []byte)
+	// Writes a merge record holding the operand, replacing any record for the key, so
+	// the caller is responsible for combining it with a record already in the memtable.
+	Merge(key, operand []byte)
+	// Writes a range tombstone, which is returned by RangeTombstones and carried by the
+	// memtable's iterators.
+	DeleteRange(start, end []byte)
+	RangeTombstones() []common.RangeTombstone
+	// Returns the memory used by the memtable, including the overhead of each entry.
+	Bytes() int64
+	// Returns the number of keys held by the memtable.
+	Entries() int64
+	// Returns the number of keys held by the memtable which are deleted.
+	Tombstones() int64
+	Iterator(start, end []byte) common.Iterator
+	UnboundedIterator() common.Iterator
+	IteratorWithOptions(opts common.IterOptions) common.Iterator
+}
+
+// A memtable backed by a persistent red-black tree, which is safe for concurrent use.
+// Each write builds a new version of the persistent sorted map and publishes it
+// atomically, so readers never take a lock and always see a complete version while
+// concurrent writers retry against the latest one. Keys and values are copied into an
+// arena which is shared by the writers under a lock. Keys are ordered by the
+// memtable's comparator.
+type TreeMemtable struct {
+	sortedMap  unsafe.Pointer
+	arenaBytes int64
+	arena      *arena
+	arenaLock  sync.Mutex
+	comparator c.Comparator
 }
 
 func (node *blackNode) getColor() color {
@@ -232,8 +287,7 @@ func (node *redBranch) balanceLeft(other persistentNode) persistentNode {
 	} else if node.getRight() != nil && node.getRight().getColor() == RED {
 		blackenedLeftNode := makeBlackNode(node.getPair(), node.getLeft(), node.getRight().getLeft())
 		blackenedRightNode := makeBlackNode(other.getPair(), node.getRight().getRight(), other.getRight())
-		pair := common.Pair{Key: node.getRight().getPair().Key, Value: node.getRight().getPair().Value}
-		return makeRedNode(pair, blackenedLeftNode, blackenedRightNode)
+		return makeRedNode(node.getRight().getPair(), blackenedLeftNode, blackenedRightNode)
 	} else {
 		return makeBlackNode(other.getPair(), node, other.getRight())
 	}
@@ -246,8 +300,7 @@ func (node *redBranch) balanceRight(other persistentNode) persistentNode {
 	} else if node.getLeft() != nil && node.getLeft().getColor() == RED {
 		blackenedLeftNode := makeBlackNode(other.getPair(), other.getLeft(), node.getLeft().getLeft())
 		blackenedRightNode := makeBlackNode(node.getPair(), node.getLeft().getRight(), node.getRight())
-		pair := common.Pair{Key: node.getLeft().getPair().Key, Value: node.getLeft().getPair().Value}
-		return makeRedNode(pair, blackenedLeftNode, blackenedRightNode)
+		return makeRedNode(node.getLeft().getPair(), blackenedLeftNode, blackenedRightNode)
 	} else {
 		return makeBlackNode(other.getPair(), other.getLeft(), node)
 	}
@@ -288,24 +341,39 @@ func (m *persistentSortedMap) getRoot() persistentNode {
 	return m.root
 }
 
-// Creates a new instance of a Memtable
-func NewMemtable() *Memtable {
-	sortedMap := &persistentSortedMap{root: nil, count: 0, bytes: 0}
-	return &Memtable{sortedMap: sortedMap}
+// Creates a new instance of a Memtable backed by a persistent red-black tree.
+func NewMemtable() Memtable {
+	return NewTreeMemtable()
+}
+
+// Creates a new instance of a TreeMemtable which orders keys bytewise.
+func NewTreeMemtable() *TreeMemtable {
+	return NewTreeMemtableWithComparator(c.BytewiseComparator{})
+}
+
+// Creates a new instance of a TreeMemtable which orders keys by the comparator.
+func NewTreeMemtableWithComparator(comparator c.Comparator) *TreeMemtable {
+	sortedMap := &persistentSortedMap{root: nil, count: 0, tombstones: 0}
+	return &TreeMemtable{sortedMap: unsafe.Pointer(sortedMap), arena: newArena(), comparator: comparator}
 }
 
-// Returns the value for a given key. The second return value signals whether the key was
+// Returns the most recently published version of the sorted map.
+func (memtable *TreeMemtable) load() *persistentSortedMap {
+	return (*persistentSortedMap)(atomic.LoadPointer(&memtable.sortedMap))
+}
+
+// Returns the pair for a given key. The second return value signals whether the key was
 // found or not found.
-func (memtable *Memtable) Get(key []byte) ([]byte, bool) {
-	node := memtable.sortedMap.getRoot()
+func (memtable *TreeMemtable) Get(key []byte) (common.Pair, bool) {
+	node := memtable.load().getRoot()
 	for {
 		if node == nil {
-			return nil, false
+			return common.Pair{}, false
 		}
-		comparison := c.Compare(key, node.getPair().Key)
+		comparison := memtable.comparator.Compare(key, node.getPair().Key)
 		switch comparison {
 		case c.EQUAL:
-			return node.getPair().Value, true
+			return node.getPair(), true
 		case c.LESS_THAN:
 			node = node.getLeft()
 		case c.GREATER_THAN:
@@ -314,50 +382,159 @@ func (memtable *Memtable) Get(key []byte) ([]byte, bool) {
 	}
 }
 
-// Writes a key/value pair to the memtable.
-// Returns a new instance of a memtable with the key value pair added.
-func (memtable *Memtable) Write(key, value []byte) {
-	sortedMap := memtable.sortedMap
-	if sortedMap.getRoot() == nil {
-		pair := common.Pair{Key: key, Value: value}
-		root := &redNode{pair: pair}
-		bytes := leni64(key) + leni64(value)
-		memtable.sortedMap = &persistentSortedMap{root: root, count: 1, bytes: bytes}
+// Writes a key/value pair to the memtable. The key and value are copied into the
+// memtable's arena, so the caller is free to reuse them.
+func (memtable *TreeMemtable) Write(key, value []byte) {
+	memtable.write(common.Pair{Key: key, Value: value, Type: common.PUT})
+}
+
+// Writes a key/value pair which expires at the given time, in nanoseconds since the
+// unix epoch, to the memtable.
+func (memtable *TreeMemtable) WriteWithExpiry(key, value []byte, expiry int64) {
+	memtable.write(common.Pair{Key: key, Value: value, Type: common.PUT, Expiry: expiry})
+}
+
+// Writes a tombstone for the key to the memtable.
+func (memtable *TreeMemtable) Delete(key []byte) {
+	memtable.write(common.Pair{Key: key, Value: []byte{}, Type: common.DELETE})
+}
+
+// Writes a single delete tombstone for the key to the memtable.
+func (memtable *TreeMemtable) SingleDelete(key []byte) {
+	memtable.write(common.Pair{Key: key, Value: []byte{}, Type: common.SINGLE_DELETE})
+}
+
+// Writes a merge record holding the operand for the key to the memtable.
+func (memtable *TreeMemtable) Merge(key, operand []byte) {
+	memtable.write(common.Pair{Key: key, Value: operand, Type: common.MERGE})
+}
+
+// Writes a pair to the memtable, copying its value into the arena along with its key
+// unless the key is already in the memtable. The new version of the sorted map is published with a compare and swap. If another
+// writer published a version first then the write is applied again to that version.
+func (memtable *TreeMemtable) write(pair common.Pair) {
+	existing, found := memtable.Get(pair.Key)
+	if found && samePair(existing, pair) {
+		return
+	}
+	memtable.arenaLock.Lock()
+	if found {
+		pair.Key = existing.Key
 	} else {
-		node, existed := addNode(sortedMap.getRoot(), key, value)
-		if existed && c.Compare(value, node.getPair().Value) != c.EQUAL {
-			bytes := (sortedMap.bytes - leni64(node.getPair().Value)) + leni64(value)
-			root := replaceNode(sortedMap.getRoot(), key, value)
-			memtable.sortedMap = &persistentSortedMap{root: root, count: sortedMap.count, bytes: bytes}
-		} else {
-			blackenedNode := node.blacken()
-			count := sortedMap.count + 1
-			bytes := sortedMap.bytes + leni64(key) + leni64(value)
-			memtable.sortedMap = &persistentSortedMap{root: blackenedNode, count: count, bytes: bytes}
+		pair.Key = memtable.arena.copy(pair.Key)
+	}
+	pair.Value = memtable.arena.copy(pair.Value)
+	atomic.StoreInt64(&memtable.arenaBytes, memtable.arena.size())
+	memtable.arenaLock.Unlock()
+
+	for {
+		sortedMap := memtable.load()
+		written := sortedMap.write(memtable.comparator, pair)
+		if written == sortedMap {
+			return
+		}
+		if atomic.CompareAndSwapPointer(&memtable.sortedMap, unsafe.Pointer(sortedMap), unsafe.Pointer(written)) {
+			return
 		}
 	}
 }
 
-func (memtable *Memtable) Bytes() int64 {
-	return memtable.sortedMap.bytes
+// Deletes every key between start and end inclusive with a range tombstone. The start
+// and end are copied into the memtable's arena, so the caller is free to reuse them.
+func (memtable *TreeMemtable) DeleteRange(start, end []byte) {
+	memtable.arenaLock.Lock()
+	start, end = memtable.arena.copy(start), memtable.arena.copy(end)
+	atomic.StoreInt64(&memtable.arenaBytes, memtable.arena.size())
+	memtable.arenaLock.Unlock()
+
+	for {
+		sortedMap := memtable.load()
+		deleted := sortedMap.deleteRange(memtable.comparator, start, end)
+		if atomic.CompareAndSwapPointer(&memtable.sortedMap, unsafe.Pointer(sortedMap), unsafe.Pointer(deleted)) {
+			return
+		}
+	}
+}
+
+// Returns the range tombstones written to the memtable.
+func (memtable *TreeMemtable) RangeTombstones() []common.RangeTombstone {
+	return memtable.load().rangeTombstones
+}
+
+// Returns the bytes copied into the memtable's arena, including values which have since
+// been overwritten, along with the overhead of each entry of the tree and each range
+// tombstone.
+func (memtable *TreeMemtable) Bytes() int64 {
+	sortedMap := memtable.load()
+	return atomic.LoadInt64(&memtable.arenaBytes) + sortedMap.count*treeEntryOverhead + int64(len(sortedMap.rangeTombstones))*rangeTombstoneOverhead
+}
+
+// Returns the number of keys held by the memtable.
+func (memtable *TreeMemtable) Entries() int64 {
+	return memtable.load().count
 }
 
-func addNode(root persistentNode, key, value []byte) (persistentNode, bool) {
+// Returns the number of keys held by the memtable whose value is a tombstone.
+func (memtable *TreeMemtable) Tombstones() int64 {
+	return memtable.load().tombstones
+}
+
+// Returns a new version of the sorted map with the pair written. Returns the same
+// version if the key is already mapped to the same value by the same type of record.
+func (sortedMap *persistentSortedMap) write(comparator c.Comparator, pair common.Pair) *persistentSortedMap {
+	if sortedMap.getRoot() == nil {
+		root := &redNode{pair: pair}
+		return &persistentSortedMap{root: root, count: 1, tombstones: isTombstone(pair), rangeTombstones: sortedMap.rangeTombstones}
+	}
+
+	node, existed := addNode(comparator, sortedMap.getRoot(), pair)
+	if !existed {
+		blackenedNode := node.blacken()
+		count := sortedMap.count + 1
+		tombstones := sortedMap.tombstones + isTombstone(pair)
+		return &persistentSortedMap{root: blackenedNode, count: count, tombstones: tombstones, rangeTombstones: sortedMap.rangeTombstones}
+	}
+	if samePair(node.getPair(), pair) {
+		return sortedMap
+	}
+	tombstones := (sortedMap.tombstones - isTombstone(node.getPair())) + isTombstone(pair)
+	root := replaceNode(comparator, sortedMap.getRoot(), pair)
+	return &persistentSortedMap{root: root, count: sortedMap.count, tombstones: tombstones, rangeTombstones: sortedMap.rangeTombstones}
+}
+
+// Returns a new version of the sorted map with the range tombstone added. Every key
+// already in the sorted map which the range tombstone covers is written as a tombstone,
+// since the range tombstone only hides older data once it is flushed alongside them.
+func (sortedMap *persistentSortedMap) deleteRange(comparator c.Comparator, start, end []byte) *persistentSortedMap {
+	rangeTombstones := make([]common.RangeTombstone, len(sortedMap.rangeTombstones), len(sortedMap.rangeTombstones)+1)
+	copy(rangeTombstones, sortedMap.rangeTombstones)
+	rangeTombstones = append(rangeTombstones, common.RangeTombstone{Start: start, End: end})
+	deleted := &persistentSortedMap{root: sortedMap.root, count: sortedMap.count, tombstones: sortedMap.tombstones, rangeTombstones: rangeTombstones}
+
+	covered := first(sortedMap.getRoot(), func(k []byte) bool {
+		return comparator.Compare(k, start) != c.LESS_THAN
+	}, []persistentNode{})
+	for ; len(covered) > 0 && comparator.Compare(covered[len(covered)-1].getPair().Key, end) != c.GREATER_THAN; covered = successor(covered) {
+		deleted = deleted.write(comparator, common.Pair{Key: covered[len(covered)-1].getPair().Key, Value: []byte{}, Type: common.DELETE})
+	}
+	return deleted
+}
+
+func addNode(comparator c.Comparator, root persistentNode, pair common.Pair) (persistentNode, bool) {
 	if root == nil {
-		pair := common.Pair{Key: key, Value: value}
 		return &redNode{pair: pair}, false
 	}
 
-	comparison := c.Compare(key, root.getPair().Key)
+	comparison := comparator.Compare(pair.Key, root.getPair().Key)
 	if comparison == c.EQUAL {
 		return root, true
 	} else {
 		var node persistentNode
 		var existed bool
 		if comparison == c.LESS_THAN {
-			node, existed = addNode(root.getLeft(), key, value)
+			node, existed = addNode(comparator, root.getLeft(), pair)
 		} else {
-			node, existed = addNode(root.getRight(), key, value)
+			node, existed = addNode(comparator, root.getRight(), pair)
 		}
 		if existed {
 			return node, true
@@ -371,30 +548,32 @@ func addNode(root persistentNode, key, value []byte) (persistentNode, bool) {
 	}
 }
 
-func replaceNode(root persistentNode, key, value []byte) persistentNode {
-	comparison := c.Compare(key, root.getPair().Key)
-	var newValue []byte
-	var left persistentNode
-	var right persistentNode
+func replaceNode(comparator c.Comparator, root persistentNode, pair common.Pair) persistentNode {
+	comparison := comparator.Compare(pair.Key, root.getPair().Key)
 	switch comparison {
-	case c.EQUAL:
-		newValue = value
-		left = root.getLeft()
-		right = root.getRight()
 	case c.LESS_THAN:
-		newValue = root.getPair().Value
-		left = replaceNode(root.getLeft(), key, value)
-		right = root.getRight()
+		return root.replace(root.getPair(), replaceNode(comparator, root.getLeft(), pair), root.getRight())
 	case c.GREATER_THAN:
-		left = root.getLeft()
-		right = replaceNode(root.getRight(), key, value)
-		newValue = root.getPair().Value
+		return root.replace(root.getPair(), root.getLeft(), replaceNode(comparator, root.getRight(), pair))
+	default:
+		return root.replace(pair, root.getLeft(), root.getRight())
 	}
-
-	pair := common.Pair{Key: key, Value: newValue}
-	return root.replace(pair, left, right)
 }
 
 func leni64(bytes []byte) int64 {
 	return int64(len(bytes))
 }
+
+// Returns 1 if the pair is a tombstone and 0 otherwise, for counting tombstones.
+func isTombstone(pair common.Pair) int64 {
+	if pair.IsTombstone() {
+		return 1
+	}
+	return 0
+}
+
+// Returns whether two pairs for the same key hold the same value written by the same
+// type of record with the same expiry.
+func samePair(pair, other common.Pair) bool {
+	return pair.Type == other.Type && pair.Expiry == other.Expiry && c.Compare(pair.Value, other.Value) == c.EQUAL
+}
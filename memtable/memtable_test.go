@@ -2,6 +2,7 @@ package memtable
 
 import (
 	"math/rand"
+	"sync"
 	"testing"
 
 	"github.com/patrickgombert/lsmt/common"
@@ -10,8 +11,8 @@ import (
 
 func TestGetNoKey(t *testing.T) {
 	mt := NewMemtable()
-	val, found := mt.Get([]byte{0})
-	if val != nil {
+	pair, found := mt.Get([]byte{0})
+	if pair.Value != nil {
 		t.Error("Expected empty map to not produce a value for Get(), but a value was produced")
 	}
 	if found {
@@ -24,7 +25,8 @@ func TestGetValue(t *testing.T) {
 	key := []byte{1}
 	value := []byte{0}
 	mt.Write(key, value)
-	val, found := mt.Get(key)
+	pair, found := mt.Get(key)
+	val := pair.Value
 	if !found {
 		t.Errorf("Expected key %q to be found, but was not found", key)
 	}
@@ -37,13 +39,27 @@ func TestGetDeletedValue(t *testing.T) {
 	mt := NewMemtable()
 	key := []byte{1}
 	mt.Write(key, []byte{1})
-	mt.Write(key, common.Tombstone)
-	val, found := mt.Get(key)
+	mt.Delete(key)
+	pair, found := mt.Get(key)
 	if !found {
 		t.Error("Expected to find tombstoned record, but did not find one")
 	}
-	if c.Compare(val, common.Tombstone) != c.EQUAL {
-		t.Errorf("Expected %q to be a tombstone", val)
+	if !pair.IsTombstone() {
+		t.Errorf("Expected %q to be a tombstone", pair.Value)
+	}
+}
+
+func TestEmptyValueIsNotATombstone(t *testing.T) {
+	mt := NewMemtable()
+	key := []byte{1}
+	mt.Delete(key)
+	mt.Write(key, []byte{})
+	pair, found := mt.Get(key)
+	if !found || pair.IsTombstone() || len(pair.Value) != 0 {
+		t.Errorf("Expected an empty put to replace the tombstone, but got %q of type %d", pair.Value, pair.Type)
+	}
+	if mt.Tombstones() != 0 {
+		t.Errorf("Expected 0 tombstones but got %d", mt.Tombstones())
 	}
 }
 
@@ -53,13 +69,222 @@ func TestInsertAndGetRandomValues(t *testing.T) {
 		key := randomBytes(1, 100)
 		value := randomBytes(0, 100)
 		mt.Write(key, value)
-		found, _ := mt.Get(key)
+		pair, _ := mt.Get(key)
+		found := pair.Value
 		if c.Compare(found, value) != c.EQUAL {
 			t.Errorf("Expected value for key %q to equal %q but got %q", key, found, value)
 		}
 	}
 }
 
+func TestOverwriteKeepsOtherKeys(t *testing.T) {
+	mt := NewMemtable()
+	for i := byte(0); i < 8; i++ {
+		mt.Write([]byte{i}, []byte{i})
+	}
+	mt.Write([]byte{7}, []byte{9})
+	mt.Write([]byte{3}, []byte{3})
+
+	for i := byte(0); i < 8; i++ {
+		expected := []byte{i}
+		if i == 7 {
+			expected = []byte{9}
+		}
+		pair, found := mt.Get([]byte{i})
+		val := pair.Value
+		if !found || c.Compare(val, expected) != c.EQUAL {
+			t.Errorf("Expected value for key %q to equal %q but got %q", []byte{i}, expected, val)
+		}
+	}
+}
+
+func TestWriteCopiesKeysAndValues(t *testing.T) {
+	mt := NewMemtable()
+	key := []byte{1}
+	value := []byte{2}
+	mt.Write(key, value)
+	key[0] = 9
+	value[0] = 9
+
+	pair, found := mt.Get([]byte{1})
+	val := pair.Value
+	if !found || c.Compare(val, []byte{2}) != c.EQUAL {
+		t.Errorf("Expected reusing the written buffers to not change the memtable, but got %q", val)
+	}
+	pair, found = mt.Get([]byte{9})
+	val = pair.Value
+	if found {
+		t.Errorf("Expected reusing the written key to not change the memtable, but got %q", val)
+	}
+}
+
+func TestEntriesAndTombstones(t *testing.T) {
+	mt := NewMemtable()
+	mt.Write([]byte{1}, []byte{1})
+	mt.Write([]byte{2}, []byte{2})
+	mt.Delete([]byte{1})
+	mt.Delete([]byte{3})
+
+	if mt.Entries() != 3 {
+		t.Errorf("Expected 3 entries but got %d", mt.Entries())
+	}
+	if mt.Tombstones() != 2 {
+		t.Errorf("Expected 2 tombstones but got %d", mt.Tombstones())
+	}
+
+	mt.Write([]byte{1}, []byte{9})
+	if mt.Tombstones() != 1 {
+		t.Errorf("Expected overwriting a tombstone to leave 1 tombstone but got %d", mt.Tombstones())
+	}
+}
+
+func TestBytesIncludesEntryOverhead(t *testing.T) {
+	mt := NewMemtable()
+	mt.Write([]byte{1}, []byte{1, 2})
+	expected := 3 + treeEntryOverhead
+	if mt.Bytes() != expected {
+		t.Errorf("Expected %d bytes but got %d", expected, mt.Bytes())
+	}
+
+	mt.Delete([]byte{1})
+	if mt.Bytes() < expected {
+		t.Errorf("Expected deleting a key to not shrink the memtable below %d bytes, but got %d", expected, mt.Bytes())
+	}
+}
+
+func TestOverwriteDoesNotCopyKey(t *testing.T) {
+	mt := NewMemtable()
+	mt.Write([]byte{1, 2, 3}, []byte{1})
+	written := mt.Bytes()
+
+	mt.Write([]byte{1, 2, 3}, []byte{2, 3})
+	expected := written + 2
+	if mt.Bytes() != expected {
+		t.Errorf("Expected %d bytes but got %d", expected, mt.Bytes())
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	mt := NewMemtable()
+	for i := byte(1); i <= 4; i++ {
+		mt.Write([]byte{i}, []byte{i})
+	}
+	mt.DeleteRange([]byte{2}, []byte{3})
+
+	for i := byte(1); i <= 4; i++ {
+		deleted := i == 2 || i == 3
+		pair, found := mt.Get([]byte{i})
+		if !found || pair.IsTombstone() != deleted || (!deleted && c.Compare(pair.Value, []byte{i}) != c.EQUAL) {
+			t.Errorf("Expected key %q to be deleted (%t) but got %q of type %d", []byte{i}, deleted, pair.Value, pair.Type)
+		}
+	}
+	if len(mt.RangeTombstones()) != 1 || mt.Tombstones() != 2 {
+		t.Errorf("Expected 1 range tombstone and 2 tombstones, but got %d and %d", len(mt.RangeTombstones()), mt.Tombstones())
+	}
+	if len(common.RangeTombstonesOf(mt.UnboundedIterator())) != 1 {
+		t.Error("Expected the memtable's iterator to carry the range tombstone, but did not")
+	}
+
+	mt.Write([]byte{2}, []byte{9})
+	pair, _ := mt.Get([]byte{2})
+	val := pair.Value
+	if c.Compare(val, []byte{9}) != c.EQUAL {
+		t.Errorf("Expected a write after the range deletion to be kept, but got %q", val)
+	}
+}
+
+func TestIteratorOrdersKeysByComparator(t *testing.T) {
+	mt := NewTreeMemtableWithComparator(c.ReverseBytewiseComparator{})
+	for i := byte(1); i <= 4; i++ {
+		mt.Write([]byte{i}, []byte{i})
+	}
+
+	iter := mt.Iterator([]byte{3}, []byte{2})
+	defer iter.Close()
+
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.CompareNext(iter, false, t)
+}
+
+func TestMergeWritesMergeRecord(t *testing.T) {
+	mt := NewMemtable()
+	mt.Write([]byte{1}, []byte{1})
+	mt.Merge([]byte{1}, []byte{2})
+
+	pair, found := mt.Get([]byte{1})
+	if !found || pair.Type != common.MERGE || c.Compare(pair.Value, []byte{2}) != c.EQUAL {
+		t.Errorf("Expected a merge record holding %q, but got %q of type %d", []byte{2}, pair.Value, pair.Type)
+	}
+	if mt.Entries() != 1 || mt.Tombstones() != 0 {
+		t.Errorf("Expected 1 entry and 0 tombstones, but got %d and %d", mt.Entries(), mt.Tombstones())
+	}
+}
+
+func TestSingleDeleteWritesSingleDeleteRecord(t *testing.T) {
+	mt := NewMemtable()
+	mt.Write([]byte{1}, []byte{1})
+	mt.SingleDelete([]byte{1})
+
+	pair, found := mt.Get([]byte{1})
+	if !found || pair.Type != common.SINGLE_DELETE {
+		t.Errorf("Expected a single delete record, but got %q of type %d", pair.Value, pair.Type)
+	}
+	if mt.Entries() != 1 || mt.Tombstones() != 1 {
+		t.Errorf("Expected 1 entry and 1 tombstone, but got %d and %d", mt.Entries(), mt.Tombstones())
+	}
+}
+
+func TestWriteWithExpiryKeepsExpiry(t *testing.T) {
+	mt := NewMemtable()
+	mt.WriteWithExpiry([]byte{1}, []byte{1}, 10)
+	mt.WriteWithExpiry([]byte{1}, []byte{1}, 20)
+
+	pair, found := mt.Get([]byte{1})
+	if !found || pair.Type != common.PUT || pair.Expiry != 20 {
+		t.Errorf("Expected a put expiring at 20, but got type %d expiring at %d", pair.Type, pair.Expiry)
+	}
+	iter := mt.UnboundedIterator()
+	defer iter.Close()
+	iter.Next()
+	iterated, _ := iter.Get()
+	if iterated.Expiry != 20 {
+		t.Errorf("Expected iterator to produce a pair expiring at 20, but got %d", iterated.Expiry)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	mt := NewMemtable()
+	var wg sync.WaitGroup
+	for w := byte(0); w < 8; w++ {
+		wg.Add(1)
+		go func(w byte) {
+			defer wg.Done()
+			for i := byte(0); i < 100; i++ {
+				mt.Write([]byte{w, i}, []byte{i})
+				mt.Get([]byte{w, i})
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for w := byte(0); w < 8; w++ {
+		for i := byte(0); i < 100; i++ {
+			pair, found := mt.Get([]byte{w, i})
+			val := pair.Value
+			if !found || c.Compare(val, []byte{i}) != c.EQUAL {
+				t.Errorf("Expected value for key %q to equal %q but got %q", []byte{w, i}, []byte{i}, val)
+			}
+		}
+	}
+	expected := 8 * 100 * (3 + treeEntryOverhead)
+	if mt.Bytes() != expected {
+		t.Errorf("Expected %d bytes but got %d", expected, mt.Bytes())
+	}
+}
+
 func randomBytes(minSize, maxSize int) []byte {
 	size := rand.Intn(maxSize-minSize) + minSize
 	ret := make([]byte, size)
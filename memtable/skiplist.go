@@ -0,0 +1,280 @@
+package memtable
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/patrickgombert/lsmt/common"
+	c "github.com/patrickgombert/lsmt/comparator"
+)
+
+const (
+	// The maximum height of a skiplist node's tower.
+	SKIPLIST_MAX_HEIGHT = 12
+	// The inverse of the probability that a node's tower grows by another level.
+	SKIPLIST_BRANCHING = 4
+)
+
+// A node of the skiplist. The key and tower are never modified once the node is linked
+// into the skiplist. Both the value and the tower's links are read and written
+// atomically.
+type skiplistNode struct {
+	key   []byte
+	value unsafe.Pointer
+	tower []unsafe.Pointer
+}
+
+// The value of a node along with the type of record which wrote it, its expiry and the
+// sequence of the write. A value is replaced as a whole so that readers never see a
+// value paired with the wrong type or expiry. The value it replaced is kept so that
+// iterators can read the node as it was when they were created.
+type skiplistValue struct {
+	value      []byte
+	recordType common.RecordType
+	expiry     int64
+	sequence   uint64
+	previous   *skiplistValue
+}
+
+// A memtable backed by a skiplist whose nodes are allocated from an arena. Reads never
+// take a lock and may run concurrently with a write, but only a single writer may write
+// to the skiplist at a time. A new node is fully built before it is linked into each
+// level of the skiplist from the bottom up, so readers either see the node or do not.
+// Every write is stamped with the next sequence, which is published once the write is
+// visible. Keys are ordered by the memtable's comparator.
+type SkiplistMemtable struct {
+	arena           *arena
+	head            *skiplistNode
+	height          int32
+	bytes           int64
+	entries         int64
+	tombstones      int64
+	rangeTombstones unsafe.Pointer
+	random          *rand.Rand
+	comparator      c.Comparator
+	sequence        uint64
+	headBytes       int64
+}
+
+// Creates a new instance of a SkiplistMemtable which orders keys bytewise.
+func NewSkiplistMemtable() *SkiplistMemtable {
+	return NewSkiplistMemtableWithComparator(c.BytewiseComparator{})
+}
+
+// Creates a new instance of a SkiplistMemtable which orders keys by the comparator.
+func NewSkiplistMemtableWithComparator(comparator c.Comparator) *SkiplistMemtable {
+	a := newArena()
+	head := a.newNode(common.Pair{}, SKIPLIST_MAX_HEIGHT, 0)
+	return &SkiplistMemtable{
+		arena:           a,
+		head:            head,
+		height:          1,
+		headBytes:       a.size(),
+		rangeTombstones: unsafe.Pointer(&[]common.RangeTombstone{}),
+		random:          rand.New(rand.NewSource(time.Now().UnixNano())),
+		comparator:      comparator,
+	}
+}
+
+// Returns the pair for a given key. The second return value signals whether the key was
+// found or not found.
+func (skiplist *SkiplistMemtable) Get(key []byte) (common.Pair, bool) {
+	node := skiplist.first(func(k []byte) bool {
+		return skiplist.comparator.Compare(k, key) != c.LESS_THAN
+	})
+	if node == nil || skiplist.comparator.Compare(node.key, key) != c.EQUAL {
+		return common.Pair{}, false
+	}
+	return node.getPair(), true
+}
+
+// Writes a key/value pair to the memtable. The key and value are copied into the
+// skiplist's arena, so the caller is free to reuse them. Must not be invoked
+// concurrently with another Write.
+func (skiplist *SkiplistMemtable) Write(key, value []byte) {
+	skiplist.write(common.Pair{Key: key, Value: value, Type: common.PUT})
+}
+
+// Writes a key/value pair which expires at the given time, in nanoseconds since the
+// unix epoch, to the memtable. Must not be invoked concurrently with another Write.
+func (skiplist *SkiplistMemtable) WriteWithExpiry(key, value []byte, expiry int64) {
+	skiplist.write(common.Pair{Key: key, Value: value, Type: common.PUT, Expiry: expiry})
+}
+
+// Writes a tombstone for the key to the memtable. Must not be invoked concurrently
+// with another Write.
+func (skiplist *SkiplistMemtable) Delete(key []byte) {
+	skiplist.write(common.Pair{Key: key, Value: []byte{}, Type: common.DELETE})
+}
+
+// Writes a single delete tombstone for the key to the memtable. Must not be invoked
+// concurrently with another Write.
+func (skiplist *SkiplistMemtable) SingleDelete(key []byte) {
+	skiplist.write(common.Pair{Key: key, Value: []byte{}, Type: common.SINGLE_DELETE})
+}
+
+// Writes a merge record holding the operand for the key to the memtable. Must not be
+// invoked concurrently with another Write.
+func (skiplist *SkiplistMemtable) Merge(key, operand []byte) {
+	skiplist.write(common.Pair{Key: key, Value: operand, Type: common.MERGE})
+}
+
+// Writes a pair to the skiplist, either replacing the value of an existing node or
+// linking in a new node, and publishes the write's sequence.
+func (skiplist *SkiplistMemtable) write(pair common.Pair) {
+	sequence := atomic.LoadUint64(&skiplist.sequence) + 1
+	var previous [SKIPLIST_MAX_HEIGHT]*skiplistNode
+	node := skiplist.head
+	for level := int(atomic.LoadInt32(&skiplist.height)) - 1; level >= 0; level-- {
+		for next := node.next(level); next != nil && skiplist.comparator.Compare(next.key, pair.Key) == c.LESS_THAN; next = node.next(level) {
+			node = next
+		}
+		previous[level] = node
+	}
+
+	if existing := node.next(0); existing != nil && skiplist.comparator.Compare(existing.key, pair.Key) == c.EQUAL {
+		old := existing.getPair()
+		if samePair(old, pair) {
+			return
+		}
+		atomic.StorePointer(&existing.value, unsafe.Pointer(skiplist.arena.newValue(pair, sequence, existing.loadValue())))
+		skiplist.updateBytes()
+		atomic.AddInt64(&skiplist.tombstones, isTombstone(pair)-isTombstone(old))
+		atomic.StoreUint64(&skiplist.sequence, sequence)
+		return
+	}
+
+	height := skiplist.randomHeight()
+	current := int(atomic.LoadInt32(&skiplist.height))
+	for level := current; level < height; level++ {
+		previous[level] = skiplist.head
+	}
+	if height > current {
+		atomic.StoreInt32(&skiplist.height, int32(height))
+	}
+
+	inserted := skiplist.arena.newNode(pair, height, sequence)
+	for level := 0; level < height; level++ {
+		atomic.StorePointer(&inserted.tower[level], unsafe.Pointer(previous[level].next(level)))
+		atomic.StorePointer(&previous[level].tower[level], unsafe.Pointer(inserted))
+	}
+	skiplist.updateBytes()
+	atomic.AddInt64(&skiplist.entries, 1)
+	atomic.AddInt64(&skiplist.tombstones, isTombstone(pair))
+	atomic.StoreUint64(&skiplist.sequence, sequence)
+}
+
+// Deletes every key between start and end inclusive with a range tombstone. Every key
+// already in the skiplist which the range tombstone covers is written as a tombstone,
+// since the range tombstone only hides older data once it is flushed alongside them.
+// Must not be invoked concurrently with another Write.
+func (skiplist *SkiplistMemtable) DeleteRange(start, end []byte) {
+	node := skiplist.first(func(k []byte) bool {
+		return skiplist.comparator.Compare(k, start) != c.LESS_THAN
+	})
+	for ; node != nil && skiplist.comparator.Compare(node.key, end) != c.GREATER_THAN; node = node.next(0) {
+		skiplist.Delete(node.key)
+	}
+
+	previous := skiplist.RangeTombstones()
+	rangeTombstones := make([]common.RangeTombstone, len(previous), len(previous)+1)
+	copy(rangeTombstones, previous)
+	rangeTombstones = append(rangeTombstones, common.RangeTombstone{Start: skiplist.arena.copy(start), End: skiplist.arena.copy(end)})
+	atomic.StorePointer(&skiplist.rangeTombstones, unsafe.Pointer(&rangeTombstones))
+	skiplist.updateBytes()
+}
+
+// Returns the range tombstones written to the memtable.
+func (skiplist *SkiplistMemtable) RangeTombstones() []common.RangeTombstone {
+	return *(*[]common.RangeTombstone)(atomic.LoadPointer(&skiplist.rangeTombstones))
+}
+
+// Returns the number of bytes the skiplist has allocated from its arena, including the
+// overhead of its nodes and range tombstones. Values which have been overwritten still
+// count towards the size since their memory is held until the skiplist is released.
+func (skiplist *SkiplistMemtable) Bytes() int64 {
+	return atomic.LoadInt64(&skiplist.bytes)
+}
+
+// Returns the number of keys held by the memtable.
+func (skiplist *SkiplistMemtable) Entries() int64 {
+	return atomic.LoadInt64(&skiplist.entries)
+}
+
+// Returns the number of keys held by the memtable whose value is a tombstone.
+func (skiplist *SkiplistMemtable) Tombstones() int64 {
+	return atomic.LoadInt64(&skiplist.tombstones)
+}
+
+// Records the bytes allocated from the arena along with the overhead of each range
+// tombstone. The head node is left out so that an empty skiplist uses no bytes.
+func (skiplist *SkiplistMemtable) updateBytes() {
+	rangeTombstones := int64(len(skiplist.RangeTombstones()))
+	atomic.StoreInt64(&skiplist.bytes, skiplist.arena.size()-skiplist.headBytes+rangeTombstones*rangeTombstoneOverhead)
+}
+
+// Returns the least node whose key satisfies within, or nil if there is no such node.
+// The within function must hold for every key after the first key it holds for.
+func (skiplist *SkiplistMemtable) first(within func([]byte) bool) *skiplistNode {
+	node := skiplist.head
+	for level := int(atomic.LoadInt32(&skiplist.height)) - 1; level >= 0; level-- {
+		for next := node.next(level); next != nil && !within(next.key); next = node.next(level) {
+			node = next
+		}
+	}
+	return node.next(0)
+}
+
+// Returns the greatest node whose key satisfies within, or nil if there is no such
+// node. The within function must hold for every key before the last key it holds for.
+func (skiplist *SkiplistMemtable) last(within func([]byte) bool) *skiplistNode {
+	node := skiplist.head
+	for level := int(atomic.LoadInt32(&skiplist.height)) - 1; level >= 0; level-- {
+		for next := node.next(level); next != nil && within(next.key); next = node.next(level) {
+			node = next
+		}
+	}
+	if node == skiplist.head {
+		return nil
+	}
+	return node
+}
+
+// Returns a random tower height where each additional level is SKIPLIST_BRANCHING
+// times less likely than the last.
+func (skiplist *SkiplistMemtable) randomHeight() int {
+	height := 1
+	for height < SKIPLIST_MAX_HEIGHT && skiplist.random.Intn(SKIPLIST_BRANCHING) == 0 {
+		height++
+	}
+	return height
+}
+
+// Returns the node following this node at the given level of the skiplist.
+func (node *skiplistNode) next(level int) *skiplistNode {
+	return (*skiplistNode)(atomic.LoadPointer(&node.tower[level]))
+}
+
+func (node *skiplistNode) loadValue() *skiplistValue {
+	return (*skiplistValue)(atomic.LoadPointer(&node.value))
+}
+
+func (node *skiplistNode) getPair() common.Pair {
+	value := node.loadValue()
+	return common.Pair{Key: node.key, Value: value.value, Type: value.recordType, Expiry: value.expiry}
+}
+
+// Returns the pair of the node as of the given sequence. The second return value is
+// false if the node was written after the sequence.
+func (node *skiplistNode) getPairAt(sequence uint64) (common.Pair, bool) {
+	value := node.loadValue()
+	for value != nil && value.sequence > sequence {
+		value = value.previous
+	}
+	if value == nil {
+		return common.Pair{}, false
+	}
+	return common.Pair{Key: node.key, Value: value.value, Type: value.recordType, Expiry: value.expiry}, true
+}
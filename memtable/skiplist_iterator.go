@@ -0,0 +1,160 @@
+package memtable
+
+import (
+	"sync/atomic"
+
+	"github.com/patrickgombert/lsmt/common"
+	c "github.com/patrickgombert/lsmt/comparator"
+)
+
+// Iterator over the nodes of a skiplist. Moving forward follows the bottom level of the
+// skiplist while moving backward searches for the node preceding the current node. The
+// iterator reads the skiplist as of the sequence published when it was created, so
+// nodes written since are skipped and overwritten nodes are read at their older value.
+type skiplistIterator struct {
+	skiplist        *SkiplistMemtable
+	rangeTombstones []common.RangeTombstone
+	sequence        uint64
+	opts            common.IterOptions
+	node            *skiplistNode
+	pair            common.Pair
+	position        common.Position
+}
+
+// Creates a new bounded iterator over the memtable.
+func (skiplist *SkiplistMemtable) Iterator(start, end []byte) common.Iterator {
+	return skiplist.IteratorWithOptions(common.IterOptions{LowerBound: start, UpperBound: end})
+}
+
+// Creates a new unbounded iterator over the memtable.
+func (skiplist *SkiplistMemtable) UnboundedIterator() common.Iterator {
+	return skiplist.IteratorWithOptions(common.IterOptions{})
+}
+
+// Creates a new iterator over the memtable which honours the bounds and limit of the
+// options provided. Keys are ordered by the memtable's comparator.
+func (skiplist *SkiplistMemtable) IteratorWithOptions(opts common.IterOptions) common.Iterator {
+	opts.Comparator = skiplist.comparator
+	sequence := atomic.LoadUint64(&skiplist.sequence)
+	var iter common.Iterator = &skiplistIterator{skiplist: skiplist, rangeTombstones: skiplist.RangeTombstones(), sequence: sequence, opts: opts}
+	if opts.Limit > 0 {
+		iter = common.NewLimitIterator(iter, opts.Limit)
+	}
+	return iter
+}
+
+// Moves the iterator forward. Returns false when either the end of the skiplist has
+// been reached or if the upper bound has been passed (if the iterator is bounded).
+func (iter *skiplistIterator) Next() (bool, error) {
+	switch iter.position {
+	case common.UNPOSITIONED, common.BEFORE_FIRST:
+		return iter.SeekToFirst()
+	case common.AT_PAIR:
+		iter.node = iter.node.next(0)
+	case common.AFTER_LAST:
+		return false, nil
+	}
+	return iter.settle(common.AFTER_LAST), nil
+}
+
+// Moves the iterator backward. Returns false when either the start of the skiplist has
+// been reached or if the lower bound has been passed (if the iterator is bounded).
+func (iter *skiplistIterator) Prev() (bool, error) {
+	switch iter.position {
+	case common.UNPOSITIONED, common.AFTER_LAST:
+		return iter.SeekToLast()
+	case common.AT_PAIR:
+		iter.node = iter.previous(iter.node)
+	case common.BEFORE_FIRST:
+		return false, nil
+	}
+	return iter.settle(common.BEFORE_FIRST), nil
+}
+
+// Positions the iterator at the first pair within the lower bound (if the iterator is
+// bounded).
+func (iter *skiplistIterator) SeekToFirst() (bool, error) {
+	iter.node = iter.skiplist.first(iter.opts.WithinLowerBound)
+	return iter.settle(common.AFTER_LAST), nil
+}
+
+// Positions the iterator at the first pair whose key is greater than or equal to key.
+func (iter *skiplistIterator) Seek(key []byte) (bool, error) {
+	iter.node = iter.skiplist.first(func(k []byte) bool {
+		return iter.opts.WithinLowerBound(k) && iter.opts.GetComparator().Compare(k, key) != c.LESS_THAN
+	})
+	return iter.settle(common.AFTER_LAST), nil
+}
+
+// Positions the iterator at the last pair within the upper bound (if the iterator is
+// bounded).
+func (iter *skiplistIterator) SeekToLast() (bool, error) {
+	iter.node = iter.skiplist.last(iter.opts.WithinUpperBound)
+	return iter.settle(common.BEFORE_FIRST), nil
+}
+
+// Positions the iterator at the last pair whose key is less than or equal to key.
+func (iter *skiplistIterator) SeekForPrev(key []byte) (bool, error) {
+	iter.node = iter.skiplist.last(func(k []byte) bool {
+		return iter.opts.WithinUpperBound(k) && iter.opts.GetComparator().Compare(k, key) != c.GREATER_THAN
+	})
+	return iter.settle(common.BEFORE_FIRST), nil
+}
+
+// Returns the range tombstones of the memtable at the time the iterator was created.
+func (iter *skiplistIterator) RangeTombstones() []common.RangeTombstone {
+	return iter.rangeTombstones
+}
+
+// Returns whether the iterator is positioned at a pair.
+func (iter *skiplistIterator) Valid() bool {
+	return iter.position == common.AT_PAIR
+}
+
+// Returns the current element's Pair.
+func (iter *skiplistIterator) Get() (*common.Pair, error) {
+	if iter.position != common.AT_PAIR {
+		return nil, nil
+	}
+	pair := iter.pair
+	return &pair, nil
+}
+
+// Closes the instance of the iterator which has the effect of making subsequent calls
+// to Next() return false and Get() return nil.
+func (iter *skiplistIterator) Close() error {
+	iter.node = nil
+	iter.position = common.AFTER_LAST
+	return nil
+}
+
+// Records the iterator's position after the node has been moved, moving on towards the
+// given end past nodes written after the iterator was created. If there is no node or
+// the node falls outside of the iterator's bounds then the iterator is positioned at
+// the given end.
+func (iter *skiplistIterator) settle(exhausted common.Position) bool {
+	for iter.node != nil && iter.opts.WithinBounds(iter.node.key) {
+		pair, visible := iter.node.getPairAt(iter.sequence)
+		if visible {
+			iter.pair = pair
+			iter.position = common.AT_PAIR
+			return true
+		}
+		if exhausted == common.AFTER_LAST {
+			iter.node = iter.node.next(0)
+		} else {
+			iter.node = iter.previous(iter.node)
+		}
+	}
+	iter.node = nil
+	iter.position = exhausted
+	return false
+}
+
+// Returns the node preceding the given node, or nil if it is the first node.
+func (iter *skiplistIterator) previous(node *skiplistNode) *skiplistNode {
+	key := node.key
+	return iter.skiplist.last(func(k []byte) bool {
+		return iter.opts.GetComparator().Compare(k, key) == c.LESS_THAN
+	})
+}
@@ -0,0 +1,367 @@
+package memtable
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/patrickgombert/lsmt/common"
+	c "github.com/patrickgombert/lsmt/comparator"
+)
+
+func TestSkiplistGetNoKey(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	pair, found := mt.Get([]byte{0})
+	val := pair.Value
+	if val != nil || found {
+		t.Errorf("Expected empty skiplist to not find a value for Get(), but got %q", val)
+	}
+}
+
+func TestSkiplistInsertAndGetRandomValues(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	written := map[string][]byte{}
+	for i := 0; i < 1000; i++ {
+		key := randomBytes(1, 10)
+		value := randomBytes(0, 10)
+		mt.Write(key, value)
+		written[string(key)] = value
+	}
+
+	var bytes int64
+	for key, value := range written {
+		pair, _ := mt.Get([]byte(key))
+		found := pair.Value
+		if c.Compare(found, value) != c.EQUAL {
+			t.Errorf("Expected value for key %q to equal %q but got %q", key, value, found)
+		}
+		bytes += int64(len(key) + len(value))
+	}
+	if mt.Bytes() <= bytes {
+		t.Errorf("Expected more than %d bytes including node overhead but got %d", bytes, mt.Bytes())
+	}
+}
+
+func TestSkiplistBytesIncludesNodeOverhead(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	if mt.Bytes() != 0 {
+		t.Errorf("Expected an empty skiplist to use 0 bytes but got %d", mt.Bytes())
+	}
+
+	mt.Write([]byte{1, 2}, []byte{3, 4, 5})
+	node := mt.head.next(0)
+	expected := nodeOverhead + linkOverhead*int64(len(node.tower)) + valueOverhead + 5
+	if mt.Bytes() != expected {
+		t.Errorf("Expected %d bytes but got %d", expected, mt.Bytes())
+	}
+}
+
+func TestSkiplistCopiesKeysAndValues(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	key := []byte{1}
+	value := []byte{2}
+	mt.Write(key, value)
+	key[0] = 9
+	value[0] = 9
+
+	pair, found := mt.Get([]byte{1})
+	val := pair.Value
+	if !found || c.Compare(val, []byte{2}) != c.EQUAL {
+		t.Errorf("Expected reusing the written buffers to not change the skiplist, but got %q", val)
+	}
+	pair, found = mt.Get([]byte{9})
+	val = pair.Value
+	if found {
+		t.Errorf("Expected reusing the written key to not change the skiplist, but got %q", val)
+	}
+}
+
+func TestSkiplistOverwrite(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	mt.Write([]byte{1}, []byte{1})
+	mt.Delete([]byte{1})
+
+	pair, found := mt.Get([]byte{1})
+	if !found || !pair.IsTombstone() {
+		t.Errorf("Expected %q to be a tombstone", pair.Value)
+	}
+	written := mt.Bytes()
+	mt.Delete([]byte{1})
+	if mt.Bytes() != written {
+		t.Errorf("Expected rewriting the same value to use no more than %d bytes, but got %d", written, mt.Bytes())
+	}
+
+	mt.Write([]byte{1}, []byte{})
+	pair, _ = mt.Get([]byte{1})
+	if pair.IsTombstone() || len(pair.Value) != 0 {
+		t.Errorf("Expected an empty put to replace the tombstone, but got %q of type %d", pair.Value, pair.Type)
+	}
+}
+
+func TestSkiplistEntriesAndTombstones(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	mt.Write([]byte{1}, []byte{1})
+	mt.Write([]byte{2}, []byte{2})
+	mt.Delete([]byte{1})
+	mt.Delete([]byte{3})
+
+	if mt.Entries() != 3 {
+		t.Errorf("Expected 3 entries but got %d", mt.Entries())
+	}
+	if mt.Tombstones() != 2 {
+		t.Errorf("Expected 2 tombstones but got %d", mt.Tombstones())
+	}
+
+	mt.Write([]byte{1}, []byte{9})
+	if mt.Tombstones() != 1 {
+		t.Errorf("Expected overwriting a tombstone to leave 1 tombstone but got %d", mt.Tombstones())
+	}
+}
+
+func TestSkiplistDeleteRange(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	for i := byte(1); i <= 4; i++ {
+		mt.Write([]byte{i}, []byte{i})
+	}
+	mt.DeleteRange([]byte{2}, []byte{3})
+
+	for i := byte(1); i <= 4; i++ {
+		deleted := i == 2 || i == 3
+		pair, found := mt.Get([]byte{i})
+		if !found || pair.IsTombstone() != deleted || (!deleted && c.Compare(pair.Value, []byte{i}) != c.EQUAL) {
+			t.Errorf("Expected key %q to be deleted (%t) but got %q of type %d", []byte{i}, deleted, pair.Value, pair.Type)
+		}
+	}
+	if len(mt.RangeTombstones()) != 1 || mt.Tombstones() != 2 {
+		t.Errorf("Expected 1 range tombstone and 2 tombstones, but got %d and %d", len(mt.RangeTombstones()), mt.Tombstones())
+	}
+	if len(common.RangeTombstonesOf(mt.UnboundedIterator())) != 1 {
+		t.Error("Expected the memtable's iterator to carry the range tombstone, but did not")
+	}
+
+	mt.Write([]byte{2}, []byte{9})
+	pair, _ := mt.Get([]byte{2})
+	val := pair.Value
+	if c.Compare(val, []byte{9}) != c.EQUAL {
+		t.Errorf("Expected a write after the range deletion to be kept, but got %q", val)
+	}
+}
+
+func TestSkiplistMergeWritesMergeRecord(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	mt.Write([]byte{1}, []byte{1})
+	mt.Merge([]byte{1}, []byte{2})
+
+	pair, found := mt.Get([]byte{1})
+	if !found || pair.Type != common.MERGE || c.Compare(pair.Value, []byte{2}) != c.EQUAL {
+		t.Errorf("Expected a merge record holding %q, but got %q of type %d", []byte{2}, pair.Value, pair.Type)
+	}
+	if mt.Entries() != 1 || mt.Tombstones() != 0 {
+		t.Errorf("Expected 1 entry and 0 tombstones, but got %d and %d", mt.Entries(), mt.Tombstones())
+	}
+}
+
+func TestSkiplistSingleDeleteWritesSingleDeleteRecord(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	mt.Write([]byte{1}, []byte{1})
+	mt.SingleDelete([]byte{1})
+
+	pair, found := mt.Get([]byte{1})
+	if !found || pair.Type != common.SINGLE_DELETE {
+		t.Errorf("Expected a single delete record, but got %q of type %d", pair.Value, pair.Type)
+	}
+	if mt.Entries() != 1 || mt.Tombstones() != 1 {
+		t.Errorf("Expected 1 entry and 1 tombstone, but got %d and %d", mt.Entries(), mt.Tombstones())
+	}
+}
+
+func TestSkiplistWriteWithExpiryKeepsExpiry(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	mt.WriteWithExpiry([]byte{1}, []byte{1}, 10)
+	mt.WriteWithExpiry([]byte{1}, []byte{1}, 20)
+
+	pair, found := mt.Get([]byte{1})
+	if !found || pair.Type != common.PUT || pair.Expiry != 20 {
+		t.Errorf("Expected a put expiring at 20, but got type %d expiring at %d", pair.Type, pair.Expiry)
+	}
+	iter := mt.UnboundedIterator()
+	defer iter.Close()
+	iter.Next()
+	iterated, _ := iter.Get()
+	if iterated.Expiry != 20 {
+		t.Errorf("Expected iterator to produce a pair expiring at 20, but got %d", iterated.Expiry)
+	}
+}
+
+func TestSkiplistIterator(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	for i := byte(4); i > 0; i-- {
+		mt.Write([]byte{i}, []byte{i})
+	}
+
+	iter := mt.Iterator([]byte{2}, []byte{3})
+	defer iter.Close()
+
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+	common.CompareNext(iter, false, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.ComparePrev(iter, false, t)
+}
+
+func TestSkiplistIteratorOrdersKeysByComparator(t *testing.T) {
+	mt := NewSkiplistMemtableWithComparator(c.ReverseBytewiseComparator{})
+	for i := byte(1); i <= 4; i++ {
+		mt.Write([]byte{i}, []byte{i})
+	}
+
+	iter := mt.Iterator([]byte{3}, []byte{2})
+	defer iter.Close()
+
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.CompareNext(iter, false, t)
+}
+
+func TestSkiplistIteratorSeek(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	for i := byte(0); i < 10; i += 2 {
+		mt.Write([]byte{i}, []byte{i})
+	}
+
+	iter := mt.UnboundedIterator()
+	defer iter.Close()
+
+	found, _ := iter.Seek([]byte{3})
+	if !found {
+		t.Error("Expected Seek() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{4}, []byte{4}, t)
+
+	found, _ = iter.SeekForPrev([]byte{3})
+	if !found {
+		t.Error("Expected SeekForPrev() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+
+	found, _ = iter.SeekToLast()
+	if !found {
+		t.Error("Expected SeekToLast() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{8}, []byte{8}, t)
+
+	found, _ = iter.Seek([]byte{9})
+	if found {
+		t.Error("Expected Seek() past the last key to not find a pair, but did")
+	}
+}
+
+func TestSkiplistIteratorWithExclusiveBoundsAndLimit(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	for i := byte(0); i < 5; i++ {
+		mt.Write([]byte{i}, []byte{i})
+	}
+
+	iter := mt.IteratorWithOptions(common.IterOptions{LowerBound: []byte{0}, UpperBound: []byte{4}, ExcludeLowerBound: true, ExcludeUpperBound: true, Limit: 2})
+	defer iter.Close()
+
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{1}, []byte{1}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.CompareNext(iter, false, t)
+}
+
+func TestSkiplistIteratorIsSnapshot(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	for i := byte(2); i <= 6; i += 2 {
+		mt.Write([]byte{i}, []byte{i})
+	}
+
+	iter := mt.UnboundedIterator()
+	defer iter.Close()
+
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+
+	mt.Write([]byte{1}, []byte{1})
+	mt.Write([]byte{3}, []byte{3})
+	mt.Write([]byte{4}, []byte{40})
+	mt.Delete([]byte{6})
+	mt.Write([]byte{7}, []byte{7})
+
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{4}, []byte{4}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{6}, []byte{6}, t)
+	pair, _ := iter.Get()
+	if pair.Type != common.PUT {
+		t.Errorf("Expected %v but got %v", common.PUT, pair.Type)
+	}
+	common.CompareNext(iter, false, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{6}, []byte{6}, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{4}, []byte{4}, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.ComparePrev(iter, false, t)
+}
+
+func TestSkiplistReadsDuringWrites(t *testing.T) {
+	mt := NewSkiplistMemtable()
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				pair, found := mt.Get([]byte{0, 1})
+				val := pair.Value
+				if found && c.Compare(val, []byte{1}) != c.EQUAL {
+					t.Errorf("Expected %q but got %q", []byte{1}, val)
+				}
+				iter := mt.UnboundedIterator()
+				var previous []byte
+				for next, _ := iter.Next(); next; next, _ = iter.Next() {
+					pair, _ := iter.Get()
+					if previous != nil && c.Compare(previous, pair.Key) != c.LESS_THAN {
+						t.Errorf("Expected %q to follow %q, but did not", pair.Key, previous)
+					}
+					previous = pair.Key
+				}
+				iter.Close()
+			}
+		}()
+	}
+
+	for w := byte(0); w < 8; w++ {
+		for i := byte(0); i < 100; i++ {
+			mt.Write([]byte{w, i}, []byte{i})
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	for w := byte(0); w < 8; w++ {
+		for i := byte(0); i < 100; i++ {
+			pair, found := mt.Get([]byte{w, i})
+			val := pair.Value
+			if !found || c.Compare(val, []byte{i}) != c.EQUAL {
+				t.Errorf("Expected value for key %q to equal %q but got %q", []byte{w, i}, []byte{i}, val)
+			}
+		}
+	}
+}
@@ -1,9 +1,7 @@
 package sst
 
 import (
-	"bytes"
-	"fmt"
-	"io"
+	"sort"
 
 	"github.com/patrickgombert/lsmt/cache"
 	"github.com/patrickgombert/lsmt/common"
@@ -11,196 +9,286 @@ import (
 	"github.com/patrickgombert/lsmt/config"
 )
 
+// A block belonging to one of the ssts of a level.
+type levelBlock struct {
+	sst   *sst
+	block *block
+}
+
 // An iterator for a block based SST level.
+// The blocks of every sst in the level are ordered by key, so the iterator treats them
+// as a single sequence of blocks. The current block is decoded in full so that the
+// iterator can move through it in either direction.
 type cachedIterator struct {
-	end        []byte
+	opts       common.IterOptions
 	level      config.LevelOptions
 	blockCache cache.Cache
+	fillCache  bool
 	ssts       []*sst
-	sstIndex   int
-	block      *bytes.Reader
+	blocks     []levelBlock
 	blockIndex int
-	nextKey    []byte
-	nextValue  []byte
+	pairs      []*common.Pair
+	pairIndex  int
+	position   common.Position
 	closed     bool
 }
 
 // Returns a new iterator which uses the block cache when fetching blocks.
 // Since the block cache and config are scoped to a level, the iterator also only
-// iterates over a single level.
-func NewCachedIterator(start, end []byte, blockCache cache.Cache, ssts []*sst, level config.LevelOptions) (common.Iterator, error) {
-	for sstIndex, sst := range ssts {
-		for blockIndex, bl := range sst.blocks {
-			if c.Compare(start, bl.start) != c.LESS_THAN && c.Compare(start, bl.end) != c.GREATER_THAN {
-				b, err := blockCache.Get(bl, func(arg cache.Shardable) ([]byte, error) {
-					return sst.ReadBlock(arg.(*block), level)
-				})
-				if err != nil {
-					return nil, err
-				}
-
-				reader := bytes.NewReader(b)
-				length := make([]byte, 1)
-				for {
-					_, err = reader.Read(length)
-					if err != nil {
-						return nil, err
-					}
-
-					k := make([]byte, length[0])
-					_, err = reader.Read(k)
-					if err != nil {
-						return nil, err
-					}
-
-					// If we've passed the start key, seek backwards as to start at the right position
-					if c.Compare(start, k) != c.LESS_THAN {
-						reader.Seek(int64(length[0])*-1, io.SeekCurrent)
-						return &cachedIterator{end: end, level: level, blockCache: blockCache, ssts: ssts, sstIndex: sstIndex, block: reader, blockIndex: blockIndex, closed: false}, nil
-						// Otherwise seek past the value
-					} else {
-						_, err = reader.Read(length)
-						if err != nil {
-							return nil, err
-						}
-						reader.Seek(int64(length[0]), io.SeekCurrent)
-					}
-				}
-			}
+// iterates over a single level. The iterator holds a reference to each of the ssts
+// until it is closed. Blocks are not read until the iterator is first positioned. The
+// iterator honours the bounds of the options, but not the limit, which is applied once
+// the levels are merged.
+func NewCachedIterator(opts common.IterOptions, blockCache cache.Cache, ssts []*sst, level config.LevelOptions) (common.Iterator, error) {
+	if !acquireAll(ssts) {
+		return nil, common.ERR_SST_RELEASED
+	}
+
+	blocks := []levelBlock{}
+	for _, s := range ssts {
+		for _, b := range s.blocks {
+			blocks = append(blocks, levelBlock{sst: s, block: b})
 		}
 	}
 
-	return &cachedIterator{closed: true}, nil
+	return &cachedIterator{
+		opts:       opts,
+		level:      level,
+		blockCache: blockCache,
+		fillCache:  !opts.DontFillCache,
+		ssts:       ssts,
+		blocks:     blocks,
+		blockIndex: -1,
+	}, nil
 }
 
 // Returns a new unbounded iterator which uses the block cache when fetching blocks.
 // Since the block cache and config are scoped to a level, the iterator also only
-// iterates over a single level.
-func NewCachedUnboundedIterator(blockCache cache.Cache, ssts []*sst, level config.LevelOptions) (common.Iterator, error) {
-	if len(ssts) == 0 {
-		return &cachedIterator{closed: true}, nil
+// iterates over a single level. The iterator holds a reference to each of the ssts
+// until it is closed.
+func NewCachedUnboundedIterator(opts common.IterOptions, blockCache cache.Cache, ssts []*sst, level config.LevelOptions) (common.Iterator, error) {
+	opts.LowerBound = nil
+	opts.UpperBound = nil
+	return NewCachedIterator(opts, blockCache, ssts, level)
+}
+
+// Returns the range tombstones held by the ssts of the level.
+func (iter *cachedIterator) RangeTombstones() []common.RangeTombstone {
+	tombstones := []common.RangeTombstone{}
+	for _, s := range iter.ssts {
+		tombstones = append(tombstones, s.rangeTombstones...)
 	}
-	if len(ssts[0].blocks) == 0 {
-		return &cachedIterator{closed: true}, nil
+	return tombstones
+}
+
+// Moves to the next pair. If necessary, calling Next will read the next block, which
+// may belong to the next SST.
+func (iter *cachedIterator) Next() (bool, error) {
+	if iter.closed {
+		return false, common.ERR_ITER_CLOSED
 	}
 
-	s := ssts[0]
-	bl := s.blocks[0]
-	b, err := blockCache.Get(bl, func(arg cache.Shardable) ([]byte, error) {
-		return s.ReadBlock(arg.(*block), level)
-	})
-	if err != nil {
-		return nil, err
+	switch iter.position {
+	case common.UNPOSITIONED, common.BEFORE_FIRST:
+		return iter.seek(iter.opts.WithinLowerBound)
+	case common.AFTER_LAST:
+		return false, nil
 	}
-	reader := bytes.NewReader(b)
 
-	return &cachedIterator{
-		end:        nil,
-		level:      level,
-		blockCache: blockCache,
-		ssts:       ssts,
-		sstIndex:   0,
-		block:      reader,
-		blockIndex: 0,
-		closed:     false,
-	}, nil
+	iter.pairIndex++
+	return iter.settleForward()
 }
 
-// Returns whether there is a next value. If necessary, calling Next will move the
-// block index and block reader to the next block as well as move the sst index to the
-// next SST.
-func (iter *cachedIterator) Next() (bool, error) {
+// Moves to the previous pair. If necessary, calling Prev will read the previous block,
+// which may belong to the previous SST.
+func (iter *cachedIterator) Prev() (bool, error) {
 	if iter.closed {
 		return false, common.ERR_ITER_CLOSED
 	}
 
-	length := make([]byte, 1)
-	_, err := iter.block.Read(length)
-	if err != nil && err != io.EOF {
-		return false, err
+	switch iter.position {
+	case common.UNPOSITIONED, common.AFTER_LAST:
+		return iter.SeekToLast()
+	case common.BEFORE_FIRST:
+		return false, nil
 	}
 
-	// Move to the next block if possible when the end of a block is hit
-	if err == io.EOF {
-		if iter.blockIndex == len(iter.ssts[iter.sstIndex].blocks)-1 {
-			if iter.sstIndex == len(iter.ssts)-1 {
-				iter.closed = true
-				return false, nil
-			} else {
-				sst := iter.ssts[iter.sstIndex+1]
-				bl := sst.blocks[0]
-				b, err := iter.blockCache.Get(bl, func(arg cache.Shardable) ([]byte, error) {
-					return sst.ReadBlock(arg.(*block), iter.level)
-				})
-				if err != nil {
-					return false, err
-				}
-				iter.block = bytes.NewReader(b)
-				iter.sstIndex++
-				iter.blockIndex = 0
-				_, err = iter.block.Read(length)
-				if err != nil {
-					return false, err
-				}
-			}
-		} else {
-			sst := iter.ssts[iter.sstIndex]
-			bl := sst.blocks[iter.blockIndex+1]
-			b, err := iter.blockCache.Get(bl, func(arg cache.Shardable) ([]byte, error) {
-				return sst.ReadBlock(arg.(*block), iter.level)
-			})
-			if err != nil {
-				return false, err
-			}
-			iter.block = bytes.NewReader(b)
-			iter.blockIndex++
-			_, err = iter.block.Read(length)
-			if err != nil {
-				return false, err
-			}
-		}
-	}
+	iter.pairIndex--
+	return iter.settleBackward()
+}
 
-	k := make([]byte, length[0])
-	_, err = iter.block.Read(k)
-	if err != nil {
-		return false, err
+// Positions the iterator at the first pair within the lower bound.
+func (iter *cachedIterator) SeekToFirst() (bool, error) {
+	if iter.closed {
+		return false, common.ERR_ITER_CLOSED
 	}
-	if iter.end != nil && c.Compare(k, iter.end) == c.GREATER_THAN {
-		iter.closed = true
-		return false, nil
+	return iter.seek(iter.opts.WithinLowerBound)
+}
+
+// Positions the iterator at the first pair whose key is greater than or equal to key.
+// Only the block which may contain the key is read.
+func (iter *cachedIterator) Seek(key []byte) (bool, error) {
+	if iter.closed {
+		return false, common.ERR_ITER_CLOSED
 	}
+	return iter.seek(func(k []byte) bool {
+		return iter.opts.WithinLowerBound(k) && iter.opts.GetComparator().Compare(k, key) != c.LESS_THAN
+	})
+}
 
-	_, err = iter.block.Read(length)
-	if err != nil {
-		fmt.Printf("block %v\n", iter.block)
-		return false, err
+// Positions the iterator at the last pair within the upper bound.
+func (iter *cachedIterator) SeekToLast() (bool, error) {
+	if iter.closed {
+		return false, common.ERR_ITER_CLOSED
 	}
-	v := make([]byte, length[0])
-	_, err = iter.block.Read(v)
-	if err != nil {
-		return false, err
+	return iter.seekForPrev(iter.opts.WithinUpperBound)
+}
+
+// Positions the iterator at the last pair whose key is less than or equal to key.
+func (iter *cachedIterator) SeekForPrev(key []byte) (bool, error) {
+	if iter.closed {
+		return false, common.ERR_ITER_CLOSED
 	}
-	iter.nextKey = k
-	iter.nextValue = v
+	return iter.seekForPrev(func(k []byte) bool {
+		return iter.opts.WithinUpperBound(k) && iter.opts.GetComparator().Compare(k, key) != c.GREATER_THAN
+	})
+}
 
-	return true, nil
+// Returns whether the iterator is positioned at a pair.
+func (iter *cachedIterator) Valid() bool {
+	return !iter.closed && iter.position == common.AT_PAIR
 }
 
-// Get the current pair. The value is moved forward with each call to Next(). The value
-// returned is cached and will continue returning the same value until Next() or Close()
-// is invoked.
+// Get the current pair. The value returned is cached and will continue returning the
+// same value until the iterator is moved or closed.
 func (iter *cachedIterator) Get() (*common.Pair, error) {
 	if iter.closed {
 		return nil, common.ERR_ITER_CLOSED
 	}
+	if iter.position != common.AT_PAIR {
+		return nil, nil
+	}
 
-	pair := &common.Pair{Key: iter.nextKey, Value: iter.nextValue}
-	return pair, nil
+	return iter.pairs[iter.pairIndex], nil
 }
 
-// Closes the iterator. Will never throw an error.
+// Closes the iterator and releases its references to the underlying ssts.
 func (iter *cachedIterator) Close() error {
 	iter.closed = true
+	iter.pairs = nil
+	if iter.ssts == nil {
+		return nil
+	}
+	err := releaseAll(iter.ssts)
+	iter.ssts = nil
+	return err
+}
+
+// Positions the iterator at the first pair whose key satisfies within. The within
+// function must hold for every key after the first key it holds for, so the first block
+// which may contain the pair is found by its end key.
+func (iter *cachedIterator) seek(within func([]byte) bool) (bool, error) {
+	blockIndex := sort.Search(len(iter.blocks), func(i int) bool {
+		return within(iter.blocks[i].block.end)
+	})
+	if blockIndex == len(iter.blocks) {
+		return iter.exhaust(common.AFTER_LAST), nil
+	}
+
+	err := iter.loadBlock(blockIndex)
+	if err != nil {
+		return false, err
+	}
+	iter.pairIndex = sort.Search(len(iter.pairs), func(i int) bool {
+		return within(iter.pairs[i].Key)
+	})
+	return iter.settleForward()
+}
+
+// Positions the iterator at the last pair whose key satisfies within. The within
+// function must hold for every key before the last key it holds for, so the last block
+// which may contain the pair is found by its start key.
+func (iter *cachedIterator) seekForPrev(within func([]byte) bool) (bool, error) {
+	blockIndex := sort.Search(len(iter.blocks), func(i int) bool {
+		return !within(iter.blocks[i].block.start)
+	}) - 1
+	if blockIndex < 0 {
+		return iter.exhaust(common.BEFORE_FIRST), nil
+	}
+
+	err := iter.loadBlock(blockIndex)
+	if err != nil {
+		return false, err
+	}
+	iter.pairIndex = sort.Search(len(iter.pairs), func(i int) bool {
+		return !within(iter.pairs[i].Key)
+	}) - 1
+	return iter.settleBackward()
+}
+
+// Moves on through later blocks while the current pair index is past the end of the
+// current block, then records the iterator's position.
+func (iter *cachedIterator) settleForward() (bool, error) {
+	for iter.pairIndex >= len(iter.pairs) {
+		if iter.blockIndex+1 >= len(iter.blocks) {
+			return iter.exhaust(common.AFTER_LAST), nil
+		}
+		err := iter.loadBlock(iter.blockIndex + 1)
+		if err != nil {
+			return false, err
+		}
+		iter.pairIndex = 0
+	}
+	return iter.settle(common.AFTER_LAST), nil
+}
+
+// Moves back through earlier blocks while the current pair index precedes the current
+// block, then records the iterator's position.
+func (iter *cachedIterator) settleBackward() (bool, error) {
+	for iter.pairIndex < 0 {
+		if iter.blockIndex <= 0 {
+			return iter.exhaust(common.BEFORE_FIRST), nil
+		}
+		err := iter.loadBlock(iter.blockIndex - 1)
+		if err != nil {
+			return false, err
+		}
+		iter.pairIndex = len(iter.pairs) - 1
+	}
+	return iter.settle(common.BEFORE_FIRST), nil
+}
+
+// Reads and decodes the block at the given index through the block cache.
+func (iter *cachedIterator) loadBlock(blockIndex int) error {
+	if blockIndex == iter.blockIndex && iter.pairs != nil {
+		return nil
+	}
+	lb := iter.blocks[blockIndex]
+	blockBytes, err := lb.sst.readCachedBlock(iter.blockCache, lb.block, iter.level, iter.fillCache)
+	if err != nil {
+		return err
+	}
+	pairs, err := decodeBlock(lb.sst.version, blockBytes)
+	if err != nil {
+		return err
+	}
+	iter.blockIndex = blockIndex
+	iter.pairs = pairs
 	return nil
 }
+
+// Records the iterator's position once the pair index points into the current block.
+// If the current pair falls outside of the iterator's bounds then the iterator is
+// positioned at the given end.
+func (iter *cachedIterator) settle(exhausted common.Position) bool {
+	if !iter.opts.WithinBounds(iter.pairs[iter.pairIndex].Key) {
+		return iter.exhaust(exhausted)
+	}
+	iter.position = common.AT_PAIR
+	return true
+}
+
+func (iter *cachedIterator) exhaust(position common.Position) bool {
+	iter.position = position
+	return false
+}
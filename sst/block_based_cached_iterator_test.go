@@ -0,0 +1,159 @@
+package sst
+
+import (
+	"testing"
+
+	"github.com/patrickgombert/lsmt/cache"
+	"github.com/patrickgombert/lsmt/common"
+	"github.com/patrickgombert/lsmt/config"
+)
+
+// Flushes single byte keys and values so that each block holds one pair and each sst
+// holds two blocks.
+func flushCachedIteratorPairs(t *testing.T, keys ...byte) ([]*sst, config.LevelOptions) {
+	sink := &config.Sink{BlockSize: 5, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 10, BloomFilterSize: 1024}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	flush := newFlush(options, sink, NOMAX)
+	for _, key := range keys {
+		flush.accept(&common.Pair{Key: []byte{key}, Value: []byte{key}})
+	}
+	ssts, err := flush.close(nil)
+	if err != nil {
+		t.Fatalf("Expected flush to succeed, but got %v", err)
+	}
+	return ssts, sink
+}
+
+func TestCachedIteratorAcrossSsts(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	ssts, level := flushCachedIteratorPairs(t, 0, 1, 2, 3, 4)
+	iter, _ := NewCachedIterator(common.IterOptions{LowerBound: []byte{1}, UpperBound: []byte{3}}, cache.NewShardedLRUCache(1, 1000), ssts, level)
+	defer iter.Close()
+
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{1}, []byte{1}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+	common.CompareNext(iter, false, t)
+}
+
+func TestCachedIteratorWithExclusiveBounds(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	ssts, level := flushCachedIteratorPairs(t, 0, 1, 2, 3, 4)
+	opts := common.IterOptions{LowerBound: []byte{1}, UpperBound: []byte{4}, ExcludeLowerBound: true, ExcludeUpperBound: true}
+	iter, _ := NewCachedIterator(opts, cache.NewShardedLRUCache(1, 1000), ssts, level)
+	defer iter.Close()
+
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+	common.CompareNext(iter, false, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+
+	found, _ := iter.Seek([]byte{0})
+	if !found {
+		t.Error("Expected Seek() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+}
+
+func TestCachedIteratorWithUpperBoundOnly(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	ssts, level := flushCachedIteratorPairs(t, 0, 1, 2, 3, 4)
+	iter, _ := NewCachedIterator(common.IterOptions{UpperBound: []byte{1}}, cache.NewShardedLRUCache(1, 1000), ssts, level)
+	defer iter.Close()
+
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{1}, []byte{1}, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{0}, []byte{0}, t)
+	common.ComparePrev(iter, false, t)
+}
+
+func TestCachedIteratorPrev(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	ssts, level := flushCachedIteratorPairs(t, 0, 1, 2, 3, 4)
+	iter, _ := NewCachedIterator(common.IterOptions{LowerBound: []byte{1}, UpperBound: []byte{3}}, cache.NewShardedLRUCache(1, 1000), ssts, level)
+	defer iter.Close()
+
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{1}, []byte{1}, t)
+	common.ComparePrev(iter, false, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{1}, []byte{1}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{1}, []byte{1}, t)
+}
+
+func TestCachedIteratorSeekForPrev(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	ssts, level := flushCachedIteratorPairs(t, 0, 2, 4, 6)
+	iter, _ := NewCachedUnboundedIterator(common.IterOptions{}, cache.NewShardedLRUCache(1, 1000), ssts, level)
+	defer iter.Close()
+
+	found, _ := iter.SeekForPrev([]byte{5})
+	if !found {
+		t.Error("Expected SeekForPrev() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{4}, []byte{4}, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+
+	found, _ = iter.SeekToLast()
+	if !found {
+		t.Error("Expected SeekToLast() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{6}, []byte{6}, t)
+	common.CompareNext(iter, false, t)
+}
+
+func TestCachedIteratorSeekReadsOneBlock(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	ssts, level := flushCachedIteratorPairs(t, 0, 2, 4, 6, 8)
+	blockCache := &countingCache{Cache: cache.NewShardedLRUCache(1, 1000)}
+	iter, _ := NewCachedUnboundedIterator(common.IterOptions{}, blockCache, ssts, level)
+	defer iter.Close()
+
+	// A key between two blocks may fall before the shortened end of the earlier block, so
+	// the seek is for a key which is held
+	found, _ := iter.Seek([]byte{6})
+	if !found || !iter.Valid() {
+		t.Error("Expected Seek() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{6}, []byte{6}, t)
+	if blockCache.gets != 1 {
+		t.Errorf("Expected Seek() to read a single block, but read %d", blockCache.gets)
+	}
+
+	found, _ = iter.Seek([]byte{9})
+	if found || iter.Valid() {
+		t.Error("Expected Seek() past the last key to not find a pair, but did")
+	}
+	found, _ = iter.SeekToFirst()
+	if !found {
+		t.Error("Expected SeekToFirst() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{0}, []byte{0}, t)
+}
@@ -19,6 +19,7 @@ type blockBasedLevelFlush struct {
 	blocks            []*block
 	currentBlock      *block
 	previousPair      *common.Pair
+	bloomFilter       *common.BloomFilter
 	bytesWritten      int64
 	currentBlockSize  int64
 	totalBytesWritten int64
@@ -51,22 +52,7 @@ func (flush *blockBasedLevelFlush) accept(pair *common.Pair) error {
 
 	// If the given pair will exceed the file size then close the file and start a new file
 	if flush.bytesWritten+additionalBytes > flush.level.GetSSTSize() {
-		flush.currentBlock.end = flush.previousPair.Key
-		flush.currentBlock.usedBytes = flush.currentBlockSize
-		remainingBlock := flush.level.GetBlockSize() - flush.currentBlockSize
-		if remainingBlock > 0 {
-			spacer := make([]byte, remainingBlock)
-			flush.writer.Write(spacer)
-		}
-		flush.bytesWritten += remainingBlock
-		flush.totalBytesWritten += remainingBlock
-		flush.ssts[len(flush.ssts)-1].metaOffset = flush.bytesWritten
-
-		err := writeMeta(flush.writer, flush.bytesWritten, flush.blocks)
-		if err != nil {
-			return err
-		}
-		err = flush.file.Close()
+		err := flush.finishSST(pair.Key)
 		if err != nil {
 			return err
 		}
@@ -76,22 +62,22 @@ func (flush *blockBasedLevelFlush) accept(pair *common.Pair) error {
 	// If the file is nil (this is the first pair or the file was just closed) then create
 	// a new file
 	if flush.file == nil {
-		file, err := newFile(flush.options.Path)
+		err := flush.startSST()
 		if err != nil {
 			return err
 		}
-		flush.file = file
-		flush.writer = bufio.NewWriter(flush.file)
-		flush.currentBlock = &block{start: pair.Key, offset: 0}
+	}
+	// Block starts are copied since the pair may point into the memory mapping of an sst
+	// which is unmapped before the new sst is
+	if flush.currentBlock == nil {
+		flush.currentBlock = &block{start: append([]byte{}, pair.Key...), offset: 0}
 		flush.blocks = []*block{flush.currentBlock}
-		flush.ssts = append(flush.ssts, &sst{file: file.Name(), blocks: flush.blocks})
-		flush.bytesWritten = int64(0)
-		flush.currentBlockSize = int64(0)
+		flush.ssts[len(flush.ssts)-1].blocks = flush.blocks
 	}
 
 	// If the block is going to be exceeded then move to the next block
 	if flush.currentBlockSize+additionalBytes > flush.level.GetBlockSize() {
-		flush.currentBlock.end = flush.previousPair.Key
+		flush.currentBlock.end = flush.options.GetComparator().FindShortestSeparator(flush.previousPair.Key, pair.Key)
 		flush.currentBlock.usedBytes = flush.currentBlockSize
 		remainingBlock := flush.level.GetBlockSize() - flush.currentBlockSize
 		if remainingBlock > 0 {
@@ -100,9 +86,10 @@ func (flush *blockBasedLevelFlush) accept(pair *common.Pair) error {
 		}
 		flush.bytesWritten += remainingBlock
 		flush.totalBytesWritten += remainingBlock
-		flush.currentBlock = &block{start: pair.Key, offset: flush.bytesWritten}
+		flush.currentBlock = &block{start: append([]byte{}, pair.Key...), offset: flush.bytesWritten}
 		flush.currentBlockSize = int64(0)
 		flush.blocks = append(flush.blocks, flush.currentBlock)
+		flush.ssts[len(flush.ssts)-1].blocks = flush.blocks
 		err := flush.writer.Flush()
 		if err != nil {
 			return err
@@ -111,8 +98,13 @@ func (flush *blockBasedLevelFlush) accept(pair *common.Pair) error {
 
 	flush.writer.WriteByte(byte(len(pair.Key)))
 	flush.writer.Write(pair.Key)
+	flush.writer.WriteByte(encodeRecordType(pair))
+	if pair.Expiry != 0 {
+		flush.writer.Write(int64toBytes(pair.Expiry))
+	}
 	flush.writer.WriteByte(byte(len(pair.Value)))
 	flush.writer.Write(pair.Value)
+	flush.bloomFilter.Insert(pair.Key)
 
 	flush.bytesWritten += additionalBytes
 	flush.currentBlockSize += additionalBytes
@@ -122,23 +114,19 @@ func (flush *blockBasedLevelFlush) accept(pair *common.Pair) error {
 	return nil
 }
 
-// Close out any open SSTs and return all created SSTs
-func (flush *blockBasedLevelFlush) close() ([]*sst, error) {
-	if len(flush.ssts) > 0 {
-		remainingBlock := flush.level.GetBlockSize() - flush.currentBlockSize
-		if remainingBlock > 0 {
-			spacer := make([]byte, remainingBlock)
-			flush.writer.Write(spacer)
-		}
-		flush.bytesWritten += remainingBlock
-		flush.ssts[len(flush.ssts)-1].metaOffset = flush.bytesWritten
-		flush.currentBlock.end = flush.previousPair.Key
-		flush.currentBlock.usedBytes = flush.currentBlockSize
-		err := writeMeta(flush.writer, flush.bytesWritten, flush.blocks)
+// Close out any open SSTs and return all created SSTs. The range tombstones are written
+// to the range deletion block of the last sst, creating an sst without any data blocks
+// if no pairs were accepted.
+func (flush *blockBasedLevelFlush) close(rangeTombstones []common.RangeTombstone) ([]*sst, error) {
+	if len(flush.ssts) == 0 && len(rangeTombstones) > 0 {
+		err := flush.startSST()
 		if err != nil {
 			return nil, err
 		}
-		err = flush.file.Close()
+	}
+	if len(flush.ssts) > 0 {
+		flush.ssts[len(flush.ssts)-1].rangeTombstones = rangeTombstones
+		err := flush.finishSST(nil)
 		if err != nil {
 			return nil, err
 		}
@@ -147,10 +135,74 @@ func (flush *blockBasedLevelFlush) close() ([]*sst, error) {
 	return flush.ssts, nil
 }
 
-// Write the block metadata to the underlying sst file
-func writeMeta(w *bufio.Writer, metaStart int64, blocks []*block) error {
-	w.Write(int64toBytes(int64(len(blocks))))
-	for _, block := range blocks {
+// Creates a new sst file whose first block is started by the next accepted pair.
+func (flush *blockBasedLevelFlush) startSST() error {
+	file, err := newFile(flush.options.Path)
+	if err != nil {
+		return err
+	}
+	flush.file = file
+	flush.writer = bufio.NewWriter(flush.file)
+	flush.currentBlock = nil
+	flush.blocks = []*block{}
+	flush.ssts = append(flush.ssts, &sst{file: file.Name(), id: fileID(file.Name()), version: SST_FORMAT_VERSION, blocks: flush.blocks, refs: 1})
+	flush.bloomFilter = common.NewBloomFilter(flush.level.GetBloomFilterSize())
+	flush.bytesWritten = int64(0)
+	flush.currentBlockSize = int64(0)
+	return nil
+}
+
+// Pads out the current block, writes the sst's filter block and range deletion block
+// followed by its metadata and closes the file. The filter and range deletion blocks do
+// not count towards the level's size. The current block's end is shortened to separate
+// it from limit, the key starting the next sst. The last block of the level has no
+// limit, so its end is shortened to a successor of its last key.
+func (flush *blockBasedLevelFlush) finishSST(limit []byte) error {
+	if flush.currentBlock != nil {
+		comparator := flush.options.GetComparator()
+		if limit != nil {
+			flush.currentBlock.end = comparator.FindShortestSeparator(flush.previousPair.Key, limit)
+		} else {
+			flush.currentBlock.end = comparator.FindShortSuccessor(flush.previousPair.Key)
+		}
+		flush.currentBlock.usedBytes = flush.currentBlockSize
+		remainingBlock := flush.level.GetBlockSize() - flush.currentBlockSize
+		if remainingBlock > 0 {
+			spacer := make([]byte, remainingBlock)
+			flush.writer.Write(spacer)
+		}
+		flush.bytesWritten += remainingBlock
+		flush.totalBytesWritten += remainingBlock
+	}
+
+	current := flush.ssts[len(flush.ssts)-1]
+	filter := flush.bloomFilter.Bytes()
+	current.filterOffset = flush.bytesWritten
+	current.filterLength = int64(len(filter))
+	flush.writer.Write(filter)
+	flush.bytesWritten += current.filterLength
+
+	rangeDeletions := encodeRangeTombstones(current.rangeTombstones)
+	current.rangeDeletionOffset = flush.bytesWritten
+	current.rangeDeletionLength = int64(len(rangeDeletions))
+	flush.writer.Write(rangeDeletions)
+	flush.bytesWritten += current.rangeDeletionLength
+	current.metaOffset = flush.bytesWritten
+
+	err := writeMeta(flush.writer, current)
+	if err != nil {
+		return err
+	}
+	return flush.file.Close()
+}
+
+// Write the format version, the block metadata and the locations of the filter block
+// and the range deletion block to the underlying sst file, followed by a footer of the
+// format magic number and the meta offset.
+func writeMeta(w *bufio.Writer, s *sst) error {
+	w.Write(int64toBytes(SST_FORMAT_VERSION))
+	w.Write(int64toBytes(int64(len(s.blocks))))
+	for _, block := range s.blocks {
 		w.WriteByte(byte(len(block.start)))
 		w.Write(block.start)
 		w.WriteByte(byte(len(block.end)))
@@ -158,12 +210,22 @@ func writeMeta(w *bufio.Writer, metaStart int64, blocks []*block) error {
 		w.Write(int64toBytes(block.usedBytes))
 		w.Write(int64toBytes(block.offset))
 	}
-	w.Write(int64toBytes(metaStart))
+	w.Write(int64toBytes(s.filterOffset))
+	w.Write(int64toBytes(s.filterLength))
+	w.Write(int64toBytes(s.rangeDeletionOffset))
+	w.Write(int64toBytes(s.rangeDeletionLength))
+	w.Write(int64toBytes(sstMagic))
+	w.Write(int64toBytes(s.metaOffset))
 	return w.Flush()
 }
 
-// Returns the size of the pair plus 2 metadata bytes.
-// One byte to hold size of key, one byte to hold size of value
+// Returns the size of the pair plus 3 metadata bytes.
+// One byte to hold size of key, one byte to hold the record type and one byte to hold
+// size of value. A pair which expires holds its expiry in another 8 bytes.
 func recordLength(pair *common.Pair) int64 {
-	return int64(len(pair.Key) + len(pair.Value) + 2)
+	length := int64(len(pair.Key) + len(pair.Value) + 3)
+	if pair.Expiry != 0 {
+		length += 8
+	}
+	return length
 }
@@ -12,13 +12,13 @@ func TestSingleSSTFileFlush(t *testing.T) {
 	common.SetUp(t)
 	defer common.TearDown(t)
 
-	sink := &config.Sink{BlockSize: 4, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 8, BloomFilterSize: 1024}
+	sink := &config.Sink{BlockSize: 5, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 10, BloomFilterSize: 1024}
 	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
 
 	flush := newFlush(options, sink, NOMAX)
 	accepting(flush, []byte{0}, []byte{0}, true, t)
 	accepting(flush, []byte{1}, []byte{1}, true, t)
-	ssts, err := flush.close()
+	ssts, err := flush.close(nil)
 
 	if err != nil {
 		t.Errorf("Failed to close flush with error %v", err)
@@ -43,8 +43,33 @@ func TestSingleSSTFileFlush(t *testing.T) {
 	if c.Compare([]byte{1}, sst.blocks[1].start) != c.EQUAL {
 		t.Errorf("Expected opened sst block 1 to start at %q, but got %q", []byte{1}, sst.blocks[1].start)
 	}
-	if c.Compare([]byte{1}, sst.blocks[1].end) != c.EQUAL {
-		t.Errorf("Expected opened sst block 1 to end at %q, but got %q", []byte{1}, sst.blocks[1].start)
+	if c.Compare([]byte{2}, sst.blocks[1].end) != c.EQUAL {
+		t.Errorf("Expected opened sst block 1 to end at %q, but got %q", []byte{2}, sst.blocks[1].end)
+	}
+}
+
+func TestFlushShortensBlockEnds(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 7, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 14, BloomFilterSize: 1024}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+
+	flush := newFlush(options, sink, NOMAX)
+	accepting(flush, []byte{1, 2, 3}, []byte{0}, true, t)
+	accepting(flush, []byte{1, 5, 0}, []byte{0}, true, t)
+	accepting(flush, []byte{1, 9, 0}, []byte{0}, true, t)
+	ssts, _ := flush.close(nil)
+
+	if len(ssts) != 2 {
+		t.Fatalf("Expected flush to produce 2 ssts but found %d", len(ssts))
+	}
+	ends := [][]byte{ssts[0].blocks[0].end, ssts[0].blocks[1].end, ssts[1].blocks[0].end}
+	expected := [][]byte{{1, 3}, {1, 6}, {2}}
+	for i := range expected {
+		if c.Compare(ends[i], expected[i]) != c.EQUAL {
+			t.Errorf("Expected block %d to end at %q, but got %q", i, expected[i], ends[i])
+		}
 	}
 }
 
@@ -52,7 +77,7 @@ func TestMultiSSTFileFlush(t *testing.T) {
 	common.SetUp(t)
 	defer common.TearDown(t)
 
-	sink := &config.Sink{BlockSize: 8, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 16, BloomFilterSize: 1024}
+	sink := &config.Sink{BlockSize: 10, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 20, BloomFilterSize: 1024}
 	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
 
 	flush := newFlush(options, sink, NOMAX)
@@ -65,7 +90,7 @@ func TestMultiSSTFileFlush(t *testing.T) {
 	accepting(flush, []byte{6}, []byte{6}, true, t)
 	accepting(flush, []byte{7}, []byte{7}, true, t)
 
-	ssts, err := flush.close()
+	ssts, err := flush.close(nil)
 
 	if err != nil {
 		t.Errorf("Failed to close flush with error %v", err)
@@ -104,8 +129,8 @@ func TestMultiSSTFileFlush(t *testing.T) {
 	if c.Compare([]byte{6}, sst1.blocks[1].start) != c.EQUAL {
 		t.Errorf("Expected opened sst block 1 to start at %q, but got %q", []byte{6}, sst1.blocks[1].start)
 	}
-	if c.Compare([]byte{7}, sst1.blocks[1].end) != c.EQUAL {
-		t.Errorf("Expected opened sst block 1 to end at %q, but got %q", []byte{7}, sst1.blocks[1].end)
+	if c.Compare([]byte{8}, sst1.blocks[1].end) != c.EQUAL {
+		t.Errorf("Expected opened sst block 1 to end at %q, but got %q", []byte{8}, sst1.blocks[1].end)
 	}
 }
 
@@ -113,16 +138,16 @@ func TestHitsMaxLevelSizeFlush(t *testing.T) {
 	common.SetUp(t)
 	defer common.TearDown(t)
 
-	level := &config.Level{BlockSize: 8, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 8, MaximumSSTFiles: 1, BloomFilterSize: 1024}
-	sink := &config.Sink{BlockSize: 8, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 16, BloomFilterSize: 1024}
+	level := &config.Level{BlockSize: 10, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 10, MaximumSSTFiles: 1, BloomFilterSize: 1024}
+	sink := &config.Sink{BlockSize: 10, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 20, BloomFilterSize: 1024}
 	options := &config.Options{Levels: []*config.Level{level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
 
-	flush := newFlush(options, level, 8)
+	flush := newFlush(options, level, 10)
 	accepting(flush, []byte{0}, []byte{0}, true, t)
 	accepting(flush, []byte{1}, []byte{1}, true, t)
 	accepting(flush, []byte{2}, []byte{2}, false, t)
 
-	ssts, err := flush.close()
+	ssts, err := flush.close(nil)
 
 	if err != nil {
 		t.Errorf("Failed to close flush with error %v", err)
@@ -141,8 +166,8 @@ func TestHitsMaxLevelSizeFlush(t *testing.T) {
 	if c.Compare([]byte{0}, sst.blocks[0].start) != c.EQUAL {
 		t.Errorf("Expected opened sst block 0 to start at %q, but got %q", []byte{0}, sst.blocks[0].start)
 	}
-	if c.Compare([]byte{1}, sst.blocks[0].end) != c.EQUAL {
-		t.Errorf("Expected opened sst block 0 to end at %q, but got %q", []byte{1}, sst.blocks[0].start)
+	if c.Compare([]byte{2}, sst.blocks[0].end) != c.EQUAL {
+		t.Errorf("Expected opened sst block 0 to end at %q, but got %q", []byte{2}, sst.blocks[0].end)
 	}
 }
 
@@ -1,14 +1,20 @@
 package sst
 
 import (
-	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/patrickgombert/lsmt/cache"
 	"github.com/patrickgombert/lsmt/common"
 	c "github.com/patrickgombert/lsmt/comparator"
 	"github.com/patrickgombert/lsmt/config"
@@ -21,24 +27,42 @@ type block struct {
 	offset    int64
 }
 
+// An sst is reference counted. The creator of an sst holds the initial reference and
+// any reader which might outlive the creator must acquire its own reference. When the
+// last reference is released the memory mapping, if there is one, is unmapped and a
+// filter block pinned in the block cache is evicted. An sst which has been rewritten by
+// a flush is marked obsolete and its file is only removed once the last reference is
+// released, so a reader never has the file removed underneath it. Removing the file
+// also evicts its blocks from the block cache.
+// The index of blocks and the range tombstones of the range deletion block are read
+// when the sst is opened and stay resident for the lifetime of the sst while the
+// filter block is read through the block cache.
 type sst struct {
-	file       string
-	blocks     []*block
-	metaOffset int64
-}
-
-func (block *block) Shard(numShards int) int {
-	return int(block.offset) % numShards
+	file                string
+	id                  uint64
+	version             int64
+	blocks              []*block
+	rangeTombstones     []common.RangeTombstone
+	metaOffset          int64
+	filterOffset        int64
+	filterLength        int64
+	rangeDeletionOffset int64
+	rangeDeletionLength int64
+	mapping             []byte
+	pinnedIn            cache.Cache
+	obsoleteIn          cache.Cache
+	refs                int32
+	obsolete            int32
 }
 
 func (sst *sst) Path() string {
 	return sst.file
 }
 
-func (sst *sst) GetBlock(key []byte) *block {
+func (sst *sst) GetBlock(comparator c.Comparator, key []byte) *block {
 	for _, block := range sst.blocks {
-		start := c.Compare(key, block.start)
-		if (start != c.LESS_THAN || start == c.EQUAL) && c.Compare(key, block.end) != c.GREATER_THAN {
+		start := comparator.Compare(key, block.start)
+		if (start != c.LESS_THAN || start == c.EQUAL) && comparator.Compare(key, block.end) != c.GREATER_THAN {
 			return block
 		}
 	}
@@ -46,7 +70,116 @@ func (sst *sst) GetBlock(key []byte) *block {
 	return nil
 }
 
+// Memory maps the sst's file. Once mapped, blocks are read directly from the mapping.
+func (sst *sst) mmap() error {
+	mapping, err := mmap(sst.file)
+	if err != nil {
+		log.Error().
+			Str("path", sst.file).
+			Err(err).
+			Msg("failed to memory map SST file")
+		return err
+	}
+	sst.mapping = mapping
+	return nil
+}
+
+// Acquires a reference to the sst. Returns false if the last reference to the sst has
+// already been released, in which case the sst must not be read.
+func (sst *sst) acquire() bool {
+	for {
+		refs := atomic.LoadInt32(&sst.refs)
+		if refs <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&sst.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// Releases a reference to the sst. Releasing the last reference unpins the sst's
+// filter block, unmaps the sst's file if it was memory mapped and removes the file if
+// the sst is obsolete.
+func (sst *sst) release() error {
+	if atomic.AddInt32(&sst.refs, -1) != 0 {
+		return nil
+	}
+	if sst.pinnedIn != nil {
+		sst.pinnedIn.Evict(sst.filterKey())
+	}
+	var err error
+	if sst.mapping != nil {
+		mapping := sst.mapping
+		sst.mapping = nil
+		err = munmap(mapping)
+	}
+	if atomic.LoadInt32(&sst.obsolete) == 1 {
+		log.Debug().
+			Str("path", sst.file).
+			Msg("removing obsolete SST file")
+		removeErr := os.Remove(sst.file)
+		if err == nil {
+			err = removeErr
+		}
+		sst.evictBlocks()
+	}
+	return err
+}
+
+// Marks the sst as obsolete so that its file is removed, and its blocks are evicted
+// from the block cache, once the last reference to the sst is released.
+func (sst *sst) markObsolete(blockCache cache.Cache) {
+	sst.obsoleteIn = blockCache
+	atomic.StoreInt32(&sst.obsolete, 1)
+}
+
+// Evicts the sst's data blocks and filter block from the block cache it was marked
+// obsolete in.
+func (sst *sst) evictBlocks() {
+	if sst.obsoleteIn == nil {
+		return
+	}
+	for _, b := range sst.blocks {
+		sst.obsoleteIn.Evict(cache.Key{FileID: sst.id, Offset: b.offset})
+	}
+	sst.obsoleteIn.Evict(sst.filterKey())
+}
+
+// Acquires a reference to every sst. If any sst has already been released then the
+// references acquired so far are released and false is returned.
+func acquireAll(ssts []*sst) bool {
+	for i, s := range ssts {
+		if !s.acquire() {
+			releaseAll(ssts[:i])
+			return false
+		}
+	}
+	return true
+}
+
+// Releases a reference to every sst, returning the last error encountered.
+func releaseAll(ssts []*sst) error {
+	var err error
+	for _, s := range ssts {
+		releaseErr := s.release()
+		if releaseErr != nil {
+			err = releaseErr
+		}
+	}
+	return err
+}
+
+// Reads a block from the sst. If the sst is memory mapped then the returned slice
+// points directly into the mapping and must not be modified.
 func (sst *sst) ReadBlock(b *block, level config.LevelOptions) ([]byte, error) {
+	if sst.mapping != nil {
+		if b.offset+b.usedBytes > int64(len(sst.mapping)) {
+			return nil, common.ERR_BLOCK_UNDERFLOW
+		}
+		return sst.mapping[b.offset : b.offset+b.usedBytes], nil
+	}
+
 	f, err := os.Open(sst.file)
 	if err != nil {
 		return nil, err
@@ -82,34 +215,208 @@ func (sst *sst) ReadBlock(b *block, level config.LevelOptions) ([]byte, error) {
 	return bytes, nil
 }
 
-// Creates a bloom filter for the keys in this SST
-func (sst *sst) populateBloomFilter(size uint32) (*common.BloomFilter, error) {
-	bloomFilter := common.NewBloomFilter(size)
-	iter, err := sst.UnboundedIterator()
-	if err != nil {
-		return nil, err
+// Reads a block through the block cache. Memory mapped ssts bypass the block cache
+// entirely since their blocks are served from the mapping without a copy. If fillCache
+// is false then a block which is not already cached is read without being inserted.
+func (sst *sst) readCachedBlock(blockCache cache.Cache, b *block, level config.LevelOptions, fillCache bool) ([]byte, error) {
+	if sst.mapping != nil {
+		return sst.ReadBlock(b, level)
 	}
-
-	next, err := iter.Next()
-	if err != nil {
-		return nil, err
+	key := cache.Key{FileID: sst.id, Offset: b.offset}
+	if !fillCache {
+		value, found := blockCache.Lookup(key)
+		if found {
+			return value, nil
+		}
+		return sst.ReadBlock(b, level)
 	}
+	return blockCache.Get(key, func(cache.Key) ([]byte, error) {
+		return sst.ReadBlock(b, level)
+	})
+}
+
+// The version of the sst format written to the meta of every sst. Ssts written in a
+// later version are rejected.
+const SST_FORMAT_VERSION int64 = 1
 
-	for next {
-		pair, err := iter.Get()
+// The version given to ssts written before the format was versioned. Their records
+// have no record type, with an empty value marking a tombstone, and they have neither a
+// filter block nor a range deletion block.
+const LEGACY_SST_FORMAT_VERSION int64 = 0
+
+// The extension of every sst file.
+const sstSuffix string = ".sst"
+
+// Precedes the meta offset at the end of every sst which records its format version.
+const sstMagic int64 = 0x6c736d7473737431
+
+// Set on the record type byte of a record which expires, in which case the 8 bytes
+// holding its expiry follow the record type byte.
+const EXPIRES byte = 0x80
+
+// Decodes the records contained in a block into pairs. Keys and values are slices of the
+// block rather than copies, so the pairs of a memory mapped sst point into its mapping
+// and are only valid while a reference to the sst is held.
+func decodeBlock(version int64, blockBytes []byte) ([]*common.Pair, error) {
+	if version == LEGACY_SST_FORMAT_VERSION {
+		return decodeLegacyBlock(blockBytes)
+	}
+	pairs := []*common.Pair{}
+	for offset := 0; offset < len(blockBytes); {
+		keyLength := int(blockBytes[offset])
+		keyEnd := offset + 1 + keyLength
+		if keyEnd >= len(blockBytes) {
+			return nil, common.ERR_BLOCK_UNDERFLOW
+		}
+		recordType, expires, err := decodeRecordType(blockBytes[keyEnd])
 		if err != nil {
 			return nil, err
 		}
+		expiry := int64(0)
+		valueLengthOffset := keyEnd + 1
+		if expires {
+			if valueLengthOffset+8 > len(blockBytes) {
+				return nil, common.ERR_BLOCK_UNDERFLOW
+			}
+			expiry = bytesToInt64(blockBytes[valueLengthOffset : valueLengthOffset+8])
+			valueLengthOffset += 8
+		}
+		if valueLengthOffset >= len(blockBytes) {
+			return nil, common.ERR_BLOCK_UNDERFLOW
+		}
+		valueLength := int(blockBytes[valueLengthOffset])
+		valueEnd := valueLengthOffset + 1 + valueLength
+		if valueEnd > len(blockBytes) {
+			return nil, common.ERR_BLOCK_UNDERFLOW
+		}
+		key := blockBytes[offset+1 : keyEnd]
+		value := blockBytes[valueLengthOffset+1 : valueEnd]
+		pairs = append(pairs, &common.Pair{Key: key, Value: value, Type: recordType, Expiry: expiry})
+		offset = valueEnd
+	}
+	return pairs, nil
+}
+
+// Decodes the records of a block written before the format was versioned. Each record
+// is its key followed by its value, and a record with an empty value is a tombstone.
+func decodeLegacyBlock(blockBytes []byte) ([]*common.Pair, error) {
+	pairs := []*common.Pair{}
+	for offset := 0; offset < len(blockBytes); {
+		keyEnd := offset + 1 + int(blockBytes[offset])
+		if keyEnd >= len(blockBytes) {
+			return nil, common.ERR_BLOCK_UNDERFLOW
+		}
+		valueEnd := keyEnd + 1 + int(blockBytes[keyEnd])
+		if valueEnd > len(blockBytes) {
+			return nil, common.ERR_BLOCK_UNDERFLOW
+		}
+		pair := &common.Pair{Key: blockBytes[offset+1 : keyEnd], Value: blockBytes[keyEnd+1 : valueEnd]}
+		if len(pair.Value) == 0 {
+			pair.Type = common.DELETE
+		}
+		pairs = append(pairs, pair)
+		offset = valueEnd
+	}
+	return pairs, nil
+}
 
-		bloomFilter.Insert(pair.Key)
+// Encodes the record type byte of a pair, setting EXPIRES if the pair expires.
+func encodeRecordType(pair *common.Pair) byte {
+	if pair.Expiry != 0 {
+		return byte(pair.Type) | EXPIRES
+	}
+	return byte(pair.Type)
+}
+
+// Decodes the record type byte of a record along with whether the record expires.
+// Range deletions are held in the range deletion block rather than as records, so they
+// are not a valid record type.
+func decodeRecordType(b byte) (common.RecordType, bool, error) {
+	recordType := common.RecordType(b &^ EXPIRES)
+	expires := b&EXPIRES != 0
+	switch recordType {
+	case common.PUT, common.DELETE, common.MERGE, common.SINGLE_DELETE:
+		return recordType, expires, nil
+	default:
+		return recordType, expires, common.ERR_UNKNOWN_RECORD_TYPE
+	}
+}
+
+// Pins the sst's filter block in the block cache until the last reference to the sst
+// is released. Memory mapped ssts read their filter block from the mapping and are not
+// pinned.
+func (sst *sst) pin(blockCache cache.Cache) error {
+	if sst.mapping != nil || sst.version == LEGACY_SST_FORMAT_VERSION {
+		return nil
+	}
+	_, err := blockCache.GetWithPriority(sst.filterKey(), cache.PINNED, sst.readFilterBlock)
+	if err != nil {
+		return err
+	}
+	sst.pinnedIn = blockCache
+	return nil
+}
 
-		next, err = iter.Next()
+// Reads the sst's bloom filter. The filter block is cached with HIGH priority, or
+// PINNED priority if the sst has been pinned, so that data blocks do not displace it.
+// Returns a nil filter for a legacy sst, which has no filter block.
+func (sst *sst) readFilter(blockCache cache.Cache) (*common.BloomFilter, error) {
+	if sst.version == LEGACY_SST_FORMAT_VERSION {
+		return nil, nil
+	}
+	if sst.mapping != nil {
+		filter, err := sst.readFilterBlock(sst.filterKey())
 		if err != nil {
 			return nil, err
 		}
+		return common.BloomFilterFromBytes(filter), nil
+	}
+
+	priority := cache.HIGH
+	if sst.pinnedIn != nil {
+		priority = cache.PINNED
+	}
+	filter, err := blockCache.GetWithPriority(sst.filterKey(), priority, sst.readFilterBlock)
+	if err != nil {
+		return nil, err
 	}
+	return common.BloomFilterFromBytes(filter), nil
+}
 
-	return bloomFilter, nil
+func (sst *sst) filterKey() cache.Key {
+	return cache.Key{FileID: sst.id, Offset: sst.filterOffset}
+}
+
+// Reads the filter block from the sst.
+func (sst *sst) readFilterBlock(cache.Key) ([]byte, error) {
+	if sst.mapping != nil {
+		if sst.filterOffset+sst.filterLength > int64(len(sst.mapping)) {
+			return nil, common.ERR_BLOCK_UNDERFLOW
+		}
+		return sst.mapping[sst.filterOffset : sst.filterOffset+sst.filterLength], nil
+	}
+
+	f, err := os.Open(sst.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	filter := make([]byte, sst.filterLength)
+	bytesRead, err := f.ReadAt(filter, sst.filterOffset)
+	if err == nil && int64(bytesRead) != sst.filterLength {
+		err = common.ERR_BLOCK_UNDERFLOW
+	}
+	if err != nil {
+		log.Error().
+			Str("path", sst.file).
+			Int64("filter_offset", sst.filterOffset).
+			Int64("filter_length", sst.filterLength).
+			Err(err).
+			Msg("failed to read filter block")
+		return nil, err
+	}
+	return filter, nil
 }
 
 func OpenSst(path string) (*sst, error) {
@@ -125,13 +432,35 @@ func OpenSst(path string) (*sst, error) {
 	int64holder := make([]byte, 8)
 	keyLength := make([]byte, 1)
 
-	// Read metadata start relative to start of file
-	f.Seek(-8, io.SeekEnd)
+	// Read the format magic number and the metadata start relative to start of file
+	f.Seek(-16, io.SeekEnd)
+	f.Read(int64holder)
+	magic := bytesToInt64(int64holder)
 	f.Read(int64holder)
 	metaOffset := bytesToInt64(int64holder)
 
-	// Seek to metadata start
-	f.Seek(metaOffset, io.SeekStart)
+	// An sst written before the format was versioned ends with its meta offset alone.
+	// The 8 bytes preceding it then hold the offset of its last block, which can never
+	// equal the magic number.
+	version := LEGACY_SST_FORMAT_VERSION
+	if magic == sstMagic {
+		// Seek to metadata start
+		f.Seek(metaOffset, io.SeekStart)
+		f.Read(int64holder)
+		version = bytesToInt64(int64holder)
+	} else {
+		metaOffset = bytesToInt64(int64holder)
+		f.Seek(metaOffset, io.SeekStart)
+	}
+	if version > SST_FORMAT_VERSION {
+		log.Error().
+			Str("path", path).
+			Int64("format_version", version).
+			Int64("supported_format_version", SST_FORMAT_VERSION).
+			Msg("SST file was written in an unsupported format")
+		return nil, common.ERR_SST_FORMAT_UNSUPPORTED
+	}
+
 	// Read number of blocks
 	f.Read(int64holder)
 	numBlocks := bytesToInt64(int64holder)
@@ -153,19 +482,158 @@ func OpenSst(path string) (*sst, error) {
 		blocks[i] = block
 	}
 
-	opened := &sst{file: path, blocks: blocks, metaOffset: metaOffset}
+	opened := &sst{
+		file:    path,
+		id:      fileID(path),
+		version: version,
+		blocks:  blocks,
+		// A legacy sst has neither a filter block nor a range deletion block
+		rangeTombstones: []common.RangeTombstone{},
+		metaOffset:      metaOffset,
+		refs:            1,
+	}
+	if version == LEGACY_SST_FORMAT_VERSION {
+		return opened, nil
+	}
+
+	f.Read(int64holder)
+	filterOffset := bytesToInt64(int64holder)
+	f.Read(int64holder)
+	filterLength := bytesToInt64(int64holder)
+	f.Read(int64holder)
+	rangeDeletionOffset := bytesToInt64(int64holder)
+	f.Read(int64holder)
+	rangeDeletionLength := bytesToInt64(int64holder)
+
+	rangeDeletions := make([]byte, rangeDeletionLength)
+	bytesRead, err := f.ReadAt(rangeDeletions, rangeDeletionOffset)
+	if err == nil && int64(bytesRead) != rangeDeletionLength {
+		err = common.ERR_BLOCK_UNDERFLOW
+	}
+	var rangeTombstones []common.RangeTombstone
+	if err == nil {
+		rangeTombstones, err = decodeRangeTombstones(rangeDeletions)
+	}
+	if err != nil {
+		log.Error().
+			Str("path", path).
+			Int64("range_deletion_offset", rangeDeletionOffset).
+			Int64("range_deletion_length", rangeDeletionLength).
+			Err(err).
+			Msg("failed to read range deletion block")
+		return nil, err
+	}
+
+	opened.rangeTombstones = rangeTombstones
+	opened.filterOffset = filterOffset
+	opened.filterLength = filterLength
+	opened.rangeDeletionOffset = rangeDeletionOffset
+	opened.rangeDeletionLength = rangeDeletionLength
 	return opened, nil
 }
 
+// Encodes range tombstones for the range deletion block. Each range tombstone is
+// recorded as its start followed by its end, each prefixed by a single length byte.
+func encodeRangeTombstones(tombstones []common.RangeTombstone) []byte {
+	encoded := []byte{}
+	for _, tombstone := range tombstones {
+		encoded = append(encoded, byte(len(tombstone.Start)))
+		encoded = append(encoded, tombstone.Start...)
+		encoded = append(encoded, byte(len(tombstone.End)))
+		encoded = append(encoded, tombstone.End...)
+	}
+	return encoded
+}
+
+// Decodes the range tombstones of a range deletion block.
+func decodeRangeTombstones(encoded []byte) ([]common.RangeTombstone, error) {
+	tombstones := []common.RangeTombstone{}
+	for offset := 0; offset < len(encoded); {
+		startEnd := offset + 1 + int(encoded[offset])
+		if startEnd >= len(encoded) {
+			return nil, common.ERR_BLOCK_UNDERFLOW
+		}
+		endEnd := startEnd + 1 + int(encoded[startEnd])
+		if endEnd > len(encoded) {
+			return nil, common.ERR_BLOCK_UNDERFLOW
+		}
+		start := append([]byte{}, encoded[offset+1:startEnd]...)
+		end := append([]byte{}, encoded[startEnd+1:endEnd]...)
+		tombstones = append(tombstones, common.RangeTombstone{Start: start, End: end})
+		offset = endEnd
+	}
+	return tombstones, nil
+}
+
+// Ssts are named by a file number which is unique within their directory, and the
+// file number identifies the sst's blocks in the block cache. The next file number of
+// a directory is found by scanning it the first time an sst is created in it.
+var fileNumbers = struct {
+	sync.Mutex
+	next map[string]uint64
+}{next: map[string]uint64{}}
+
+// Ssts whose names hold no file number, such as those written before ssts were
+// numbered, are identified by an id assigned when they are first opened. These ids
+// have the high bit set so that they never collide with a file number.
+var unnumberedIDs = struct {
+	sync.Mutex
+	ids map[string]uint64
+}{ids: map[string]uint64{}}
+
+const unnumberedID uint64 = 1 << 63
+
+// Creates a new sst file in path named by the directory's next file number.
 func newFile(path string) (*os.File, error) {
-	b := make([]byte, 16)
-	_, err := rand.Read(b)
+	fileNumbers.Lock()
+	next, found := fileNumbers.next[path]
+	if !found {
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			fileNumbers.Unlock()
+			return nil, err
+		}
+		for _, file := range files {
+			number, numbered := parseFileNumber(file.Name())
+			if numbered && number >= next {
+				next = number + 1
+			}
+		}
+	}
+	fileNumbers.next[path] = next + 1
+	fileNumbers.Unlock()
+
+	return os.OpenFile(fmt.Sprintf("%s%06d%s", path, next, sstSuffix), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+}
+
+// Returns the file number held by the name of an sst file, if it holds one.
+func parseFileNumber(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, sstSuffix) {
+		return 0, false
+	}
+	number, err := strconv.ParseUint(strings.TrimSuffix(name, sstSuffix), 10, 63)
 	if err != nil {
-		return nil, err
+		return 0, false
+	}
+	return number, true
+}
+
+// Returns the id which identifies the blocks of the sst at path in the block cache. The
+// id is the sst's file number, so re-opening the same sst produces the same id.
+func fileID(path string) uint64 {
+	number, numbered := parseFileNumber(filepath.Base(path))
+	if numbered {
+		return number
 	}
 
-	fileName := fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
-	return os.Create(fmt.Sprintf("%s%s.sst", path, fileName))
+	unnumberedIDs.Lock()
+	defer unnumberedIDs.Unlock()
+	id, found := unnumberedIDs.ids[path]
+	if !found {
+		id = unnumberedID | uint64(len(unnumberedIDs.ids))
+		unnumberedIDs.ids[path] = id
+	}
+	return id
 }
 
 func int64toBytes(i int64) []byte {
@@ -14,36 +14,53 @@ import (
 	"github.com/patrickgombert/lsmt/memtable"
 )
 
+// The ssts of a level along with the range tombstones held by them, which hide the keys
+// they cover in the levels below.
 type blockBasedLevel struct {
-	ssts         []*sst
-	bloomFilters []*common.BloomFilter
-	blockCache   cache.Cache
+	ssts            []*sst
+	rangeTombstones []common.RangeTombstone
 }
 
-// A manager for block based SSTs
+// Creates a new level of ssts.
+func newBlockBasedLevel(ssts []*sst) *blockBasedLevel {
+	rangeTombstones := []common.RangeTombstone{}
+	for _, s := range ssts {
+		rangeTombstones = append(rangeTombstones, s.rangeTombstones...)
+	}
+	return &blockBasedLevel{ssts: ssts, rangeTombstones: rangeTombstones}
+}
+
+// A manager for block based SSTs. A single block cache is shared by every level and is
+// carried over to the managers produced by Flush so that warm blocks survive manifest
+// changes.
 type BlockBasedSSTManager struct {
-	levels   []*blockBasedLevel
-	options  *config.Options
-	manifest *Manifest
+	levels     []*blockBasedLevel
+	options    *config.Options
+	manifest   *Manifest
+	blockCache cache.Cache
 }
 
 func OpenBlockBasedSSTManager(manifest *Manifest, options *config.Options) (*BlockBasedSSTManager, error) {
+	comparator := options.GetComparator().Name()
+	if manifest.Comparator != "" && manifest.Comparator != comparator {
+		log.Error().
+			Str("manifest", manifest.Comparator).
+			Str("options", comparator).
+			Msg("manifest was written with a different comparator")
+		return nil, common.ERR_COMPARATOR_MISMATCH
+	}
+
 	levels := make([]*blockBasedLevel, len(manifest.Levels))
-	levelOptions := make([]config.LevelOptions, len(manifest.Levels))
 	for i, _ := range manifest.Levels {
-		lvl, err := options.GetLevel(i)
+		_, err := options.GetLevel(i)
 		if err != nil {
 			return nil, err
 		}
-		levelOptions[i] = lvl
 	}
 
+	blockCache := newBlockCache(options)
 	for i, entries := range manifest.Levels {
-		level := levelOptions[i]
-		bloomFilters := make([]*common.BloomFilter, len(entries))
-		cache := cache.NewShardedLRUCache(level.GetBlockCacheShards(), level.GetBlockCacheSize())
 		ssts := make([]*sst, len(entries))
-		l := &blockBasedLevel{ssts: ssts, bloomFilters: bloomFilters, blockCache: cache}
 
 		for idx, entry := range entries {
 			log.Debug().
@@ -54,117 +71,202 @@ func OpenBlockBasedSSTManager(manifest *Manifest, options *config.Options) (*Blo
 			if err != nil {
 				return nil, err
 			}
+			if options.IOMode == config.MmapIO {
+				err = sst.mmap()
+				if err != nil {
+					return nil, err
+				}
+			}
+			if i == 0 && options.PinL0IndexAndFilterBlocks {
+				err = sst.pin(blockCache)
+				if err != nil {
+					return nil, err
+				}
+			}
 			ssts[idx] = sst
+		}
+
+		levels[i] = newBlockBasedLevel(ssts)
+	}
 
-			bloomFilter, err := sst.populateBloomFilter(level.GetBloomFilterSize())
+	manager := &BlockBasedSSTManager{levels: levels, options: options, manifest: manifest, blockCache: blockCache}
+	return manager, nil
+}
+
+// Appends the levels below the deepest level written by a flush to its new levels. They
+// were not part of the flush and are carried over unchanged, along with their ssts' warm
+// blocks in the block cache, since a manifest written without them would lose every sst
+// beneath the levels which were written.
+func (manager *BlockBasedSSTManager) carryOver(newLevels []*blockBasedLevel) ([]*blockBasedLevel, error) {
+	if len(newLevels) >= len(manager.levels) {
+		return newLevels, nil
+	}
+	for _, untouched := range manager.levels[len(newLevels):] {
+		if !acquireAll(untouched.ssts) {
+			return nil, common.ERR_SST_RELEASED
+		}
+		newLevels = append(newLevels, untouched)
+	}
+	return newLevels, nil
+}
+
+// Gets the pair for the given key.
+// The pair at the highest level will be returned. If no pair is found then it will
+// return nil, and if the key is covered by a range tombstone of a level above any pair
+// then it will return a tombstone. Merge records are combined with the levels beneath
+// them and returned as a put. A put which has expired is returned with its expiry for
+// the caller to check. Uses the write through block cache while searching for a
+// value. Each sst's filter block is consulted before any of its data blocks are read.
+func (manager *BlockBasedSSTManager) Get(key []byte) (*common.Pair, error) {
+	operands := [][]byte{}
+	for levelIndex, level := range manager.levels {
+		levelOptions, err := manager.options.GetLevel(levelIndex)
+		if err != nil {
+			return nil, err
+		}
+		for _, sst := range level.ssts {
+			foundBlock := sst.GetBlock(manager.options.GetComparator(), key)
+			if foundBlock == nil {
+				continue
+			}
+			if !sst.acquire() {
+				return nil, common.ERR_SST_RELEASED
+			}
+			pair, err := getFromSst(manager.options.GetComparator(), sst, foundBlock, key, manager.blockCache, levelOptions)
+			sst.release()
 			if err != nil {
 				return nil, err
 			}
-
-			bloomFilters[idx] = bloomFilter
+			if pair == nil {
+				continue
+			}
+			if pair.Type != common.MERGE {
+				return manager.merge(key, pair, operands)
+			}
+			// The ssts of a level do not overlap, so no other sst of the level holds the key
+			operands = append(operands, pair.Value)
+			break
+		}
+		if common.Covers(manager.options.GetComparator(), level.rangeTombstones, key) {
+			return manager.merge(key, &common.Pair{Key: key, Value: []byte{}, Type: common.DELETE}, operands)
 		}
+	}
+
+	return manager.merge(key, nil, operands)
+}
 
-		levels[i] = l
+// Combines the merge operands, ordered newest first, with the pair beneath them. An
+// expired pair has no value to combine with. Returns the pair unchanged if there are no
+// operands.
+func (manager *BlockBasedSSTManager) merge(key []byte, pair *common.Pair, operands [][]byte) (*common.Pair, error) {
+	if len(operands) == 0 {
+		return pair, nil
 	}
+	if manager.options.MergeOperator == nil {
+		return nil, common.ERR_NO_MERGE_OPERATOR
+	}
+	var value []byte
+	if pair != nil && pair.Type == common.PUT && !pair.Expired(manager.options.Now()) {
+		value = pair.Value
+	}
+	return &common.Pair{Key: key, Value: common.FullMerge(manager.options.MergeOperator, key, value, operands), Type: common.PUT}, nil
+}
 
-	manager := &BlockBasedSSTManager{levels: levels, options: options, manifest: manifest}
-	return manager, nil
+// Returns the statistics for the block cache shared by the manager's levels.
+func (manager *BlockBasedSSTManager) BlockCacheStats() cache.Stats {
+	return manager.blockCache.Stats()
 }
 
-// Gets a value for the given key.
-// The value at the highest level will be returned. If no value is found then it will
-// return nil. Uses the write through block cache while searching for a value.
-func (manager *BlockBasedSSTManager) Get(key []byte) ([]byte, error) {
+// Returns the number of ssts and their size for each of the manager's levels.
+func (manager *BlockBasedSSTManager) LevelStats() []LevelStats {
+	stats := make([]LevelStats, len(manager.levels))
+	for i, level := range manager.levels {
+		stats[i].Files = len(level.ssts)
+		for _, s := range level.ssts {
+			// The data blocks are followed by the filter block
+			stats[i].Bytes += s.filterOffset
+		}
+	}
+	return stats
+}
+
+// Releases the manager's references to all of its ssts. Iterators which were created
+// before Close was invoked hold their own references and remain usable.
+func (manager *BlockBasedSSTManager) Close() error {
+	var err error
 	for _, level := range manager.levels {
-		for i, sst := range level.ssts {
-			if level.bloomFilters[i].Test(key) {
-				foundBlock := sst.GetBlock(key)
-				if foundBlock != nil {
-					b, err := level.blockCache.Get(foundBlock, func(bl cache.Shardable) ([]byte, error) {
-						var levelOptions, err = manager.options.GetLevel(i)
-						if err != nil {
-							return nil, err
-						}
-						return sst.ReadBlock(bl.(*block), levelOptions)
-					})
-
-					if err != nil {
-						return nil, err
-					}
-
-					reader := bytes.NewReader(b)
-					length := make([]byte, 1)
-					for {
-						_, err = reader.Read(length)
-						if err == io.EOF {
-							return nil, nil
-						}
-						if err != nil {
-							return nil, err
-						}
-						k := make([]byte, length[0])
-						bytesRead, err := reader.Read(k)
-						if err == io.EOF || bytesRead < int(length[0]) {
-							return nil, nil
-						}
-						_, err = reader.Read(length)
-
-						if c.Compare(k, key) == c.EQUAL {
-							v := make([]byte, length[0])
-							bytesRead, err = reader.Read(v)
-							if err == io.EOF || bytesRead < int(length[0]) {
-								return nil, nil
-							}
-							if err != nil {
-								return nil, err
-							}
-
-							return v, nil
-						} else {
-							_, err = reader.Seek(int64(length[0]), io.SeekCurrent)
-							if err == io.EOF {
-								return nil, nil
-							}
-							if err != nil {
-								return nil, err
-							}
-						}
-					}
-				}
-			}
+		releaseErr := releaseAll(level.ssts)
+		if releaseErr != nil {
+			err = releaseErr
 		}
 	}
+	return err
+}
 
-	return nil, nil
+// Returns a new manager for the same ssts which holds its own reference to each of
+// them, so that closing either manager leaves the other usable.
+func (manager *BlockBasedSSTManager) Acquire() (SSTManager, error) {
+	for i, level := range manager.levels {
+		if !acquireAll(level.ssts) {
+			for _, acquired := range manager.levels[:i] {
+				releaseAll(acquired.ssts)
+			}
+			return nil, common.ERR_SST_RELEASED
+		}
+	}
+	return &BlockBasedSSTManager{levels: manager.levels, options: manager.options, manifest: manager.manifest, blockCache: manager.blockCache}, nil
 }
 
 // Creates a block cached iterator for each level of SSTs. Combines each level's iterator
-// into a MergedIterator.
-func (manager *BlockBasedSSTManager) Iterator(start, end []byte) (common.Iterator, error) {
+// into a MergedIterator which honours the bounds and limit of the options provided.
+// Keys are ordered by the comparator of the manager's options.
+func (manager *BlockBasedSSTManager) Iterator(opts common.IterOptions) (common.Iterator, error) {
+	opts.Comparator = manager.options.GetComparator()
 	iterators := make([]common.Iterator, len(manager.levels))
 	for i, level := range manager.levels {
 		levelConfig, err := manager.options.GetLevel(i)
 		if err != nil {
 			return nil, err
 		}
-		iter, err := NewCachedIterator(start, end, level.blockCache, level.ssts, levelConfig)
+		iter, err := NewCachedIterator(opts, manager.blockCache, level.ssts, levelConfig)
 		if err != nil {
 			return nil, err
 		}
 		iterators[i] = iter
 	}
 
-	mergedIterator := common.NewMergedIterator(iterators, false)
+	var mergedIterator common.Iterator = common.NewMergedIterator(iterators, false, manager.options.MergeOperator, manager.options.Now(), opts.Comparator)
+	if opts.Limit > 0 {
+		mergedIterator = common.NewLimitIterator(mergedIterator, opts.Limit)
+	}
 	return mergedIterator, nil
 }
 
 // Flush a slice of memables to disk. Calling Flush will also trigger compaction.
-func (manager *BlockBasedSSTManager) Flush(tables []*memtable.Memtable) (SSTManager, error) {
+// The log number recorded in the new manifest never moves backwards.
+// The ssts of every level which is rewritten are marked obsolete once the new manifest
+// has been written. Their files are removed when the last reference to them, held by
+// this manager or by an open iterator, is released.
+func (manager *BlockBasedSSTManager) Flush(tables []memtable.Memtable, logNumber int) (SSTManager, error) {
+	if logNumber < manager.manifest.LogNumber {
+		logNumber = manager.manifest.LogNumber
+	}
+	// Records are expired against a single time for the whole flush
+	now := manager.options.Now()
+	comparator := manager.options.GetComparator()
+	// The key range passed to the compaction filter widens as each level is merged in
+	merged := &keyRange{comparator: comparator}
 	iters := make([]common.Iterator, len(tables))
 	for i, table := range tables {
 		iters[i] = table.UnboundedIterator()
+		err := merged.includeMemtable(table)
+		if err != nil {
+			return nil, err
+		}
 	}
-	iter := common.NewMergedIterator(iters, true)
+	var iter common.Iterator = common.NewMergedIterator(iters, true, manager.options.MergeOperator, now, comparator)
+	// Closing the merged iterator releases the references held on the levels read
+	defer func() { iter.Close() }()
 
 	newLevels := []*blockBasedLevel{}
 	var pair *common.Pair
@@ -175,8 +277,18 @@ func (manager *BlockBasedSSTManager) Flush(tables []*memtable.Memtable) (SSTMana
 		if err != nil {
 			return nil, err
 		}
-		iter = common.NewMergedIterator([]common.Iterator{iter, levelIter}, true)
+		err = rewind(iter, pair)
+		if err != nil {
+			return nil, err
+		}
+		pair = nil
+		iter = common.NewMergedIterator([]common.Iterator{iter, levelIter}, true, manager.options.MergeOperator, now, comparator)
 		flush := newFlush(manager.options, level, level.SSTSize*int64(level.MaximumSSTFiles))
+		if i < len(manager.levels) {
+			merged.includeLevel(manager.levels[i])
+		}
+		context := config.CompactionContext{Level: i, Start: merged.start, End: merged.end}
+		bottom := manager.isBottom(i)
 
 		for {
 			// It is possible to have a leftover pair that was not accepted, check for that case first
@@ -200,9 +312,11 @@ func (manager *BlockBasedSSTManager) Flush(tables []*memtable.Memtable) (SSTMana
 				return nil, err
 			}
 
-			// If the iterator has been exhausted then we are done
+			// If the iterator has been exhausted then we are done. The range tombstones of
+			// everything merged are kept with this level, the deepest written, so that they
+			// only hide the older levels below it.
 			if !next {
-				ssts, err := flush.close()
+				ssts, err := flush.close(common.CoalesceRangeTombstones(comparator, common.RangeTombstonesOf(iter)))
 				if err != nil {
 					log.Error().
 						Int("level", i).
@@ -210,7 +324,7 @@ func (manager *BlockBasedSSTManager) Flush(tables []*memtable.Memtable) (SSTMana
 						Msg("flush failed to close")
 					return nil, err
 				}
-				l, err := newLevel(ssts, level)
+				l, err := newLevel(ssts, manager.options, i, manager.blockCache)
 				if err != nil {
 					log.Error().
 						Int("level", i).
@@ -218,9 +332,12 @@ func (manager *BlockBasedSSTManager) Flush(tables []*memtable.Memtable) (SSTMana
 						Msg("failed to generate new block based level")
 					return nil, err
 				}
-				newLevels = append(newLevels, l)
+				newLevels, err = manager.carryOver(append(newLevels, l))
+				if err != nil {
+					return nil, err
+				}
 
-				manifest, err := newManifest(newLevels, manager.options.Path, manager.manifest.Version)
+				manifest, err := newManifest(newLevels, manager.options.Path, manager.manifest.Version, manager.options.GetComparator().Name(), logNumber)
 				if err != nil {
 					log.Error().
 						Int("version", manager.manifest.Version+1).
@@ -229,17 +346,24 @@ func (manager *BlockBasedSSTManager) Flush(tables []*memtable.Memtable) (SSTMana
 						Msg("failed to generate new manifest")
 					return nil, err
 				}
-				newManager := &BlockBasedSSTManager{levels: newLevels, options: manager.options, manifest: manifest}
+				manager.markObsolete(i + 1)
+				newManager := &BlockBasedSSTManager{levels: newLevels, options: manager.options, manifest: manifest, blockCache: manager.blockCache}
 				return newManager, nil
 			}
 			pair, err = iter.Get()
 			if err != nil {
 				return nil, err
 			}
+			pair = manager.filter(context, pair)
+			// A single delete which did not meet its put, such as one which replaced its put
+			// in a memtable, is dropped once nothing lies beneath the level to hold the put
+			if bottom && pair.Type == common.SINGLE_DELETE {
+				pair = nil
+			}
 		}
 
 		// Close the flush and generate the new level
-		ssts, err := flush.close()
+		ssts, err := flush.close(nil)
 		if err != nil {
 			log.Error().
 				Int("level", i).
@@ -248,7 +372,7 @@ func (manager *BlockBasedSSTManager) Flush(tables []*memtable.Memtable) (SSTMana
 
 			return nil, err
 		}
-		l, err := newLevel(ssts, level)
+		l, err := newLevel(ssts, manager.options, i, manager.blockCache)
 		if err != nil {
 			log.Error().
 				Int("level", i).
@@ -264,8 +388,17 @@ func (manager *BlockBasedSSTManager) Flush(tables []*memtable.Memtable) (SSTMana
 	if err != nil {
 		return nil, err
 	}
-	iter = common.NewMergedIterator([]common.Iterator{iter, sinkIter}, false)
+	err = rewind(iter, pair)
+	if err != nil {
+		return nil, err
+	}
+	pair = nil
+	iter = common.NewMergedIterator([]common.Iterator{iter, sinkIter}, false, manager.options.MergeOperator, now, comparator)
 	flush := newFlush(manager.options, manager.options.Sink, NOMAX)
+	if len(manager.options.Levels) < len(manager.levels) {
+		merged.includeLevel(manager.levels[len(manager.options.Levels)])
+	}
+	context := config.CompactionContext{Level: len(manager.options.Levels), IsSink: true, Start: merged.start, End: merged.end}
 
 	for {
 		// It is possible to have a leftover pair that was not accepted, check for that case first
@@ -296,9 +429,12 @@ func (manager *BlockBasedSSTManager) Flush(tables []*memtable.Memtable) (SSTMana
 		if err != nil {
 			return nil, err
 		}
+		// A pair removed from the sink is not written at all
+		pair = manager.filter(context, pair)
 	}
 
-	ssts, err := flush.close()
+	// Nothing lies below the sink, so its range tombstones are dropped
+	ssts, err := flush.close(nil)
 	if err != nil {
 		log.Error().
 			Str("level", "sink").
@@ -307,7 +443,7 @@ func (manager *BlockBasedSSTManager) Flush(tables []*memtable.Memtable) (SSTMana
 
 		return nil, err
 	}
-	l, err := newLevel(ssts, manager.options.Sink)
+	l, err := newLevel(ssts, manager.options, len(manager.options.Levels), manager.blockCache)
 	if err != nil {
 		log.Error().
 			Str("level", "sink").
@@ -318,7 +454,7 @@ func (manager *BlockBasedSSTManager) Flush(tables []*memtable.Memtable) (SSTMana
 	}
 	newLevels = append(newLevels, l)
 
-	manifest, err := newManifest(newLevels, manager.options.Path, manager.manifest.Version)
+	manifest, err := newManifest(newLevels, manager.options.Path, manager.manifest.Version, manager.options.GetComparator().Name(), logNumber)
 	if err != nil {
 		log.Error().
 			Int("version", manager.manifest.Version+1).
@@ -328,11 +464,122 @@ func (manager *BlockBasedSSTManager) Flush(tables []*memtable.Memtable) (SSTMana
 
 		return nil, err
 	}
-	newManager := &BlockBasedSSTManager{levels: newLevels, options: manager.options, manifest: manifest}
+	manager.markObsolete(len(manager.levels))
+	newManager := &BlockBasedSSTManager{levels: newLevels, options: manager.options, manifest: manifest, blockCache: manager.blockCache}
 	return newManager, nil
 }
 
-// Creates an unbounded cached iterator for a single level
+// Marks the ssts of the given number of leading levels as obsolete.
+func (manager *BlockBasedSSTManager) markObsolete(levels int) {
+	if levels > len(manager.levels) {
+		levels = len(manager.levels)
+	}
+	for _, level := range manager.levels[:levels] {
+		for _, s := range level.ssts {
+			s.markObsolete(manager.blockCache)
+		}
+	}
+}
+
+// Returns whether no level below the given level holds any ssts.
+func (manager *BlockBasedSSTManager) isBottom(level int) bool {
+	for i := level + 1; i < len(manager.levels); i++ {
+		if len(manager.levels[i].ssts) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Moves the iterator back over the leftover pair which did not fit in the previous
+// level, if there is one. Once the next level is composed into the iterator the
+// leftover pair is returned again, in key order with the pairs of the next level.
+func rewind(iter common.Iterator, leftover *common.Pair) error {
+	if leftover == nil {
+		return nil
+	}
+	_, err := iter.Prev()
+	return err
+}
+
+// Applies the compaction filter to a put about to be written to a level. Returns nil
+// if the put is removed from the sink and a tombstone if it is removed from any other
+// level. Other pairs are returned unchanged.
+func (manager *BlockBasedSSTManager) filter(context config.CompactionContext, pair *common.Pair) *common.Pair {
+	if manager.options.CompactionFilter == nil || pair.Type != common.PUT {
+		return pair
+	}
+	decision, value := manager.options.CompactionFilter.Filter(context, pair.Key, pair.Value)
+	switch decision {
+	case config.Remove:
+		if context.IsSink {
+			return nil
+		}
+		return &common.Pair{Key: pair.Key, Value: []byte{}, Type: common.DELETE}
+	case config.ChangeValue:
+		if value == nil {
+			value = []byte{}
+		}
+		return &common.Pair{Key: pair.Key, Value: value, Type: common.PUT, Expiry: pair.Expiry}
+	default:
+		return pair
+	}
+}
+
+// The smallest and largest keys of the records merged into a level by a flush, in the
+// comparator's order. The end taken from a level is the shortened end of its last
+// block, which may lie past its largest key. Both are nil until a key is included.
+type keyRange struct {
+	comparator c.Comparator
+	start      []byte
+	end        []byte
+}
+
+// Widens the range to include the keys from start to end.
+func (r *keyRange) include(start, end []byte) {
+	if r.start == nil || r.comparator.Compare(start, r.start) == c.LESS_THAN {
+		r.start = start
+	}
+	if r.end == nil || r.comparator.Compare(end, r.end) == c.GREATER_THAN {
+		r.end = end
+	}
+}
+
+// Widens the range to include the first and last keys of the memtable.
+func (r *keyRange) includeMemtable(table memtable.Memtable) error {
+	iter := table.UnboundedIterator()
+	defer iter.Close()
+	found, err := iter.SeekToFirst()
+	if err != nil || !found {
+		return err
+	}
+	first, err := iter.Get()
+	if err != nil {
+		return err
+	}
+	_, err = iter.SeekToLast()
+	if err != nil {
+		return err
+	}
+	last, err := iter.Get()
+	if err != nil {
+		return err
+	}
+	r.include(first.Key, last.Key)
+	return nil
+}
+
+// Widens the range to include the blocks of every sst of the level.
+func (r *keyRange) includeLevel(level *blockBasedLevel) {
+	for _, sst := range level.ssts {
+		if len(sst.blocks) > 0 {
+			r.include(sst.blocks[0].start, sst.blocks[len(sst.blocks)-1].end)
+		}
+	}
+}
+
+// Creates an unbounded cached iterator for a single level. Since the level is about to
+// be rewritten, the blocks read are not inserted into the block cache.
 func (manager *BlockBasedSSTManager) levelUnboundedIterator(level int) (common.Iterator, error) {
 	levelConfig, err := manager.options.GetLevel(level)
 	if err != nil {
@@ -340,28 +587,58 @@ func (manager *BlockBasedSSTManager) levelUnboundedIterator(level int) (common.I
 	}
 	if level < len(manager.levels) {
 		l := manager.levels[level]
-		return NewCachedUnboundedIterator(l.blockCache, l.ssts, levelConfig)
+		opts := common.IterOptions{DontFillCache: true, Comparator: manager.options.GetComparator()}
+		return NewCachedUnboundedIterator(opts, manager.blockCache, l.ssts, levelConfig)
 	} else {
 		return common.EmptyIterator(), nil
 	}
 }
 
 // Creates a new blockBasedLevel
-func newLevel(ssts []*sst, options config.LevelOptions) (*blockBasedLevel, error) {
-	cache := cache.NewShardedLRUCache(options.GetBlockCacheShards(), options.GetBlockCacheSize())
-	bloomFilters := make([]*common.BloomFilter, len(ssts))
-	for i, sst := range ssts {
-		bloomFilter, err := sst.populateBloomFilter(options.GetBloomFilterSize())
-		if err != nil {
-			return nil, err
+func newLevel(ssts []*sst, options *config.Options, levelIndex int, blockCache cache.Cache) (*blockBasedLevel, error) {
+	for _, sst := range ssts {
+		if options.IOMode == config.MmapIO {
+			err := sst.mmap()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if levelIndex == 0 && options.PinL0IndexAndFilterBlocks {
+			err := sst.pin(blockCache)
+			if err != nil {
+				return nil, err
+			}
 		}
-		bloomFilters[i] = bloomFilter
 	}
-	return &blockBasedLevel{ssts: ssts, bloomFilters: bloomFilters, blockCache: cache}, nil
+	return newBlockBasedLevel(ssts), nil
 }
 
-// Creates a new manifest, creating entries for each level
-func newManifest(levels []*blockBasedLevel, path string, version int) (*Manifest, error) {
+// Returns the block cache provided by the options. If no block cache was provided then
+// a new ShardedLRUCache is created which is large enough to hold each level's
+// BlockCacheSize.
+func newBlockCache(options *config.Options) cache.Cache {
+	if options.BlockCache != nil {
+		return options.BlockCache
+	}
+
+	size := options.Sink.GetBlockCacheSize()
+	shards := options.Sink.GetBlockCacheShards()
+	for _, level := range options.Levels {
+		size += level.GetBlockCacheSize()
+		if level.GetBlockCacheShards() > shards {
+			shards = level.GetBlockCacheShards()
+		}
+	}
+	if shards < 1 {
+		shards = 1
+	}
+
+	return cache.NewShardedLRUCache(shards, size)
+}
+
+// Creates a new manifest, creating entries for each level and recording the name of
+// the comparator
+func newManifest(levels []*blockBasedLevel, path string, version int, comparator string, logNumber int) (*Manifest, error) {
 	manifestLevels := make([][]SST, len(levels))
 	for i, l := range levels {
 		innerLevel := make([]SST, len(l.ssts))
@@ -372,9 +649,104 @@ func newManifest(levels []*blockBasedLevel, path string, version int) (*Manifest
 	}
 
 	manifestPath := path + manifestPrefix + strconv.Itoa(version+1)
-	err := WriteManifest(manifestPath, manifestLevels)
+	err := WriteManifest(manifestPath, manifestLevels, comparator, logNumber)
 	if err != nil {
 		return nil, err
 	}
 	return MostRecentManifest(path)
 }
+
+// Finds the value for key within a single block of an sst after checking the sst's
+// filter. Returns nil if the key is not present in the block.
+func getFromSst(comparator c.Comparator, sst *sst, b *block, key []byte, blockCache cache.Cache, level config.LevelOptions) (*common.Pair, error) {
+	filter, err := sst.readFilter(blockCache)
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil && !filter.Test(key) {
+		return nil, nil
+	}
+	return getFromBlock(comparator, sst, b, key, blockCache, level)
+}
+
+// Finds the pair for key within a single block. Returns nil if the key is not present
+// in the block.
+func getFromBlock(comparator c.Comparator, sst *sst, b *block, key []byte, blockCache cache.Cache, level config.LevelOptions) (*common.Pair, error) {
+	blockBytes, err := sst.readCachedBlock(blockCache, b, level, true)
+	if err != nil {
+		return nil, err
+	}
+	if sst.version == LEGACY_SST_FORMAT_VERSION {
+		pairs, err := decodeLegacyBlock(blockBytes)
+		if err != nil {
+			return nil, err
+		}
+		for _, pair := range pairs {
+			if comparator.Compare(pair.Key, key) == c.EQUAL {
+				return &common.Pair{Key: append([]byte{}, pair.Key...), Value: append([]byte{}, pair.Value...), Type: pair.Type}, nil
+			}
+		}
+		return nil, nil
+	}
+
+	reader := bytes.NewReader(blockBytes)
+	length := make([]byte, 1)
+	expiryBytes := make([]byte, 8)
+	for {
+		_, err = reader.Read(length)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		k := make([]byte, length[0])
+		bytesRead, err := reader.Read(k)
+		if err == io.EOF || bytesRead < int(length[0]) {
+			return nil, nil
+		}
+		// The record type is followed by the expiry, if the record expires, and then by
+		// the length of the value
+		typeByte, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil
+		}
+		recordType, expires, err := decodeRecordType(typeByte)
+		if err != nil {
+			return nil, err
+		}
+		expiry := int64(0)
+		if expires {
+			_, err = io.ReadFull(reader, expiryBytes)
+			if err != nil {
+				return nil, nil
+			}
+			expiry = bytesToInt64(expiryBytes)
+		}
+		valueLength, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil
+		}
+
+		if comparator.Compare(k, key) == c.EQUAL {
+			v := make([]byte, valueLength)
+			bytesRead, err = reader.Read(v)
+			if (err == io.EOF && valueLength > 0) || bytesRead < int(valueLength) {
+				return nil, nil
+			}
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+
+			return &common.Pair{Key: k, Value: v, Type: recordType, Expiry: expiry}, nil
+		} else {
+			_, err = reader.Seek(int64(valueLength), io.SeekCurrent)
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
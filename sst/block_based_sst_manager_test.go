@@ -1,8 +1,11 @@
 package sst
 
 import (
+	"os"
 	"testing"
+	"time"
 
+	"github.com/patrickgombert/lsmt/cache"
 	"github.com/patrickgombert/lsmt/common"
 	c "github.com/patrickgombert/lsmt/comparator"
 	"github.com/patrickgombert/lsmt/config"
@@ -15,28 +18,87 @@ func TestGetFoundKeyNotInCache(t *testing.T) {
 
 	mt := memtable.NewMemtable()
 	mt.Write([]byte{0}, []byte{0})
-	sink := &config.Sink{BlockSize: 4, SSTSize: 8, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 12}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 12}
 	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
 	manager, _ := FlushFrom(options, mt)
 
-	value, _ := manager.Get([]byte{0})
+	pair, _ := manager.Get([]byte{0})
+	value := pair.Value
 	if c.Compare([]byte{0}, value) != c.EQUAL {
 		t.Errorf("Expected mananger Get to produce %q, but got %q", []byte{0}, value)
 	}
 }
 
+func TestGetTellsEmptyValuesFromTombstones(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{0}, []byte{})
+	mt.Delete([]byte{1})
+	level := &config.Level{BlockSize: 100, SSTSize: 1000, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 1}
+	sink := &config.Sink{BlockSize: 100, SSTSize: 1000, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: []*config.Level{level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manager, _ := FlushFrom(options, mt)
+	defer manager.Close()
+
+	pair, _ := manager.Get([]byte{0})
+	if pair == nil || pair.IsTombstone() || len(pair.Value) != 0 {
+		t.Errorf("Expected an empty value, but got %v", pair)
+	}
+	pair, _ = manager.Get([]byte{1})
+	if pair == nil || !pair.IsTombstone() {
+		t.Errorf("Expected a tombstone, but got %v", pair)
+	}
+}
+
+func TestFlushKeepsMergeRecordsUntilTheyReachTheirValue(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	level := &config.Level{BlockSize: 10, SSTSize: 10, BlockCacheSize: 10, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 1}
+	sink := &config.Sink{BlockSize: 10, SSTSize: 10, BlockCacheSize: 10, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: []*config.Level{level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096, MergeOperator: config.AppendOperator{}}
+	written := memtable.NewMemtable()
+	written.Write([]byte{1}, []byte("a"))
+	written.Write([]byte{2}, []byte("aaaaa"))
+	manager, _ := FlushFrom(options, written)
+
+	// The operand fits in the first level, above the value it applies to in the sink
+	merged := memtable.NewMemtable()
+	merged.Merge([]byte{2}, []byte("b"))
+	manager, _ = manager.Flush([]memtable.Memtable{merged}, 0)
+	compareLevelRecord(manager, 0, []byte{2}, []byte("b"), common.MERGE, t)
+	compareManagerGet(manager, []byte{2}, []byte("aaaaab"), t)
+
+	iter, _ := manager.Iterator(common.IterOptions{LowerBound: []byte{2}})
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte("aaaaab"), t)
+	iter.Close()
+
+	// Pushing the operand down into the sink resolves it with the value
+	pushed := memtable.NewMemtable()
+	pushed.Write([]byte{0}, []byte("aaaaa"))
+	manager, _ = manager.Flush([]memtable.Memtable{pushed}, 0)
+	defer manager.Close()
+	compareLevelRecord(manager, 1, []byte{2}, []byte("aaaaab"), common.PUT, t)
+	compareManagerGet(manager, []byte{2}, []byte("aaaaab"), t)
+}
+
 func TestGetFoundKeyInCache(t *testing.T) {
 	common.SetUp(t)
 	defer common.TearDown(t)
 
 	mt := memtable.NewMemtable()
 	mt.Write([]byte{0}, []byte{0})
-	sink := &config.Sink{BlockSize: 4, SSTSize: 8, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
 	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
 	manager, _ := FlushFrom(options, mt)
 
-	value, _ := manager.Get([]byte{0})
-	value, _ = manager.Get([]byte{0})
+	pair, _ := manager.Get([]byte{0})
+	value := pair.Value
+	pair, _ = manager.Get([]byte{0})
+	value = pair.Value
 
 	if c.Compare([]byte{0}, value) != c.EQUAL {
 		t.Errorf("Expected mananger Get to produce %q, but got %q", []byte{0}, value)
@@ -50,12 +112,721 @@ func TestGetNotFound(t *testing.T) {
 	mt := memtable.NewMemtable()
 	mt.Write([]byte{0}, []byte{0})
 	mt.Write([]byte{2}, []byte{2})
-	sink := &config.Sink{BlockSize: 8, SSTSize: 8, BlockCacheSize: 8, BlockCacheShards: 1}
+	sink := &config.Sink{BlockSize: 10, SSTSize: 10, BlockCacheSize: 8, BlockCacheShards: 1}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manager, _ := FlushFrom(options, mt)
+
+	pair, _ := manager.Get([]byte{1})
+	if pair != nil {
+		t.Errorf("Expected non-existent key to product nil pair, but got %q", pair.Value)
+	}
+}
+
+func TestGetMmapIO(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{0}, []byte{0})
+	mt.Write([]byte{1}, []byte{1})
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096, IOMode: config.MmapIO}
+	manager, _ := FlushFrom(options, mt)
+	defer manager.Close()
+
+	pair, _ := manager.Get([]byte{1})
+	value := pair.Value
+	if c.Compare([]byte{1}, value) != c.EQUAL {
+		t.Errorf("Expected mananger Get to produce %q, but got %q", []byte{1}, value)
+	}
+}
+
+func TestFlushRetainsUntouchedLevels(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{0}, []byte{0})
+	mt.Write([]byte{1}, []byte{1})
+	mt.Write([]byte{2}, []byte{2})
+	level := &config.Level{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 1}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: []*config.Level{level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manager, _ := FlushFrom(options, mt)
+
+	overwrite := memtable.NewMemtable()
+	overwrite.Write([]byte{0}, []byte{9})
+	manager, _ = manager.Flush([]memtable.Memtable{overwrite}, 0)
+
+	pair, _ := manager.Get([]byte{2})
+	value := pair.Value
+	if c.Compare([]byte{2}, value) != c.EQUAL {
+		t.Errorf("Expected mananger Get to produce %q from the sink, but got %q", []byte{2}, value)
+	}
+	pair, _ = manager.Get([]byte{0})
+	value = pair.Value
+	if c.Compare([]byte{9}, value) != c.EQUAL {
+		t.Errorf("Expected mananger Get to produce %q, but got %q", []byte{9}, value)
+	}
+}
+
+func TestFlushOverflowMergesLowerLevelInOrder(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	level := &config.Level{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 1}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: []*config.Level{level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manager, _ := OpenBlockBasedSSTManager(&Manifest{Levels: [][]Entry{}, Version: 0}, options)
+	var flushed SSTManager = manager
+	for _, key := range []byte{0, 1, 2, 3, 4, 5} {
+		mt := memtable.NewMemtable()
+		mt.Write([]byte{key}, []byte{key})
+		flushed, _ = flushed.Flush([]memtable.Memtable{mt}, 0)
+	}
+
+	iter, _ := flushed.Iterator(common.IterOptions{})
+	defer iter.Close()
+	for _, key := range []byte{0, 1, 2, 3, 4, 5} {
+		common.CompareNext(iter, true, t)
+		common.CompareGet(iter, []byte{key}, []byte{key}, t)
+	}
+	common.CompareNext(iter, false, t)
+}
+
+func TestFlushOverflowMergesLowerLevelInComparatorOrder(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	level := &config.Level{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 1}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: []*config.Level{level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096, Comparator: c.ReverseBytewiseComparator{}}
+	manager, _ := OpenBlockBasedSSTManager(&Manifest{Levels: [][]Entry{}, Version: 0}, options)
+	var flushed SSTManager = manager
+	for _, key := range []byte{0, 1, 2, 3, 4, 5} {
+		mt := memtable.NewTreeMemtableWithComparator(c.ReverseBytewiseComparator{})
+		mt.Write([]byte{key}, []byte{key})
+		flushed, _ = flushed.Flush([]memtable.Memtable{mt}, 0)
+	}
+
+	iter, _ := flushed.Iterator(common.IterOptions{})
+	defer iter.Close()
+	for _, key := range []byte{5, 4, 3, 2, 1, 0} {
+		common.CompareNext(iter, true, t)
+		common.CompareGet(iter, []byte{key}, []byte{key}, t)
+	}
+	common.CompareNext(iter, false, t)
+
+	pair, _ := flushed.Get([]byte{2})
+	if pair == nil || c.Compare(pair.Value, []byte{2}) != c.EQUAL {
+		t.Errorf("Expected manager Get to produce %q, but got %v", []byte{2}, pair)
+	}
+	comparator := flushed.(*BlockBasedSSTManager).manifest.Comparator
+	if comparator != "ReverseBytewiseComparator" {
+		t.Errorf("Expected manifest to have comparator %q, but got %q", "ReverseBytewiseComparator", comparator)
+	}
+}
+
+func TestOpenWithMismatchedComparatorReturnsError(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 12}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manifest := &Manifest{Levels: [][]Entry{}, Version: 0, Comparator: "ReverseBytewiseComparator"}
+	_, err := OpenBlockBasedSSTManager(manifest, options)
+	if err != common.ERR_COMPARATOR_MISMATCH {
+		t.Errorf("Expected opening with a different comparator to return %q, but got %v", common.ERR_COMPARATOR_MISMATCH, err)
+	}
+}
+
+func TestFlushKeepsRangeTombstonesAboveOlderLevels(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	level := &config.Level{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 1}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: []*config.Level{level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manager, _ := OpenBlockBasedSSTManager(&Manifest{Levels: [][]Entry{}, Version: 0}, options)
+	written := memtable.NewMemtable()
+	for _, key := range []byte{0, 1, 2, 3, 4, 5} {
+		written.Write([]byte{key}, []byte{key})
+	}
+	flushed, _ := manager.Flush([]memtable.Memtable{written}, 0)
+
+	deleted := memtable.NewMemtable()
+	deleted.DeleteRange([]byte{1}, []byte{3})
+	flushed, _ = flushed.Flush([]memtable.Memtable{deleted}, 0)
+	compareRangeDeleted(flushed, t)
+
+	manifest, _ := MostRecentManifest(common.TEST_DIR)
+	reopened, _ := OpenBlockBasedSSTManager(manifest, options)
+	defer reopened.Close()
+	compareRangeDeleted(reopened, t)
+}
+
+func TestFlushDropsRangeTombstonesAtSink(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{0}, []byte{0})
+	manager, _ := FlushFrom(options, mt)
+
+	deleted := memtable.NewMemtable()
+	deleted.DeleteRange([]byte{0}, []byte{1})
+	flushed, _ := manager.Flush([]memtable.Memtable{deleted}, 0)
+	defer flushed.Close()
+
+	for _, level := range flushed.(*BlockBasedSSTManager).levels {
+		if len(level.rangeTombstones) != 0 {
+			t.Errorf("Expected the sink to drop range tombstones, but got %d", len(level.rangeTombstones))
+		}
+	}
+	pair, _ := flushed.Get([]byte{0})
+	if pair != nil {
+		t.Errorf("Expected range deleted key to produce nil, but got %q", pair.Value)
+	}
+}
+
+// Checks that keys 1 through 3 were range deleted from keys 0 through 5.
+func compareRangeDeleted(manager SSTManager, t *testing.T) {
+	for _, key := range []byte{0, 1, 2, 3, 4, 5} {
+		pair, _ := manager.Get([]byte{key})
+		if key >= 1 && key <= 3 {
+			if pair == nil || !pair.IsTombstone() {
+				t.Errorf("Expected range deleted key %q to produce a tombstone, but got %v", []byte{key}, pair)
+			}
+		} else if pair == nil || c.Compare(pair.Value, []byte{key}) != c.EQUAL {
+			t.Errorf("Expected key %q to produce %q, but got %v", []byte{key}, []byte{key}, pair)
+		}
+	}
+
+	iter, _ := manager.Iterator(common.IterOptions{})
+	defer iter.Close()
+	for _, key := range []byte{0, 4, 5} {
+		common.CompareNext(iter, true, t)
+		common.CompareGet(iter, []byte{key}, []byte{key}, t)
+	}
+	common.CompareNext(iter, false, t)
+}
+
+func TestFlushDropsSingleDeletesWithTheirPut(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	level := &config.Level{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 4}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: []*config.Level{level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manager, _ := OpenBlockBasedSSTManager(&Manifest{Levels: [][]Entry{}, Version: 0}, options)
+	written := memtable.NewMemtable()
+	written.Write([]byte{0}, []byte{0})
+	written.Write([]byte{1}, []byte{1})
+	flushed, _ := manager.Flush([]memtable.Memtable{written}, 0)
+
+	deleted := memtable.NewMemtable()
+	deleted.SingleDelete([]byte{1})
+	deleted.SingleDelete([]byte{2})
+	flushed, _ = flushed.Flush([]memtable.Memtable{deleted}, 0)
+	defer flushed.Close()
+
+	iter, _ := flushed.(*BlockBasedSSTManager).levelUnboundedIterator(0)
+	defer iter.Close()
+	for next, _ := iter.Next(); next; next, _ = iter.Next() {
+		pair, _ := iter.Get()
+		if c.Compare(pair.Key, []byte{1}) == c.EQUAL {
+			t.Errorf("Expected the single delete and its put to be dropped, but got type %d", pair.Type)
+		}
+	}
+	compareLevelRecord(flushed, 0, []byte{0}, []byte{0}, common.PUT, t)
+	pair, _ := flushed.Get([]byte{1})
+	if pair != nil {
+		t.Errorf("Expected single deleted key to produce nil, but got %q", pair.Value)
+	}
+}
+
+func TestFlushDropsSingleDeletesOverAPutInTheSameMemtable(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	level := &config.Level{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 4}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: []*config.Level{level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manager, _ := OpenBlockBasedSSTManager(&Manifest{Levels: [][]Entry{}, Version: 0}, options)
+	table := memtable.NewMemtable()
+	table.Write([]byte{0}, []byte{0})
+	table.Write([]byte{1}, []byte{1})
+	table.SingleDelete([]byte{1})
+	flushed, _ := manager.Flush([]memtable.Memtable{table}, 0)
+	defer flushed.Close()
+
+	for l := 0; l <= len(options.Levels); l++ {
+		iter, _ := flushed.(*BlockBasedSSTManager).levelUnboundedIterator(l)
+		for next, _ := iter.Next(); next; next, _ = iter.Next() {
+			pair, _ := iter.Get()
+			if c.Compare(pair.Key, []byte{1}) == c.EQUAL {
+				t.Errorf("Expected no record for the single deleted key on disk, but level %d holds type %d", l, pair.Type)
+			}
+		}
+		iter.Close()
+	}
+	compareLevelRecord(flushed, 0, []byte{0}, []byte{0}, common.PUT, t)
+}
+
+func TestFlushKeepsSingleDeletesAboveOlderLevels(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	level := &config.Level{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 1}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: []*config.Level{level, level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manager, _ := OpenBlockBasedSSTManager(&Manifest{Levels: [][]Entry{}, Version: 0}, options)
+	written := memtable.NewMemtable()
+	for i := byte(1); i < 7; i++ {
+		written.Write([]byte{i}, []byte{i})
+	}
+	flushed, _ := manager.Flush([]memtable.Memtable{written}, 0)
+
+	deleted := memtable.NewMemtable()
+	deleted.SingleDelete([]byte{0})
+	flushed, _ = flushed.Flush([]memtable.Memtable{deleted}, 0)
+	defer flushed.Close()
+
+	compareLevelRecord(flushed, 0, []byte{0}, []byte{}, common.SINGLE_DELETE, t)
+}
+
+// A clock which only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func TestFlushDropsExpiredPairs(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	clock := &fakeClock{now: time.Unix(0, 50)}
+	level := &config.Level{BlockSize: 20, SSTSize: 40, BlockCacheSize: 40, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 4}
+	sink := &config.Sink{BlockSize: 20, SSTSize: 40, BlockCacheSize: 40, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: []*config.Level{level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096, Clock: clock}
+	manager, _ := OpenBlockBasedSSTManager(&Manifest{Levels: [][]Entry{}, Version: 0}, options)
+	written := memtable.NewMemtable()
+	written.WriteWithExpiry([]byte{0}, []byte{0}, 100)
+	written.Write([]byte{1}, []byte{1})
+	flushed, _ := manager.Flush([]memtable.Memtable{written}, 0)
+	pair, _ := flushed.Get([]byte{0})
+	if pair == nil || pair.Expiry != 100 || c.Compare(pair.Value, []byte{0}) != c.EQUAL {
+		t.Errorf("Expected a put expiring at 100, but got %v", pair)
+	}
+
+	clock.now = time.Unix(0, 100)
+	overwrite := memtable.NewMemtable()
+	overwrite.Write([]byte{2}, []byte{2})
+	flushed, _ = flushed.Flush([]memtable.Memtable{overwrite}, 0)
+	defer flushed.Close()
+
+	compareLevelRecord(flushed, 0, []byte{0}, []byte{}, common.DELETE, t)
+	compareManagerGet(flushed, []byte{1}, []byte{1}, t)
+	compareManagerGet(flushed, []byte{2}, []byte{2}, t)
+}
+
+// Removes key 1, changes the value of key 2 to 9 and records the context of each call.
+type recordingFilter struct {
+	contexts []config.CompactionContext
+}
+
+func (filter *recordingFilter) Name() string {
+	return "recordingFilter"
+}
+
+func (filter *recordingFilter) Filter(context config.CompactionContext, key, value []byte) (config.CompactionDecision, []byte) {
+	filter.contexts = append(filter.contexts, context)
+	switch key[0] {
+	case 1:
+		return config.Remove, nil
+	case 2:
+		return config.ChangeValue, []byte{9}
+	default:
+		return config.Keep, nil
+	}
+}
+
+func TestFlushAppliesCompactionFilter(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	filter := &recordingFilter{}
+	level := &config.Level{BlockSize: 5, SSTSize: 10, BlockCacheSize: 5, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 4}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 5, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: []*config.Level{level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096, CompactionFilter: filter}
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{0}, []byte{0})
+	mt.Write([]byte{1}, []byte{1})
+	mt.Write([]byte{2}, []byte{2})
+	mt.Delete([]byte{3})
+	manager, _ := FlushFrom(options, mt)
+	defer manager.Close()
+
+	compareLevelRecord(manager, 0, []byte{0}, []byte{0}, common.PUT, t)
+	compareLevelRecord(manager, 0, []byte{1}, []byte{}, common.DELETE, t)
+	compareLevelRecord(manager, 0, []byte{2}, []byte{9}, common.PUT, t)
+	compareLevelRecord(manager, 0, []byte{3}, []byte{}, common.DELETE, t)
+	if len(filter.contexts) != 3 {
+		t.Fatalf("Expected the filter to be invoked for 3 puts, but was invoked %d times", len(filter.contexts))
+	}
+	for _, context := range filter.contexts {
+		if context.Level != 0 || context.IsSink || c.Compare(context.Start, []byte{0}) != c.EQUAL || c.Compare(context.End, []byte{3}) != c.EQUAL {
+			t.Errorf("Expected a context for level 0 from %q to %q, but got %+v", []byte{0}, []byte{3}, context)
+		}
+	}
+}
+
+func TestFlushRemovesFilteredPairsFromSink(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	filter := &recordingFilter{}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 5, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096, CompactionFilter: filter}
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{1}, []byte{1})
+	mt.Write([]byte{2}, []byte{2})
+	manager, _ := FlushFrom(options, mt)
+	defer manager.Close()
+
+	iter, _ := manager.(*BlockBasedSSTManager).levelUnboundedIterator(0)
+	defer iter.Close()
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{9}, t)
+	common.CompareNext(iter, false, t)
+	if len(filter.contexts) != 2 || !filter.contexts[0].IsSink {
+		t.Errorf("Expected the filter to be invoked twice for the sink, but got %+v", filter.contexts)
+	}
+}
+
+func TestFlushRemovesObsoleteSstOnLastRelease(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{0}, []byte{0})
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
 	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
 	manager, _ := FlushFrom(options, mt)
+	obsolete := manager.(*BlockBasedSSTManager).levels[0].ssts[0].file
+
+	iter, _ := manager.Iterator(common.IterOptions{})
+	overwrite := memtable.NewMemtable()
+	overwrite.Write([]byte{0}, []byte{9})
+	newManager, _ := manager.Flush([]memtable.Memtable{overwrite}, 0)
+	defer newManager.Close()
+	manager.Close()
+
+	_, err := os.Stat(obsolete)
+	if err != nil {
+		t.Errorf("Expected obsolete sst to remain while an iterator reads it, but got %v", err)
+	}
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{0}, []byte{0}, t)
+	iter.Close()
+
+	_, err = os.Stat(obsolete)
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected obsolete sst to be removed once released, but got %v", err)
+	}
+}
+
+func TestFlushEvictsObsoleteSstBlocksOnLastRelease(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{0}, []byte{0})
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 1000, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manager, _ := FlushFrom(options, mt)
+	blockBased := manager.(*BlockBasedSSTManager)
+	obsolete := blockBased.levels[0].ssts[0]
+	manager.Get([]byte{0})
+
+	blockKey := cache.Key{FileID: obsolete.id, Offset: obsolete.blocks[0].offset}
+	if _, found := blockBased.blockCache.Lookup(blockKey); !found {
+		t.Fatal("Expected Get to cache the sst's block, but did not")
+	}
+
+	overwrite := memtable.NewMemtable()
+	overwrite.Write([]byte{0}, []byte{9})
+	newManager, _ := manager.Flush([]memtable.Memtable{overwrite}, 0)
+	defer newManager.Close()
+	manager.Close()
+
+	if _, found := blockBased.blockCache.Lookup(blockKey); found {
+		t.Error("Expected the obsolete sst's block to be evicted, but was cached")
+	}
+	if _, found := blockBased.blockCache.Lookup(obsolete.filterKey()); found {
+		t.Error("Expected the obsolete sst's filter block to be evicted, but was cached")
+	}
+}
+
+func TestLevelStatsCountsDataBlocks(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{0}, []byte{0})
+	mt.DeleteRange([]byte{1}, []byte{2})
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manager, _ := FlushFrom(options, mt)
+	defer manager.Close()
+
+	stats := manager.LevelStats()
+	if len(stats) != 1 || stats[0].Files != 1 || stats[0].Bytes != sink.BlockSize {
+		t.Errorf("Expected 1 file holding %d bytes of data blocks, but got %+v", sink.BlockSize, stats)
+	}
+}
+
+func TestSharedBlockCache(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{0}, []byte{0})
+	blockCache := &countingCache{Cache: cache.NewShardedLRUCache(1, 1000)}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BloomFilterSize: 1000}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096, BlockCache: blockCache}
+	manager, _ := FlushFrom(options, mt)
+
+	pair, _ := manager.Get([]byte{0})
+	value := pair.Value
+	if c.Compare([]byte{0}, value) != c.EQUAL {
+		t.Errorf("Expected mananger Get to produce %q, but got %q", []byte{0}, value)
+	}
+	if blockCache.gets != 1 {
+		t.Errorf("Expected Get to use the shared block cache once, but used it %d times", blockCache.gets)
+	}
+}
+
+type countingCache struct {
+	cache.Cache
+	gets int
+}
+
+func (cc *countingCache) Get(key cache.Key, provider func(cache.Key) ([]byte, error)) ([]byte, error) {
+	cc.gets++
+	return cc.Cache.Get(key, provider)
+}
+
+func TestIteratorDontFillCache(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{0}, []byte{0})
+	mt.Write([]byte{1}, []byte{1})
+	blockCache := &countingCache{Cache: cache.NewShardedLRUCache(1, 1000)}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BloomFilterSize: 1000}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096, BlockCache: blockCache}
+	manager, _ := FlushFrom(options, mt)
+
+	iter, _ := manager.Iterator(common.IterOptions{LowerBound: []byte{0}, UpperBound: []byte{1}, DontFillCache: true})
+	defer iter.Close()
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{0}, []byte{0}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{1}, []byte{1}, t)
+	common.CompareNext(iter, false, t)
+
+	if blockCache.gets != 0 {
+		t.Errorf("Expected iterator to not fill the block cache, but filled it %d times", blockCache.gets)
+	}
+	_, found := blockCache.Lookup(cache.Key{FileID: manager.(*BlockBasedSSTManager).levels[0].ssts[0].id, Offset: 0})
+	if found {
+		t.Error("Expected block read by the iterator to not be cached, but was")
+	}
+}
+
+func TestPinL0IndexAndFilterBlocks(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{0}, []byte{0})
+	mt.Write([]byte{1}, []byte{1})
+	blockCache := cache.NewShardedLRUCache(1, 10)
+	level := &config.Level{BlockSize: 5, SSTSize: 5, BloomFilterSize: 1000, MaximumSSTFiles: 1}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BloomFilterSize: 1000}
+	options := &config.Options{Levels: []*config.Level{level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096, BlockCache: blockCache, PinL0IndexAndFilterBlocks: true}
+	manager, _ := FlushFrom(options, mt)
+	l0 := manager.(*BlockBasedSSTManager).levels[0].ssts[0]
+
+	// The filter blocks are larger than the cache, so only pinned entries remain cached
+	for i := 0; i < 10; i++ {
+		manager.Get([]byte{1})
+	}
+	_, found := blockCache.Lookup(l0.filterKey())
+	if !found {
+		t.Error("Expected the level 0 filter block to be pinned, but it was evicted")
+	}
+
+	manager.Close()
+	_, found = blockCache.Lookup(l0.filterKey())
+	if found {
+		t.Error("Expected the level 0 filter block to be unpinned once released, but it was cached")
+	}
+}
+
+// Checks that the pair for key in the given level holds the value and record type.
+func compareLevelRecord(manager SSTManager, level int, key, value []byte, recordType common.RecordType, t *testing.T) {
+	iter, _ := manager.(*BlockBasedSSTManager).levelUnboundedIterator(level)
+	defer iter.Close()
+	for next, _ := iter.Next(); next; next, _ = iter.Next() {
+		pair, _ := iter.Get()
+		if c.Compare(pair.Key, key) != c.EQUAL {
+			continue
+		}
+		if c.Compare(pair.Value, value) != c.EQUAL || pair.Type != recordType {
+			t.Errorf("Expected level %d to hold %q of type %d, but got %q of type %d", level, value, recordType, pair.Value, pair.Type)
+		}
+		return
+	}
+	t.Errorf("Expected level %d to hold key %q, but did not", level, key)
+}
+
+// Checks that the manager produces a put holding the value for key.
+func compareManagerGet(manager SSTManager, key, value []byte, t *testing.T) {
+	pair, err := manager.Get(key)
+	if err != nil || pair == nil || pair.Type != common.PUT || c.Compare(pair.Value, value) != c.EQUAL {
+		t.Errorf("Expected manager Get to produce %q, but got %v and error %v", value, pair, err)
+	}
+}
+
+func TestManagerReadsAndRewritesLegacySsts(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	path := common.TEST_DIR + "legacy"
+	writeLegacySst(path, 8, [][]*common.Pair{
+		{{Key: []byte{0}, Value: []byte{0}}, {Key: []byte{1}, Value: []byte{}}},
+		{{Key: []byte{2}, Value: []byte{2}}},
+	})
+
+	sink := &config.Sink{BlockSize: 8, SSTSize: 16, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manager, err := OpenBlockBasedSSTManager(&Manifest{Levels: [][]Entry{{{Path: path}}}, Version: 1}, options)
+	if err != nil {
+		t.Fatalf("Expected manager to open a legacy sst but got %v", err)
+	}
+
+	pair, _ := manager.Get([]byte{2})
+	if pair == nil || c.Compare(pair.Value, []byte{2}) != c.EQUAL {
+		t.Errorf("Expected manager Get to produce %q, but got %v", []byte{2}, pair)
+	}
+	pair, _ = manager.Get([]byte{1})
+	if pair == nil || pair.Type != common.DELETE {
+		t.Errorf("Expected manager Get to produce a tombstone, but got %v", pair)
+	}
+
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{3}, []byte{3})
+	flushed, err := manager.Flush([]memtable.Memtable{mt}, 0)
+	if err != nil {
+		t.Fatalf("Expected flush over a legacy sst to succeed but got %v", err)
+	}
+	for _, level := range flushed.(*BlockBasedSSTManager).levels {
+		for _, sst := range level.ssts {
+			if sst.version != SST_FORMAT_VERSION {
+				t.Errorf("Expected flushed sst to have version %d, but got %d", SST_FORMAT_VERSION, sst.version)
+			}
+		}
+	}
+
+	iter, _ := flushed.Iterator(common.IterOptions{})
+	defer iter.Close()
+	for _, key := range []byte{0, 2, 3} {
+		common.CompareNext(iter, true, t)
+		common.CompareGet(iter, []byte{key}, []byte{key}, t)
+	}
+	common.CompareNext(iter, false, t)
+}
+
+func TestFlushIntoUpperLevelKeepsLowerLevels(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	sinkOptions := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	mt := memtable.NewMemtable()
+	mt.Write([]byte{1}, []byte{1})
+	mt.Write([]byte{2}, []byte{2})
+	sinkOnly, _ := FlushFrom(sinkOptions, mt)
+	sinkManifest := sinkOnly.(*BlockBasedSSTManager).manifest
+	sinkOnly.Close()
+
+	// Level 0 is empty while the sink holds data, so the flush below only writes level 0
+	level := &config.Level{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 1}
+	options := &config.Options{Levels: []*config.Level{level}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manifest := &Manifest{Levels: [][]Entry{{}, sinkManifest.Levels[0]}, Version: sinkManifest.Version}
+	manager, err := OpenBlockBasedSSTManager(manifest, options)
+	if err != nil {
+		t.Fatalf("Expected manager to open but got %v", err)
+	}
+	mt = memtable.NewMemtable()
+	mt.Write([]byte{0}, []byte{0})
+	flushed, _ := manager.Flush([]memtable.Memtable{mt}, 0)
+	flushed.Close()
+
+	reopenedManifest, _ := MostRecentManifest(common.TEST_DIR)
+	if len(reopenedManifest.Levels) != 2 || len(reopenedManifest.Levels[1]) == 0 {
+		t.Errorf("Expected the manifest to keep the sink's ssts, but got %v", reopenedManifest.Levels)
+	}
+	reopened, _ := OpenBlockBasedSSTManager(reopenedManifest, options)
+	defer reopened.Close()
+	for _, key := range []byte{0, 1, 2} {
+		pair, _ := reopened.Get([]byte{key})
+		if pair == nil || c.Compare(pair.Value, []byte{key}) != c.EQUAL {
+			t.Errorf("Expected manager Get to produce %q, but got %v", []byte{key}, pair)
+		}
+	}
+}
+
+func TestFlushOverflowKeepsLeftoverPairInOrderAcrossLevels(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	level0 := &config.Level{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 1}
+	level1 := &config.Level{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000, MaximumSSTFiles: 1}
+	sink := &config.Sink{BlockSize: 5, SSTSize: 10, BlockCacheSize: 4, BlockCacheShards: 1, BloomFilterSize: 1000}
+	options := &config.Options{Levels: []*config.Level{level0, level1}, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	manager, _ := OpenBlockBasedSSTManager(&Manifest{Levels: [][]Entry{}, Version: 0}, options)
+	var flushed SSTManager = manager
+	// Each flush writes a key larger than those already written, so the pair left over
+	// from an overflowing level is larger than the keys held by the level below it
+	for _, key := range []byte{0, 1, 2, 3, 4, 5, 6, 7} {
+		mt := memtable.NewMemtable()
+		mt.Write([]byte{key}, []byte{key})
+		flushed, _ = flushed.Flush([]memtable.Memtable{mt}, 0)
+	}
 
-	value, _ := manager.Get([]byte{1})
-	if value != nil {
-		t.Errorf("Expected non-existent key to product nil value, but got %q", value)
+	manifest, _ := MostRecentManifest(common.TEST_DIR)
+	reopened, _ := OpenBlockBasedSSTManager(manifest, options)
+	defer reopened.Close()
+	for _, manager := range []SSTManager{flushed, reopened} {
+		iter, _ := manager.Iterator(common.IterOptions{})
+		for _, key := range []byte{0, 1, 2, 3, 4, 5, 6, 7} {
+			common.CompareNext(iter, true, t)
+			common.CompareGet(iter, []byte{key}, []byte{key}, t)
+			pair, _ := manager.Get([]byte{key})
+			if pair == nil || c.Compare(pair.Value, []byte{key}) != c.EQUAL {
+				t.Errorf("Expected manager Get to produce %q, but got %v", []byte{key}, pair)
+			}
+		}
+		common.CompareNext(iter, false, t)
+		iter.Close()
 	}
 }
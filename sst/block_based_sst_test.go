@@ -1,8 +1,12 @@
 package sst
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
+	"unsafe"
 
+	"github.com/patrickgombert/lsmt/cache"
 	"github.com/patrickgombert/lsmt/common"
 	c "github.com/patrickgombert/lsmt/comparator"
 	"github.com/patrickgombert/lsmt/config"
@@ -15,16 +19,110 @@ func TestOpenErrorFileNotFound(t *testing.T) {
 	}
 }
 
+func TestOpenRejectsUnsupportedFormatVersion(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 5, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 10, BloomFilterSize: 1024}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	flush := newFlush(options, sink, NOMAX)
+	flush.accept(&common.Pair{Key: []byte{0}, Value: []byte{0}})
+	ssts, _ := flush.close(nil)
+
+	f, _ := os.OpenFile(ssts[0].file, os.O_WRONLY, 0644)
+	f.WriteAt(int64toBytes(SST_FORMAT_VERSION+1), ssts[0].metaOffset)
+	f.Close()
+
+	_, err := OpenSst(ssts[0].file)
+	if err != common.ERR_SST_FORMAT_UNSUPPORTED {
+		t.Errorf("Expected %v but got %v", common.ERR_SST_FORMAT_UNSUPPORTED, err)
+	}
+}
+
+func TestOpenReadsLegacySst(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	path := common.TEST_DIR + "legacy"
+	writeLegacySst(path, 8, [][]*common.Pair{
+		{{Key: []byte{0}, Value: []byte{0}}, {Key: []byte{1}, Value: []byte{}}},
+		{{Key: []byte{2}, Value: []byte{2}}},
+	})
+
+	sst, err := OpenSst(path)
+	if err != nil {
+		t.Fatalf("Expected legacy sst to open but got %v", err)
+	}
+	if sst.version != LEGACY_SST_FORMAT_VERSION {
+		t.Errorf("Expected legacy sst to have version %d, but got %d", LEGACY_SST_FORMAT_VERSION, sst.version)
+	}
+	if len(sst.blocks) != 2 {
+		t.Fatalf("Expected legacy sst to have 2 blocks, but got %d", len(sst.blocks))
+	}
+	if len(sst.rangeTombstones) != 0 {
+		t.Errorf("Expected legacy sst to have no range tombstones, but got %d", len(sst.rangeTombstones))
+	}
+
+	iter, _ := sst.UnboundedIterator(c.BytewiseComparator{})
+	expected := []*common.Pair{
+		{Key: []byte{0}, Value: []byte{0}, Type: common.PUT},
+		{Key: []byte{1}, Value: []byte{}, Type: common.DELETE},
+		{Key: []byte{2}, Value: []byte{2}, Type: common.PUT},
+	}
+	for _, pair := range expected {
+		common.CompareNext(iter, true, t)
+		actual, _ := iter.Get()
+		if c.Compare(actual.Key, pair.Key) != c.EQUAL || c.Compare(actual.Value, pair.Value) != c.EQUAL || actual.Type != pair.Type {
+			t.Errorf("Expected legacy pair %v but got %v", pair, actual)
+		}
+	}
+	common.CompareNext(iter, false, t)
+	iter.Close()
+}
+
+// Writes an sst in the format used before the format was versioned. Each record is its
+// key followed by its value, blocks are padded to the block size and the meta holds
+// only the index of blocks followed by the offset of the meta.
+func writeLegacySst(path string, blockSize int64, blocks [][]*common.Pair) {
+	data := []byte{}
+	index := []*block{}
+	for _, pairs := range blocks {
+		b := &block{start: pairs[0].Key, end: pairs[len(pairs)-1].Key, offset: int64(len(data))}
+		for _, pair := range pairs {
+			data = append(data, byte(len(pair.Key)))
+			data = append(data, pair.Key...)
+			data = append(data, byte(len(pair.Value)))
+			data = append(data, pair.Value...)
+		}
+		b.usedBytes = int64(len(data)) - b.offset
+		data = append(data, make([]byte, blockSize-b.usedBytes)...)
+		index = append(index, b)
+	}
+
+	metaOffset := int64(len(data))
+	data = append(data, int64toBytes(int64(len(index)))...)
+	for _, b := range index {
+		data = append(data, byte(len(b.start)))
+		data = append(data, b.start...)
+		data = append(data, byte(len(b.end)))
+		data = append(data, b.end...)
+		data = append(data, int64toBytes(b.usedBytes)...)
+		data = append(data, int64toBytes(b.offset)...)
+	}
+	data = append(data, int64toBytes(metaOffset)...)
+	ioutil.WriteFile(path, data, 0644)
+}
+
 func TestFlushAndOpen(t *testing.T) {
 	common.SetUp(t)
 	defer common.TearDown(t)
 
-	sink := &config.Sink{BlockSize: 4, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 8, BloomFilterSize: 1024}
+	sink := &config.Sink{BlockSize: 5, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 10, BloomFilterSize: 1024}
 	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
 	flush := newFlush(options, sink, NOMAX)
 	flush.accept(&common.Pair{Key: []byte{0}, Value: []byte{0}})
 	flush.accept(&common.Pair{Key: []byte{1}, Value: []byte{1}})
-	ssts, _ := flush.close()
+	ssts, _ := flush.close(nil)
 
 	sst, _ := OpenSst(ssts[0].file)
 	if sst.file != ssts[0].file {
@@ -42,8 +140,8 @@ func TestFlushAndOpen(t *testing.T) {
 	if c.Compare([]byte{1}, sst.blocks[1].start) != c.EQUAL {
 		t.Errorf("Expected opened sst block 1 to start at %q, but got %q", []byte{1}, sst.blocks[1].start)
 	}
-	if c.Compare([]byte{1}, sst.blocks[1].end) != c.EQUAL {
-		t.Errorf("Expected opened sst block 1 to end at %q, but got %q", []byte{1}, sst.blocks[1].start)
+	if c.Compare([]byte{2}, sst.blocks[1].end) != c.EQUAL {
+		t.Errorf("Expected opened sst block 1 to end at %q, but got %q", []byte{2}, sst.blocks[1].end)
 	}
 }
 
@@ -51,7 +149,7 @@ func TestFlushAndOpenMultiSSTFlush(t *testing.T) {
 	common.SetUp(t)
 	defer common.TearDown(t)
 
-	sink := &config.Sink{BlockSize: 8, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 16, BloomFilterSize: 1024}
+	sink := &config.Sink{BlockSize: 10, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 20, BloomFilterSize: 1024}
 	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
 	flush := newFlush(options, sink, NOMAX)
 	flush.accept(&common.Pair{Key: []byte{0}, Value: []byte{0}})
@@ -62,7 +160,7 @@ func TestFlushAndOpenMultiSSTFlush(t *testing.T) {
 	flush.accept(&common.Pair{Key: []byte{5}, Value: []byte{5}})
 	flush.accept(&common.Pair{Key: []byte{6}, Value: []byte{6}})
 	flush.accept(&common.Pair{Key: []byte{7}, Value: []byte{7}})
-	ssts, _ := flush.close()
+	ssts, _ := flush.close(nil)
 
 	if len(ssts) != 2 {
 		t.Errorf("Expected to flush %d tables, but flushed %d", 2, len(ssts))
@@ -98,7 +196,241 @@ func TestFlushAndOpenMultiSSTFlush(t *testing.T) {
 	if c.Compare([]byte{6}, sst1.blocks[1].start) != c.EQUAL {
 		t.Errorf("Expected opened sst block 1 to start at %q, but got %q", []byte{6}, sst1.blocks[1].start)
 	}
-	if c.Compare([]byte{7}, sst1.blocks[1].end) != c.EQUAL {
-		t.Errorf("Expected opened sst block 1 to end at %q, but got %q", []byte{7}, sst1.blocks[1].end)
+	if c.Compare([]byte{8}, sst1.blocks[1].end) != c.EQUAL {
+		t.Errorf("Expected opened sst block 1 to end at %q, but got %q", []byte{8}, sst1.blocks[1].end)
+	}
+}
+
+func TestMmapReadBlock(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 5, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 10, BloomFilterSize: 1024}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	flush := newFlush(options, sink, NOMAX)
+	flush.accept(&common.Pair{Key: []byte{0}, Value: []byte{0}})
+	flush.accept(&common.Pair{Key: []byte{1}, Value: []byte{1}})
+	ssts, _ := flush.close(nil)
+
+	sst, _ := OpenSst(ssts[0].file)
+	err := sst.mmap()
+	if err != nil {
+		t.Errorf("Failed to memory map sst with error %v", err)
+	}
+
+	b, _ := sst.ReadBlock(sst.blocks[1], sink)
+	if c.Compare([]byte{1, 1, 0, 1, 1}, b) != c.EQUAL {
+		t.Errorf("Expected mapped block 1 to be %q, but got %q", []byte{1, 1, 0, 1, 1}, b)
+	}
+
+	sst.release()
+	if sst.mapping != nil {
+		t.Error("Expected releasing the last reference to unmap the sst, but did not")
+	}
+}
+
+func TestMmapIteratorReadsPairsFromTheMapping(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 5, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 10, BloomFilterSize: 1024}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	flush := newFlush(options, sink, NOMAX)
+	flush.accept(&common.Pair{Key: []byte{0}, Value: []byte{0}})
+	flush.accept(&common.Pair{Key: []byte{1}, Value: []byte{1}})
+	ssts, _ := flush.close(nil)
+
+	sst, _ := OpenSst(ssts[0].file)
+	sst.mmap()
+	defer sst.release()
+	iter, _ := sst.UnboundedIterator(c.BytewiseComparator{})
+	defer iter.Close()
+
+	start := uintptr(unsafe.Pointer(&sst.mapping[0]))
+	end := start + uintptr(len(sst.mapping))
+	for next, _ := iter.Next(); next; next, _ = iter.Next() {
+		pair, _ := iter.Get()
+		for _, b := range [][]byte{pair.Key, pair.Value} {
+			address := uintptr(unsafe.Pointer(&b[0]))
+			if address < start || address >= end {
+				t.Errorf("Expected %q to be read from the mapping without a copy, but was not", b)
+			}
+		}
+	}
+}
+
+func TestMmapUnmapsOnLastRelease(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 5, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 10, BloomFilterSize: 1024}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	flush := newFlush(options, sink, NOMAX)
+	flush.accept(&common.Pair{Key: []byte{0}, Value: []byte{0}})
+	ssts, _ := flush.close(nil)
+
+	sst, _ := OpenSst(ssts[0].file)
+	sst.mmap()
+	sst.acquire()
+
+	sst.release()
+	if sst.mapping == nil {
+		t.Error("Expected sst to remain mapped while a reference is held, but was unmapped")
+	}
+	sst.release()
+	if sst.mapping != nil {
+		t.Error("Expected releasing the last reference to unmap the sst, but did not")
+	}
+	if sst.acquire() {
+		t.Error("Expected acquiring a released sst to fail, but succeeded")
+	}
+}
+
+func TestCachedBlocksSurviveReopen(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 5, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 10, BloomFilterSize: 1024}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	flush := newFlush(options, sink, NOMAX)
+	flush.accept(&common.Pair{Key: []byte{0}, Value: []byte{0}})
+	ssts, _ := flush.close(nil)
+
+	blockCache := cache.NewShardedLRUCache(4, 8192)
+	first, _ := OpenSst(ssts[0].file)
+	first.readCachedBlock(blockCache, first.blocks[0], sink, true)
+
+	second, _ := OpenSst(ssts[0].file)
+	key := cache.Key{FileID: second.id, Offset: second.blocks[0].offset}
+	b, _ := blockCache.Get(key, func(cache.Key) ([]byte, error) {
+		t.Error("Expected block to be cached for a re-opened sst, but was not")
+		return nil, nil
+	})
+	if c.Compare([]byte{1, 0, 0, 1, 0}, b) != c.EQUAL {
+		t.Errorf("Expected cached block to be %q, but got %q", []byte{1, 0, 0, 1, 0}, b)
+	}
+}
+
+func TestOpenSstReadsFilterBlock(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 5, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 10, BloomFilterSize: 1024}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	flush := newFlush(options, sink, NOMAX)
+	flush.accept(&common.Pair{Key: []byte{0}, Value: []byte{0}})
+	flush.accept(&common.Pair{Key: []byte{1}, Value: []byte{1}})
+	ssts, _ := flush.close(nil)
+
+	sst, _ := OpenSst(ssts[0].file)
+	if sst.filterOffset != 10 || sst.filterLength != 129 {
+		t.Errorf("Expected filter block at offset 10 with length 129, but got offset %d and length %d", sst.filterOffset, sst.filterLength)
+	}
+	filter, err := sst.readFilter(cache.NewShardedLRUCache(1, 1000))
+	if err != nil {
+		t.Errorf("Expected to read the filter block, but got %v", err)
+	}
+	if !filter.Test([]byte{0}) || !filter.Test([]byte{1}) {
+		t.Error("Expected the filter block to contain the flushed keys, but did not")
+	}
+}
+
+func TestDecodeBlockKeepsRecordTypes(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 4096, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 4096, BloomFilterSize: 1024}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	flush := newFlush(options, sink, NOMAX)
+	flush.accept(&common.Pair{Key: []byte{0}, Value: []byte{}, Type: common.PUT})
+	flush.accept(&common.Pair{Key: []byte{1}, Value: []byte{}, Type: common.DELETE})
+	ssts, _ := flush.close(nil)
+
+	sst, _ := OpenSst(ssts[0].file)
+	b, _ := sst.ReadBlock(sst.blocks[0], sink)
+	pairs, err := decodeBlock(SST_FORMAT_VERSION, b)
+	if err != nil || len(pairs) != 2 {
+		t.Fatalf("Expected to decode 2 pairs, but got %d and error %v", len(pairs), err)
+	}
+	if pairs[0].Type != common.PUT || pairs[1].Type != common.DELETE {
+		t.Errorf("Expected a put and a delete, but got types %d and %d", pairs[0].Type, pairs[1].Type)
+	}
+
+	_, err = decodeBlock(SST_FORMAT_VERSION, []byte{1, 0, byte(common.RANGE_DELETE), 0})
+	if err != common.ERR_UNKNOWN_RECORD_TYPE {
+		t.Errorf("Expected %v but got %v", common.ERR_UNKNOWN_RECORD_TYPE, err)
+	}
+}
+
+func TestDecodeBlockKeepsExpiry(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 4096, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 4096, BloomFilterSize: 1024}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	flush := newFlush(options, sink, NOMAX)
+	flush.accept(&common.Pair{Key: []byte{0}, Value: []byte{0}, Type: common.PUT, Expiry: 42})
+	flush.accept(&common.Pair{Key: []byte{1}, Value: []byte{1}, Type: common.PUT})
+	ssts, _ := flush.close(nil)
+
+	sst, _ := OpenSst(ssts[0].file)
+	b, _ := sst.ReadBlock(sst.blocks[0], sink)
+	pairs, err := decodeBlock(SST_FORMAT_VERSION, b)
+	if err != nil || len(pairs) != 2 {
+		t.Fatalf("Expected to decode 2 pairs, but got %d and error %v", len(pairs), err)
+	}
+	if pairs[0].Type != common.PUT || pairs[0].Expiry != 42 || c.Compare(pairs[0].Value, []byte{0}) != c.EQUAL {
+		t.Errorf("Expected a put expiring at 42, but got type %d expiring at %d", pairs[0].Type, pairs[0].Expiry)
+	}
+	if pairs[1].Expiry != 0 || c.Compare(pairs[1].Value, []byte{1}) != c.EQUAL {
+		t.Errorf("Expected a put which does not expire, but got one expiring at %d", pairs[1].Expiry)
+	}
+
+	pair, _ := getFromBlock(c.BytewiseComparator{}, sst, sst.blocks[0], []byte{1}, cache.NewShardedLRUCache(1, 8192), sink)
+	if pair == nil || pair.Expiry != 0 || c.Compare(pair.Value, []byte{1}) != c.EQUAL {
+		t.Errorf("Expected Get to skip over the expiry of the preceding record, but got %v", pair)
+	}
+	pair, _ = getFromBlock(c.BytewiseComparator{}, sst, sst.blocks[0], []byte{0}, cache.NewShardedLRUCache(1, 8192), sink)
+	if pair == nil || pair.Expiry != 42 {
+		t.Errorf("Expected Get to produce a pair expiring at 42, but got %v", pair)
+	}
+}
+
+func TestNewFileContinuesTheDirectorysFileNumbers(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	dir, _ := ioutil.TempDir(common.TEST_DIR, "numbered")
+	dir += "/"
+	ioutil.WriteFile(dir+"000041.sst", []byte{}, 0644)
+	ioutil.WriteFile(dir+"0c5a2f1e-3b4d-9e8f-7a6b-5c4d3e2f1a0b.sst", []byte{}, 0644)
+
+	first, _ := newFile(dir)
+	first.Close()
+	second, _ := newFile(dir)
+	second.Close()
+	if first.Name() != dir+"000042.sst" {
+		t.Errorf("Expected new file to be %s, but got %s", dir+"000042.sst", first.Name())
+	}
+	if second.Name() != dir+"000043.sst" {
+		t.Errorf("Expected new file to be %s, but got %s", dir+"000043.sst", second.Name())
+	}
+}
+
+func TestFileIDIsTheFileNumber(t *testing.T) {
+	if fileID("/tmp/lsmt/000042.sst") != 42 {
+		t.Errorf("Expected file id to be %d, but got %d", 42, fileID("/tmp/lsmt/000042.sst"))
+	}
+
+	legacy := "/tmp/lsmt/0c5a2f1e-3b4d-9e8f-7a6b-5c4d3e2f1a0b.sst"
+	other := "/tmp/lsmt/1d6b3e2f-4c5e-0f9a-8b7c-6d5e4f3a2b1c.sst"
+	if fileID(legacy) != fileID(legacy) {
+		t.Error("Expected an unnumbered sst to keep its file id, but it changed")
+	}
+	if fileID(legacy) == fileID(other) {
+		t.Error("Expected unnumbered ssts to have different file ids, but they were equal")
+	}
+	if fileID(legacy)&unnumberedID == 0 {
+		t.Errorf("Expected an unnumbered sst's file id to have the high bit set, but got %d", fileID(legacy))
 	}
 }
@@ -1,98 +1,193 @@
 package sst
 
 import (
-	"bytes"
 	"io"
 	"os"
+	"sort"
 
 	"github.com/patrickgombert/lsmt/common"
+	c "github.com/patrickgombert/lsmt/comparator"
 )
 
-// An unbounded Iterator which will traverse an entire SST file
+// An unbounded Iterator which will traverse an entire SST file in either direction
 type unboundedSstIterator struct {
-	sst         *sst
-	f           *os.File
-	blockBuffer *bytes.Reader
-	blockIndex  int
-	closed      bool
-	nextPair    *common.Pair
+	sst        *sst
+	f          *os.File
+	blockIndex int
+	pairs      []*common.Pair
+	pairIndex  int
+	position   common.Position
+	closed     bool
+	comparator c.Comparator
 }
 
-// Create a new unbounded iterator for the sst
-func (sst *sst) UnboundedIterator() (*unboundedSstIterator, error) {
-	f, err := os.Open(sst.file)
-	if err != nil {
-		return nil, err
+// Create a new unbounded iterator for the sst. If the sst is memory mapped then blocks
+// are read from the mapping, otherwise the sst's file is opened for the lifetime of
+// the iterator. Keys are ordered by the comparator the sst was written with.
+func (sst *sst) UnboundedIterator(comparator c.Comparator) (*unboundedSstIterator, error) {
+	if !sst.acquire() {
+		return nil, common.ERR_SST_RELEASED
 	}
 
-	f.Seek(sst.blocks[0].offset, io.SeekStart)
-	blockBytes := make([]byte, sst.blocks[0].usedBytes)
-	bytesRead, err := f.Read(blockBytes)
-	if err == nil && int64(bytesRead) != sst.blocks[0].usedBytes {
-		err = common.ERR_BLOCK_UNDERFLOW
+	iter := &unboundedSstIterator{
+		sst:        sst,
+		blockIndex: -1,
+		closed:     false,
+		comparator: comparator,
 	}
-	if err != nil {
-		return nil, err
+	if sst.mapping == nil {
+		f, err := os.Open(sst.file)
+		if err != nil {
+			sst.release()
+			return nil, err
+		}
+		iter.f = f
 	}
-	blockBuffer := bytes.NewReader(blockBytes)
 
-	return &unboundedSstIterator{
-		sst:         sst,
-		f:           f,
-		blockBuffer: blockBuffer,
-		blockIndex:  0,
-		closed:      false,
-		nextPair:    nil,
-	}, nil
+	return iter, nil
 }
 
-// Determines whether a next value exists in the iterator.
-// If necessary it will read the next block into an in memory buffer.
+// Moves to the next pair. If necessary it will read the next block into memory.
 func (iter *unboundedSstIterator) Next() (bool, error) {
 	if iter.closed {
 		return false, common.ERR_ITER_CLOSED
 	}
 
-	if iter.blockBuffer.Len() == 0 {
-		if iter.blockIndex+1 == len(iter.sst.blocks) {
-			return false, nil
-		}
+	switch iter.position {
+	case common.UNPOSITIONED, common.BEFORE_FIRST:
+		return iter.SeekToFirst()
+	case common.AT_PAIR:
+		iter.pairIndex++
+	case common.AFTER_LAST:
+		return false, nil
+	}
+	return iter.settleForward()
+}
 
-		iter.blockIndex++
-		iter.f.Seek(iter.sst.blocks[iter.blockIndex].offset, io.SeekStart)
-		blockBytes := make([]byte, iter.sst.blocks[iter.blockIndex].usedBytes)
-		bytesRead, err := iter.f.Read(blockBytes)
-		if err == nil && int64(bytesRead) != iter.sst.blocks[iter.blockIndex].usedBytes {
-			err = common.ERR_BLOCK_UNDERFLOW
-		}
-		if err != nil {
-			return false, err
-		}
-		iter.blockBuffer = bytes.NewReader(blockBytes)
+// Positions the iterator at the first pair in the sst.
+func (iter *unboundedSstIterator) SeekToFirst() (bool, error) {
+	if iter.closed {
+		return false, common.ERR_ITER_CLOSED
+	}
+	if len(iter.sst.blocks) == 0 {
+		iter.position = common.AFTER_LAST
+		return false, nil
 	}
 
-	length := make([]byte, 1)
-	_, err := iter.blockBuffer.Read(length)
+	err := iter.loadBlock(0)
 	if err != nil {
 		return false, err
 	}
-	key := make([]byte, length[0])
-	_, err = iter.blockBuffer.Read(key)
+	iter.pairIndex = 0
+	return iter.settleForward()
+}
+
+// Positions the iterator at the first pair whose key is greater than or equal to key.
+func (iter *unboundedSstIterator) Seek(key []byte) (bool, error) {
+	if iter.closed {
+		return false, common.ERR_ITER_CLOSED
+	}
+
+	blocks := iter.sst.blocks
+	blockIndex := sort.Search(len(blocks), func(i int) bool {
+		return iter.comparator.Compare(blocks[i].end, key) != c.LESS_THAN
+	})
+	if blockIndex == len(blocks) {
+		iter.position = common.AFTER_LAST
+		return false, nil
+	}
+
+	err := iter.loadBlock(blockIndex)
 	if err != nil {
 		return false, err
 	}
-	_, err = iter.blockBuffer.Read(length)
+	iter.pairIndex = sort.Search(len(iter.pairs), func(i int) bool {
+		return iter.comparator.Compare(iter.pairs[i].Key, key) != c.LESS_THAN
+	})
+	return iter.settleForward()
+}
+
+// Moves on through later blocks while the current pair index is past the end of the
+// current block, then records the iterator's position.
+func (iter *unboundedSstIterator) settleForward() (bool, error) {
+	for iter.pairIndex >= len(iter.pairs) {
+		if iter.blockIndex+1 >= len(iter.sst.blocks) {
+			iter.position = common.AFTER_LAST
+			return false, nil
+		}
+		err := iter.loadBlock(iter.blockIndex + 1)
+		if err != nil {
+			return false, err
+		}
+		iter.pairIndex = 0
+	}
+	iter.position = common.AT_PAIR
+	return true, nil
+}
+
+// Moves to the previous pair. If necessary it will read the previous block into memory.
+func (iter *unboundedSstIterator) Prev() (bool, error) {
+	if iter.closed {
+		return false, common.ERR_ITER_CLOSED
+	}
+
+	switch iter.position {
+	case common.UNPOSITIONED, common.AFTER_LAST:
+		return iter.SeekToLast()
+	case common.AT_PAIR:
+		iter.pairIndex--
+	case common.BEFORE_FIRST:
+		return false, nil
+	}
+	return iter.settleBackward()
+}
+
+// Positions the iterator at the last pair in the sst.
+func (iter *unboundedSstIterator) SeekToLast() (bool, error) {
+	if iter.closed {
+		return false, common.ERR_ITER_CLOSED
+	}
+	if len(iter.sst.blocks) == 0 {
+		iter.position = common.BEFORE_FIRST
+		return false, nil
+	}
+
+	err := iter.loadBlock(len(iter.sst.blocks) - 1)
 	if err != nil {
 		return false, err
 	}
-	value := make([]byte, length[0])
-	_, err = iter.blockBuffer.Read(value)
+	iter.pairIndex = len(iter.pairs) - 1
+	return iter.settleBackward()
+}
+
+// Positions the iterator at the last pair whose key is less than or equal to key.
+func (iter *unboundedSstIterator) SeekForPrev(key []byte) (bool, error) {
+	if iter.closed {
+		return false, common.ERR_ITER_CLOSED
+	}
+
+	blocks := iter.sst.blocks
+	blockIndex := sort.Search(len(blocks), func(i int) bool {
+		return iter.comparator.Compare(blocks[i].start, key) == c.GREATER_THAN
+	}) - 1
+	if blockIndex < 0 {
+		iter.position = common.BEFORE_FIRST
+		return false, nil
+	}
+
+	err := iter.loadBlock(blockIndex)
 	if err != nil {
 		return false, err
 	}
-	iter.nextPair = &common.Pair{Key: key, Value: value}
+	iter.pairIndex = sort.Search(len(iter.pairs), func(i int) bool {
+		return iter.comparator.Compare(iter.pairs[i].Key, key) == c.GREATER_THAN
+	}) - 1
+	return iter.settleBackward()
+}
 
-	return true, nil
+// Returns whether the iterator is positioned at a pair.
+func (iter *unboundedSstIterator) Valid() bool {
+	return !iter.closed && iter.position == common.AT_PAIR
 }
 
 // Get the current pair in the iterator
@@ -100,14 +195,86 @@ func (iter *unboundedSstIterator) Get() (*common.Pair, error) {
 	if iter.closed {
 		return nil, common.ERR_ITER_CLOSED
 	}
+	if iter.position != common.AT_PAIR {
+		return nil, nil
+	}
 
-	return iter.nextPair, nil
+	return iter.pairs[iter.pairIndex], nil
 }
 
 // Close the iterator.
 // Close is terminal and will cause Next and Get to return errors.
 func (iter *unboundedSstIterator) Close() error {
-	err := iter.f.Close()
+	if iter.closed {
+		return nil
+	}
 	iter.closed = true
+	iter.pairs = nil
+
+	var err error
+	if iter.f != nil {
+		err = iter.f.Close()
+	}
+	releaseErr := iter.sst.release()
+	if err == nil {
+		err = releaseErr
+	}
 	return err
 }
+
+// Moves back through earlier blocks while the current pair index precedes the current
+// block, then records the iterator's position.
+func (iter *unboundedSstIterator) settleBackward() (bool, error) {
+	for iter.pairIndex < 0 {
+		if iter.blockIndex <= 0 {
+			iter.position = common.BEFORE_FIRST
+			return false, nil
+		}
+		err := iter.loadBlock(iter.blockIndex - 1)
+		if err != nil {
+			return false, err
+		}
+		iter.pairIndex = len(iter.pairs) - 1
+	}
+	iter.position = common.AT_PAIR
+	return true, nil
+}
+
+// Reads and decodes the block at the given index, either from the memory mapping or
+// from the file.
+func (iter *unboundedSstIterator) loadBlock(index int) error {
+	if index == iter.blockIndex && iter.pairs != nil {
+		return nil
+	}
+
+	blockBytes, err := iter.readBlock(index)
+	if err != nil {
+		return err
+	}
+	pairs, err := decodeBlock(iter.sst.version, blockBytes)
+	if err != nil {
+		return err
+	}
+	iter.blockIndex = index
+	iter.pairs = pairs
+	return nil
+}
+
+// Reads the block at the given index, either from the memory mapping or from the file.
+func (iter *unboundedSstIterator) readBlock(index int) ([]byte, error) {
+	b := iter.sst.blocks[index]
+	if iter.f == nil {
+		return iter.sst.ReadBlock(b, nil)
+	}
+
+	iter.f.Seek(b.offset, io.SeekStart)
+	blockBytes := make([]byte, b.usedBytes)
+	bytesRead, err := iter.f.Read(blockBytes)
+	if err == nil && int64(bytesRead) != b.usedBytes {
+		err = common.ERR_BLOCK_UNDERFLOW
+	}
+	if err != nil {
+		return nil, err
+	}
+	return blockBytes, nil
+}
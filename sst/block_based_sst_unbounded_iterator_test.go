@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/patrickgombert/lsmt/common"
+	c "github.com/patrickgombert/lsmt/comparator"
 	"github.com/patrickgombert/lsmt/config"
 )
 
@@ -16,10 +17,10 @@ func TestUnboundedIterator(t *testing.T) {
 	flush := newFlush(options, sink, NOMAX)
 	flush.accept(&common.Pair{Key: []byte{1}, Value: []byte{1, 1}})
 	flush.accept(&common.Pair{Key: []byte{2}, Value: []byte{2, 2}})
-	ssts, _ := flush.close()
+	ssts, _ := flush.close(nil)
 
 	sst, _ := OpenSst(ssts[0].file)
-	iter, _ := sst.UnboundedIterator()
+	iter, _ := sst.UnboundedIterator(c.BytewiseComparator{})
 	defer iter.Close()
 
 	common.CompareNext(iter, true, t)
@@ -28,3 +29,62 @@ func TestUnboundedIterator(t *testing.T) {
 	common.CompareGet(iter, []byte{2}, []byte{2, 2}, t)
 	common.CompareNext(iter, false, t)
 }
+
+func TestUnboundedIteratorPrev(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 5, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 20, BloomFilterSize: 1024}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	flush := newFlush(options, sink, NOMAX)
+	flush.accept(&common.Pair{Key: []byte{1}, Value: []byte{1}})
+	flush.accept(&common.Pair{Key: []byte{2}, Value: []byte{2}})
+	flush.accept(&common.Pair{Key: []byte{3}, Value: []byte{3}})
+	ssts, _ := flush.close(nil)
+
+	sst, _ := OpenSst(ssts[0].file)
+	iter, _ := sst.UnboundedIterator(c.BytewiseComparator{})
+	defer iter.Close()
+
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.ComparePrev(iter, true, t)
+	common.CompareGet(iter, []byte{1}, []byte{1}, t)
+	common.ComparePrev(iter, false, t)
+
+	found, _ := iter.SeekForPrev([]byte{2, 0})
+	if !found {
+		t.Error("Expected SeekForPrev() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{2}, []byte{2}, t)
+	common.CompareNext(iter, true, t)
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+}
+
+func TestUnboundedIteratorSeek(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	sink := &config.Sink{BlockSize: 5, BlockCacheSize: 8192, BlockCacheShards: 1, SSTSize: 20, BloomFilterSize: 1024}
+	options := &config.Options{Levels: common.EMPTY_LEVELS, Sink: sink, Path: common.TEST_DIR, MemtableMaximumSize: 1048576, KeyMaximumSize: 1024, ValueMaximumSize: 4096}
+	flush := newFlush(options, sink, NOMAX)
+	flush.accept(&common.Pair{Key: []byte{1}, Value: []byte{1}})
+	flush.accept(&common.Pair{Key: []byte{3}, Value: []byte{3}})
+	ssts, _ := flush.close(nil)
+
+	sst, _ := OpenSst(ssts[0].file)
+	iter, _ := sst.UnboundedIterator(c.BytewiseComparator{})
+	defer iter.Close()
+
+	found, _ := iter.Seek([]byte{2})
+	if !found || !iter.Valid() {
+		t.Error("Expected Seek() to find a pair, but did not")
+	}
+	common.CompareGet(iter, []byte{3}, []byte{3}, t)
+	common.CompareNext(iter, false, t)
+	if iter.Valid() {
+		t.Error("Expected iterator past the last pair to not be valid, but was")
+	}
+}
@@ -2,9 +2,13 @@ package sst
 
 import (
 	"encoding/binary"
+	"io"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
+
+	c "github.com/patrickgombert/lsmt/comparator"
 )
 
 const manifestPrefix string = "manifest"
@@ -13,9 +17,17 @@ type Entry struct {
 	Path string
 }
 
+// The ssts of each level along with the name of the comparator which ordered their
+// keys. A manifest written before the comparator was recorded is read as ordered by the
+// bytewise comparator. Only a manifest built in memory, such as the empty manifest of a
+// new lsmt, has an empty comparator name, which is not checked against the options.
+// LogNumber is the number of the oldest write-ahead log whose writes are not held by the
+// manifest's ssts, so every log numbered below it has been flushed.
 type Manifest struct {
-	Levels  [][]Entry
-	Version int
+	Levels     [][]Entry
+	Version    int
+	Comparator string
+	LogNumber  int
 }
 
 func MostRecentManifest(dir string) (*Manifest, error) {
@@ -27,7 +39,7 @@ func MostRecentManifest(dir string) (*Manifest, error) {
 	mostRecent := -1
 	manifestFile := ""
 	for _, file := range files {
-		if file.Name()[:len(manifestPrefix)] == manifestPrefix {
+		if strings.HasPrefix(file.Name(), manifestPrefix) {
 			manifestNumber, err := strconv.Atoi(file.Name()[len(manifestPrefix):])
 			if err != nil {
 				return nil, err
@@ -98,10 +110,34 @@ func OpenManifest(dir, path string) (*Manifest, error) {
 		}
 	}
 
-	return &Manifest{Levels: entries, Version: version}, nil
+	// Manifests written before the comparator was recorded were ordered bytewise
+	comparator := c.BytewiseComparator{}.Name()
+	_, err = f.Read(byteHolder)
+	if err == nil {
+		name := make([]byte, int(byteHolder[0]))
+		_, err = io.ReadFull(f, name)
+		if err != nil {
+			return nil, err
+		}
+		comparator = string(name)
+	} else if err != io.EOF {
+		return nil, err
+	}
+
+	// Manifests written before the log number was recorded leave every log to be replayed
+	logNumber := 0
+	int64Holder := make([]byte, 8)
+	_, err = io.ReadFull(f, int64Holder)
+	if err == nil {
+		logNumber = int(binary.BigEndian.Uint64(int64Holder))
+	} else if err != io.EOF {
+		return nil, err
+	}
+
+	return &Manifest{Levels: entries, Version: version, Comparator: comparator, LogNumber: logNumber}, nil
 }
 
-func WriteManifest(path string, levels [][]SST) error {
+func WriteManifest(path string, levels [][]SST, comparator string, logNumber int) error {
 	f, err := os.Create(path)
 	if err != nil {
 		return err
@@ -119,6 +155,9 @@ func WriteManifest(path string, levels [][]SST) error {
 			f.Write([]byte(sst.Path()))
 		}
 	}
+	f.Write([]byte{byte(len(comparator))})
+	f.Write([]byte(comparator))
+	f.Write(int64toBytes(int64(logNumber)))
 
 	return nil
 }
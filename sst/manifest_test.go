@@ -1,9 +1,11 @@
 package sst
 
 import (
+	"io/ioutil"
 	"testing"
 
 	"github.com/patrickgombert/lsmt/common"
+	c "github.com/patrickgombert/lsmt/comparator"
 )
 
 type testSst struct {
@@ -22,7 +24,7 @@ func TestWriteAndReadManifest(t *testing.T) {
 	levels[0] = []SST{&testSst{path: "./file0.sst"}}
 	levels[1] = []SST{&testSst{path: "./file1.sst"}}
 
-	WriteManifest(common.TEST_DIR+"manifest1", levels)
+	WriteManifest(common.TEST_DIR+"manifest1", levels, "ReverseBytewiseComparator", 7)
 	manifest, _ := OpenManifest(common.TEST_DIR, "manifest1")
 
 	if manifest.Version != 1 {
@@ -45,4 +47,29 @@ func TestWriteAndReadManifest(t *testing.T) {
 	if level1[0].Path != "./file1.sst" {
 		t.Errorf("Expected level 1 / entry 1 to have file path %q, but got %q", "./file1.sst", level1[0].Path)
 	}
+	if manifest.Comparator != "ReverseBytewiseComparator" {
+		t.Errorf("Expected manifest to have comparator %q, but got %q", "ReverseBytewiseComparator", manifest.Comparator)
+	}
+	if manifest.LogNumber != 7 {
+		t.Errorf("Expected manifest to have log number %d, but got %d", 7, manifest.LogNumber)
+	}
+}
+
+func TestReadManifestWithoutComparatorIsBytewise(t *testing.T) {
+	common.SetUp(t)
+	defer common.TearDown(t)
+
+	// A manifest written before comparators were recorded holds only its levels
+	ioutil.WriteFile(common.TEST_DIR+"manifest1", []byte{0, 0, 0, 0}, 0644)
+	manifest, err := OpenManifest(common.TEST_DIR, "manifest1")
+
+	if err != nil {
+		t.Fatalf("Expected no error, but got %s", err)
+	}
+	if manifest.Comparator != (c.BytewiseComparator{}).Name() {
+		t.Errorf("Expected manifest to have comparator %q, but got %q", c.BytewiseComparator{}.Name(), manifest.Comparator)
+	}
+	if manifest.LogNumber != 0 {
+		t.Errorf("Expected manifest to have log number %d, but got %d", 0, manifest.LogNumber)
+	}
 }
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package sst
+
+import (
+	"os"
+	"syscall"
+)
+
+// Maps the entire file at path into memory as read only.
+func mmap(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return []byte{}, nil
+	}
+
+	return syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// Unmaps a mapping previously created by mmap.
+func munmap(mapping []byte) error {
+	if len(mapping) == 0 {
+		return nil
+	}
+	return syscall.Munmap(mapping)
+}
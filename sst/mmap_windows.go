@@ -0,0 +1,13 @@
+//go:build windows
+
+package sst
+
+import "github.com/patrickgombert/lsmt/common"
+
+func mmap(path string) ([]byte, error) {
+	return nil, common.ERR_MMAP_UNSUPPORTED
+}
+
+func munmap(mapping []byte) error {
+	return common.ERR_MMAP_UNSUPPORTED
+}
@@ -1,6 +1,7 @@
 package sst
 
 import (
+	"github.com/patrickgombert/lsmt/cache"
 	"github.com/patrickgombert/lsmt/common"
 	"github.com/patrickgombert/lsmt/memtable"
 )
@@ -9,8 +10,24 @@ type SST interface {
 	Path() string
 }
 
+// Manages the ssts described by a manifest. A manager holds a reference to each of its
+// ssts until it is closed, and Acquire creates another manager holding its own
+// references to the same ssts. Flush records logNumber, the number of the oldest
+// write-ahead log whose writes are not among the flushed memtables, in the new
+// manifest.
 type SSTManager interface {
-	Get(key []byte) ([]byte, error)
-	Iterator(start, end []byte) (common.Iterator, error)
-	Flush(tables []*memtable.Memtable) (SSTManager, error)
+	Get(key []byte) (*common.Pair, error)
+	Acquire() (SSTManager, error)
+	Iterator(opts common.IterOptions) (common.Iterator, error)
+	Flush(tables []memtable.Memtable, logNumber int) (SSTManager, error)
+	BlockCacheStats() cache.Stats
+	LevelStats() []LevelStats
+	Close() error
+}
+
+// Statistics for a single level of ssts. Bytes counts the data blocks of the level's
+// ssts, leaving out their filter and range deletion blocks.
+type LevelStats struct {
+	Files int
+	Bytes int64
 }
@@ -0,0 +1,138 @@
+package lsmt
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/patrickgombert/lsmt/config"
+)
+
+// How severely writes are stalled.
+type stall int8
+
+const (
+	NO_STALL stall = 0
+	DELAY    stall = 1
+	STOP     stall = 2
+)
+
+// Counts of the write stalls since the lsmt was opened. Delays counts groups of writes
+// which were delayed by a soft limit, Stops counts groups of writes which were blocked
+// by a hard limit and StallTime is the total time writes spent stalled.
+type WriteStallStats struct {
+	Delays    uint64
+	Stops     uint64
+	StallTime time.Duration
+}
+
+// Write stall counters which are updated atomically so that they can be read without
+// holding the write lock.
+type stallCounters struct {
+	delays    uint64
+	stops     uint64
+	stallTime int64
+}
+
+func (counters *stallCounters) stats() WriteStallStats {
+	return WriteStallStats{
+		Delays:    atomic.LoadUint64(&counters.delays),
+		Stops:     atomic.LoadUint64(&counters.stops),
+		StallTime: time.Duration(atomic.LoadInt64(&counters.stallTime)),
+	}
+}
+
+// Stalls the leader of a group of writes while the lsmt is over one of its write stall
+// limits. A soft limit delays the leader once. A hard limit blocks the leader until
+// flushes bring the lsmt back under the limit, starting a flush of the immutable
+// memtables if none is running. A hard limit which no flush can help with, as there is
+// neither a running flush nor an immutable memtable to flush, delays the leader like a
+// soft limit. Must be invoked while holding the write lock.
+func (db *lsmt) stall() {
+	limits := db.options.WriteStall
+	if limits == nil {
+		return
+	}
+
+	start := time.Now()
+	stalled, stopped := false, false
+	for {
+		current := (*version)(atomic.LoadPointer(&db.version))
+		severity, reason := stallFor(current, limits)
+		if severity == NO_STALL {
+			break
+		}
+		stalled = true
+		if severity == STOP && !db.flushLock.IsLocked() {
+			if len(current.inactiveMemtables) == 0 {
+				severity = DELAY
+			} else if db.flushLock.TryLock() {
+				go db.flushInactive()
+			}
+		}
+
+		if severity == STOP {
+			if !stopped {
+				stopped = true
+				atomic.AddUint64(&db.stalls.stops, 1)
+				log.Warn().
+					Str(Action, "stall").
+					Str("reason", reason).
+					Msg("stopping writes until a flush completes")
+			}
+			db.flushed.Wait()
+			continue
+		}
+
+		atomic.AddUint64(&db.stalls.delays, 1)
+		log.Warn().
+			Str(Action, "stall").
+			Str("reason", reason).
+			Dur("delay", limits.Delay).
+			Msg("delaying writes")
+		db.writeLock.Unlock()
+		time.Sleep(limits.Delay)
+		db.writeLock.Lock()
+		break
+	}
+
+	if stalled {
+		atomic.AddInt64(&db.stalls.stallTime, int64(time.Since(start)))
+	}
+}
+
+// Returns the most severe stall the version is due, along with the limit responsible.
+func stallFor(current *version, limits *config.WriteStall) (stall, string) {
+	var l0Files int
+	var pendingBytes int64
+	levels := current.sstManager.LevelStats()
+	if len(levels) > 0 {
+		l0Files = levels[0].Files
+		pendingBytes = levels[0].Bytes
+	}
+	for _, inactive := range current.inactiveMemtables {
+		pendingBytes += inactive.Bytes()
+	}
+
+	severity, reason := NO_STALL, ""
+	checks := []struct {
+		reason string
+		value  int64
+		soft   int64
+		hard   int64
+	}{
+		{"immutable_memtables", int64(len(current.inactiveMemtables)), int64(limits.ImmutableMemtablesSoftLimit), int64(limits.ImmutableMemtablesHardLimit)},
+		{"l0_files", int64(l0Files), int64(limits.L0FilesSoftLimit), int64(limits.L0FilesHardLimit)},
+		{"pending_flush_bytes", pendingBytes, limits.PendingFlushBytesSoftLimit, limits.PendingFlushBytesHardLimit},
+	}
+	for _, check := range checks {
+		if check.hard > 0 && check.value >= check.hard {
+			return STOP, check.reason
+		}
+		if severity == NO_STALL && check.soft > 0 && check.value >= check.soft {
+			severity, reason = DELAY, check.reason
+		}
+	}
+	return severity, reason
+}
@@ -0,0 +1,105 @@
+package lsmt
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/patrickgombert/lsmt/common"
+	mt "github.com/patrickgombert/lsmt/memtable"
+	"github.com/patrickgombert/lsmt/sst"
+)
+
+// A consistent view of the lsmt: the active memtable, the inactive memtables awaiting
+// flush and the sst manager holding everything flushed before them. A version is never
+// modified once it is published, instead a new version is published in its place.
+// Versions are reference counted. The lsmt holds a reference to its current version
+// and every reader, such as an iterator, acquires its own so that the memtables and
+// ssts it reads remain available until it is done with them. Each version owns its sst
+// manager, which is closed when the last reference to the version is released.
+type version struct {
+	activeMemtable    mt.Memtable
+	inactiveMemtables []mt.Memtable
+	sstManager        sst.SSTManager
+	refs              int32
+}
+
+// Creates a new version holding a single reference for the caller.
+func newVersion(active mt.Memtable, inactive []mt.Memtable, sstManager sst.SSTManager) *version {
+	return &version{activeMemtable: active, inactiveMemtables: inactive, sstManager: sstManager, refs: 1}
+}
+
+// Acquires a reference to the version. Returns false if the last reference to the
+// version has already been released, in which case the version must not be read.
+func (v *version) acquire() bool {
+	for {
+		refs := atomic.LoadInt32(&v.refs)
+		if refs <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&v.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// Releases a reference to the version. Releasing the last reference closes the
+// version's sst manager.
+func (v *version) release() error {
+	if atomic.AddInt32(&v.refs, -1) != 0 {
+		return nil
+	}
+	return v.sstManager.Close()
+}
+
+// Returns every memtable of the version, the active memtable first followed by the
+// inactive memtables from newest to oldest.
+func (v *version) memtables() []mt.Memtable {
+	tables := make([]mt.Memtable, len(v.inactiveMemtables)+1)
+	tables[0] = v.activeMemtable
+	for i, inactive := range v.inactiveMemtables {
+		tables[i+1] = inactive
+	}
+	return tables
+}
+
+// Acquires a reference to the lsmt's current version. Returns nil if the current
+// version has been released, which only happens once the lsmt is closed.
+func (db *lsmt) acquireVersion() *version {
+	for {
+		current := (*version)(atomic.LoadPointer(&db.version))
+		if current.acquire() {
+			return current
+		}
+		if atomic.LoadPointer(&db.version) == unsafe.Pointer(current) {
+			return nil
+		}
+	}
+}
+
+// Publishes a new current version and releases the lsmt's reference to the previous
+// one. Readers holding the previous version continue to see it until they release it.
+func (db *lsmt) installVersion(v *version) error {
+	previous := (*version)(atomic.SwapPointer(&db.version, unsafe.Pointer(v)))
+	return previous.release()
+}
+
+// An iterator which holds a reference to the version it was created from until it is
+// closed.
+type versionIterator struct {
+	common.Iterator
+	version *version
+}
+
+// Closes the underlying iterator and releases the iterator's reference to its version.
+func (iter *versionIterator) Close() error {
+	err := iter.Iterator.Close()
+	if iter.version == nil {
+		return err
+	}
+	releaseErr := iter.version.release()
+	iter.version = nil
+	if err == nil {
+		err = releaseErr
+	}
+	return err
+}
@@ -0,0 +1,218 @@
+package lsmt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/patrickgombert/lsmt/common"
+	mt "github.com/patrickgombert/lsmt/memtable"
+)
+
+const logPrefix string = "log"
+
+// The write-ahead log of a single memtable. Each group of writes is appended as one
+// frame, a length and a crc32 checksum followed by the group's records, and synced
+// before any of the group is written to the memtable. A log is removed once its
+// memtable has been flushed.
+type writeAheadLog struct {
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// A numbered log file found in the lsmt's directory.
+type logFile struct {
+	path   string
+	number int
+}
+
+// Creates a new empty log numbered number in dir.
+func newWriteAheadLog(dir string, number int) (*writeAheadLog, error) {
+	path := dir + logPrefix + strconv.Itoa(number)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{path: path, file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// Appends the records of every batch as a single frame and syncs the log. Puts which
+// expire are logged with their expiry so that a replay expires them at the same time.
+func (wal *writeAheadLog) append(batches []*Batch, now int64) error {
+	payload := []byte{}
+	for _, batch := range batches {
+		for _, record := range batch.records {
+			expiry := int64(0)
+			if record.expires {
+				expiry = now + int64(record.ttl)
+			}
+			payload = appendLogRecord(payload, record, expiry)
+		}
+	}
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	wal.writer.Write(header)
+	wal.writer.Write(payload)
+	err := wal.writer.Flush()
+	if err != nil {
+		return err
+	}
+	return wal.file.Sync()
+}
+
+// Closes the log's file.
+func (wal *writeAheadLog) close() error {
+	return wal.file.Close()
+}
+
+// Encodes a record as its type, its expiry, and then its key, value and end each
+// prefixed by their length.
+func appendLogRecord(b []byte, record batchRecord, expiry int64) []byte {
+	b = append(b, byte(record.recordType))
+	b = append(b, int64toBytes(expiry)...)
+	for _, field := range [][]byte{record.key, record.value, record.end} {
+		b = appendUvarint(b, uint64(len(field)))
+		b = append(b, field...)
+	}
+	return b
+}
+
+// Returns the log files in dir ordered from oldest to newest.
+func logFiles(dir string) ([]logFile, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	logs := []logFile{}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), logPrefix) {
+			continue
+		}
+		number, err := strconv.Atoi(file.Name()[len(logPrefix):])
+		if err != nil {
+			continue
+		}
+		logs = append(logs, logFile{path: dir + file.Name(), number: number})
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].number < logs[j].number
+	})
+	return logs, nil
+}
+
+// Writes every frame of the log to the memtable in the order the frames were appended.
+// A frame which is truncated or fails its checksum was being appended when the lsmt
+// stopped, so it and anything after it is ignored.
+func (db *lsmt) replay(path string, table mt.Memtable) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	header := make([]byte, 8)
+	for {
+		_, err = io.ReadFull(reader, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return ignoreTail(path, err)
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header))
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return ignoreTail(path, err)
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return ignoreTail(path, common.ERR_LOG_CORRUPT)
+		}
+		err = db.replayFrame(payload, table)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Logs that the rest of a log could not be read and is being ignored.
+func ignoreTail(path string, err error) error {
+	log.Warn().
+		Str("path", path).
+		Err(err).
+		Msg("ignoring incomplete write at the end of the log")
+	return nil
+}
+
+// Writes each record of a frame to the memtable.
+func (db *lsmt) replayFrame(payload []byte, table mt.Memtable) error {
+	for len(payload) > 0 {
+		if len(payload) < 9 {
+			return common.ERR_LOG_CORRUPT
+		}
+		recordType := common.RecordType(payload[0])
+		expiry := bytesToInt64(payload[1:9])
+		payload = payload[9:]
+		fields := make([][]byte, 3)
+		for i := range fields {
+			length, n := binary.Uvarint(payload)
+			if n <= 0 || uint64(len(payload)-n) < length {
+				return common.ERR_LOG_CORRUPT
+			}
+			fields[i] = payload[n : n+int(length)]
+			payload = payload[n+int(length):]
+		}
+
+		key, value, end := fields[0], fields[1], fields[2]
+		switch recordType {
+		case common.RANGE_DELETE:
+			table.DeleteRange(key, end)
+		case common.DELETE:
+			table.Delete(key)
+		case common.SINGLE_DELETE:
+			table.SingleDelete(key)
+		case common.MERGE:
+			// Merge records can only be replayed by the operator which wrote them
+			if db.options.MergeOperator == nil {
+				return common.ERR_NO_MERGE_OPERATOR
+			}
+			db.writeMerge(table, key, value)
+		case common.PUT:
+			if expiry != 0 {
+				table.WriteWithExpiry(key, value, expiry)
+			} else {
+				table.Write(key, value)
+			}
+		default:
+			return common.ERR_UNKNOWN_RECORD_TYPE
+		}
+	}
+	return nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func int64toBytes(i int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(i))
+	return b
+}
+
+func bytesToInt64(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
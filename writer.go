@@ -0,0 +1,161 @@
+package lsmt
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/patrickgombert/lsmt/common"
+	mt "github.com/patrickgombert/lsmt/memtable"
+)
+
+// A caller waiting in the writer queue along with the result of its write. A writer
+// with a nil batch is closing the lsmt and is never included in another writer's group.
+type writer struct {
+	batch *Batch
+	err   error
+	done  bool
+	cond  *sync.Cond
+}
+
+// Commits a batch through the writer queue. Concurrent callers are coalesced into
+// groups: the writer at the head of the queue becomes the leader, appends every batch
+// queued behind it to the write-ahead log with a single append and sync, applies the
+// batches to the active memtable and then wakes each follower with its own result. A
+// batch is only applied once it has been synced to the log. The write lock is released
+// while the group is logged and applied so that other callers can queue up to form the
+// next group.
+func (db *lsmt) commit(batch *Batch) error {
+	w := &writer{batch: batch, cond: sync.NewCond(&db.writeLock)}
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+
+	db.writers = append(db.writers, w)
+	for !w.done && db.writers[0] != w {
+		w.cond.Wait()
+	}
+	if w.done {
+		return w.err
+	}
+
+	group := 1
+	for group < len(db.writers) && db.writers[group].batch != nil {
+		group++
+	}
+	writers := db.writers[:group]
+	if db.closed {
+		for _, queued := range writers {
+			queued.err = common.ERR_LSMT_CLOSED
+		}
+		db.dequeue(group)
+		return w.err
+	}
+
+	db.stall()
+
+	// Only the leader writes to the active memtable, and only the leader retires it, so
+	// the memtable stays active while the lock is released.
+	current := (*version)(atomic.LoadPointer(&db.version))
+	wal := db.wal
+	db.writeLock.Unlock()
+	// Every record of the group expires relative to the same time
+	now := db.options.Now()
+	batches := make([]*Batch, len(writers))
+	for i, queued := range writers {
+		batches[i] = queued.batch
+	}
+	err := wal.append(batches, now)
+	if err != nil {
+		log.Error().
+			Int("writers", len(writers)).
+			Err(err).
+			Msg("failed to append to the write-ahead log")
+		db.writeLock.Lock()
+		for _, queued := range writers {
+			queued.err = err
+		}
+		db.dequeue(group)
+		return w.err
+	}
+	for _, queued := range writers {
+		for _, record := range queued.batch.records {
+			switch record.recordType {
+			case common.RANGE_DELETE:
+				current.activeMemtable.DeleteRange(record.key, record.end)
+			case common.DELETE:
+				current.activeMemtable.Delete(record.key)
+			case common.SINGLE_DELETE:
+				current.activeMemtable.SingleDelete(record.key)
+			case common.MERGE:
+				db.writeMerge(current.activeMemtable, record.key, record.value)
+			default:
+				if record.expires {
+					current.activeMemtable.WriteWithExpiry(record.key, record.value, now+int64(record.ttl))
+				} else {
+					current.activeMemtable.Write(record.key, record.value)
+				}
+			}
+		}
+	}
+	db.writeLock.Lock()
+
+	db.checkFlush(current.activeMemtable)
+	db.dequeue(group)
+	return w.err
+}
+
+// Writes a merge operand to the active memtable. The memtable holds a single record for
+// each key, so the operand is combined with a record the memtable already holds for the
+// key. Only the memtable is read, older data is left for reads and flushes to combine
+// with the operand. Like a merge resolved by a flush, combining the operand with a put
+// which expires produces a put which does not.
+func (db *lsmt) writeMerge(table mt.Memtable, key, operand []byte) {
+	operator := db.options.MergeOperator
+	pair, found := table.Get(key)
+	if !found {
+		if common.Covers(db.options.GetComparator(), table.RangeTombstones(), key) {
+			table.Write(key, operator.Merge(key, nil, operand))
+		} else {
+			table.Merge(key, operand)
+		}
+		return
+	}
+	switch {
+	case pair.Type == common.MERGE:
+		table.Merge(key, operator.Merge(key, pair.Value, operand))
+	case pair.IsTombstone() || pair.Expired(db.options.Now()):
+		table.Write(key, operator.Merge(key, nil, operand))
+	default:
+		table.Write(key, operator.Merge(key, pair.Value, operand))
+	}
+}
+
+// Waits at the head of the writer queue to close the lsmt, so that every group queued
+// ahead has been applied. Returns false if the lsmt was already closed. Must be invoked
+// while holding the write lock.
+func (db *lsmt) closeWriters() bool {
+	w := &writer{cond: sync.NewCond(&db.writeLock)}
+	db.writers = append(db.writers, w)
+	for db.writers[0] != w {
+		w.cond.Wait()
+	}
+	closing := !db.closed
+	db.closed = true
+	db.dequeue(1)
+	return closing
+}
+
+// Removes the leading group of writers from the queue, waking each follower to return
+// its result and waking the writer which is now at the head of the queue to lead the
+// next group. Must be invoked while holding the write lock.
+func (db *lsmt) dequeue(group int) {
+	for _, follower := range db.writers[1:group] {
+		follower.done = true
+		follower.cond.Signal()
+	}
+	db.writers = db.writers[group:]
+	if len(db.writers) > 0 {
+		db.writers[0].cond.Signal()
+	}
+}